@@ -24,6 +24,140 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// ConfigDrift is the VM config option which doesn't match the config generated from the machine request.
+type ConfigDrift struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Option   string                 `protobuf:"bytes,1,opt,name=option,proto3" json:"option,omitempty"`
+	Expected string                 `protobuf:"bytes,2,opt,name=expected,proto3" json:"expected,omitempty"`
+	Actual   string                 `protobuf:"bytes,3,opt,name=actual,proto3" json:"actual,omitempty"`
+	// Disruptive is set for the options which can't be changed without restarting the VM.
+	Disruptive    bool `protobuf:"varint,4,opt,name=disruptive,proto3" json:"disruptive,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConfigDrift) Reset() {
+	*x = ConfigDrift{}
+	mi := &file_specs_specs_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConfigDrift) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConfigDrift) ProtoMessage() {}
+
+func (x *ConfigDrift) ProtoReflect() protoreflect.Message {
+	mi := &file_specs_specs_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConfigDrift.ProtoReflect.Descriptor instead.
+func (*ConfigDrift) Descriptor() ([]byte, []int) {
+	return file_specs_specs_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ConfigDrift) GetOption() string {
+	if x != nil {
+		return x.Option
+	}
+	return ""
+}
+
+func (x *ConfigDrift) GetExpected() string {
+	if x != nil {
+		return x.Expected
+	}
+	return ""
+}
+
+func (x *ConfigDrift) GetActual() string {
+	if x != nil {
+		return x.Actual
+	}
+	return ""
+}
+
+func (x *ConfigDrift) GetDisruptive() bool {
+	if x != nil {
+		return x.Disruptive
+	}
+	return false
+}
+
+// NICAddress is the static address allocated to the VM NIC.
+type NICAddress struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Nic is the index of the Proxmox NIC, 0 for net0.
+	Nic int32 `protobuf:"varint,1,opt,name=nic,proto3" json:"nic,omitempty"`
+	// Address is the address with the prefix length, e.g. 10.5.0.10/24.
+	Address string `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"`
+	// Gateway is the default gateway of the NIC subnet, it's empty if the subnet has no gateway.
+	Gateway       string `protobuf:"bytes,3,opt,name=gateway,proto3" json:"gateway,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NICAddress) Reset() {
+	*x = NICAddress{}
+	mi := &file_specs_specs_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NICAddress) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NICAddress) ProtoMessage() {}
+
+func (x *NICAddress) ProtoReflect() protoreflect.Message {
+	mi := &file_specs_specs_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NICAddress.ProtoReflect.Descriptor instead.
+func (*NICAddress) Descriptor() ([]byte, []int) {
+	return file_specs_specs_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *NICAddress) GetNic() int32 {
+	if x != nil {
+		return x.Nic
+	}
+	return 0
+}
+
+func (x *NICAddress) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *NICAddress) GetGateway() string {
+	if x != nil {
+		return x.Gateway
+	}
+	return ""
+}
+
 // MachineSpec is stored in Omni in the infra provisioner state.
 type MachineSpec struct {
 	state            protoimpl.MessageState `protogen:"open.v1"`
@@ -35,16 +169,26 @@ type MachineSpec struct {
 	VolumeUploadTask string                 `protobuf:"bytes,6,opt,name=volume_upload_task,json=volumeUploadTask,proto3" json:"volume_upload_task,omitempty"`
 	VmCreateTask     string                 `protobuf:"bytes,7,opt,name=vm_create_task,json=vmCreateTask,proto3" json:"vm_create_task,omitempty"`
 	VmStartTask      string                 `protobuf:"bytes,8,opt,name=vm_start_task,json=vmStartTask,proto3" json:"vm_start_task,omitempty"`
-	VmStopTask       string                 `protobuf:"bytes,9,opt,name=vm_stop_task,json=vmStopTask,proto3" json:"vm_stop_task,omitempty"`
-	VmDeleteTask     string                 `protobuf:"bytes,10,opt,name=vm_delete_task,json=vmDeleteTask,proto3" json:"vm_delete_task,omitempty"`
 	Vmid             int32                  `protobuf:"varint,11,opt,name=vmid,proto3" json:"vmid,omitempty"`
-	unknownFields    protoimpl.UnknownFields
-	sizeCache        protoimpl.SizeCache
+	TemplateVmid     int32                  `protobuf:"varint,12,opt,name=template_vmid,json=templateVmid,proto3" json:"template_vmid,omitempty"`
+	TemplateTask     string                 `protobuf:"bytes,13,opt,name=template_task,json=templateTask,proto3" json:"template_task,omitempty"`
+	CloneTask        string                 `protobuf:"bytes,14,opt,name=clone_task,json=cloneTask,proto3" json:"clone_task,omitempty"`
+	HaResource       string                 `protobuf:"bytes,15,opt,name=ha_resource,json=haResource,proto3" json:"ha_resource,omitempty"`
+	// ConfigDrift is the list of the VM config options changed outside of the provider which are not fixed.
+	ConfigDrift []*ConfigDrift `protobuf:"bytes,16,rep,name=config_drift,json=configDrift,proto3" json:"config_drift,omitempty"`
+	// Cluster is the name of the Proxmox cluster the VM is created in, empty for the machines created before the clusters were introduced.
+	Cluster string `protobuf:"bytes,17,opt,name=cluster,proto3" json:"cluster,omitempty"`
+	// Addresses are the static addresses allocated to the VM NICs, they are released when the VM is removed.
+	Addresses []*NICAddress `protobuf:"bytes,18,rep,name=addresses,proto3" json:"addresses,omitempty"`
+	// ClusterVnets are the SDN VNets created for the Omni cluster the VM is attached to, they are removed with the last VM of the cluster.
+	ClusterVnets  []string `protobuf:"bytes,19,rep,name=cluster_vnets,json=clusterVnets,proto3" json:"cluster_vnets,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *MachineSpec) Reset() {
 	*x = MachineSpec{}
-	mi := &file_specs_specs_proto_msgTypes[0]
+	mi := &file_specs_specs_proto_msgTypes[2]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -56,7 +200,7 @@ func (x *MachineSpec) String() string {
 func (*MachineSpec) ProtoMessage() {}
 
 func (x *MachineSpec) ProtoReflect() protoreflect.Message {
-	mi := &file_specs_specs_proto_msgTypes[0]
+	mi := &file_specs_specs_proto_msgTypes[2]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -69,7 +213,7 @@ func (x *MachineSpec) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MachineSpec.ProtoReflect.Descriptor instead.
 func (*MachineSpec) Descriptor() ([]byte, []int) {
-	return file_specs_specs_proto_rawDescGZIP(), []int{0}
+	return file_specs_specs_proto_rawDescGZIP(), []int{2}
 }
 
 func (x *MachineSpec) GetUuid() string {
@@ -128,23 +272,138 @@ func (x *MachineSpec) GetVmStartTask() string {
 	return ""
 }
 
-func (x *MachineSpec) GetVmStopTask() string {
+func (x *MachineSpec) GetVmid() int32 {
+	if x != nil {
+		return x.Vmid
+	}
+	return 0
+}
+
+func (x *MachineSpec) GetTemplateVmid() int32 {
+	if x != nil {
+		return x.TemplateVmid
+	}
+	return 0
+}
+
+func (x *MachineSpec) GetTemplateTask() string {
 	if x != nil {
-		return x.VmStopTask
+		return x.TemplateTask
 	}
 	return ""
 }
 
-func (x *MachineSpec) GetVmDeleteTask() string {
+func (x *MachineSpec) GetCloneTask() string {
 	if x != nil {
-		return x.VmDeleteTask
+		return x.CloneTask
 	}
 	return ""
 }
 
-func (x *MachineSpec) GetVmid() int32 {
+func (x *MachineSpec) GetHaResource() string {
 	if x != nil {
-		return x.Vmid
+		return x.HaResource
+	}
+	return ""
+}
+
+func (x *MachineSpec) GetConfigDrift() []*ConfigDrift {
+	if x != nil {
+		return x.ConfigDrift
+	}
+	return nil
+}
+
+func (x *MachineSpec) GetCluster() string {
+	if x != nil {
+		return x.Cluster
+	}
+	return ""
+}
+
+func (x *MachineSpec) GetAddresses() []*NICAddress {
+	if x != nil {
+		return x.Addresses
+	}
+	return nil
+}
+
+func (x *MachineSpec) GetClusterVnets() []string {
+	if x != nil {
+		return x.ClusterVnets
+	}
+	return nil
+}
+
+// IPLeaseSpec is the static address leased to the VM NIC, it's stored in Omni in the infra provisioner state.
+type IPLeaseSpec struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Address is the address with the prefix length, e.g. 10.5.0.10/24.
+	Address string `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+	// Pool is the name of the pool, or the subnet for the pools without the name.
+	Pool string `protobuf:"bytes,2,opt,name=pool,proto3" json:"pool,omitempty"`
+	// Machine is the machine request ID.
+	Machine string `protobuf:"bytes,3,opt,name=machine,proto3" json:"machine,omitempty"`
+	// Nic is the index of the Proxmox NIC, 0 for net0.
+	Nic           int32 `protobuf:"varint,4,opt,name=nic,proto3" json:"nic,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IPLeaseSpec) Reset() {
+	*x = IPLeaseSpec{}
+	mi := &file_specs_specs_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IPLeaseSpec) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IPLeaseSpec) ProtoMessage() {}
+
+func (x *IPLeaseSpec) ProtoReflect() protoreflect.Message {
+	mi := &file_specs_specs_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IPLeaseSpec.ProtoReflect.Descriptor instead.
+func (*IPLeaseSpec) Descriptor() ([]byte, []int) {
+	return file_specs_specs_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *IPLeaseSpec) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *IPLeaseSpec) GetPool() string {
+	if x != nil {
+		return x.Pool
+	}
+	return ""
+}
+
+func (x *IPLeaseSpec) GetMachine() string {
+	if x != nil {
+		return x.Machine
+	}
+	return ""
+}
+
+func (x *IPLeaseSpec) GetNic() int32 {
+	if x != nil {
+		return x.Nic
 	}
 	return 0
 }
@@ -153,7 +412,19 @@ var File_specs_specs_proto protoreflect.FileDescriptor
 
 const file_specs_specs_proto_rawDesc = "" +
 	"\n" +
-	"\x11specs/specs.proto\x12\bemuspecs\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\x1egoogle/protobuf/duration.proto\"\xe9\x02\n" +
+	"\x11specs/specs.proto\x12\bemuspecs\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\x1egoogle/protobuf/duration.proto\"y\n" +
+	"\vConfigDrift\x12\x16\n" +
+	"\x06option\x18\x01 \x01(\tR\x06option\x12\x1a\n" +
+	"\bexpected\x18\x02 \x01(\tR\bexpected\x12\x16\n" +
+	"\x06actual\x18\x03 \x01(\tR\x06actual\x12\x1e\n" +
+	"\n" +
+	"disruptive\x18\x04 \x01(\bR\n" +
+	"disruptive\"R\n" +
+	"\n" +
+	"NICAddress\x12\x10\n" +
+	"\x03nic\x18\x01 \x01(\x05R\x03nic\x12\x18\n" +
+	"\aaddress\x18\x02 \x01(\tR\aaddress\x12\x18\n" +
+	"\agateway\x18\x03 \x01(\tR\agateway\"\xd8\x04\n" +
 	"\vMachineSpec\x12\x12\n" +
 	"\x04uuid\x18\x01 \x01(\tR\x04uuid\x12\x1c\n" +
 	"\tschematic\x18\x02 \x01(\tR\tschematic\x12#\n" +
@@ -162,12 +433,23 @@ const file_specs_specs_proto_rawDesc = "" +
 	"\x04node\x18\x05 \x01(\tR\x04node\x12,\n" +
 	"\x12volume_upload_task\x18\x06 \x01(\tR\x10volumeUploadTask\x12$\n" +
 	"\x0evm_create_task\x18\a \x01(\tR\fvmCreateTask\x12\"\n" +
-	"\rvm_start_task\x18\b \x01(\tR\vvmStartTask\x12 \n" +
-	"\fvm_stop_task\x18\t \x01(\tR\n" +
-	"vmStopTask\x12$\n" +
-	"\x0evm_delete_task\x18\n" +
-	" \x01(\tR\fvmDeleteTask\x12\x12\n" +
-	"\x04vmid\x18\v \x01(\x05R\x04vmidB=Z;github.com/siderolabs/omni-infra-provider-proxmox/api/specsb\x06proto3"
+	"\rvm_start_task\x18\b \x01(\tR\vvmStartTask\x12\x12\n" +
+	"\x04vmid\x18\v \x01(\x05R\x04vmid\x12#\n" +
+	"\rtemplate_vmid\x18\f \x01(\x05R\ftemplateVmid\x12#\n" +
+	"\rtemplate_task\x18\r \x01(\tR\ftemplateTask\x12\x1d\n" +
+	"\n" +
+	"clone_task\x18\x0e \x01(\tR\tcloneTask\x12\x1f\n" +
+	"\vha_resource\x18\x0f \x01(\tR\n" +
+	"haResource\x128\n" +
+	"\fconfig_drift\x18\x10 \x03(\v2\x15.emuspecs.ConfigDriftR\vconfigDrift\x12\x18\n" +
+	"\acluster\x18\x11 \x01(\tR\acluster\x122\n" +
+	"\taddresses\x18\x12 \x03(\v2\x14.emuspecs.NICAddressR\taddresses\x12#\n" +
+	"\rcluster_vnets\x18\x13 \x03(\tR\fclusterVnets\"g\n" +
+	"\vIPLeaseSpec\x12\x18\n" +
+	"\aaddress\x18\x01 \x01(\tR\aaddress\x12\x12\n" +
+	"\x04pool\x18\x02 \x01(\tR\x04pool\x12\x18\n" +
+	"\amachine\x18\x03 \x01(\tR\amachine\x12\x10\n" +
+	"\x03nic\x18\x04 \x01(\x05R\x03nicB=Z;github.com/siderolabs/omni-infra-provider-proxmox/api/specsb\x06proto3"
 
 var (
 	file_specs_specs_proto_rawDescOnce sync.Once
@@ -181,16 +463,21 @@ func file_specs_specs_proto_rawDescGZIP() []byte {
 	return file_specs_specs_proto_rawDescData
 }
 
-var file_specs_specs_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_specs_specs_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
 var file_specs_specs_proto_goTypes = []any{
-	(*MachineSpec)(nil), // 0: emuspecs.MachineSpec
+	(*ConfigDrift)(nil), // 0: emuspecs.ConfigDrift
+	(*NICAddress)(nil),  // 1: emuspecs.NICAddress
+	(*MachineSpec)(nil), // 2: emuspecs.MachineSpec
+	(*IPLeaseSpec)(nil), // 3: emuspecs.IPLeaseSpec
 }
 var file_specs_specs_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0, // 0: emuspecs.MachineSpec.config_drift:type_name -> emuspecs.ConfigDrift
+	1, // 1: emuspecs.MachineSpec.addresses:type_name -> emuspecs.NICAddress
+	2, // [2:2] is the sub-list for method output_type
+	2, // [2:2] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_specs_specs_proto_init() }
@@ -204,7 +491,7 @@ func file_specs_specs_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_specs_specs_proto_rawDesc), len(file_specs_specs_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   1,
+			NumMessages:   4,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
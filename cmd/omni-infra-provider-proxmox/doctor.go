@@ -0,0 +1,174 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.yaml.in/yaml/v4"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the Proxmox permissions and prerequisites of the provider",
+	Long: `Connects to every Proxmox cluster in the config and reports for each node the privileges of the API user
+compared to what the provision steps need, the ISO and import storages, and the network bridges.
+If the machine class provider data is set, also checks the storages matching its storage_selector,
+the bridges and VLAN tags of its NICs and the PCI resource mappings it references.
+Exits with the non-zero code if any problems are found.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		configData, err := os.ReadFile(doctorCfg.configFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Proxmox config file %q: %w", doctorCfg.configFile, err)
+		}
+
+		proxmoxConfig, err := config.Parse(configData)
+		if err != nil {
+			return fmt.Errorf("invalid Proxmox config file %q: %w", doctorCfg.configFile, err)
+		}
+
+		if err = proxmoxConfig.ResolveSecrets(cmd.Context()); err != nil {
+			return fmt.Errorf("failed to resolve the secrets of Proxmox config file %q: %w", doctorCfg.configFile, err)
+		}
+
+		var data *provider.Data
+
+		if doctorCfg.machineClass != "" {
+			if data, err = readMachineClass(doctorCfg.machineClass); err != nil {
+				return err
+			}
+		}
+
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+
+		defaultClient, providerOptions, err := newClusters(ctx, zap.NewNop(), proxmoxConfig, instrumentation{})
+		if err != nil {
+			return fmt.Errorf("failed to create Proxmox client: %w", err)
+		}
+
+		reports, err := provider.NewProvisioner(defaultClient, providerOptions...).Doctor(ctx, data)
+
+		printReports(cmd.OutOrStdout(), reports)
+
+		if err != nil {
+			return err
+		}
+
+		if slices.ContainsFunc(reports, func(report provider.NodeReport) bool { return len(report.Problems) > 0 }) {
+			return errors.New("found problems")
+		}
+
+		return nil
+	},
+}
+
+var doctorCfg struct {
+	configFile   string
+	machineClass string
+}
+
+func readMachineClass(path string) (*provider.Data, error) {
+	machineClass, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the machine class file %q: %w", path, err)
+	}
+
+	if err = provider.ValidateData(string(machineClass)); err != nil {
+		return nil, fmt.Errorf("invalid machine class file %q: %w", path, err)
+	}
+
+	var data provider.Data
+
+	if err = yaml.Unmarshal(machineClass, &data); err != nil {
+		return nil, fmt.Errorf("invalid machine class file %q: %w", path, err)
+	}
+
+	return &data, nil
+}
+
+func printReports(out io.Writer, reports []provider.NodeReport) {
+	list := func(values []string) string {
+		if len(values) == 0 {
+			return "-"
+		}
+
+		return strings.Join(values, ", ")
+	}
+
+	for _, report := range reports {
+		fmt.Fprintf(out, "cluster %s, node %s\n", report.Cluster, report.Node) //nolint:errcheck
+
+		if report.Permissions != nil {
+			fmt.Fprintln(out, "  permissions:") //nolint:errcheck
+
+			for _, check := range report.Permissions {
+				status := "ok"
+				if !check.Granted {
+					status = "MISSING"
+				}
+
+				fmt.Fprintf(out, "    %-8s%s on %s (%s)\n", status, check.Privilege, check.Path, strings.Join(check.Steps, ", ")) //nolint:errcheck
+			}
+
+			fmt.Fprintf(out, "  iso storages: %s\n", list(report.ISOStorages))       //nolint:errcheck
+			fmt.Fprintf(out, "  import storages: %s\n", list(report.ImportStorages)) //nolint:errcheck
+
+			if report.SelectedStorages != nil {
+				fmt.Fprintf(out, "  selected storages: %s\n", list(report.SelectedStorages)) //nolint:errcheck
+			}
+
+			bridges := make([]string, 0, len(report.Bridges))
+
+			for _, bridge := range report.Bridges {
+				if slices.Contains(report.VLANAwareBridges, bridge) {
+					bridge += " (VLAN aware)"
+				}
+
+				bridges = append(bridges, bridge)
+			}
+
+			fmt.Fprintf(out, "  bridges: %s\n", list(bridges))        //nolint:errcheck
+			fmt.Fprintf(out, "  SDN VNets: %s\n", list(report.VNets)) //nolint:errcheck
+
+			if report.PCIMappings != nil {
+				fmt.Fprintf(out, "  PCI mappings: %s\n", list(report.PCIMappings)) //nolint:errcheck
+			}
+		}
+
+		if len(report.Problems) == 0 {
+			fmt.Fprintln(out, "  no problems found") //nolint:errcheck
+
+			continue
+		}
+
+		fmt.Fprintln(out, "  problems:") //nolint:errcheck
+
+		for _, problem := range report.Problems {
+			fmt.Fprintf(out, "    %s\n", problem) //nolint:errcheck
+		}
+	}
+}
+
+func init() {
+	doctorCmd.Flags().StringVar(&doctorCfg.configFile, "config-file", "", "Proxmox provider config")
+	doctorCmd.Flags().StringVar(&doctorCfg.machineClass, "machine-class", "", "machine class provider data YAML to check the prerequisites of")
+	doctorCmd.MarkFlagRequired("config-file") //nolint:errcheck
+
+	rootCmd.AddCommand(doctorCmd)
+}
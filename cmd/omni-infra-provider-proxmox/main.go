@@ -6,28 +6,42 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	_ "embed"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/luthermonson/go-proxmox"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/siderolabs/omni/client/pkg/client"
 	"github.com/siderolabs/omni/client/pkg/infra"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"go.yaml.in/yaml/v4"
 
 	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/failover"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/health"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/logging"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/metrics"
 	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
 	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/meta"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/tracing"
 )
 
 //go:embed data/schema.json
@@ -43,11 +57,11 @@ var rootCmd = &cobra.Command{
 	Long:         `Connects to Omni as an infra provider and manages VMs in Proxmox`,
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, _ []string) error {
-		loggerConfig := zap.NewProductionConfig()
+		if cfg.debug {
+			cfg.logLevel = zapcore.DebugLevel.String()
+		}
 
-		logger, err := loggerConfig.Build(
-			zap.AddStacktrace(zapcore.ErrorLevel),
-		)
+		logger, err := logging.New(cfg.logLevel, cfg.logFormat)
 		if err != nil {
 			return fmt.Errorf("failed to create logger: %w", err)
 		}
@@ -56,53 +70,119 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("omni-api-endpoint flag is not set")
 		}
 
-		var proxmoxConfig config.Config
+		if cfg.livenessCheckInterval <= 0 || cfg.readinessCheckInterval <= 0 {
+			return fmt.Errorf("the health check intervals should be positive")
+		}
+
+		configData, err := os.ReadFile(cfg.configFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Proxmox config file %q: %w", cfg.configFile, err)
+		}
 
-		configFile, err := os.Open(cfg.configFile)
+		proxmoxConfig, err := config.Parse(configData)
 		if err != nil {
-			return fmt.Errorf("failed to read Proxmox config file %q", cfg.configFile)
+			return fmt.Errorf("invalid Proxmox config file %q: %w", cfg.configFile, err)
 		}
 
-		decoder := yaml.NewDecoder(configFile)
+		for _, warning := range proxmoxConfig.Warnings() {
+			logger.Warn("Proxmox config file warning", zap.String("path", cfg.configFile), zap.Error(warning))
+		}
 
-		if err = decoder.Decode(&proxmoxConfig); err != nil {
-			return fmt.Errorf("failed to read Proxmox config file %q", cfg.configFile)
+		if err = proxmoxConfig.ResolveSecrets(cmd.Context()); err != nil {
+			return fmt.Errorf("failed to resolve the secrets of Proxmox config file %q: %w", cfg.configFile, err)
 		}
 
-		var opts []proxmox.Option
+		var instr instrumentation
+
+		if cfg.debug {
+			instr.debugLogger = logger.With(zap.String("component", "proxmox-api"))
 
-		switch {
-		case proxmoxConfig.Proxmox.Password != "" && proxmoxConfig.Proxmox.Username != "":
-			opts = append(opts, proxmox.WithCredentials(&proxmox.Credentials{
-				Username: proxmoxConfig.Proxmox.Username,
-				Password: proxmoxConfig.Proxmox.Password,
-				Realm:    proxmoxConfig.Proxmox.Realm,
-			}))
-		case proxmoxConfig.Proxmox.TokenID != "" && proxmoxConfig.Proxmox.TokenSecret != "":
-			opts = append(opts, proxmox.WithAPIToken(proxmoxConfig.Proxmox.TokenID, proxmoxConfig.Proxmox.TokenSecret))
+			logger.Warn("logging the Proxmox API requests, the logs might contain sensitive data")
 		}
 
-		if proxmoxConfig.Proxmox.InsecureSkipVerify {
-			httpClient := &http.Client{
-				Timeout: time.Second * 30,
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-				},
+		// the metrics and the health endpoints share the server if they are on the same address
+		muxes := map[string]*http.ServeMux{}
+
+		handle := func(address, pattern string, handler http.Handler) {
+			if muxes[address] == nil {
+				muxes[address] = http.NewServeMux()
+			}
+
+			muxes[address].Handle(pattern, handler)
+		}
+
+		if cfg.metricsListenAddress != "" {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+			instr.metrics = metrics.New(registry)
+
+			handle(cfg.metricsListenAddress, "/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		}
+
+		if cfg.otlpEndpoint != "" {
+			shutdownTracing, err := tracing.Setup(cmd.Context(), cfg.otlpEndpoint, "omni-infra-provider-proxmox")
+			if err != nil {
+				return err
 			}
 
-			logger.Info("using insecure connection to Proxmox")
+			defer func() {
+				shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer shutdownCancel()
+
+				if err := shutdownTracing(shutdownCtx); err != nil {
+					logger.Warn("failed to export the remaining spans", zap.Error(err))
+				}
+			}()
 
-			opts = append(opts, proxmox.WithHTTPClient(
-				httpClient,
-			))
+			instr.tracing = true
+
+			logger.Info("exporting traces", zap.String("endpoint", cfg.otlpEndpoint))
 		}
 
-		proxmoxClient := proxmox.NewClient(
-			proxmoxConfig.Proxmox.URL,
-			opts...,
-		)
+		// the failover health checks of the clients are stopped when the clients are replaced,
+		// clientsMu guards the cancel func of the current clients and the config they are created from, as they are replaced by the config watcher
+		var clientsMu sync.Mutex
+
+		clientsCtx, cancelClients := context.WithCancel(cmd.Context())
+		appliedConfig := proxmoxConfig
+
+		defer func() {
+			clientsMu.Lock()
+			defer clientsMu.Unlock()
+
+			cancelClients()
+		}()
+
+		defaultClient, providerOptions, err := newClusters(clientsCtx, logger, proxmoxConfig, instr)
+		if err != nil {
+			return err
+		}
+
+		clientOptions := []client.Option{
+			client.WithInsecureSkipTLSVerify(cfg.insecureSkipVerify),
+		}
+
+		if cfg.serviceAccountKey != "" {
+			clientOptions = append(clientOptions, client.WithServiceAccount(cfg.serviceAccountKey))
+		}
+
+		omniClient, err := client.New(cfg.omniAPIEndpoint, clientOptions...)
+		if err != nil {
+			return fmt.Errorf("failed to create Omni client: %w", err)
+		}
+
+		defer omniClient.Close() //nolint:errcheck
+
+		if err = resources.RegisterIPLease(); err != nil {
+			return fmt.Errorf("failed to register the IP lease resource: %w", err)
+		}
 
-		provisioner := provider.NewProvisioner(proxmoxClient)
+		provisioner := provider.NewProvisioner(defaultClient, append(providerOptions,
+			provider.WithMetrics(instr.metrics),
+			provider.WithLeaseStore(provider.NewLeaseStore(omniClient.Omni().State())),
+			provider.WithState(omniClient.Omni().State()),
+		)...)
 
 		ip, err := infra.NewProvider(meta.ProviderID, provisioner, infra.ProviderConfig{
 			Name:        cfg.providerName,
@@ -114,29 +194,317 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("failed to create infra provider: %w", err)
 		}
 
-		logger.Info("starting infra provider")
+		// the drift reconciler and the garbage collector are restarted once their settings are changed on reload
+		startBackground := func(backgroundConfig *config.Config) context.CancelFunc {
+			ctx, cancel := context.WithCancel(cmd.Context())
 
-		clientOptions := []client.Option{
-			client.WithInsecureSkipTLSVerify(cfg.insecureSkipVerify),
+			if backgroundConfig.Drift.Interval > 0 {
+				reconciler := provider.NewDriftReconciler(provisioner, omniClient.Omni().State(), provider.DriftOptions{
+					Interval:      backgroundConfig.Drift.Interval,
+					Fix:           backgroundConfig.Drift.Fix,
+					FixDisruptive: backgroundConfig.Drift.FixDisruptive,
+				})
+
+				go reconciler.Run(ctx, logger.With(zap.String("component", "drift")))
+			}
+
+			if backgroundConfig.GC.Interval > 0 {
+				gc := provider.NewGarbageCollector(provisioner, omniClient.Omni().State(), provider.GCOptions{
+					Interval:    backgroundConfig.GC.Interval,
+					GracePeriod: cmp.Or(backgroundConfig.GC.GracePeriod, time.Hour),
+					DryRun:      backgroundConfig.GC.DryRun,
+				})
+
+				go gc.Run(ctx, logger.With(zap.String("component", "gc")))
+			}
+
+			return cancel
 		}
 
-		if cfg.serviceAccountKey != "" {
-			clientOptions = append(clientOptions, client.WithServiceAccount(cfg.serviceAccountKey))
+		cancelBackground := startBackground(proxmoxConfig)
+
+		watcher := config.NewWatcher(cfg.configFile, configData, logger.With(zap.String("component", "config")), func(ctx context.Context, newConfig *config.Config) error {
+			if err := newConfig.ResolveSecrets(ctx); err != nil {
+				return err
+			}
+
+			nextCtx, nextCancel := context.WithCancel(ctx)
+
+			newDefaultClient, newProviderOptions, err := newClusters(nextCtx, logger, newConfig, instr)
+			if err != nil {
+				nextCancel()
+
+				return err
+			}
+
+			provisioner.Reconfigure(newDefaultClient, newProviderOptions...)
+
+			clientsMu.Lock()
+			defer clientsMu.Unlock()
+
+			cancelClients()
+			cancelClients = nextCancel
+
+			if newConfig.Drift != appliedConfig.Drift || newConfig.GC != appliedConfig.GC {
+				logger.Info("restarting the drift detection and the garbage collection with the new settings")
+
+				cancelBackground()
+				cancelBackground = startBackground(newConfig)
+			}
+
+			appliedConfig = newConfig
+
+			return nil
+		})
+
+		go func() {
+			if err := watcher.Run(cmd.Context()); err != nil {
+				logger.Error("failed to watch the config file", zap.Error(err))
+			}
+		}()
+
+		reloadSignal := make(chan os.Signal, 1)
+		signal.Notify(reloadSignal, syscall.SIGHUP)
+
+		defer signal.Stop(reloadSignal)
+
+		go func() {
+			for {
+				select {
+				case <-cmd.Context().Done():
+					return
+				case <-reloadSignal:
+					logger.Info("reloading the config file on SIGHUP")
+
+					watcher.Trigger()
+				}
+			}
+		}()
+
+		if cfg.healthListenAddress != "" {
+			healthLogger := logger.With(zap.String("component", "health"))
+
+			liveness := health.NewProbe(healthLogger, health.Check{
+				Name: "omni",
+				Run: func(ctx context.Context) error {
+					return provider.CheckOmni(ctx, omniClient.Omni().State())
+				},
+				Interval: cfg.livenessCheckInterval,
+			})
+
+			readiness := health.NewProbe(healthLogger, health.Check{
+				Name:     "proxmox",
+				Run:      provisioner.CheckProxmox,
+				Interval: cfg.readinessCheckInterval,
+			})
+
+			go liveness.Run(cmd.Context())
+			go readiness.Run(cmd.Context())
+
+			handle(cfg.healthListenAddress, "/healthz", liveness)
+			handle(cfg.healthListenAddress, "/readyz", readiness)
 		}
 
+		for address, mux := range muxes {
+			if err = serveHTTP(cmd.Context(), logger, address, mux); err != nil {
+				return err
+			}
+		}
+
+		logger.Info("starting infra provider")
+
 		return ip.Run(cmd.Context(), logger, infra.WithOmniEndpoint(cfg.omniAPIEndpoint), infra.WithClientOptions(
 			clientOptions...,
 		), infra.WithEncodeRequestIDsIntoTokens())
 	},
 }
 
+// newClusters creates the Proxmox clients of all clusters in the config, the default cluster client is nil if it's not configured.
+func newClusters(ctx context.Context, logger *zap.Logger, proxmoxConfig *config.Config, instr instrumentation) (*proxmox.Client, []provider.Option, error) {
+	providerOptions := []provider.Option{
+		provider.WithOvercommit(proxmoxConfig.Capacity.CPUOvercommitRatio, proxmoxConfig.Capacity.MemoryOvercommitRatio),
+		provider.WithIPPools(proxmoxConfig.IPAM.Pools...),
+	}
+
+	var defaultClient *proxmox.Client
+
+	if len(proxmoxConfig.Proxmox.Endpoints()) > 0 {
+		var err error
+
+		defaultClient, err = newProxmoxClient(ctx, logger, provider.DefaultCluster, proxmoxConfig.Proxmox, instr)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, cluster := range proxmoxConfig.Clusters {
+		clusterClient, err := newProxmoxClient(ctx, logger.With(zap.String("cluster", cluster.Name)), cluster.Name, cluster.Proxmox, instr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cluster %q: %w", cluster.Name, err)
+		}
+
+		providerOptions = append(providerOptions, provider.WithCluster(cluster.Name, clusterClient, cluster.Labels))
+	}
+
+	if netbox := proxmoxConfig.IPAM.NetBox; netbox != nil {
+		httpClient := &http.Client{Timeout: 30 * time.Second}
+
+		if netbox.InsecureSkipVerify {
+			httpClient.Transport = &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+		}
+
+		netboxIPAM, err := ipam.NewNetBox(netbox.URL, netbox.Token, ipam.NetBoxOptions{
+			HTTPClient: httpClient,
+			Tags:       netbox.Tags,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		providerOptions = append(providerOptions, provider.WithExternalIPAM(ipam.BackendNetBox, netboxIPAM))
+	}
+
+	return defaultClient, providerOptions, nil
+}
+
+// instrumentation is the metrics, the tracing and the debug logging of the Proxmox API requests.
+type instrumentation struct {
+	// metrics are nil if the metrics are disabled.
+	metrics *metrics.Metrics
+	// debugLogger is nil if the requests are not logged.
+	debugLogger *zap.Logger
+	tracing     bool
+}
+
+// transport wraps the base transport of the cluster client, it returns nil if the instrumentation is disabled and the base is nil.
+func (i instrumentation) transport(cluster string, base http.RoundTripper) http.RoundTripper {
+	if i.debugLogger != nil {
+		base = logging.Transport(i.debugLogger.With(zap.String("cluster", cluster)), base)
+	}
+
+	base = i.metrics.Transport(cluster, base)
+
+	if i.tracing {
+		base = tracing.Transport(otel.GetTracerProvider(), cluster, base)
+	}
+
+	return base
+}
+
 var cfg struct {
-	omniAPIEndpoint     string
-	serviceAccountKey   string
-	providerName        string
-	providerDescription string
-	configFile          string
-	insecureSkipVerify  bool
+	omniAPIEndpoint        string
+	serviceAccountKey      string
+	providerName           string
+	providerDescription    string
+	configFile             string
+	metricsListenAddress   string
+	otlpEndpoint           string
+	logLevel               string
+	logFormat              string
+	healthListenAddress    string
+	livenessCheckInterval  time.Duration
+	readinessCheckInterval time.Duration
+	insecureSkipVerify     bool
+	debug                  bool
+}
+
+// newProxmoxClient creates the Proxmox API client, the requests fail over between the endpoints if there are several of them.
+func newProxmoxClient(ctx context.Context, logger *zap.Logger, cluster string, proxmoxConfig config.Proxmox, instr instrumentation) (*proxmox.Client, error) {
+	var opts []proxmox.Option
+
+	switch {
+	case proxmoxConfig.Password != "" && proxmoxConfig.Username != "":
+		opts = append(opts, proxmox.WithCredentials(&proxmox.Credentials{
+			Username: proxmoxConfig.Username,
+			Password: proxmoxConfig.Password,
+			Realm:    proxmoxConfig.Realm,
+		}))
+	case proxmoxConfig.TokenID != "" && proxmoxConfig.TokenSecret != "":
+		opts = append(opts, proxmox.WithAPIToken(proxmoxConfig.TokenID, proxmoxConfig.TokenSecret))
+	}
+
+	endpoints := proxmoxConfig.Endpoints()
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("the Proxmox API url is not set")
+	}
+
+	var transport http.RoundTripper
+
+	if proxmoxConfig.InsecureSkipVerify {
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+
+		logger.Info("using insecure connection to Proxmox")
+	}
+
+	if len(endpoints) > 1 {
+		base := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert,errcheck
+
+		// the endpoint which is down should not take all the request time
+		base.DialContext = (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+
+		if proxmoxConfig.InsecureSkipVerify {
+			base.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+
+		failoverTransport, err := failover.NewTransport(base, logger, endpoints...)
+		if err != nil {
+			return nil, err
+		}
+
+		go failoverTransport.Run(ctx, cmp.Or(proxmoxConfig.HealthCheckInterval, 30*time.Second))
+
+		logger.Info("using Proxmox API endpoints failover", zap.Strings("endpoints", endpoints))
+
+		transport = failoverTransport
+	}
+
+	transport = instr.transport(cluster, transport)
+
+	if transport != nil {
+		opts = append(opts, proxmox.WithHTTPClient(&http.Client{
+			Timeout:   time.Second * 30,
+			Transport: transport,
+		}))
+	}
+
+	return proxmox.NewClient(
+		endpoints[0],
+		opts...,
+	), nil
+}
+
+// serveHTTP starts the HTTP listener of the metrics and the health endpoints, it's stopped when the context is canceled.
+func serveHTTP(ctx context.Context, logger *zap.Logger, address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %w", address, err)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		server.Close() //nolint:errcheck
+	}()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server failed", zap.String("address", address), zap.Error(err))
+		}
+	}()
+
+	logger.Info("serving HTTP", zap.String("address", listener.Addr().String()))
+
+	return nil
 }
 
 func main() {
@@ -146,7 +514,7 @@ func main() {
 }
 
 func app() error {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGHUP, syscall.SIGTERM)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	return rootCmd.ExecuteContext(ctx)
@@ -163,4 +531,15 @@ func init() {
 
 	// Read everything into this config file
 	rootCmd.Flags().StringVar(&cfg.configFile, "config-file", "", "Proxmox provider config")
+	rootCmd.Flags().StringVar(&cfg.metricsListenAddress, "metrics-listen-address", "", "address to serve the Prometheus metrics on, e.g. :9090, the metrics are disabled if not set")
+	rootCmd.Flags().StringVar(&cfg.otlpEndpoint, "otlp-endpoint", "",
+		"OTLP gRPC endpoint to export the traces to, e.g. http://localhost:4317, the tracing is disabled if not set")
+	rootCmd.Flags().StringVar(&cfg.healthListenAddress, "health-listen-address", "",
+		"address to serve the /healthz and /readyz endpoints on, e.g. :8080, the health checks are disabled if not set")
+	rootCmd.Flags().DurationVar(&cfg.livenessCheckInterval, "liveness-check-interval", 30*time.Second, "interval of the Omni API check reported by /healthz")
+	rootCmd.Flags().DurationVar(&cfg.readinessCheckInterval, "readiness-check-interval", 30*time.Second, "interval of the Proxmox API checks reported by /readyz")
+	rootCmd.Flags().StringVar(&cfg.logLevel, "log-level", zapcore.InfoLevel.String(), "log level, one of debug, info, warn or error")
+	rootCmd.Flags().StringVar(&cfg.logFormat, "log-format", logging.FormatJSON, "log format, json or console")
+	rootCmd.Flags().BoolVar(&cfg.debug, "debug", false,
+		"log the generated VM options and the Proxmox API request and response bodies with the secrets redacted, implies --log-level=debug")
 }
@@ -0,0 +1,191 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v4"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/config"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the provider config and the machine class provider data",
+	Long: `Checks the provider config file and the machine class provider data files without connecting to Proxmox or Omni.
+The unknown fields are rejected. Each error and warning is printed with the file name and the field path.
+Exits with the non-zero code if any of the files is invalid.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		if validateCfg.configFile == "" && len(validateCfg.machineClasses) == 0 {
+			return errors.New("nothing to validate, set --config-file or --machine-class")
+		}
+
+		out := cmd.OutOrStdout()
+		valid := true
+
+		report := func(path string, errs, warnings []string) {
+			for _, w := range warnings {
+				fmt.Fprintf(out, "%s: warning: %s\n", path, w) //nolint:errcheck
+			}
+
+			if len(errs) == 0 {
+				fmt.Fprintf(out, "%s: OK\n", path) //nolint:errcheck
+
+				return
+			}
+
+			valid = false
+
+			for _, e := range errs {
+				fmt.Fprintf(out, "%s: %s\n", path, e) //nolint:errcheck
+			}
+		}
+
+		if validateCfg.configFile != "" {
+			errs, warnings := validateConfigFile(validateCfg.configFile)
+
+			report(validateCfg.configFile, errs, warnings)
+		}
+
+		for _, path := range validateCfg.machineClasses {
+			report(path, validateMachineClassFile(path), nil)
+		}
+
+		if !valid {
+			return errors.New("validation failed")
+		}
+
+		return nil
+	},
+}
+
+var validateCfg struct {
+	configFile     string
+	machineClasses []string
+}
+
+// validateConfigFile returns the errors and the warnings of the provider config, the warnings don't fail the validation.
+func validateConfigFile(path string) (errs, warnings []string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+
+	proxmoxConfig, err := config.ParseStrict(data)
+	if err != nil {
+		return errorLines(err), nil
+	}
+
+	for _, warning := range proxmoxConfig.Warnings() {
+		warnings = append(warnings, warning.Error())
+	}
+
+	return nil, warnings
+}
+
+// validateMachineClassFile checks the machine class provider data against the JSON schema shown in Omni, and against the provider Go types.
+func validateMachineClassFile(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	errs, err := validateSchema(data)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	if err = provider.ValidateData(string(data)); err != nil {
+		errs = append(errs, errorLines(err)...)
+	}
+
+	return errs
+}
+
+func validateSchema(data []byte) ([]string, error) {
+	compiler := jsonschema.NewCompiler()
+
+	if err := compiler.AddResource("schema.json", strings.NewReader(schema)); err != nil {
+		return nil, err
+	}
+
+	compiled, err := compiler.Compile("schema.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+
+	if err = yaml.Unmarshal(data, &value); err != nil {
+		return []string{err.Error()}, nil
+	}
+
+	// the schema is validated against the JSON values
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+
+	if err = decoder.Decode(&value); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var validationErr *jsonschema.ValidationError
+
+	if err = compiled.Validate(value); !errors.As(err, &validationErr) {
+		return nil, err
+	}
+
+	var (
+		errs    []string
+		flatten func(*jsonschema.ValidationError)
+	)
+
+	flatten = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			field := strings.ReplaceAll(strings.TrimPrefix(e.InstanceLocation, "/"), "/", ".")
+			if field == "" {
+				field = "(root)"
+			}
+
+			errs = append(errs, fmt.Sprintf("%s: %s", field, e.Message))
+		}
+
+		for _, cause := range e.Causes {
+			flatten(cause)
+		}
+	}
+
+	flatten(validationErr)
+
+	return errs, nil
+}
+
+// errorLines splits the joined errors.
+func errorLines(err error) []string {
+	return strings.Split(err.Error(), "\n")
+}
+
+func init() {
+	validateCmd.Flags().StringVar(&validateCfg.configFile, "config-file", "", "Proxmox provider config to validate")
+	validateCmd.Flags().StringSliceVar(&validateCfg.machineClasses, "machine-class", nil, "machine class provider data YAML to validate, can be repeated")
+
+	rootCmd.AddCommand(validateCmd)
+}
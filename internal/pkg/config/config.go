@@ -5,9 +5,22 @@
 // Package config describes the connection settings for Proxmox infra provider.
 package config
 
+import (
+	"time"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+)
+
 // Config describes Proxmox provider configuration.
 type Config struct {
-	Proxmox Proxmox `yaml:"proxmox"`
+	Secrets  Secrets   `yaml:"secrets,omitempty"`
+	Clusters []Cluster `yaml:"clusters,omitempty"`
+	IPAM     IPAM      `yaml:"ipam,omitempty"`
+	// Proxmox is the default cluster, it can be omitted if the clusters are set.
+	Proxmox  Proxmox  `yaml:"proxmox,omitempty"`
+	GC       GC       `yaml:"gc,omitempty"`
+	Capacity Capacity `yaml:"capacity,omitempty"`
+	Drift    Drift    `yaml:"drift,omitempty"`
 }
 
 // Proxmox is the config for accessing Proxmox API.
@@ -15,11 +28,92 @@ type Proxmox struct {
 	URL string `yaml:"url"`
 
 	Username string `yaml:"username,omitempty"`
+	// Password and TokenSecret can refer to the secret: file:<path>, env:<variable> or vault:<mount>/<path>#<key>.
 	Password string `yaml:"password,omitempty"`
 	Realm    string `yaml:"realm,omitempty"`
 
 	TokenID     string `yaml:"tokenID,omitempty"`
 	TokenSecret string `yaml:"tokenSecret,omitempty"`
 
+	// URLs are the API endpoints of the other nodes of the same cluster, the requests fail over to them when the current endpoint is down.
+	URLs []string `yaml:"urls,omitempty"`
+	// HealthCheckInterval is the period of the API endpoints health checks when there are several endpoints, defaults to 30s.
+	HealthCheckInterval time.Duration `yaml:"healthCheckInterval,omitempty"`
+
 	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
 }
+
+// Cluster is one of the named Proxmox clusters managed by the provider.
+type Cluster struct {
+	// Labels can be matched by the cluster_selector of the machine class.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Name is referred by the cluster field of the machine class, and it's recorded in the provider Machine resources.
+	Name string `yaml:"name"`
+
+	Proxmox `yaml:",inline"`
+}
+
+// Capacity is the config for the node capacity checks done before placing the VMs.
+type Capacity struct {
+	// CPUOvercommitRatio limits the total number of vCPUs of the VMs on a node to the node CPUs multiplied by the ratio, 0 means no limit.
+	CPUOvercommitRatio float64 `yaml:"cpuOvercommitRatio,omitempty"`
+	// MemoryOvercommitRatio limits the total memory of the VMs on a node to the node memory multiplied by the ratio, 0 means no limit.
+	MemoryOvercommitRatio float64 `yaml:"memoryOvercommitRatio,omitempty"`
+}
+
+// Drift is the config for the detection of the VM config changes made outside of the provider.
+type Drift struct {
+	// Interval is the period of the VM config checks, 0 disables the drift detection.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Fix applies the changes which don't require restarting the VM: tags, description, onboot and balloon.
+	Fix bool `yaml:"fix,omitempty"`
+	// FixDisruptive applies the rest of the changes, most of them take effect after the VM restart.
+	FixDisruptive bool `yaml:"fixDisruptive,omitempty"`
+}
+
+// GC is the config for the removal of the VMs, the ISOs and the disk images left on Proxmox without a machine.
+type GC struct {
+	// Interval is the period of the garbage collection, 0 disables the garbage collection.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// GracePeriod is the minimal age of the orphaned VM or ISO to be removed, defaults to 1h.
+	GracePeriod time.Duration `yaml:"gracePeriod,omitempty"`
+	// DryRun only logs the orphaned VMs, ISOs and disk images.
+	DryRun bool `yaml:"dryRun,omitempty"`
+}
+
+// IPAM is the config for the allocation of the static addresses of the VM NICs.
+type IPAM struct {
+	// NetBox is the backend of the pools with the netbox backend.
+	NetBox *NetBox `yaml:"netbox,omitempty"`
+	// Pools are referred by the pool field of the machine class NIC settings.
+	Pools []ipam.Pool `yaml:"pools,omitempty"`
+}
+
+// NetBox is the config for the NetBox compatible IPAM the addresses are allocated in.
+type NetBox struct {
+	// URL is the NetBox address, e.g. https://netbox.example.com.
+	URL string `yaml:"url"`
+	// Token is the NetBox API token, it can refer to the secret.
+	Token string `yaml:"token"`
+	// Tags are set on the allocated addresses, the tags should exist in NetBox.
+	Tags []string `yaml:"tags,omitempty"`
+
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+}
+
+// Secrets is the config for the external secret stores the secret fields can refer to.
+type Secrets struct {
+	Vault *Vault `yaml:"vault,omitempty"`
+}
+
+// Vault is the config for the HashiCorp Vault compatible KV secrets engine.
+type Vault struct {
+	// Address is the Vault address, e.g. https://vault.example.com:8200.
+	Address string `yaml:"address"`
+	// Token is the Vault token, it can refer to the file or the environment variable with the token.
+	Token string `yaml:"token"`
+	// Namespace is the Vault Enterprise namespace.
+	Namespace string `yaml:"namespace,omitempty"`
+	// KVVersion is the version of the KV secrets engine, 1 or 2, defaults to 2.
+	KVVersion int `yaml:"kvVersion,omitempty"`
+}
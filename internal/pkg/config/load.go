@@ -0,0 +1,315 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"go.yaml.in/yaml/v4"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/secrets"
+)
+
+// defaultCluster is the name of the cluster configured by the proxmox block, it can't be used by the named clusters.
+const defaultCluster = "default"
+
+// Parse decodes and validates the config.
+func Parse(data []byte) (*Config, error) {
+	return parse(data, false)
+}
+
+// ParseStrict decodes and validates the config, rejecting the unknown fields.
+func ParseStrict(data []byte) (*Config, error) {
+	return parse(data, true)
+}
+
+func parse(data []byte, strict bool) (*Config, error) {
+	var config Config
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(strict)
+
+	var (
+		errs     []error
+		loadErrs *yaml.LoadErrors
+	)
+
+	// the fields which can't be decoded are reported along with the validation errors of the rest of the config
+	if err := decoder.Decode(&config); errors.As(err, &loadErrs) {
+		for _, loadErr := range loadErrs.Errors {
+			errs = append(errs, loadErr)
+		}
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := errors.Join(append(errs, config.Validate())...); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Validate checks the config for the errors which can be found without connecting to Proxmox.
+// All errors are returned, each prefixed with the path of the field.
+func (c *Config) Validate() error {
+	var errs []error
+
+	names := map[string]struct{}{
+		defaultCluster: {},
+	}
+
+	for i, cluster := range c.Clusters {
+		field := fmt.Sprintf("clusters[%d]", i)
+
+		if cluster.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: each Proxmox cluster should have the name", field))
+		} else {
+			field = fmt.Sprintf("clusters[%d] (%s)", i, cluster.Name)
+		}
+
+		if _, ok := names[cluster.Name]; ok && cluster.Name != "" {
+			errs = append(errs, fmt.Errorf("%s: duplicate Proxmox cluster name %q", field, cluster.Name))
+		}
+
+		names[cluster.Name] = struct{}{}
+
+		if !cluster.Proxmox.configured() {
+			errs = append(errs, fmt.Errorf("%s: the Proxmox API url is not set", field))
+		}
+
+		errs = append(errs, c.validateProxmox(field, cluster.Proxmox)...)
+	}
+
+	switch {
+	case c.Proxmox.configured():
+		errs = append(errs, c.validateProxmox("proxmox", c.Proxmox)...)
+	case c.Proxmox.Username != "" || c.Proxmox.Password != "" || c.Proxmox.TokenID != "" || c.Proxmox.TokenSecret != "":
+		errs = append(errs, errors.New("proxmox: the Proxmox API url is not set"))
+	case len(c.Clusters) == 0:
+		errs = append(errs, errors.New("no Proxmox clusters are configured"))
+	}
+
+	pools := map[string]struct{}{}
+
+	for i, pool := range c.IPAM.Pools {
+		field := fmt.Sprintf("ipam.pools[%d]", i)
+
+		if pool.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: each pool should have the name", field))
+		} else {
+			field = fmt.Sprintf("ipam.pools[%d] (%s)", i, pool.Name)
+		}
+
+		if _, ok := pools[pool.Name]; ok && pool.Name != "" {
+			errs = append(errs, fmt.Errorf("%s: duplicate pool name %q", field, pool.Name))
+		}
+
+		pools[pool.Name] = struct{}{}
+
+		if err := pool.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+
+		if pool.Backend == ipam.BackendNetBox && c.IPAM.NetBox == nil {
+			errs = append(errs, fmt.Errorf("%s: the pool uses NetBox, but netbox is not configured in the ipam", field))
+		}
+	}
+
+	if netbox := c.IPAM.NetBox; netbox != nil {
+		if netbox.URL == "" || netbox.Token == "" {
+			errs = append(errs, errors.New("ipam.netbox: netbox should have the url and the token"))
+		} else if err := validateURL(netbox.URL); err != nil {
+			errs = append(errs, fmt.Errorf("ipam.netbox.url: %w", err))
+		}
+
+		if strings.HasPrefix(netbox.Token, secrets.SchemeVault+":") && c.Secrets.Vault == nil {
+			errs = append(errs, errors.New("ipam.netbox.token: the secret refers to Vault, but vault is not configured in the secrets"))
+		}
+	}
+
+	if vault := c.Secrets.Vault; vault != nil {
+		if vault.Address == "" || vault.Token == "" {
+			errs = append(errs, errors.New("secrets.vault: vault should have the address and the token"))
+		} else if err := validateURL(vault.Address); err != nil {
+			errs = append(errs, fmt.Errorf("secrets.vault.address: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Warnings returns the problems of the config which don't prevent the provider from starting, each prefixed with the path of the field.
+func (c *Config) Warnings() []error {
+	var warnings []error
+
+	check := func(field string, p Proxmox) {
+		// the API might be reachable without the credentials, e.g. through the reverse proxy adding them
+		if p.configured() && p.Username == "" && p.Password == "" && p.TokenID == "" && p.TokenSecret == "" {
+			warnings = append(warnings, fmt.Errorf("%s: neither the username and the password nor the tokenID and the tokenSecret are set, the Proxmox API is accessed without auth", field))
+		}
+	}
+
+	check("proxmox", c.Proxmox)
+
+	for i, cluster := range c.Clusters {
+		field := fmt.Sprintf("clusters[%d]", i)
+
+		if cluster.Name != "" {
+			field = fmt.Sprintf("clusters[%d] (%s)", i, cluster.Name)
+		}
+
+		check(field, cluster.Proxmox)
+	}
+
+	return warnings
+}
+
+// validateProxmox checks the API endpoints and the auth settings of the cluster.
+func (c *Config) validateProxmox(field string, p Proxmox) []error {
+	var errs []error
+
+	if p.URL != "" {
+		if err := validateAPIURL(p.URL); err != nil {
+			errs = append(errs, fmt.Errorf("%s.url: %w", field, err))
+		}
+	}
+
+	for i, u := range p.URLs {
+		if err := validateAPIURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("%s.urls[%d]: %w", field, i, err))
+		}
+	}
+
+	passwordAuth := p.Username != "" || p.Password != ""
+	tokenAuth := p.TokenID != "" || p.TokenSecret != ""
+
+	switch {
+	case passwordAuth && tokenAuth:
+		errs = append(errs, fmt.Errorf("%s: either the username and the password or the tokenID and the tokenSecret should be set, not both", field))
+	case passwordAuth && (p.Username == "" || p.Password == ""):
+		errs = append(errs, fmt.Errorf("%s: the username and the password should be set together", field))
+	case tokenAuth && (p.TokenID == "" || p.TokenSecret == ""):
+		errs = append(errs, fmt.Errorf("%s: the tokenID and the tokenSecret should be set together", field))
+	}
+
+	// the reference would be used as the secret if the secret store is not configured
+	for _, secret := range []struct{ name, value string }{{"password", p.Password}, {"tokenSecret", p.TokenSecret}} {
+		if strings.HasPrefix(secret.value, secrets.SchemeVault+":") && c.Secrets.Vault == nil {
+			errs = append(errs, fmt.Errorf("%s.%s: the secret refers to Vault, but vault is not configured in the secrets", field, secret.name))
+		}
+	}
+
+	if p.HealthCheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("%s.healthCheckInterval: should not be negative", field))
+	}
+
+	return errs
+}
+
+// validateAPIURL checks that the URL is the Proxmox API URL, e.g. https://pve.example.com:8006/api2/json,
+// or https://proxy.example.com/pve/api2/json if the API is served under a path prefix by the reverse proxy.
+func validateAPIURL(value string) error {
+	if err := validateURL(value); err != nil {
+		return err
+	}
+
+	u, _ := url.Parse(value) //nolint:errcheck
+
+	if !strings.HasSuffix(strings.TrimSuffix(u.Path, "/"), "/api2/json") {
+		return fmt.Errorf("%q should end with /api2/json, e.g. https://pve.example.com:8006/api2/json", value)
+	}
+
+	return nil
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%q should be an absolute http or https URL", value)
+	}
+
+	return nil
+}
+
+// Endpoints returns the API endpoints of the cluster, the url goes first.
+func (p Proxmox) Endpoints() []string {
+	if p.URL == "" {
+		return p.URLs
+	}
+
+	return append([]string{p.URL}, p.URLs...)
+}
+
+func (p Proxmox) configured() bool {
+	return len(p.Endpoints()) > 0
+}
+
+// ResolveSecrets replaces the secret references in the config with the secrets.
+func (c *Config) ResolveSecrets(ctx context.Context) error {
+	resolver := secrets.NewResolver()
+
+	if vault := c.Secrets.Vault; vault != nil {
+		token, err := resolver.Resolve(ctx, vault.Token)
+		if err != nil {
+			return fmt.Errorf("vault token: %w", err)
+		}
+
+		provider, err := secrets.NewVaultProvider(vault.Address, token, secrets.VaultOptions{
+			Namespace: vault.Namespace,
+			KVVersion: vault.KVVersion,
+		})
+		if err != nil {
+			return err
+		}
+
+		resolver.Register(secrets.SchemeVault, provider)
+	}
+
+	if err := c.Proxmox.resolveSecrets(ctx, resolver); err != nil {
+		return err
+	}
+
+	for i := range c.Clusters {
+		if err := c.Clusters[i].Proxmox.resolveSecrets(ctx, resolver); err != nil {
+			return fmt.Errorf("cluster %q: %w", c.Clusters[i].Name, err)
+		}
+	}
+
+	if netbox := c.IPAM.NetBox; netbox != nil {
+		var err error
+
+		if netbox.Token, err = resolver.Resolve(ctx, netbox.Token); err != nil {
+			return fmt.Errorf("netbox token: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Proxmox) resolveSecrets(ctx context.Context, resolver *secrets.Resolver) error {
+	var err error
+
+	if p.Password, err = resolver.Resolve(ctx, p.Password); err != nil {
+		return fmt.Errorf("password: %w", err)
+	}
+
+	if p.TokenSecret, err = resolver.Resolve(ctx, p.TokenSecret); err != nil {
+		return fmt.Errorf("tokenSecret: %w", err)
+	}
+
+	return nil
+}
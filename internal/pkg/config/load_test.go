@@ -0,0 +1,235 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/config"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	const token = "    tokenID: omni@pve!provider\n    tokenSecret: secret\n"
+
+	for _, test := range []struct {
+		name     string
+		data     string
+		errs     []string
+		warnings []string
+		strict   bool
+	}{
+		{
+			name: "default cluster",
+			data: "proxmox:\n  url: https://pve1:8006/api2/json\n  username: root\n  password: secret\n  realm: pam\n",
+		},
+		{
+			name: "failover endpoints",
+			data: "proxmox:\n  urls:\n    - https://pve1:8006/api2/json\n    - https://pve2:8006/api2/json/\n  tokenID: omni@pve!provider\n  tokenSecret: secret\n",
+		},
+		{
+			name: "named clusters",
+			data: "clusters:\n  - name: a\n    url: https://pve1:8006/api2/json\n" + token + "  - name: b\n    url: https://pve2:8006/api2/json\n" + token,
+		},
+		{
+			name: "unknown field is ignored",
+			data: "proxmox:\n  url: https://pve1:8006/api2/json\n  token: secret\n  tokenID: omni@pve!provider\n  tokenSecret: secret\n",
+		},
+		{
+			name:   "unknown field",
+			data:   "proxmox:\n  url: https://pve1:8006/api2/json\n  token: secret\n  tokenID: omni@pve!provider\n  tokenSecret: secret\n",
+			strict: true,
+			errs:   []string{"field token not found in type config.Proxmox"},
+		},
+		{
+			name: "empty",
+			data: "",
+			errs: []string{"no Proxmox clusters are configured"},
+		},
+		{
+			name: "no cluster name",
+			data: "clusters:\n  - url: https://pve1:8006/api2/json\n" + token,
+			errs: []string{"clusters[0]: each Proxmox cluster should have the name"},
+		},
+		{
+			name: "default cluster name",
+			data: "clusters:\n  - name: default\n    url: https://pve1:8006/api2/json\n" + token,
+			errs: []string{`clusters[0] (default): duplicate Proxmox cluster name "default"`},
+		},
+		{
+			name: "no cluster url",
+			data: "clusters:\n  - name: a\n" + token,
+			errs: []string{"clusters[0] (a): the Proxmox API url is not set"},
+		},
+		{
+			name: "no default cluster url",
+			data: "proxmox:\n  username: root\n  password: secret\nclusters:\n  - name: a\n    url: https://pve1:8006/api2/json\n" + token,
+			errs: []string{"proxmox: the Proxmox API url is not set"},
+		},
+		{
+			name: "invalid urls",
+			data: "proxmox:\n  url: pve1:8006\n  urls:\n    - https://pve2:8006\n  tokenID: omni@pve!provider\n  tokenSecret: secret\n",
+			errs: []string{
+				`proxmox.url: "pve1:8006" should be an absolute http or https URL`,
+				`proxmox.urls[0]: "https://pve2:8006" should end with /api2/json`,
+			},
+		},
+		{
+			name: "mixed auth",
+			data: "proxmox:\n  url: https://pve1:8006/api2/json\n  username: root\n  password: secret\n  tokenID: omni@pve!provider\n  tokenSecret: secret\n",
+			errs: []string{"proxmox: either the username and the password or the tokenID and the tokenSecret should be set, not both"},
+		},
+		{
+			name: "no password",
+			data: "clusters:\n  - name: a\n    url: https://pve1:8006/api2/json\n    username: root\n",
+			errs: []string{"clusters[0] (a): the username and the password should be set together"},
+		},
+		{
+			name: "no token secret",
+			data: "proxmox:\n  url: https://pve1:8006/api2/json\n  tokenID: omni@pve!provider\n",
+			errs: []string{"proxmox: the tokenID and the tokenSecret should be set together"},
+		},
+		{
+			name:     "no auth",
+			data:     "proxmox:\n  url: https://pve1:8006/api2/json\nclusters:\n  - name: a\n    url: https://pve2:8006/api2/json\n" + token,
+			warnings: []string{"proxmox: neither the username and the password nor the tokenID and the tokenSecret are set, the Proxmox API is accessed without auth"},
+		},
+		{
+			name: "path prefix",
+			data: "proxmox:\n  url: https://proxy.example.com/pve/api2/json\n  urls:\n    - https://proxy.example.com/pve/api2/json/\n" +
+				"  tokenID: omni@pve!provider\n  tokenSecret: secret\n",
+		},
+		{
+			name: "vault is not configured",
+			data: "proxmox:\n  url: https://pve1:8006/api2/json\n  username: root\n  password: vault:secret/proxmox#password\n",
+			errs: []string{"proxmox.password: the secret refers to Vault, but vault is not configured"},
+		},
+		{
+			name: "vault without token",
+			data: "proxmox:\n  url: https://pve1:8006/api2/json\n  username: root\n  password: secret\nsecrets:\n  vault:\n    address: https://vault:8200\n",
+			errs: []string{"secrets.vault: vault should have the address and the token"},
+		},
+		{
+			name: "ip pools",
+			data: "clusters:\n  - name: a\n    url: https://pve1:8006/api2/json\n" + token + "ipam:\n  pools:\n    - name: lan\n      cidr: 10.5.0.0/24\n      gateway: 10.5.0.1\n" +
+				"      ranges: [10.5.0.100-10.5.0.200]\n      exclude: [10.5.0.150]\n",
+		},
+		{
+			name: "invalid ip pools",
+			data: "clusters:\n  - name: a\n    url: https://pve1:8006/api2/json\n" + token + "ipam:\n  pools:\n    - cidr: 10.5.0.0/24\n    - name: lan\n      cidr: 10.5.0.0/24\n" +
+				"    - name: lan\n      cidr: 10.6.0.0/24\n      ranges: [10.5.0.100-10.5.0.200]\n",
+			errs: []string{
+				"ipam.pools[0]: each pool should have the name",
+				`ipam.pools[2] (lan): duplicate pool name "lan"`,
+				`ipam.pools[2] (lan): invalid range "10.5.0.100-10.5.0.200": should be in 10.6.0.1-10.6.0.254`,
+			},
+		},
+		{
+			name: "netbox",
+			data: "clusters:\n  - name: a\n    url: https://pve1:8006/api2/json\n" + token + "ipam:\n  netbox:\n    url: https://netbox.example.com\n    token: env:NETBOX_TOKEN\n" +
+				"  pools:\n    - name: lan\n      cidr: 10.5.0.0/24\n      backend: netbox\n",
+		},
+		{
+			name: "netbox is not configured",
+			data: "clusters:\n  - name: a\n    url: https://pve1:8006/api2/json\n" + token + "ipam:\n  pools:\n    - name: lan\n      cidr: 10.5.0.0/24\n      backend: netbox\n" +
+				"      ranges: [10.5.0.100-10.5.0.200]\n    - name: wan\n      cidr: 10.6.0.0/24\n      backend: infoblox\n",
+			errs: []string{
+				"ipam.pools[0] (lan): the ranges and the exclusions of the NetBox pools are managed in NetBox",
+				"ipam.pools[0] (lan): the pool uses NetBox, but netbox is not configured in the ipam",
+				`ipam.pools[1] (wan): unknown backend "infoblox": should be builtin or netbox`,
+			},
+		},
+		{
+			name: "netbox without token",
+			data: "clusters:\n  - name: a\n    url: https://pve1:8006/api2/json\n" + token + "ipam:\n  netbox:\n    url: https://netbox.example.com\n",
+			errs: []string{"ipam.netbox: netbox should have the url and the token"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			parse := config.Parse
+			if test.strict {
+				parse = config.ParseStrict
+			}
+
+			cfg, err := parse([]byte(test.data))
+
+			if test.errs == nil {
+				require.NoError(t, err)
+
+				var warnings []string
+
+				for _, warning := range cfg.Warnings() {
+					warnings = append(warnings, warning.Error())
+				}
+
+				assert.Equal(t, test.warnings, warnings)
+
+				return
+			}
+
+			require.Error(t, err)
+
+			for _, expected := range test.errs {
+				assert.ErrorContains(t, err, expected)
+			}
+		})
+	}
+}
+
+//nolint:paralleltest
+func TestResolveSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" || r.URL.Path != "/v1/secret/data/proxmox" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		w.Write([]byte(`{"data":{"data":{"tokenSecret":"from-vault"}}}`)) //nolint:errcheck
+	}))
+	defer vault.Close()
+
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0o600))
+
+	t.Setenv("TEST_VAULT_TOKEN", "vault-token")
+
+	cfg, err := config.Parse([]byte(`proxmox:
+  url: https://pve1:8006/api2/json
+  username: root
+  password: file:` + path + `
+  realm: pam
+clusters:
+  - name: site-a
+    url: https://pve.site-a:8006/api2/json
+    tokenID: omni@pve!provider
+    tokenSecret: vault:secret/proxmox#tokenSecret
+secrets:
+  vault:
+    address: ` + vault.URL + `
+    token: env:TEST_VAULT_TOKEN
+`))
+	require.NoError(t, err)
+
+	require.NoError(t, cfg.ResolveSecrets(t.Context()))
+
+	assert.Equal(t, "from-file", cfg.Proxmox.Password)
+	assert.Equal(t, "root", cfg.Proxmox.Username)
+	assert.Equal(t, "from-vault", cfg.Clusters[0].TokenSecret)
+
+	cfg.Clusters[0].TokenSecret = "vault:secret/other#tokenSecret"
+
+	require.ErrorContains(t, cfg.ResolveSecrets(t.Context()), `cluster "site-a": tokenSecret: failed to resolve the vault secret reference`)
+}
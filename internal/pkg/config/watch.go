@@ -0,0 +1,124 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// reloadDelay groups the file system events of a single config file update.
+const reloadDelay = 500 * time.Millisecond
+
+// ReloadFunc applies the new config, the config is kept unchanged if it returns an error.
+type ReloadFunc func(ctx context.Context, config *Config) error
+
+// Watcher reloads the config file when it changes, or when the reload is triggered, e.g. on SIGHUP.
+//
+// The new config is validated before it's applied, the invalid config is logged and ignored.
+type Watcher struct {
+	logger  *zap.Logger
+	reload  ReloadFunc
+	trigger chan struct{}
+	path    string
+	// applied is the content of the config file which was applied last.
+	applied []byte
+}
+
+// NewWatcher creates a new Watcher, the current is the content of the config file which is already applied.
+func NewWatcher(path string, current []byte, logger *zap.Logger, reload ReloadFunc) *Watcher {
+	return &Watcher{
+		path:    path,
+		applied: current,
+		logger:  logger,
+		reload:  reload,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// Trigger reloads the config even if the file is not changed, e.g. to re-read the secrets it refers to.
+func (w *Watcher) Trigger() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run watches the config file until the context is canceled.
+//
+// The directory of the file is watched, as the file is usually replaced rather than written to,
+// e.g. by the editors, or by Kubernetes when the ConfigMap is updated.
+func (w *Watcher) Run(ctx context.Context) error {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create the config file watcher: %w", err)
+	}
+
+	defer fsWatcher.Close() //nolint:errcheck
+
+	if err = fsWatcher.Add(filepath.Dir(w.path)); err != nil {
+		return fmt.Errorf("failed to watch the config file %q: %w", w.path, err)
+	}
+
+	timer := time.NewTimer(0)
+	<-timer.C
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-fsWatcher.Errors:
+			w.logger.Warn("config file watch error", zap.Error(err))
+		case <-fsWatcher.Events:
+			// the events of other files in the directory are not filtered out, the content is compared instead
+			timer.Reset(reloadDelay)
+		case <-timer.C:
+			w.check(ctx, false)
+		case <-w.trigger:
+			w.check(ctx, true)
+		}
+	}
+}
+
+func (w *Watcher) check(ctx context.Context, force bool) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		w.logger.Warn("failed to read the config file", zap.String("path", w.path), zap.Error(err))
+
+		return
+	}
+
+	if !force && bytes.Equal(data, w.applied) {
+		return
+	}
+
+	config, err := Parse(data)
+	if err != nil {
+		w.logger.Error("the config file is invalid, keeping the current config", zap.String("path", w.path), zap.Error(err))
+
+		return
+	}
+
+	for _, warning := range config.Warnings() {
+		w.logger.Warn("config file warning", zap.String("path", w.path), zap.Error(warning))
+	}
+
+	if err = w.reload(ctx, config); err != nil {
+		w.logger.Error("failed to apply the config, keeping the current config", zap.String("path", w.path), zap.Error(err))
+
+		return
+	}
+
+	w.applied = data
+
+	w.logger.Info("reloaded the config file", zap.String("path", w.path))
+}
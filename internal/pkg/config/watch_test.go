@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/config"
+)
+
+func TestWatcher(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+
+	write := func(content string) {
+		// the file is replaced, as the editors and Kubernetes do
+		require.NoError(t, os.WriteFile(path+".tmp", []byte(content), 0o600))
+		require.NoError(t, os.Rename(path+".tmp", path))
+	}
+
+	const initial = "proxmox:\n  url: https://pve1:8006/api2/json\n"
+
+	write(initial)
+
+	reloaded := make(chan *config.Config, 10)
+
+	watcher := config.NewWatcher(path, []byte(initial), zaptest.NewLogger(t), func(_ context.Context, cfg *config.Config) error {
+		reloaded <- cfg
+
+		return nil
+	})
+
+	go watcher.Run(ctx) //nolint:errcheck
+
+	next := func() *config.Config {
+		select {
+		case cfg := <-reloaded:
+			return cfg
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "config is not reloaded")
+		}
+
+		return nil
+	}
+
+	noReload := func() {
+		select {
+		case cfg := <-reloaded:
+			require.FailNow(t, "unexpected reload", "%+v", cfg)
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	// give the watcher time to start watching
+	time.Sleep(100 * time.Millisecond)
+
+	write("proxmox:\n  url: https://pve1:8006/api2/json\n  tokenID: omni@pve!provider\n  tokenSecret: secret\n")
+
+	assert.Equal(t, "secret", next().Proxmox.TokenSecret)
+
+	// the invalid config is not applied
+	write("clusters:\n  - url: https://pve1:8006/api2/json\n")
+	noReload()
+
+	// the unchanged config is not reloaded, unless triggered
+	write("proxmox:\n  url: https://pve1:8006/api2/json\n  tokenID: omni@pve!provider\n  tokenSecret: secret\n")
+	noReload()
+
+	watcher.Trigger()
+	assert.Equal(t, "secret", next().Proxmox.TokenSecret)
+}
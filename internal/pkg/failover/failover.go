@@ -0,0 +1,326 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package failover implements the HTTP transport failing over between the Proxmox API endpoints of the cluster nodes.
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EndpointStatus is the health of the API endpoint.
+type EndpointStatus struct {
+	// LastError is the error of the last failed request or health check.
+	LastError error
+	URL       string
+	Healthy   bool
+	Current   bool
+}
+
+type endpoint struct {
+	url       *url.URL
+	lastError error
+	healthy   bool
+}
+
+// Transport is the http.RoundTripper which sends the requests to the current API endpoint,
+// switching to the next healthy endpoint when the current one can't be reached.
+//
+// The current endpoint is sticky: the requests keep going to it while it works, even if an endpoint listed before it becomes healthy again.
+// The requests are made to the first endpoint URL, they are rewritten to the current endpoint.
+type Transport struct {
+	base      http.RoundTripper
+	logger    *zap.Logger
+	endpoints []*endpoint
+	current   int
+	mu        sync.Mutex
+}
+
+// NewTransport creates a new Transport, the base transport is used for the requests to all endpoints.
+func NewTransport(base http.RoundTripper, logger *zap.Logger, endpoints ...string) (*Transport, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no API endpoints")
+	}
+
+	t := &Transport{
+		base:   base,
+		logger: logger,
+	}
+
+	for _, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API endpoint %q: %w", e, err)
+		}
+
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid API endpoint %q: should be an absolute URL", e)
+		}
+
+		t.endpoints = append(t.endpoints, &endpoint{
+			url:     u,
+			healthy: true,
+		})
+	}
+
+	return t, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+//
+// The request is retried on the other endpoints only if it's safe: the connection to the endpoint wasn't established,
+// or the request is idempotent. The 502 and 503 responses to the other requests are returned as is, as the endpoint might have processed them.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var lastErr error
+
+	for i, index := range t.order() {
+		attempt := t.rewrite(req, t.endpoints[index].url)
+
+		// the body of the first attempt is consumed
+		if i > 0 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				break
+			}
+
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			attempt.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attempt)
+
+		switch {
+		case err == nil && resp.StatusCode != http.StatusBadGateway && resp.StatusCode != http.StatusServiceUnavailable:
+			t.succeeded(index)
+
+			return resp, nil
+		case err == nil && !isIdempotent(req.Method):
+			// the next requests go to the other endpoint
+			t.failed(index, fmt.Errorf("%s responded with %s", t.endpoints[index].url.Host, resp.Status))
+
+			return resp, nil
+		case err == nil:
+			resp.Body.Close() //nolint:errcheck
+
+			lastErr = fmt.Errorf("%s responded with %s", t.endpoints[index].url.Host, resp.Status)
+		case req.Context().Err() != nil:
+			return nil, err
+		default:
+			lastErr = err
+
+			if !isDialError(err) && !isIdempotent(req.Method) {
+				t.failed(index, err)
+
+				return nil, err
+			}
+		}
+
+		t.failed(index, lastErr)
+	}
+
+	return nil, fmt.Errorf("all Proxmox API endpoints failed, last error: %w", lastErr)
+}
+
+// Check probes all endpoints, so that the failover skips the ones which are down, and the current endpoint is switched if it's down.
+func (t *Transport) Check(ctx context.Context) {
+	for index, e := range t.endpoints {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+
+		err := t.probe(ctx, e.url)
+
+		cancel()
+
+		t.mu.Lock()
+
+		if err == nil && !e.healthy {
+			t.logger.Info("Proxmox API endpoint is healthy again", zap.String("endpoint", e.url.Host))
+		}
+
+		if err != nil && e.healthy {
+			t.logger.Warn("Proxmox API endpoint health check failed", zap.String("endpoint", e.url.Host), zap.Error(err))
+		}
+
+		e.healthy = err == nil
+		e.lastError = err
+
+		// the current endpoint is switched only if it's down and the other endpoint is up
+		if !e.healthy && index == t.current {
+			t.switchFrom(index)
+		}
+
+		t.mu.Unlock()
+	}
+}
+
+// Run checks the endpoints every interval until the context is canceled.
+func (t *Transport) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.Check(ctx)
+	}
+}
+
+// Status returns the status of all endpoints.
+func (t *Transport) Status() []EndpointStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]EndpointStatus, 0, len(t.endpoints))
+
+	for index, e := range t.endpoints {
+		result = append(result, EndpointStatus{
+			URL:       e.url.String(),
+			Healthy:   e.healthy,
+			Current:   index == t.current,
+			LastError: e.lastError,
+		})
+	}
+
+	return result
+}
+
+// probe checks if the Proxmox API responds, any response except the proxy errors means the API is up, even if the request is not authorized.
+func (t *Transport) probe(ctx context.Context, u *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.JoinPath("version").String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// order returns the endpoints to try: the current one first, then the healthy ones, then the rest in the config order.
+func (t *Transport) order() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	order := []int{t.current}
+
+	for _, healthy := range []bool{true, false} {
+		for index, e := range t.endpoints {
+			if index != t.current && e.healthy == healthy {
+				order = append(order, index)
+			}
+		}
+	}
+
+	return order
+}
+
+func (t *Transport) succeeded(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.endpoints[index]
+	e.healthy = true
+	e.lastError = nil
+
+	if index != t.current {
+		t.logger.Warn("switched to another Proxmox API endpoint",
+			zap.String("from", t.endpoints[t.current].url.Host),
+			zap.String("to", e.url.Host),
+		)
+
+		t.current = index
+	}
+}
+
+func (t *Transport) failed(index int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.endpoints[index]
+	e.healthy = false
+	e.lastError = err
+}
+
+// switchFrom makes the first healthy endpoint the current one.
+func (t *Transport) switchFrom(index int) {
+	for next, e := range t.endpoints {
+		if next != index && e.healthy {
+			t.logger.Warn("switched to another Proxmox API endpoint",
+				zap.String("from", t.endpoints[index].url.Host),
+				zap.String("to", e.url.Host),
+			)
+
+			t.current = next
+
+			return
+		}
+	}
+}
+
+// rewrite points the copy of the request made to the first endpoint to the given endpoint.
+func (t *Transport) rewrite(req *http.Request, target *url.URL) *http.Request {
+	primary := t.endpoints[0].url
+
+	req = req.Clone(req.Context())
+
+	if target == primary {
+		return req
+	}
+
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.Host = ""
+
+	// the escaped path is rewritten, so the escaped characters of the request path, e.g. %2F in the volume IDs, are kept
+	if path, ok := strings.CutPrefix(req.URL.EscapedPath(), primary.EscapedPath()); ok {
+		rawPath := strings.TrimSuffix(target.EscapedPath(), "/") + path
+
+		if unescaped, err := url.PathUnescape(rawPath); err == nil {
+			req.URL.Path = unescaped
+			req.URL.RawPath = rawPath
+		}
+	}
+
+	return req
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
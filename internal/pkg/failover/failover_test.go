@@ -0,0 +1,208 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package failover_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/failover"
+)
+
+type fakeEndpoint struct {
+	*httptest.Server
+	name     string
+	requests atomic.Int32
+	status   atomic.Int32
+}
+
+func newFakeEndpoint(t *testing.T, name string) *fakeEndpoint {
+	t.Helper()
+
+	e := &fakeEndpoint{name: name}
+	e.status.Store(http.StatusOK)
+
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.requests.Add(1)
+
+		body, _ := io.ReadAll(r.Body) //nolint:errcheck
+
+		w.WriteHeader(int(e.status.Load()))
+		w.Write([]byte(e.name + " " + r.Method + " " + r.URL.EscapedPath() + " " + string(body))) //nolint:errcheck
+	}))
+
+	t.Cleanup(e.Close)
+
+	return e
+}
+
+func (e *fakeEndpoint) api() string {
+	return e.URL + "/api2/json"
+}
+
+func do(t *testing.T, client *http.Client, method, url, body string) (string, error) {
+	t.Helper()
+
+	var reader io.Reader
+
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(t.Context(), method, url, reader)
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return string(data), nil
+}
+
+func TestTransportFailover(t *testing.T) {
+	t.Parallel()
+
+	down := newFakeEndpoint(t, "pve1")
+	down.Close()
+
+	pve2 := newFakeEndpoint(t, "pve2")
+	pve3 := newFakeEndpoint(t, "pve3")
+
+	transport, err := failover.NewTransport(http.DefaultTransport, zaptest.NewLogger(t), down.api(), pve2.api(), pve3.api())
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: transport}
+
+	// the requests are made to the first endpoint and rewritten to the one which is up
+	resp, err := do(t, client, http.MethodGet, down.api()+"/nodes", "")
+	require.NoError(t, err)
+	assert.Equal(t, "pve2 GET /api2/json/nodes ", resp)
+
+	// the escaped characters of the path are kept
+	resp, err = do(t, client, http.MethodGet, down.api()+"/nodes/pve2/storage/local/content/local:iso%2Ftalos.iso", "")
+	require.NoError(t, err)
+	assert.Equal(t, "pve2 GET /api2/json/nodes/pve2/storage/local/content/local:iso%2Ftalos.iso ", resp)
+
+	// the request body is replayed, the connection to the endpoint which is down was never established
+	resp, err = do(t, client, http.MethodPost, down.api()+"/nodes/pve2/qemu", "vmid=100")
+	require.NoError(t, err)
+	assert.Equal(t, "pve2 POST /api2/json/nodes/pve2/qemu vmid=100", resp)
+
+	status := transport.Status()
+	require.Len(t, status, 3)
+	assert.False(t, status[0].Healthy)
+	assert.Error(t, status[0].LastError)
+	assert.True(t, status[1].Current)
+
+	// the endpoint responding with 503 is skipped
+	pve2.status.Store(http.StatusServiceUnavailable)
+
+	resp, err = do(t, client, http.MethodGet, down.api()+"/version", "")
+	require.NoError(t, err)
+	assert.Equal(t, "pve3 GET /api2/json/version ", resp)
+
+	// the current endpoint is sticky
+	pve2.status.Store(http.StatusOK)
+
+	resp, err = do(t, client, http.MethodGet, down.api()+"/version", "")
+	require.NoError(t, err)
+	assert.Equal(t, "pve3 GET /api2/json/version ", resp)
+
+	// the errors which are not the proxy errors are returned as is
+	pve3.status.Store(http.StatusForbidden)
+
+	resp, err = do(t, client, http.MethodGet, down.api()+"/version", "")
+	require.NoError(t, err)
+	assert.Equal(t, "pve3 GET /api2/json/version ", resp)
+	assert.True(t, transport.Status()[2].Current)
+
+	// the non-idempotent requests are not replayed after the proxy errors, the next requests go to the other endpoint
+	pve3.status.Store(http.StatusBadGateway)
+
+	replayed := pve2.requests.Load()
+
+	resp, err = do(t, client, http.MethodPost, down.api()+"/nodes/pve3/qemu", "vmid=101")
+	require.NoError(t, err)
+	assert.Equal(t, "pve3 POST /api2/json/nodes/pve3/qemu vmid=101", resp)
+	assert.Equal(t, replayed, pve2.requests.Load())
+
+	resp, err = do(t, client, http.MethodGet, down.api()+"/version", "")
+	require.NoError(t, err)
+	assert.Equal(t, "pve2 GET /api2/json/version ", resp)
+
+	pve2.Close()
+	pve3.Close()
+
+	_, err = do(t, client, http.MethodGet, down.api()+"/version", "")
+	require.ErrorContains(t, err, "all Proxmox API endpoints failed")
+}
+
+func TestTransportCheck(t *testing.T) {
+	t.Parallel()
+
+	pve1 := newFakeEndpoint(t, "pve1")
+	pve2 := newFakeEndpoint(t, "pve2")
+
+	transport, err := failover.NewTransport(http.DefaultTransport, zaptest.NewLogger(t), pve1.api(), pve2.api())
+	require.NoError(t, err)
+
+	transport.Check(t.Context())
+
+	for _, status := range transport.Status() {
+		assert.True(t, status.Healthy, status.URL)
+	}
+
+	assert.True(t, transport.Status()[0].Current)
+
+	// the current endpoint is switched by the health check, before any request fails
+	pve1.status.Store(http.StatusBadGateway)
+
+	transport.Check(t.Context())
+
+	status := transport.Status()
+	assert.False(t, status[0].Healthy)
+	assert.ErrorContains(t, status[0].LastError, "502")
+	assert.True(t, status[1].Current)
+
+	requests := pve1.requests.Load()
+
+	resp, err := do(t, &http.Client{Transport: transport}, http.MethodGet, pve1.api()+"/nodes", "")
+	require.NoError(t, err)
+	assert.Equal(t, "pve2 GET /api2/json/nodes ", resp)
+	assert.Equal(t, requests, pve1.requests.Load())
+
+	// the unauthorized response means the API is up
+	pve1.status.Store(http.StatusUnauthorized)
+
+	transport.Check(t.Context())
+
+	status = transport.Status()
+	assert.True(t, status[0].Healthy)
+	assert.True(t, status[1].Current)
+}
+
+func TestNewTransport(t *testing.T) {
+	t.Parallel()
+
+	_, err := failover.NewTransport(http.DefaultTransport, zaptest.NewLogger(t))
+	require.Error(t, err)
+
+	_, err = failover.NewTransport(http.DefaultTransport, zaptest.NewLogger(t), "https://pve1:8006/api2/json", "pve2:8006")
+	require.ErrorContains(t, err, `invalid API endpoint "pve2:8006"`)
+}
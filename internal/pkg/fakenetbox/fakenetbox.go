@@ -0,0 +1,339 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package fakenetbox implements an in-process fake NetBox IPAM API server which can be used in tests.
+//
+// Only the prefixes and the IP addresses endpoints used by the provider are implemented.
+package fakenetbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Token is the API token accepted by the fake server.
+const Token = "fake-token"
+
+// Address describes a fake NetBox IP address.
+type Address struct {
+	// CustomFields are the custom field values, the numbers read from the requests are float64.
+	CustomFields map[string]any `json:"custom_fields"`
+	// Address is the address with the prefix length, e.g. 10.5.0.10/24.
+	Address     string   `json:"address"`
+	Description string   `json:"description"`
+	Status      string   `json:"status"`
+	Tags        []string `json:"-"`
+	ID          int      `json:"id"`
+}
+
+type prefix struct {
+	Prefix string `json:"prefix"`
+	ID     int    `json:"id"`
+	VRF    int    `json:"-"`
+}
+
+type tag struct {
+	Name string `json:"name"`
+}
+
+// Server is the fake NetBox API server.
+type Server struct {
+	srv       *httptest.Server
+	prefixes  []prefix
+	addresses []Address
+	lastID    int
+	mu        sync.Mutex
+}
+
+// NewServer starts a new fake NetBox API server.
+func NewServer() *Server {
+	s := &Server{}
+
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// URL returns the NetBox address of the server.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// HTTPClient returns the HTTP client connected to the server.
+func (s *Server) HTTPClient() *http.Client {
+	return s.srv.Client()
+}
+
+// AddPrefix adds the prefix without the VRF, e.g. 10.5.0.0/24, and returns its ID.
+func (s *Server) AddPrefix(p string) int {
+	return s.AddVRFPrefix(p, 0)
+}
+
+// AddVRFPrefix adds the prefix to the VRF with the ID and returns the prefix ID.
+func (s *Server) AddVRFPrefix(p string, vrf int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+
+	s.prefixes = append(s.prefixes, prefix{ID: s.lastID, Prefix: p, VRF: vrf})
+
+	return s.lastID
+}
+
+// AddAddress adds the IP address, e.g. the address used outside of Proxmox.
+func (s *Server) AddAddress(address Address) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+
+	address.ID = s.lastID
+
+	s.addresses = append(s.addresses, address)
+}
+
+// SetDescription changes the description of the IP address, e.g. edited by the user.
+func (s *Server) SetDescription(id int, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.addresses {
+		if s.addresses[i].ID == id {
+			s.addresses[i].Description = description
+		}
+	}
+}
+
+// Addresses returns the copies of all IP addresses in the order of creation.
+func (s *Server) Addresses() []Address {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]Address, 0, len(s.addresses))
+
+	for _, address := range s.addresses {
+		address.Tags = slices.Clone(address.Tags)
+		address.CustomFields = maps.Clone(address.CustomFields)
+
+		res = append(res, address)
+	}
+
+	return res
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Token "+Token {
+		writeJSON(w, http.StatusForbidden, map[string]string{"detail": "Invalid token"})
+
+		return
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, "/api/ipam/")
+	if !ok || !strings.HasSuffix(path, "/") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "Not found."})
+
+		return
+	}
+
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "prefixes":
+		query := r.URL.Query()
+
+		results := slices.DeleteFunc(slices.Clone(s.prefixes), func(p prefix) bool {
+			return (query.Has("prefix") && p.Prefix != query.Get("prefix")) ||
+				(query.Has("id") && strconv.Itoa(p.ID) != query.Get("id")) ||
+				(query.Has("vrf_id") && strconv.Itoa(p.VRF) != query.Get("vrf_id"))
+		})
+
+		writeJSON(w, http.StatusOK, map[string]any{"count": len(results), "next": nil, "results": results})
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "prefixes" && parts[2] == "available-ips":
+		s.allocate(w, r, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "ip-addresses":
+		s.list(w, r)
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "ip-addresses":
+		address, err := decodeAddress(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+
+			return
+		}
+
+		if _, err = netip.ParsePrefix(address.Address); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+
+			return
+		}
+
+		s.lastID++
+		address.ID = s.lastID
+		s.addresses = append(s.addresses, address)
+
+		writeJSON(w, http.StatusCreated, address)
+	case (r.Method == http.MethodPatch || r.Method == http.MethodDelete) && len(parts) == 2 && parts[0] == "ip-addresses":
+		index := slices.IndexFunc(s.addresses, func(address Address) bool { return strconv.Itoa(address.ID) == parts[1] })
+		if index == -1 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"detail": "No IPAddress matches the given query."})
+
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			s.addresses = slices.Delete(s.addresses, index, index+1)
+
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
+
+		var patch map[string]string
+
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+
+			return
+		}
+
+		if description, ok := patch["description"]; ok {
+			s.addresses[index].Description = description
+		}
+
+		writeJSON(w, http.StatusOK, s.addresses[index])
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"detail": fmt.Sprintf("Method %q not allowed.", r.Method)})
+	}
+}
+
+// allocate creates the first free address of the prefix, the network and the broadcast addresses are skipped.
+func (s *Server) allocate(w http.ResponseWriter, r *http.Request, id string) {
+	index := slices.IndexFunc(s.prefixes, func(p prefix) bool { return strconv.Itoa(p.ID) == id })
+	if index == -1 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"detail": "No Prefix matches the given query."})
+
+		return
+	}
+
+	p := netip.MustParsePrefix(s.prefixes[index].Prefix)
+
+	address, err := decodeAddress(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"detail": err.Error()})
+
+		return
+	}
+
+	for addr := p.Addr().Next(); p.Contains(addr.Next()); addr = addr.Next() {
+		if slices.ContainsFunc(s.addresses, func(existing Address) bool {
+			return netip.MustParsePrefix(existing.Address).Addr() == addr
+		}) {
+			continue
+		}
+
+		s.lastID++
+		address.ID = s.lastID
+		address.Address = netip.PrefixFrom(addr, p.Bits()).String()
+		s.addresses = append(s.addresses, address)
+
+		writeJSON(w, http.StatusCreated, address)
+
+		return
+	}
+
+	writeJSON(w, http.StatusConflict, map[string]string{
+		"detail": fmt.Sprintf("An insufficient number of IP addresses are available within prefix %s (1 requested, 0 available)", p),
+	})
+}
+
+// list returns the page of the addresses matching the address, the description__isw and the custom field filters.
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	results := slices.DeleteFunc(slices.Clone(s.addresses), func(address Address) bool {
+		if query.Has("address") && netip.MustParsePrefix(address.Address).Addr().String() != query.Get("address") {
+			return true
+		}
+
+		for key := range query {
+			if field, ok := strings.CutPrefix(key, "cf_"); ok && fmt.Sprint(address.CustomFields[field]) != query.Get(key) {
+				return true
+			}
+		}
+
+		return !strings.HasPrefix(strings.ToLower(address.Description), strings.ToLower(query.Get("description__isw")))
+	})
+
+	limit, _ := strconv.Atoi(query.Get("limit")) //nolint:errcheck
+	if limit <= 0 {
+		limit = 50
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset")) //nolint:errcheck
+
+	page := results[min(offset, len(results)):min(offset+limit, len(results))]
+
+	var next *string
+
+	if offset+limit < len(results) {
+		query.Set("offset", strconv.Itoa(offset+limit))
+
+		u := url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawQuery: query.Encode()}
+		nextURL := u.String()
+		next = &nextURL
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"count": len(results), "next": next, "results": page})
+}
+
+func decodeAddress(r *http.Request) (Address, error) {
+	var body struct {
+		CustomFields map[string]any `json:"custom_fields"`
+		Address      string         `json:"address"`
+		Description  string         `json:"description"`
+		Status       string         `json:"status"`
+		Tags         []tag          `json:"tags"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return Address{}, err
+	}
+
+	address := Address{
+		Address:      body.Address,
+		Description:  body.Description,
+		Status:       body.Status,
+		CustomFields: body.CustomFields,
+	}
+
+	for _, t := range body.Tags {
+		address.Tags = append(address.Tags, t.Name)
+	}
+
+	return address, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(body) //nolint:errcheck
+}
@@ -0,0 +1,411 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package fakeproxmox implements an in-process fake Proxmox VE API server which can be used with the go-proxmox client in tests.
+package fakeproxmox
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luthermonson/go-proxmox"
+)
+
+const (
+	// TokenID is the API token ID accepted by the fake server.
+	TokenID = "root@pam!fake"
+	// TokenSecret is the API token secret accepted by the fake server.
+	TokenSecret = "fake-secret"
+
+	firstVMID = 100
+)
+
+// Node describes a fake Proxmox node.
+type Node struct {
+	Name string
+	// Status is the node status, defaults to online.
+	Status string
+	// Description is the node notes.
+	Description string
+	// Bridges are the Linux bridges of the node network.
+	Bridges   []Bridge
+	CPUUsage  float64
+	MaxMemory uint64
+	Memory    uint64
+	Uptime    uint64
+	CPUs      int
+}
+
+// Bridge describes a fake Proxmox node network bridge.
+type Bridge struct {
+	Name      string
+	VLANAware bool
+}
+
+// Storage describes a fake Proxmox storage.
+type Storage struct {
+	Name string
+	// Type is the storage type, defaults to dir.
+	Type string
+	// Pool is the resource pool the storage belongs to.
+	Pool    string
+	Content []string
+	Total   uint64
+	Used    uint64
+	Shared  bool
+}
+
+// VM describes a fake Proxmox VM.
+type VM struct {
+	Config map[string]string
+	// FirewallOptions are the VM firewall options, e.g. enable and policy_in.
+	FirewallOptions map[string]string
+	Node            string
+	Status          string
+	Lock            string
+	// Pool is the resource pool the VM belongs to.
+	Pool string
+	// GuestAddresses are reported by the guest agent of the running VM, the agent doesn't respond if there are none.
+	GuestAddresses []string
+	// FirewallRules are the VM firewall rules in the order of their positions.
+	FirewallRules []FirewallRule
+	ID            int
+	Template      bool
+}
+
+// Name returns the VM name.
+func (vm VM) Name() string {
+	return vm.Config["name"]
+}
+
+// Tags returns the VM tags.
+func (vm VM) Tags() []string {
+	if vm.Config["tags"] == "" {
+		return nil
+	}
+
+	return strings.FieldsFunc(vm.Config["tags"], func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
+}
+
+// TaskBehavior controls how the tasks of some type finish.
+type TaskBehavior struct {
+	// ExitStatus is the task exit status, defaults to OK.
+	ExitStatus string
+	// Polls is the number of the status polls for which the task is reported as running.
+	Polls int
+	// Count limits the number of tasks the behavior applies to, zero means all further tasks.
+	Count int
+}
+
+type node struct {
+	storages map[string]*storage
+	vms      map[int]*VM
+	// containers are the LXC container IDs, only listed in the cluster resources.
+	containers []int
+	Node
+}
+
+type storage struct {
+	volumes map[string]uint64
+	Storage
+}
+
+type failure struct {
+	method  string
+	path    string
+	message string
+	code    int
+	count   int
+}
+
+// Server is the fake Proxmox VE API server.
+type Server struct {
+	srv           *httptest.Server
+	nodes         map[string]*node
+	tasks         map[proxmox.UPID]*task
+	taskBehaviors map[string][]TaskBehavior
+	requests      map[string]int
+	haGroups      map[string]struct{}
+	haResources   map[string]map[string]string
+	// permissions are the privileges of the API token by the ACL path, the token has all privileges if they are not set.
+	permissions map[string][]string
+	// pciMappings are the node PCI devices by the mapping ID and the node name.
+	pciMappings map[string]map[string]string
+	zones       map[string]*Zone
+	vnets       map[string]*VNet
+	// securityGroups are the cluster firewall security groups.
+	securityGroups map[string]struct{}
+	started        time.Time
+	failures       []*failure
+	taskCounter    int
+	mu             sync.Mutex
+}
+
+// NewServer starts a new fake Proxmox VE API server.
+func NewServer() *Server {
+	s := &Server{
+		nodes:          map[string]*node{},
+		tasks:          map[proxmox.UPID]*task{},
+		taskBehaviors:  map[string][]TaskBehavior{},
+		requests:       map[string]int{},
+		haGroups:       map[string]struct{}{},
+		haResources:    map[string]map[string]string{},
+		pciMappings:    map[string]map[string]string{},
+		zones:          map[string]*Zone{},
+		vnets:          map[string]*VNet{},
+		securityGroups: map[string]struct{}{},
+		started:        time.Now(),
+	}
+
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// URL returns the base API URL of the server.
+func (s *Server) URL() string {
+	return s.srv.URL + "/api2/json"
+}
+
+// Client creates a new go-proxmox client connected to the server.
+func (s *Server) Client() *proxmox.Client {
+	return proxmox.NewClient(s.URL(),
+		proxmox.WithHTTPClient(s.srv.Client()),
+		proxmox.WithAPIToken(TokenID, TokenSecret),
+	)
+}
+
+// AddNode adds a node to the cluster.
+func (s *Server) AddNode(n Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n.Status == "" {
+		n.Status = "online"
+	}
+
+	s.nodes[n.Name] = &node{
+		Node:     n,
+		storages: map[string]*storage{},
+		vms:      map[int]*VM{},
+	}
+}
+
+// AddStorage adds a storage to the node.
+func (s *Server) AddStorage(nodeName string, st Storage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st.Type == "" {
+		st.Type = "dir"
+	}
+
+	s.nodes[nodeName].storages[st.Name] = &storage{
+		Storage: st,
+		volumes: map[string]uint64{},
+	}
+}
+
+// AddVolume adds a volume to the node storage.
+func (s *Server) AddVolume(nodeName, volID string, size uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	storageName, _, _ := strings.Cut(volID, ":")
+
+	s.nodes[nodeName].storages[storageName].volumes[volID] = size
+}
+
+// HasVolume checks if the volume exists on the node.
+func (s *Server) HasVolume(nodeName, volID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	storageName, _, _ := strings.Cut(volID, ":")
+
+	st, ok := s.nodes[nodeName].storages[storageName]
+	if !ok {
+		return false
+	}
+
+	_, ok = st.volumes[volID]
+
+	return ok
+}
+
+// SetNodeStatus changes the node status, e.g. to offline.
+func (s *Server) SetNodeStatus(nodeName, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[nodeName].Status = status
+}
+
+// AddContainer adds an LXC container to the node, it's only listed in the cluster resources.
+func (s *Server) AddContainer(nodeName string, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[nodeName].containers = append(s.nodes[nodeName].containers, id)
+}
+
+// AddVM adds a VM to the node.
+func (s *Server) AddVM(vm VM) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if vm.Status == "" {
+		vm.Status = "stopped"
+	}
+
+	vm.Config = maps.Clone(vm.Config)
+	if vm.Config == nil {
+		vm.Config = map[string]string{}
+	}
+
+	vm.GuestAddresses = slices.Clone(vm.GuestAddresses)
+	vm.FirewallOptions = maps.Clone(vm.FirewallOptions)
+	vm.FirewallRules = slices.Clone(vm.FirewallRules)
+
+	s.nodes[vm.Node].vms[vm.ID] = &vm
+}
+
+// MoveVM moves the VM to another node, the way the HA manager or the migration does.
+func (s *Server) MoveVM(nodeName string, vmid int, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm := s.nodes[nodeName].vms[vmid]
+	vm.Node = target
+
+	delete(s.nodes[nodeName].vms, vmid)
+	s.nodes[target].vms[vmid] = vm
+}
+
+// VM returns the copy of the VM state.
+func (s *Server) VM(nodeName string, vmid int) (VM, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.nodes[nodeName].vms[vmid]
+	if !ok {
+		return VM{}, false
+	}
+
+	res := *vm
+	res.Config = maps.Clone(vm.Config)
+	res.GuestAddresses = slices.Clone(vm.GuestAddresses)
+	res.FirewallOptions = maps.Clone(vm.FirewallOptions)
+	res.FirewallRules = slices.Clone(vm.FirewallRules)
+
+	return res, true
+}
+
+// VMs returns the copies of all VMs on the node sorted by the VMID.
+func (s *Server) VMs(nodeName string) []VM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := slices.Sorted(maps.Keys(s.nodes[nodeName].vms))
+	res := make([]VM, 0, len(ids))
+
+	for _, id := range ids {
+		vm := *s.nodes[nodeName].vms[id]
+		vm.Config = maps.Clone(vm.Config)
+		vm.FirewallOptions = maps.Clone(vm.FirewallOptions)
+		vm.FirewallRules = slices.Clone(vm.FirewallRules)
+
+		res = append(res, vm)
+	}
+
+	return res
+}
+
+// SetTaskBehavior configures how the further tasks of the type (e.g. qmcreate, qmstart, download) finish.
+// Behaviors with the limited count are applied in the order they were added.
+func (s *Server) SetTaskBehavior(taskType string, behavior TaskBehavior) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if behavior.Count == 0 {
+		s.taskBehaviors[taskType] = []TaskBehavior{behavior}
+
+		return
+	}
+
+	s.taskBehaviors[taskType] = append(s.taskBehaviors[taskType], behavior)
+}
+
+// FailRequests makes the next count requests to the API path fail with the HTTP code and the message.
+func (s *Server) FailRequests(method, path string, count, code int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &failure{
+		method:  method,
+		path:    path,
+		count:   count,
+		code:    code,
+		message: message,
+	})
+}
+
+// Requests returns the number of requests made to the API path.
+func (s *Server) Requests(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[method+" "+path]
+}
+
+// AddHAGroup adds an HA group.
+func (s *Server) AddHAGroup(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.haGroups[name] = struct{}{}
+}
+
+// HAResource returns the copy of the HA resource config by its ID, e.g. vm:100.
+func (s *Server) HAResource(sid string) (map[string]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resource, ok := s.haResources[sid]
+
+	return maps.Clone(resource), ok
+}
+
+// SetPermissions grants the privileges on the ACL path to the API token, the privileges are propagated to the child paths.
+// Once any privileges are set, the token has only the privileges granted explicitly.
+func (s *Server) SetPermissions(path string, privileges ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.permissions == nil {
+		s.permissions = map[string][]string{}
+	}
+
+	s.permissions[path] = privileges
+}
+
+// AddPCIMapping adds the PCI resource mapping with the device path on each of the nodes.
+func (s *Server) AddPCIMapping(id string, devices map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pciMappings[id] = maps.Clone(devices)
+}
@@ -0,0 +1,181 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fakeproxmox
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var firewallActions = []string{"ACCEPT", "DROP", "REJECT"}
+
+// FirewallRule describes a fake Proxmox VM firewall rule.
+type FirewallRule struct {
+	// Type is in, out or group.
+	Type string
+	// Action is ACCEPT, DROP or REJECT, or the security group name for the group rules.
+	Action  string
+	Proto   string
+	DPort   string
+	SPort   string
+	Source  string
+	Dest    string
+	Iface   string
+	Comment string
+	Enable  bool
+}
+
+// AddSecurityGroup adds the cluster firewall security group.
+func (s *Server) AddSecurityGroup(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.securityGroups[name] = struct{}{}
+}
+
+func (s *Server) routeFirewall(method string, parts []string) (any, error) {
+	if method == http.MethodGet && match(parts, "groups") {
+		groups := make([]any, 0, len(s.securityGroups))
+
+		for _, name := range slices.Sorted(maps.Keys(s.securityGroups)) {
+			groups = append(groups, map[string]any{"group": name, "digest": "fake"})
+		}
+
+		return groups, nil
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /cluster/firewall/%s' not implemented", method, strings.Join(parts, "/"))
+}
+
+//nolint:gocyclo,cyclop
+func (s *Server) routeVMFirewall(method string, n *node, vm *VM, parts []string, params url.Values) (any, error) {
+	switch {
+	case method == http.MethodGet && match(parts, "options"):
+		options := map[string]any{}
+
+		for k, v := range vm.FirewallOptions {
+			if k == "enable" {
+				options[k], _ = strconv.Atoi(v) //nolint:errcheck
+
+				continue
+			}
+
+			options[k] = v
+		}
+
+		return options, nil
+	case method == http.MethodPut && match(parts, "options"):
+		if vm.FirewallOptions == nil {
+			vm.FirewallOptions = map[string]string{}
+		}
+
+		for _, key := range []string{"policy_in", "policy_out"} {
+			if value := params.Get(key); value != "" && !slices.Contains(firewallActions, value) {
+				return nil, errorf(http.StatusBadRequest, "Parameter verification failed: %s: value '%s' does not have a value in the enumeration '%s'",
+					key, value, strings.Join(firewallActions, ", "))
+			}
+		}
+
+		for _, key := range []string{"enable", "policy_in", "policy_out"} {
+			if params.Has(key) {
+				vm.FirewallOptions[key] = params.Get(key)
+			}
+		}
+
+		for key := range strings.SplitSeq(params.Get("delete"), ",") {
+			delete(vm.FirewallOptions, key)
+		}
+
+		return nil, nil //nolint:nilnil
+	case method == http.MethodGet && match(parts, "rules"):
+		rules := make([]any, 0, len(vm.FirewallRules))
+
+		for pos, rule := range vm.FirewallRules {
+			rules = append(rules, firewallRuleStatus(pos, rule))
+		}
+
+		return rules, nil
+	case method == http.MethodPost && match(parts, "rules"):
+		rule := FirewallRule{
+			Type:    params.Get("type"),
+			Action:  params.Get("action"),
+			Proto:   params.Get("proto"),
+			DPort:   params.Get("dport"),
+			SPort:   params.Get("sport"),
+			Source:  params.Get("source"),
+			Dest:    params.Get("dest"),
+			Iface:   params.Get("iface"),
+			Comment: params.Get("comment"),
+			Enable:  params.Get("enable") == "1",
+		}
+
+		switch rule.Type {
+		case "group":
+			if _, ok := s.securityGroups[rule.Action]; !ok {
+				return nil, errorf(http.StatusInternalServerError, "security group '%s' does not exist", rule.Action)
+			}
+		case "in", "out":
+			if !slices.Contains(firewallActions, rule.Action) {
+				return nil, errorf(http.StatusInternalServerError, "unknown action '%s'", rule.Action)
+			}
+		default:
+			return nil, errorf(http.StatusBadRequest, "Parameter verification failed: type: value '%s' does not have a value in the enumeration 'in, out, forward, group'", rule.Type)
+		}
+
+		if (rule.DPort != "" || rule.SPort != "") && rule.Proto == "" {
+			return nil, errorf(http.StatusInternalServerError, "proto: missing property - 'proto' is required with 'dport' or 'sport'")
+		}
+
+		// the new rules are inserted at the top
+		vm.FirewallRules = slices.Insert(vm.FirewallRules, 0, rule)
+
+		return nil, nil //nolint:nilnil
+	case method == http.MethodDelete && match(parts, "rules", "*"):
+		pos, err := strconv.Atoi(parts[1])
+		if err != nil || pos < 0 || pos >= len(vm.FirewallRules) {
+			return nil, errorf(http.StatusInternalServerError, "no rule at position %s", parts[1])
+		}
+
+		vm.FirewallRules = slices.Delete(vm.FirewallRules, pos, pos+1)
+
+		return nil, nil //nolint:nilnil
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/qemu/%d/firewall/%s' not implemented", method, n.Name, vm.ID, strings.Join(parts, "/"))
+}
+
+func firewallRuleStatus(pos int, rule FirewallRule) map[string]any {
+	res := map[string]any{
+		"pos":    pos,
+		"type":   rule.Type,
+		"action": rule.Action,
+		"enable": 0,
+		"digest": "fake",
+	}
+
+	if rule.Enable {
+		res["enable"] = 1
+	}
+
+	for key, value := range map[string]string{
+		"proto":   rule.Proto,
+		"dport":   rule.DPort,
+		"sport":   rule.SPort,
+		"source":  rule.Source,
+		"dest":    rule.Dest,
+		"iface":   rule.Iface,
+		"comment": rule.Comment,
+	} {
+		if value != "" {
+			res[key] = value
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,1219 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fakeproxmox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luthermonson/go-proxmox"
+)
+
+const (
+	gib = 1 << 30
+	mib = 1 << 20
+)
+
+var (
+	diskKeyRe = regexp.MustCompile(`^(scsi|virtio|sata|ide)\d+$`)
+	netKeyRe  = regexp.MustCompile(`^net\d+$`)
+)
+
+type apiError struct {
+	message string
+	code    int
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func errorf(code int, format string, args ...any) error {
+	return &apiError{
+		code:    code,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+func match(parts []string, pattern ...string) bool {
+	if len(parts) != len(pattern) {
+		return false
+	}
+
+	for i, p := range pattern {
+		if p != "*" && p != parts[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	path, ok := strings.CutPrefix(r.URL.Path, "/api2/json")
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+
+		return
+	}
+
+	if r.Header.Get("Authorization") != fmt.Sprintf("PVEAPIToken=%s=%s", TokenID, TokenSecret) {
+		writeError(w, http.StatusUnauthorized, "authentication failure")
+
+		return
+	}
+
+	params, err := parseParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[r.Method+" "+path]++
+
+	for _, f := range s.failures {
+		if f.count > 0 && f.method == r.Method && f.path == path {
+			f.count--
+
+			writeError(w, f.code, f.message)
+
+			return
+		}
+	}
+
+	data, err := s.route(r.Method, strings.Split(strings.Trim(path, "/"), "/"), params)
+	if err != nil {
+		code := http.StatusInternalServerError
+
+		if apiErr, ok := err.(*apiError); ok { //nolint:errorlint
+			code = apiErr.code
+		}
+
+		writeError(w, code, err.Error())
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	if err = json.NewEncoder(w).Encode(map[string]any{"data": data}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeError sends the error message as the HTTP status reason phrase like the Proxmox API does.
+func writeError(w http.ResponseWriter, code int, message string) {
+	message = strings.NewReplacer("\r", " ", "\n", " ").Replace(message)
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, message, code)
+
+		return
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, message, code)
+
+		return
+	}
+
+	defer conn.Close() //nolint:errcheck
+
+	body := `{"data":null}`
+
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\nContent-Type: application/json;charset=UTF-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", code, message, len(body), body) //nolint:errcheck
+
+	buf.Flush() //nolint:errcheck
+}
+
+func parseParams(r *http.Request) (url.Values, error) {
+	params := r.URL.Query()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")) //nolint:errcheck
+
+	switch mediaType {
+	case "application/json":
+		var body map[string]any
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		for k, v := range body {
+			switch v := v.(type) {
+			case float64:
+				params.Set(k, strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				if v {
+					params.Set(k, "1")
+				} else {
+					params.Set(k, "0")
+				}
+			case nil:
+			default:
+				params.Set(k, fmt.Sprint(v))
+			}
+		}
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(mib); err != nil {
+			return nil, err
+		}
+
+		for k, v := range r.MultipartForm.Value {
+			params[k] = v
+		}
+
+		for _, files := range r.MultipartForm.File {
+			for _, f := range files {
+				params.Set("filename", f.Filename)
+			}
+		}
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+
+		for k, v := range r.PostForm {
+			params[k] = v
+		}
+	}
+
+	return params, nil
+}
+
+func (s *Server) route(method string, parts []string, params url.Values) (any, error) {
+	switch {
+	case method == http.MethodGet && match(parts, "version"):
+		return map[string]any{
+			"version": "8.4.1",
+			"release": "8.4",
+			"repoid":  "fake",
+		}, nil
+	case method == http.MethodGet && match(parts, "cluster", "status"):
+		return s.clusterStatus(), nil
+	case method == http.MethodGet && match(parts, "cluster", "resources"):
+		return s.clusterResources(params.Get("type")), nil
+	case method == http.MethodGet && match(parts, "cluster", "nextid"):
+		return strconv.Itoa(s.nextID()), nil
+	case method == http.MethodGet && match(parts, "nodes"):
+		return s.nodeList(), nil
+	case method == http.MethodGet && match(parts, "access", "permissions"):
+		return s.effectivePermissions(params.Get("path")), nil
+	case method == http.MethodGet && match(parts, "cluster", "mapping", "pci"):
+		return s.pciMappingList(), nil
+	case len(parts) >= 3 && parts[0] == "cluster" && parts[1] == "ha":
+		return s.routeHA(method, parts[2:], params)
+	case len(parts) >= 2 && parts[0] == "cluster" && parts[1] == "sdn":
+		return s.routeSDN(method, parts[2:], params)
+	case len(parts) >= 3 && parts[0] == "cluster" && parts[1] == "firewall":
+		return s.routeFirewall(method, parts[2:])
+	case len(parts) >= 3 && parts[0] == "nodes":
+		n, ok := s.nodes[parts[1]]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "hostname lookup '%s' failed - failed to get address info for: %s: Name or service not known", parts[1], parts[1])
+		}
+
+		if n.Status != "online" {
+			return nil, errorf(595, "No route to host")
+		}
+
+		return s.routeNode(method, n, parts[2:], params)
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /%s' not implemented", method, strings.Join(parts, "/"))
+}
+
+//nolint:gocyclo,cyclop
+func (s *Server) routeNode(method string, n *node, parts []string, params url.Values) (any, error) {
+	switch {
+	case method == http.MethodGet && match(parts, "status"):
+		return s.nodeStatus(n), nil
+	case method == http.MethodGet && match(parts, "config"):
+		return map[string]any{
+			"description": n.Description,
+			"digest":      "fake",
+		}, nil
+	case method == http.MethodGet && len(parts) >= 3 && parts[0] == "tasks" && parts[len(parts)-1] == "status":
+		// the UPID of the volume tasks contains the volume ID with a slash
+		upid := proxmox.UPID(strings.Join(parts[1:len(parts)-1], "/"))
+
+		t, ok := s.tasks[upid]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "unable to parse worker upid '%s'", upid)
+		}
+
+		return t.status(upid), nil
+	case method == http.MethodGet && match(parts, "network"):
+		bridges := make([]any, 0, len(n.Bridges))
+
+		for _, bridge := range n.Bridges {
+			vlanAware := 0
+			if bridge.VLANAware {
+				vlanAware = 1
+			}
+
+			bridges = append(bridges, map[string]any{
+				"iface":             bridge.Name,
+				"type":              "bridge",
+				"active":            1,
+				"autostart":         1,
+				"bridge_vlan_aware": vlanAware,
+			})
+		}
+
+		return bridges, nil
+	case len(parts) >= 1 && parts[0] == "sdn":
+		return s.routeNodeSDN(method, n, parts[1:])
+	case method == http.MethodGet && match(parts, "storage"):
+		storages := make([]any, 0, len(n.storages))
+
+		for _, name := range slices.Sorted(maps.Keys(n.storages)) {
+			storages = append(storages, storageStatus(n.storages[name]))
+		}
+
+		return storages, nil
+	case len(parts) >= 2 && parts[0] == "storage":
+		st, ok := n.storages[parts[1]]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "storage '%s' does not exist", parts[1])
+		}
+
+		return s.routeStorage(method, n, st, parts[2:], params)
+	case method == http.MethodGet && match(parts, "qemu"):
+		vms := make([]any, 0, len(n.vms))
+
+		for _, id := range slices.Sorted(maps.Keys(n.vms)) {
+			vms = append(vms, vmStatus(n.vms[id]))
+		}
+
+		return vms, nil
+	case method == http.MethodPost && match(parts, "qemu"):
+		return s.createVM(n, params)
+	case len(parts) >= 2 && parts[0] == "qemu":
+		vmid, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "Parameter verification failed: vmid: type check ('integer') failed")
+		}
+
+		vm, ok := n.vms[vmid]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "Configuration file 'nodes/%s/qemu-server/%d.conf' does not exist", n.Name, vmid)
+		}
+
+		return s.routeVM(method, n, vm, parts[2:], params)
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/%s' not implemented", method, n.Name, strings.Join(parts, "/"))
+}
+
+//nolint:gocyclo,cyclop
+func (s *Server) routeStorage(method string, n *node, st *storage, parts []string, params url.Values) (any, error) {
+	switch {
+	case method == http.MethodGet && match(parts, "status"):
+		return storageStatus(st), nil
+	case method == http.MethodGet && match(parts, "content"):
+		volumes := make([]any, 0, len(st.volumes))
+
+		for _, volID := range slices.Sorted(maps.Keys(st.volumes)) {
+			volume := s.volumeStatus(volID, st.volumes[volID])
+
+			if content := params.Get("content"); content != "" && volume["content"] != content {
+				continue
+			}
+
+			volumes = append(volumes, volume)
+		}
+
+		return volumes, nil
+	case len(parts) >= 2 && parts[0] == "content":
+		volID := strings.Join(parts[1:], "/")
+
+		size, ok := st.volumes[volID]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "volume '%s' does not exist", volID)
+		}
+
+		switch method {
+		case http.MethodGet:
+			return s.volumeStatus(volID, size), nil
+		case http.MethodDelete:
+			return s.startTask(n.Name, "imgdel", volID, func() {
+				s.freeVolume(st, volID)
+			}, nil), nil
+		}
+	case method == http.MethodPost && (match(parts, "download-url") || match(parts, "upload")):
+		content := params.Get("content")
+
+		if !slices.Contains(st.Content, content) {
+			return nil, errorf(http.StatusInternalServerError, "storage '%s' does not support content-type '%s'", st.Name, content)
+		}
+
+		volID := fmt.Sprintf("%s:%s/%s", st.Name, content, params.Get("filename"))
+
+		// uploads replace the existing files
+		if parts[0] == "upload" {
+			st.volumes[volID] = mib
+
+			return s.startTask(n.Name, "imgcopy", "", nil, nil), nil
+		}
+
+		if _, ok := st.volumes[volID]; ok {
+			return nil, errorf(http.StatusInternalServerError, "refusing to override existing file '%s'", params.Get("filename"))
+		}
+
+		return s.startTask(n.Name, "download", st.Name, func() {
+			st.volumes[volID] = 100 * mib
+			st.Used += 100 * mib
+		}, nil), nil
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/storage/%s/%s' not implemented", method, n.Name, st.Name, strings.Join(parts, "/"))
+}
+
+//nolint:gocognit,gocyclo,cyclop
+func (s *Server) routeVM(method string, n *node, vm *VM, parts []string, params url.Values) (any, error) {
+	id := strconv.Itoa(vm.ID)
+
+	switch {
+	case method == http.MethodGet && match(parts, "status", "current"):
+		return vmStatus(vm), nil
+	case method == http.MethodGet && match(parts, "config"):
+		config := map[string]any{
+			"digest": "fake",
+		}
+
+		for k, v := range vm.Config {
+			config[k] = v
+		}
+
+		if vm.Template {
+			config["template"] = 1
+		}
+
+		return config, nil
+	case method == http.MethodGet && match(parts, "agent", "network-get-interfaces"):
+		if vm.Status != "running" || len(vm.GuestAddresses) == 0 {
+			return nil, errorf(http.StatusInternalServerError, "QEMU guest agent is not running")
+		}
+
+		addresses := make([]map[string]any, 0, len(vm.GuestAddresses))
+
+		for _, address := range vm.GuestAddresses {
+			addresses = append(addresses, map[string]any{"ip-address": address})
+		}
+
+		return map[string]any{
+			"result": []map[string]any{
+				{"name": "eth0", "ip-addresses": addresses},
+			},
+		}, nil
+	case (method == http.MethodPost || method == http.MethodPut) && match(parts, "config"):
+		if err := s.checkLock(vm); err != nil {
+			return nil, err
+		}
+
+		if err := s.applyConfig(n, vm, params); err != nil {
+			return nil, err
+		}
+
+		if method == http.MethodPut {
+			return nil, nil //nolint:nilnil
+		}
+
+		return s.startTask(n.Name, "qmconfig", id, nil, nil), nil
+	case method == http.MethodPost && match(parts, "status", "*"):
+		if err := s.checkLock(vm); err != nil {
+			return nil, err
+		}
+
+		switch parts[1] {
+		case "start":
+			if vm.Template {
+				return nil, errorf(http.StatusInternalServerError, "you can't start a vm if it's a template")
+			}
+
+			return s.startTask(n.Name, "qmstart", id, func() {
+				vm.Status = "running"
+			}, nil), nil
+		case "stop", "shutdown":
+			return s.startTask(n.Name, "qm"+parts[1], id, func() {
+				vm.Status = "stopped"
+			}, nil), nil
+		}
+	case method == http.MethodDelete && len(parts) == 0:
+		if err := s.checkLock(vm); err != nil {
+			return nil, err
+		}
+
+		if vm.Status == "running" {
+			return nil, errorf(http.StatusInternalServerError, "VM %d is running - destroy failed", vm.ID)
+		}
+
+		if _, ok := s.haResources["vm:"+id]; ok && params.Get("purge") != "1" {
+			return nil, errorf(http.StatusInternalServerError, "unable to remove VM %d - used in HA resources and purge parameter not set.", vm.ID)
+		}
+
+		return s.startTask(n.Name, "qmdestroy", id, func() {
+			for _, volID := range vmVolumes(vm) {
+				if st, ok := n.storages[volumeStorage(volID)]; ok && strings.Contains(volID, fmt.Sprintf("vm-%d-", vm.ID)) {
+					s.freeVolume(st, volID)
+				}
+			}
+
+			delete(n.vms, vm.ID)
+		}, nil), nil
+	case method == http.MethodPost && match(parts, "template"):
+		if vm.Status == "running" {
+			return nil, errorf(http.StatusInternalServerError, "you can't convert a running VM to a template")
+		}
+
+		return s.startTask(n.Name, "qmtemplate", id, func() {
+			vm.Template = true
+		}, nil), nil
+	case method == http.MethodPost && match(parts, "clone"):
+		return s.cloneVM(n, vm, params)
+	case len(parts) >= 2 && parts[0] == "firewall":
+		return s.routeVMFirewall(method, n, vm, parts[1:], params)
+	case method == http.MethodPut && match(parts, "resize"):
+		disk := params.Get("disk")
+
+		if _, ok := vm.Config[disk]; !ok {
+			return nil, errorf(http.StatusInternalServerError, "disk '%s' does not exist", disk)
+		}
+
+		size := params.Get("size")
+		if grow, ok := strings.CutPrefix(size, "+"); ok {
+			size = fmt.Sprintf("%dG", diskSize(vm.Config[disk])+diskSize("size="+grow))
+		}
+
+		if diskSize("size="+size) < diskSize(vm.Config[disk]) {
+			return nil, errorf(http.StatusInternalServerError, "shrinking disks is not supported")
+		}
+
+		return s.startTask(n.Name, "qmresize", id, func() {
+			vm.Config[disk] = setDiskOption(vm.Config[disk], "size", size)
+		}, nil), nil
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/qemu/%d/%s' not implemented", method, n.Name, vm.ID, strings.Join(parts, "/"))
+}
+
+var haResourceParams = []string{"state", "group", "max_restart", "max_relocate", "comment"}
+
+func (s *Server) routeHA(method string, parts []string, params url.Values) (any, error) {
+	switch {
+	case method == http.MethodGet && match(parts, "groups"):
+		groups := make([]any, 0, len(s.haGroups))
+
+		for _, name := range slices.Sorted(maps.Keys(s.haGroups)) {
+			groups = append(groups, map[string]any{"group": name, "type": "group"})
+		}
+
+		return groups, nil
+	case method == http.MethodGet && match(parts, "resources"):
+		resources := make([]any, 0, len(s.haResources))
+
+		for _, sid := range slices.Sorted(maps.Keys(s.haResources)) {
+			resources = append(resources, haResourceStatus(sid, s.haResources[sid]))
+		}
+
+		return resources, nil
+	case method == http.MethodPost && match(parts, "resources"):
+		sid := params.Get("sid")
+
+		if _, ok := s.haResources[sid]; ok {
+			return nil, errorf(http.StatusInternalServerError, "resource ID '%s' already defined", sid)
+		}
+
+		vmid, ok := strings.CutPrefix(sid, "vm:")
+		if !ok {
+			return nil, errorf(http.StatusBadRequest, "Parameter verification failed. sid: invalid format")
+		}
+
+		if !s.vmExists(vmid) {
+			return nil, errorf(http.StatusInternalServerError, "unable to find VM '%s'", vmid)
+		}
+
+		resource := map[string]string{"state": "started"}
+
+		if err := s.applyHAParams(resource, params); err != nil {
+			return nil, err
+		}
+
+		s.haResources[sid] = resource
+
+		return nil, nil //nolint:nilnil
+	case len(parts) == 2 && parts[0] == "resources":
+		resource, ok := s.haResources[parts[1]]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "no such resource '%s'", parts[1])
+		}
+
+		switch method {
+		case http.MethodGet:
+			return haResourceStatus(parts[1], resource), nil
+		case http.MethodPut:
+			return nil, s.applyHAParams(resource, params)
+		case http.MethodDelete:
+			delete(s.haResources, parts[1])
+
+			return nil, nil //nolint:nilnil
+		}
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /cluster/ha/%s' not implemented", method, strings.Join(parts, "/"))
+}
+
+func (s *Server) applyHAParams(resource map[string]string, params url.Values) error {
+	if group := params.Get("group"); group != "" {
+		if _, ok := s.haGroups[group]; !ok {
+			return errorf(http.StatusInternalServerError, "group '%s' does not exist", group)
+		}
+	}
+
+	for _, key := range haResourceParams {
+		if params.Has(key) {
+			resource[key] = params.Get(key)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) vmExists(vmid string) bool {
+	id, err := strconv.Atoi(vmid)
+	if err != nil {
+		return false
+	}
+
+	for _, n := range s.nodes {
+		if _, ok := n.vms[id]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func haResourceStatus(sid string, resource map[string]string) map[string]any {
+	status := map[string]any{
+		"sid":  sid,
+		"type": "vm",
+	}
+
+	for k, v := range resource {
+		if n, err := strconv.Atoi(v); err == nil {
+			status[k] = n
+		} else {
+			status[k] = v
+		}
+	}
+
+	return status
+}
+
+func (s *Server) createVM(n *node, params url.Values) (any, error) {
+	vmid, err := strconv.Atoi(params.Get("vmid"))
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "Parameter verification failed: vmid: type check ('integer') failed")
+	}
+
+	for _, other := range s.nodes {
+		if _, ok := other.vms[vmid]; ok {
+			return nil, errorf(http.StatusInternalServerError, "unable to create VM %d - VM %d already exists on node '%s'", vmid, vmid, other.Name)
+		}
+	}
+
+	params.Del("vmid")
+
+	vm := &VM{
+		ID:     vmid,
+		Node:   n.Name,
+		Status: "stopped",
+		Lock:   "create",
+		Config: map[string]string{
+			"meta": vmMeta(),
+		},
+	}
+
+	if err = s.applyConfig(n, vm, params); err != nil {
+		return nil, err
+	}
+
+	n.vms[vmid] = vm
+
+	return s.startTask(n.Name, "qmcreate", strconv.Itoa(vmid), func() {
+		vm.Lock = ""
+	}, func() {
+		delete(n.vms, vmid)
+	}), nil
+}
+
+func (s *Server) cloneVM(n *node, source *VM, params url.Values) (any, error) {
+	newID, err := strconv.Atoi(params.Get("newid"))
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "Parameter verification failed: newid: type check ('integer') failed")
+	}
+
+	for _, other := range s.nodes {
+		if _, ok := other.vms[newID]; ok {
+			return nil, errorf(http.StatusInternalServerError, "unable to create VM %d: config file already exists", newID)
+		}
+	}
+
+	full := params.Get("full") == "1"
+
+	if !full && !source.Template {
+		return nil, errorf(http.StatusInternalServerError, "Linked clone feature is not supported for non-template VMs")
+	}
+
+	if !full && params.Get("storage") != "" {
+		return nil, errorf(http.StatusBadRequest, "Parameter verification failed: storage: option is only allowed with full clone")
+	}
+
+	vm := &VM{
+		ID:     newID,
+		Node:   n.Name,
+		Status: "stopped",
+		Lock:   "clone",
+		Config: maps.Clone(source.Config),
+		// the firewall config is copied with the VM config
+		FirewallOptions: maps.Clone(source.FirewallOptions),
+		FirewallRules:   slices.Clone(source.FirewallRules),
+	}
+
+	vm.Config["meta"] = vmMeta()
+
+	if name := params.Get("name"); name != "" {
+		vm.Config["name"] = name
+	}
+
+	for key, value := range source.Config {
+		if !diskKeyRe.MatchString(key) || strings.Contains(value, "media=cdrom") {
+			continue
+		}
+
+		volID, options, _ := strings.Cut(value, ",")
+
+		storageName := volumeStorage(volID)
+		if full && params.Get("storage") != "" {
+			storageName = params.Get("storage")
+		}
+
+		st, ok := n.storages[storageName]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "storage '%s' does not exist", storageName)
+		}
+
+		newVolID := s.allocateVolume(st, newID, diskSize(value))
+		if !full {
+			newVolID = fmt.Sprintf("%s/%s", volID, strings.TrimPrefix(newVolID, st.Name+":"))
+		}
+
+		vm.Config[key] = strings.Join([]string{newVolID, options}, ",")
+	}
+
+	n.vms[newID] = vm
+
+	return s.startTask(n.Name, "qmclone", strconv.Itoa(source.ID), func() {
+		vm.Lock = ""
+	}, func() {
+		delete(n.vms, newID)
+	}), nil
+}
+
+func (s *Server) checkLock(vm *VM) error {
+	if vm.Lock != "" {
+		return errorf(http.StatusInternalServerError, "VM is locked (%s)", vm.Lock)
+	}
+
+	return nil
+}
+
+// applyConfig updates the VM config allocating new disks on the storages.
+func (s *Server) applyConfig(n *node, vm *VM, params url.Values) error {
+	for _, key := range strings.Split(params.Get("delete"), ",") {
+		delete(vm.Config, key)
+	}
+
+	params.Del("delete")
+	params.Del("digest")
+
+	if cdrom := params.Get("cdrom"); cdrom != "" {
+		params.Del("cdrom")
+		params.Set("ide2", cdrom+",media=cdrom")
+	}
+
+	for key := range params {
+		value := params.Get(key)
+
+		// Proxmox generates the MAC address if it's not set
+		if model, options, _ := strings.Cut(value, ","); netKeyRe.MatchString(key) && !strings.Contains(model, "=") {
+			value = fmt.Sprintf("%s=BC:24:11:00:%02X:%02X,%s", model, vm.ID%256, len(key), options)
+		}
+
+		if !diskKeyRe.MatchString(key) || strings.Contains(value, "media=cdrom") {
+			vm.Config[key] = value
+
+			continue
+		}
+
+		volID, options, _ := strings.Cut(value, ",")
+
+		storageName, size, ok := strings.Cut(volID, ":")
+		if !ok {
+			return errorf(http.StatusBadRequest, "Parameter verification failed: %s: invalid format - unable to parse drive options", key)
+		}
+
+		st, ok := n.storages[storageName]
+		if !ok {
+			return errorf(http.StatusInternalServerError, "storage '%s' does not exist", storageName)
+		}
+
+		sizeGiB, err := strconv.ParseUint(size, 10, 64)
+		if err != nil {
+			// existing volume
+			vm.Config[key] = value
+
+			continue
+		}
+
+		if !slices.Contains(st.Content, "images") {
+			return errorf(http.StatusInternalServerError, "storage '%s' does not support vm images", storageName)
+		}
+
+		if importFrom := diskOption(value, "import-from"); importFrom != "" {
+			source, ok := n.storages[volumeStorage(importFrom)]
+			if !ok {
+				return errorf(http.StatusInternalServerError, "storage '%s' does not exist", volumeStorage(importFrom))
+			}
+
+			importSize, ok := source.volumes[importFrom]
+			if !ok {
+				return errorf(http.StatusInternalServerError, "volume '%s' does not exist", importFrom)
+			}
+
+			sizeGiB = max(sizeGiB, (importSize+gib-1)/gib)
+			options = setDiskOption(options, "import-from", "")
+		}
+
+		newVolID := s.allocateVolume(st, vm.ID, sizeGiB)
+
+		vm.Config[key] = strings.Trim(strings.Join([]string{newVolID, setDiskOption(options, "size", fmt.Sprintf("%dG", sizeGiB))}, ","), ",")
+	}
+
+	return nil
+}
+
+func (s *Server) allocateVolume(st *storage, vmid int, sizeGiB uint64) string {
+	for i := 0; ; i++ {
+		volID := fmt.Sprintf("%s:vm-%d-disk-%d", st.Name, vmid, i)
+
+		if _, ok := st.volumes[volID]; !ok {
+			st.volumes[volID] = sizeGiB * gib
+			st.Used += sizeGiB * gib
+
+			return volID
+		}
+	}
+}
+
+func (s *Server) freeVolume(st *storage, volID string) {
+	st.Used -= min(st.Used, st.volumes[volID])
+
+	delete(st.volumes, volID)
+}
+
+func (s *Server) nextID() int {
+	for id := firstVMID; ; id++ {
+		used := false
+
+		for _, n := range s.nodes {
+			if _, ok := n.vms[id]; ok {
+				used = true
+
+				break
+			}
+		}
+
+		if !used {
+			return id
+		}
+	}
+}
+
+func (s *Server) clusterStatus() []any {
+	res := []any{
+		map[string]any{
+			"type":    "cluster",
+			"id":      "cluster",
+			"name":    "fake",
+			"nodes":   len(s.nodes),
+			"quorate": 1,
+			"version": 1,
+		},
+	}
+
+	for i, name := range slices.Sorted(maps.Keys(s.nodes)) {
+		online := 0
+		if s.nodes[name].Status == "online" {
+			online = 1
+		}
+
+		res = append(res, map[string]any{
+			"type":   "node",
+			"id":     "node/" + name,
+			"name":   name,
+			"nodeid": i + 1,
+			"online": online,
+			"local":  0,
+			"ip":     fmt.Sprintf("10.0.0.%d", i+1),
+		})
+	}
+
+	return res
+}
+
+func (s *Server) clusterResources(resourceType string) []any {
+	var res []any
+
+	for _, name := range slices.Sorted(maps.Keys(s.nodes)) {
+		n := s.nodes[name]
+
+		if resourceType == "" || resourceType == "node" {
+			res = append(res, map[string]any{
+				"id":     "node/" + n.Name,
+				"type":   "node",
+				"node":   n.Name,
+				"status": n.Status,
+				"maxcpu": n.CPUs,
+				"cpu":    n.CPUUsage,
+				"maxmem": n.MaxMemory,
+				"mem":    n.Memory,
+				"uptime": n.Uptime,
+			})
+		}
+
+		if resourceType == "" || resourceType == "storage" {
+			for _, storageName := range slices.Sorted(maps.Keys(n.storages)) {
+				st := n.storages[storageName]
+
+				res = append(res, map[string]any{
+					"id":         fmt.Sprintf("storage/%s/%s", n.Name, st.Name),
+					"type":       "storage",
+					"node":       n.Name,
+					"storage":    st.Name,
+					"plugintype": st.Type,
+					"content":    strings.Join(st.Content, ","),
+					"pool":       st.Pool,
+					"status":     "available",
+					"maxdisk":    st.Total,
+					"disk":       st.Used,
+				})
+			}
+		}
+
+		if resourceType == "" || resourceType == "vm" {
+			for _, id := range slices.Sorted(maps.Keys(n.vms)) {
+				vm := vmStatus(n.vms[id])
+
+				vm["id"] = fmt.Sprintf("qemu/%d", id)
+				vm["type"] = "qemu"
+				vm["node"] = n.Name
+				vm["pool"] = n.vms[id].Pool
+
+				res = append(res, vm)
+			}
+
+			for _, id := range n.containers {
+				res = append(res, map[string]any{
+					"id":     fmt.Sprintf("lxc/%d", id),
+					"type":   "lxc",
+					"vmid":   id,
+					"node":   n.Name,
+					"name":   fmt.Sprintf("ct%d", id),
+					"status": "running",
+				})
+			}
+		}
+	}
+
+	return res
+}
+
+// allPrivileges are the privileges of the API token if the permissions are not set.
+var allPrivileges = []string{
+	"Datastore.Allocate", "Datastore.AllocateSpace", "Datastore.AllocateTemplate", "Datastore.Audit",
+	"Mapping.Audit", "Mapping.Use", "SDN.Audit", "SDN.Use",
+	"Sys.Audit", "Sys.Console", "Sys.Modify",
+	"VM.Allocate", "VM.Audit", "VM.Clone", "VM.Config.CDROM", "VM.Config.CPU", "VM.Config.Cloudinit", "VM.Config.Disk",
+	"VM.Config.HWType", "VM.Config.Memory", "VM.Config.Network", "VM.Config.Options", "VM.PowerMgmt",
+}
+
+// effectivePermissions returns the privileges on the path, inherited from the closest parent path with the privileges set.
+func (s *Server) effectivePermissions(path string) map[string]any {
+	privileges := allPrivileges
+
+	if s.permissions != nil {
+		privileges = nil
+
+		for parent := path; ; {
+			if granted, ok := s.permissions[parent]; ok {
+				privileges = granted
+
+				break
+			}
+
+			if parent == "/" {
+				break
+			}
+
+			parent = "/" + strings.Trim(parent[:strings.LastIndex(parent, "/")+1], "/")
+		}
+	}
+
+	effective := map[string]any{}
+
+	for _, privilege := range privileges {
+		effective[privilege] = 1
+	}
+
+	return map[string]any{
+		path: effective,
+	}
+}
+
+func (s *Server) pciMappingList() []any {
+	res := make([]any, 0, len(s.pciMappings))
+
+	for _, id := range slices.Sorted(maps.Keys(s.pciMappings)) {
+		var entries []string
+
+		for _, nodeName := range slices.Sorted(maps.Keys(s.pciMappings[id])) {
+			entries = append(entries, fmt.Sprintf("node=%s,path=%s,id=10de:2204", nodeName, s.pciMappings[id][nodeName]))
+		}
+
+		res = append(res, map[string]any{
+			"id":  id,
+			"map": entries,
+		})
+	}
+
+	return res
+}
+
+func (s *Server) nodeList() []any {
+	res := make([]any, 0, len(s.nodes))
+
+	for _, name := range slices.Sorted(maps.Keys(s.nodes)) {
+		n := s.nodes[name]
+
+		status := map[string]any{
+			"node":   n.Name,
+			"id":     "node/" + n.Name,
+			"type":   "node",
+			"status": n.Status,
+		}
+
+		if n.Status == "online" {
+			status["cpu"] = n.CPUUsage
+			status["maxcpu"] = n.CPUs
+			status["mem"] = n.Memory
+			status["maxmem"] = n.MaxMemory
+			status["uptime"] = n.Uptime
+		}
+
+		res = append(res, status)
+	}
+
+	return res
+}
+
+func (s *Server) nodeStatus(n *node) map[string]any {
+	return map[string]any{
+		"cpu": n.CPUUsage,
+		"cpuinfo": map[string]any{
+			"cpus":    n.CPUs,
+			"cores":   n.CPUs,
+			"sockets": 1,
+			"model":   "fake",
+			"mhz":     "2000.000",
+		},
+		"memory": map[string]any{
+			"total": n.MaxMemory,
+			"used":  n.Memory,
+			"free":  n.MaxMemory - min(n.MaxMemory, n.Memory),
+		},
+		"loadavg":    []string{"0.00", "0.00", "0.00"},
+		"uptime":     n.Uptime,
+		"pveversion": "pve-manager/8.4.1/fake",
+		"kversion":   "Linux 6.8.12-fake-pve",
+	}
+}
+
+func storageStatus(st *storage) map[string]any {
+	shared := 0
+	if st.Shared {
+		shared = 1
+	}
+
+	return map[string]any{
+		"storage":       st.Name,
+		"type":          st.Type,
+		"content":       strings.Join(st.Content, ","),
+		"total":         st.Total,
+		"used":          st.Used,
+		"avail":         st.Total - min(st.Total, st.Used),
+		"used_fraction": float64(st.Used) / float64(max(st.Total, 1)),
+		"active":        1,
+		"enabled":       1,
+		"shared":        shared,
+	}
+}
+
+// volumeStatus reports all volumes as created when the server was started.
+func (s *Server) volumeStatus(volID string, size uint64) map[string]any {
+	content := "images"
+
+	if _, path, ok := strings.Cut(volID, ":"); ok {
+		if dir, _, ok := strings.Cut(path, "/"); ok && (dir == "iso" || dir == "import" || dir == "vztmpl") {
+			content = dir
+		}
+	}
+
+	format := "raw"
+	if idx := strings.LastIndex(volID, "."); idx != -1 && content != "images" {
+		format = volID[idx+1:]
+	}
+
+	return map[string]any{
+		"volid":   volID,
+		"content": content,
+		"format":  format,
+		"size":    size,
+		"used":    size,
+		"ctime":   s.started.Unix(),
+	}
+}
+
+func vmStatus(vm *VM) map[string]any {
+	status := map[string]any{
+		"vmid":      vm.ID,
+		"name":      vm.Config["name"],
+		"status":    vm.Status,
+		"qmpstatus": vm.Status,
+		"uptime":    0,
+		"cpus":      1,
+	}
+
+	if cores, err := strconv.Atoi(vm.Config["cores"]); err == nil {
+		sockets, err := strconv.Atoi(vm.Config["sockets"])
+		if err != nil {
+			sockets = 1
+		}
+
+		status["cpus"] = cores * sockets
+	}
+
+	if memory, err := strconv.ParseUint(vm.Config["memory"], 10, 64); err == nil {
+		status["maxmem"] = memory * mib
+	}
+
+	if vm.Config["tags"] != "" {
+		status["tags"] = vm.Config["tags"]
+	}
+
+	if vm.Lock != "" {
+		status["lock"] = vm.Lock
+	}
+
+	if vm.Template {
+		status["template"] = 1
+	}
+
+	return status
+}
+
+func vmMeta() string {
+	return fmt.Sprintf("creation-qemu=9.2.0,ctime=%d", time.Now().Unix())
+}
+
+func vmVolumes(vm *VM) []string {
+	var volumes []string
+
+	for key, value := range vm.Config {
+		if !diskKeyRe.MatchString(key) || strings.Contains(value, "media=cdrom") {
+			continue
+		}
+
+		volID, _, _ := strings.Cut(value, ",")
+
+		// linked clones reference the base volume: storage:base-100-disk-0/vm-101-disk-0
+		if base, own, ok := strings.Cut(volID, "/"); ok {
+			volID = volumeStorage(base) + ":" + own
+		}
+
+		volumes = append(volumes, volID)
+	}
+
+	return volumes
+}
+
+func volumeStorage(volID string) string {
+	storageName, _, _ := strings.Cut(volID, ":")
+
+	return storageName
+}
+
+func diskSize(value string) uint64 {
+	size := diskOption(value, "size")
+
+	sizeGiB, err := strconv.ParseUint(strings.TrimSuffix(size, "G"), 10, 64)
+	if err != nil {
+		return 1
+	}
+
+	return sizeGiB
+}
+
+func diskOption(value, name string) string {
+	for option := range strings.SplitSeq(value, ",") {
+		if v, ok := strings.CutPrefix(option, name+"="); ok {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// setDiskOption replaces the option in the comma separated disk options, empty value removes it.
+func setDiskOption(value, name, optionValue string) string {
+	options := slices.DeleteFunc(strings.Split(value, ","), func(option string) bool {
+		return option == "" || strings.HasPrefix(option, name+"=")
+	})
+
+	if optionValue != "" {
+		options = append(options, name+"="+optionValue)
+	}
+
+	return strings.Join(options, ",")
+}
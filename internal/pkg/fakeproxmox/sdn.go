@@ -0,0 +1,261 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fakeproxmox
+
+import (
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/luthermonson/go-proxmox"
+)
+
+// Zone describes a fake Proxmox SDN zone.
+type Zone struct {
+	Name string
+	// Type is the zone type, defaults to simple.
+	Type string
+	// Nodes are the nodes the zone is deployed to, all nodes if not set.
+	Nodes []string
+}
+
+// VNet describes a fake Proxmox SDN VNet.
+type VNet struct {
+	Name  string
+	Zone  string
+	Alias string
+	// Subnets are the subnets of the VNet.
+	Subnets []Subnet
+	Tag     int
+	// Applied is set once the SDN config with the VNet is applied, only the applied VNets are deployed to the nodes.
+	Applied bool
+}
+
+// Subnet describes a fake Proxmox SDN subnet.
+type Subnet struct {
+	CIDR    string
+	Gateway string
+}
+
+// ID returns the subnet ID Proxmox generates, e.g. zone1-10.5.0.0-24.
+func (subnet Subnet) ID(zone string) string {
+	prefix := netip.MustParsePrefix(subnet.CIDR)
+
+	return zone + "-" + prefix.Addr().String() + "-" + strconv.Itoa(prefix.Bits())
+}
+
+// AddZone adds the SDN zone.
+func (s *Server) AddZone(zone Zone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if zone.Type == "" {
+		zone.Type = "simple"
+	}
+
+	zone.Nodes = slices.Clone(zone.Nodes)
+
+	s.zones[zone.Name] = &zone
+}
+
+// AddVNet adds the SDN VNet.
+func (s *Server) AddVNet(vnet VNet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vnet.Subnets = slices.Clone(vnet.Subnets)
+
+	s.vnets[vnet.Name] = &vnet
+}
+
+// VNets returns the copies of all SDN VNets sorted by the name.
+func (s *Server) VNets() []VNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]VNet, 0, len(s.vnets))
+
+	for _, name := range slices.Sorted(maps.Keys(s.vnets)) {
+		vnet := *s.vnets[name]
+		vnet.Subnets = slices.Clone(vnet.Subnets)
+
+		res = append(res, vnet)
+	}
+
+	return res
+}
+
+//nolint:gocyclo,cyclop
+func (s *Server) routeSDN(method string, parts []string, params url.Values) (any, error) {
+	switch {
+	case method == http.MethodPut && len(parts) == 0:
+		return s.applySDN(), nil
+	case method == http.MethodGet && match(parts, "zones"):
+		zones := make([]any, 0, len(s.zones))
+
+		for _, name := range slices.Sorted(maps.Keys(s.zones)) {
+			zones = append(zones, zoneStatus(s.zones[name]))
+		}
+
+		return zones, nil
+	case method == http.MethodGet && match(parts, "vnets"):
+		vnets := make([]any, 0, len(s.vnets))
+
+		for _, name := range slices.Sorted(maps.Keys(s.vnets)) {
+			vnets = append(vnets, vnetStatus(s.vnets[name]))
+		}
+
+		return vnets, nil
+	case method == http.MethodPost && match(parts, "vnets"):
+		name := params.Get("vnet")
+
+		if _, ok := s.vnets[name]; ok {
+			return nil, errorf(http.StatusInternalServerError, "create sdn vnet object failed: vnet ID '%s' already defined", name)
+		}
+
+		zone, ok := s.zones[params.Get("zone")]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "create sdn vnet object failed: zone '%s' does not exist", params.Get("zone"))
+		}
+
+		tag, _ := strconv.Atoi(params.Get("tag")) //nolint:errcheck
+
+		if zone.Type != "simple" && tag == 0 {
+			return nil, errorf(http.StatusInternalServerError, "create sdn vnet object failed: missing vlan tag")
+		}
+
+		if tag != 0 && slices.ContainsFunc(slices.Collect(maps.Values(s.vnets)), func(vnet *VNet) bool { return vnet.Zone == zone.Name && vnet.Tag == tag }) {
+			return nil, errorf(http.StatusInternalServerError, "create sdn vnet object failed: tag %d already exists in the zone %s", tag, zone.Name)
+		}
+
+		s.vnets[name] = &VNet{
+			Name:  name,
+			Zone:  zone.Name,
+			Alias: params.Get("alias"),
+			Tag:   tag,
+		}
+
+		return nil, nil //nolint:nilnil
+	case len(parts) >= 2 && parts[0] == "vnets":
+		vnet, ok := s.vnets[parts[1]]
+		if !ok {
+			return nil, errorf(http.StatusInternalServerError, "sdn '%s' does not exist", parts[1])
+		}
+
+		switch {
+		case method == http.MethodGet && len(parts) == 2:
+			return vnetStatus(vnet), nil
+		case method == http.MethodDelete && len(parts) == 2:
+			if len(vnet.Subnets) > 0 {
+				return nil, errorf(http.StatusInternalServerError, "cannot delete vnet %s, it has subnets", vnet.Name)
+			}
+
+			delete(s.vnets, vnet.Name)
+
+			return nil, nil //nolint:nilnil
+		case method == http.MethodGet && len(parts) == 3 && parts[2] == "subnets":
+			subnets := make([]any, 0, len(vnet.Subnets))
+
+			for _, subnet := range vnet.Subnets {
+				subnets = append(subnets, map[string]any{
+					"subnet":  subnet.ID(vnet.Zone),
+					"cidr":    subnet.CIDR,
+					"gateway": subnet.Gateway,
+					"type":    "subnet",
+					"vnet":    vnet.Name,
+					"zone":    vnet.Zone,
+				})
+			}
+
+			return subnets, nil
+		}
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /cluster/sdn/%s' not implemented", method, strings.Join(parts, "/"))
+}
+
+// applySDN starts the task deploying the SDN config to the nodes, the removed VNets are undeployed right away.
+func (s *Server) applySDN() proxmox.UPID {
+	pending := slices.Collect(maps.Keys(s.vnets))
+
+	return s.startTask(slices.Min(slices.Collect(maps.Keys(s.nodes))), "reloadnetworkall", "", func() {
+		for _, name := range pending {
+			if vnet, ok := s.vnets[name]; ok {
+				vnet.Applied = true
+			}
+		}
+	}, nil)
+}
+
+func (s *Server) routeNodeSDN(method string, n *node, parts []string) (any, error) {
+	switch {
+	case method == http.MethodGet && match(parts, "zones"):
+		var zones []any
+
+		for _, name := range slices.Sorted(maps.Keys(s.zones)) {
+			if zone := s.zones[name]; len(zone.Nodes) == 0 || slices.Contains(zone.Nodes, n.Name) {
+				zones = append(zones, map[string]any{"zone": zone.Name, "status": "available"})
+			}
+		}
+
+		return zones, nil
+	case method == http.MethodGet && match(parts, "zones", "*", "content"):
+		zone, ok := s.zones[parts[1]]
+		if !ok || (len(zone.Nodes) > 0 && !slices.Contains(zone.Nodes, n.Name)) {
+			return nil, errorf(http.StatusInternalServerError, "zone '%s' does not exist on the node", parts[1])
+		}
+
+		var content []any
+
+		for _, name := range slices.Sorted(maps.Keys(s.vnets)) {
+			if vnet := s.vnets[name]; vnet.Zone == zone.Name && vnet.Applied {
+				content = append(content, map[string]any{"vnet": vnet.Name, "status": "available"})
+			}
+		}
+
+		return content, nil
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/sdn/%s' not implemented", method, n.Name, strings.Join(parts, "/"))
+}
+
+func zoneStatus(zone *Zone) map[string]any {
+	res := map[string]any{
+		"zone": zone.Name,
+		"type": zone.Type,
+	}
+
+	if len(zone.Nodes) > 0 {
+		res["nodes"] = strings.Join(zone.Nodes, ",")
+	}
+
+	return res
+}
+
+func vnetStatus(vnet *VNet) map[string]any {
+	res := map[string]any{
+		"vnet": vnet.Name,
+		"zone": vnet.Zone,
+		"type": "vnet",
+	}
+
+	if vnet.Alias != "" {
+		res["alias"] = vnet.Alias
+	}
+
+	if vnet.Tag != 0 {
+		res["tag"] = vnet.Tag
+	}
+
+	if !vnet.Applied {
+		res["state"] = "new"
+	}
+
+	return res
+}
@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fakeproxmox
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/luthermonson/go-proxmox"
+)
+
+type task struct {
+	onSuccess  func()
+	onFailure  func()
+	node       string
+	taskType   string
+	id         string
+	exitStatus string
+	startTime  int64
+	polls      int
+	finished   bool
+}
+
+// startTask creates a new task, the callbacks are called with the server lock held when the task finishes.
+func (s *Server) startTask(nodeName, taskType, id string, onSuccess, onFailure func()) proxmox.UPID {
+	s.taskCounter++
+
+	t := &task{
+		node:       nodeName,
+		taskType:   taskType,
+		id:         id,
+		exitStatus: "OK",
+		startTime:  time.Now().Unix(),
+		onSuccess:  onSuccess,
+		onFailure:  onFailure,
+	}
+
+	if behaviors := s.taskBehaviors[taskType]; len(behaviors) > 0 {
+		behavior := behaviors[0]
+
+		if behavior.ExitStatus != "" {
+			t.exitStatus = behavior.ExitStatus
+		}
+
+		t.polls = behavior.Polls
+
+		if behavior.Count > 0 {
+			behavior.Count--
+
+			if behavior.Count == 0 {
+				s.taskBehaviors[taskType] = behaviors[1:]
+			} else {
+				behaviors[0] = behavior
+			}
+		}
+	}
+
+	upid := proxmox.UPID(fmt.Sprintf("UPID:%s:%08X:%08X:%08X:%s:%s:%s:", nodeName, s.taskCounter, s.taskCounter, t.startTime, taskType, id, TokenID))
+
+	s.tasks[upid] = t
+
+	if t.polls == 0 {
+		t.finish()
+	}
+
+	return upid
+}
+
+func (t *task) finish() {
+	if t.finished {
+		return
+	}
+
+	t.finished = true
+
+	switch {
+	case t.exitStatus == "OK" && t.onSuccess != nil:
+		t.onSuccess()
+	case t.exitStatus != "OK" && t.onFailure != nil:
+		t.onFailure()
+	}
+}
+
+func (t *task) status(upid proxmox.UPID) map[string]any {
+	if !t.finished {
+		if t.polls > 0 {
+			t.polls--
+		} else {
+			t.finish()
+		}
+	}
+
+	res := map[string]any{
+		"upid":      upid,
+		"node":      t.node,
+		"type":      t.taskType,
+		"id":        t.id,
+		"user":      TokenID,
+		"starttime": t.startTime,
+		"status":    "running",
+	}
+
+	if t.finished {
+		res["status"] = "stopped"
+		res["exitstatus"] = t.exitStatus
+	}
+
+	return res
+}
@@ -0,0 +1,165 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package health implements the liveness and the readiness probes of the provider.
+package health
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultTimeout is the timeout of a single check run.
+const defaultTimeout = 10 * time.Second
+
+// errNotChecked is the status of the check which didn't run yet.
+var errNotChecked = errors.New("not checked yet")
+
+// Check is the periodic health check.
+type Check struct {
+	// Run returns nil if the component is healthy.
+	Run  func(ctx context.Context) error
+	Name string
+	// Interval is the period of the check.
+	Interval time.Duration
+	// Timeout limits the duration of a single run, defaults to 10s.
+	Timeout time.Duration
+}
+
+// Result is the last result of the check.
+type Result struct {
+	Checked time.Time
+	Err     error
+	Name    string
+}
+
+// Probe runs the checks in the background and reports their last results over HTTP,
+// so that the probe requests don't wait for the checks and don't overload the checked APIs.
+type Probe struct {
+	logger  *zap.Logger
+	checks  []Check
+	results []Result
+	mu      sync.Mutex
+}
+
+// NewProbe creates a new Probe, the checks don't run until Run is called.
+func NewProbe(logger *zap.Logger, checks ...Check) *Probe {
+	results := make([]Result, len(checks))
+
+	for i, check := range checks {
+		results[i] = Result{
+			Name: check.Name,
+			Err:  errNotChecked,
+		}
+	}
+
+	return &Probe{
+		logger:  logger,
+		checks:  checks,
+		results: results,
+	}
+}
+
+// Run runs each check immediately and then every check interval until the context is canceled.
+func (p *Probe) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for i := range p.checks {
+		wg.Go(func() {
+			p.runCheck(ctx, i)
+		})
+	}
+
+	wg.Wait()
+}
+
+func (p *Probe) runCheck(ctx context.Context, index int) {
+	check := p.checks[index]
+
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.Check(ctx, index)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check runs the check with the index once and records the result.
+func (p *Probe) Check(ctx context.Context, index int) {
+	check := p.checks[index]
+
+	checkCtx, cancel := context.WithTimeout(ctx, cmp.Or(check.Timeout, defaultTimeout))
+	defer cancel()
+
+	err := check.Run(checkCtx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	previous := p.results[index].Err
+
+	switch {
+	case err != nil && (previous == nil || previous.Error() != err.Error()):
+		p.logger.Warn("health check failed", zap.String("check", check.Name), zap.Error(err))
+	case err == nil && previous != nil && !errors.Is(previous, errNotChecked):
+		p.logger.Info("health check recovered", zap.String("check", check.Name))
+	}
+
+	p.results[index] = Result{
+		Name:    check.Name,
+		Err:     err,
+		Checked: time.Now(),
+	}
+}
+
+// Results returns the last results of the checks.
+func (p *Probe) Results() []Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]Result(nil), p.results...)
+}
+
+// ServeHTTP responds with 200 if all checks passed, and with 503 otherwise, the body lists the results of the checks.
+func (p *Probe) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var (
+		body    strings.Builder
+		healthy = true
+	)
+
+	for _, result := range p.Results() {
+		if result.Err != nil {
+			healthy = false
+
+			fmt.Fprintf(&body, "[-] %s: %s\n", result.Name, result.Err)
+
+			continue
+		}
+
+		fmt.Fprintf(&body, "[+] %s: ok\n", result.Name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	w.Write([]byte(body.String())) //nolint:errcheck
+}
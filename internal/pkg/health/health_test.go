@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package health_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/health"
+)
+
+func get(t *testing.T, handler http.Handler) (int, string) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(recorder, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/readyz", nil))
+
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestProbe(t *testing.T) {
+	t.Parallel()
+
+	var proxmoxErr atomic.Pointer[error]
+
+	probe := health.NewProbe(zaptest.NewLogger(t),
+		health.Check{
+			Name:     "omni",
+			Run:      func(context.Context) error { return nil },
+			Interval: time.Hour,
+		},
+		health.Check{
+			Name: "proxmox",
+			Run: func(context.Context) error {
+				if err := proxmoxErr.Load(); err != nil {
+					return *err
+				}
+
+				return nil
+			},
+			Interval: time.Hour,
+		},
+	)
+
+	// the checks which didn't run yet are failing
+	code, body := get(t, probe)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "[-] omni: not checked yet\n[-] proxmox: not checked yet\n", body)
+
+	probe.Check(t.Context(), 0)
+	probe.Check(t.Context(), 1)
+
+	code, body = get(t, probe)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[+] omni: ok\n[+] proxmox: ok\n", body)
+
+	err := errors.New("cluster \"default\": no nodes are online")
+	proxmoxErr.Store(&err)
+
+	probe.Check(t.Context(), 1)
+
+	code, body = get(t, probe)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "[+] omni: ok\n[-] proxmox: cluster \"default\": no nodes are online\n", body)
+
+	results := probe.Results()
+	require.Len(t, results, 2)
+	assert.False(t, results[1].Checked.IsZero())
+}
+
+func TestProbeRun(t *testing.T) {
+	t.Parallel()
+
+	var runs atomic.Int32
+
+	probe := health.NewProbe(zaptest.NewLogger(t), health.Check{
+		Name: "slow",
+		Run: func(ctx context.Context) error {
+			runs.Add(1)
+
+			// the check is limited by the timeout
+			<-ctx.Done()
+
+			return ctx.Err()
+		},
+		Interval: 10 * time.Millisecond,
+		Timeout:  10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	done := make(chan struct{})
+
+	go func() {
+		probe.Run(ctx)
+
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return runs.Load() >= 3 }, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+
+	code, body := get(t, probe)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[-] slow: context")
+}
@@ -0,0 +1,172 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package ipam implements the allocation of the static addresses of the VM NICs from the address pools.
+package ipam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// ErrLeased is returned by the Store when the address is already leased.
+var ErrLeased = errors.New("the address is already leased")
+
+// The backends the addresses of the pools are allocated by.
+const (
+	// BackendBuiltin allocates the addresses with the Allocator, it's the default.
+	BackendBuiltin = "builtin"
+	// BackendNetBox allocates the addresses in NetBox.
+	BackendNetBox = "netbox"
+)
+
+// IPAM allocates the static addresses of the VM NICs from the pools.
+type IPAM interface {
+	// Allocate leases the free address of the pool to the NIC of the machine, the address already leased to the NIC is returned again.
+	// The addresses for which inUse returns true should be skipped, inUse can be nil.
+	Allocate(ctx context.Context, pool Pool, owner string, nic int, inUse func(netip.Addr) bool) (Lease, error)
+	// Reserve records the lease allocated before, it fails with ErrLeased if the address is leased to another machine.
+	Reserve(ctx context.Context, lease Lease) error
+	// Assign records the ID of the VM created for the machine in its leases.
+	Assign(ctx context.Context, owner string, vmid int) error
+	// Release removes all leases of the machine.
+	Release(ctx context.Context, owner string) error
+}
+
+// Lease is the address leased to the NIC of the machine.
+type Lease struct {
+	// Address is the address with the prefix length of the pool subnet, e.g. 10.5.0.10/24.
+	Address netip.Prefix
+	// Pool is the name of the pool, or the subnet for the pools without the name.
+	Pool string
+	// Owner is the machine request ID.
+	Owner string
+	// NIC is the index of the Proxmox NIC, 0 for net0.
+	NIC int
+}
+
+// Store persists the leases, the addresses are unique across all pools.
+type Store interface {
+	// Create records the lease, it fails with ErrLeased if the address is already leased.
+	Create(ctx context.Context, lease Lease) error
+	// Delete removes the lease of the address, it's not an error if the address isn't leased.
+	Delete(ctx context.Context, addr netip.Addr) error
+	// List returns all leases.
+	List(ctx context.Context) ([]Lease, error)
+}
+
+// Allocator leases the free addresses of the pools to the machines, keeping the leases in the Store.
+type Allocator struct {
+	store Store
+}
+
+// NewAllocator creates a new Allocator keeping the leases in the store.
+func NewAllocator(store Store) *Allocator {
+	return &Allocator{store: store}
+}
+
+// Allocate leases the free address of the pool to the NIC of the machine, the address already leased to the NIC is returned again.
+// The addresses for which inUse returns true are skipped, e.g. the addresses of the existing VMs, inUse can be nil.
+func (a *Allocator) Allocate(ctx context.Context, pool Pool, owner string, nic int, inUse func(netip.Addr) bool) (Lease, error) {
+	s, err := pool.parse()
+	if err != nil {
+		return Lease{}, fmt.Errorf("pool %s: %w", pool, err)
+	}
+
+	leases, err := a.store.List(ctx)
+	if err != nil {
+		return Lease{}, fmt.Errorf("failed to list the leases: %w", err)
+	}
+
+	leased := make(map[netip.Addr]struct{}, len(leases))
+
+	for _, lease := range leases {
+		if lease.Owner == owner && lease.NIC == nic && s.prefix.Contains(lease.Address.Addr()) {
+			return lease, nil
+		}
+
+		leased[lease.Address.Addr()] = struct{}{}
+	}
+
+	for addr := range s.candidates() {
+		if _, ok := leased[addr]; ok {
+			continue
+		}
+
+		if inUse != nil && inUse(addr) {
+			continue
+		}
+
+		lease := Lease{
+			Address: netip.PrefixFrom(addr, s.prefix.Bits()),
+			Pool:    pool.String(),
+			Owner:   owner,
+			NIC:     nic,
+		}
+
+		err = a.store.Create(ctx, lease)
+
+		switch {
+		case err == nil:
+			return lease, nil
+		case errors.Is(err, ErrLeased):
+			// the address was leased concurrently
+			continue
+		default:
+			return Lease{}, fmt.Errorf("failed to lease %s: %w", addr, err)
+		}
+	}
+
+	return Lease{}, fmt.Errorf("pool %s: no free addresses left", pool)
+}
+
+// Reserve records the lease allocated before, e.g. the address recorded in the machine before the leases were persisted.
+// It fails with ErrLeased if the address is leased to another machine.
+func (a *Allocator) Reserve(ctx context.Context, lease Lease) error {
+	err := a.store.Create(ctx, lease)
+	if !errors.Is(err, ErrLeased) {
+		return err
+	}
+
+	leases, listErr := a.store.List(ctx)
+	if listErr != nil {
+		return fmt.Errorf("failed to list the leases: %w", listErr)
+	}
+
+	if slices.ContainsFunc(leases, func(existing Lease) bool {
+		return existing.Address.Addr() == lease.Address.Addr() && existing.Owner == lease.Owner && existing.NIC == lease.NIC
+	}) {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %w", lease.Address.Addr(), err)
+}
+
+// Assign implements IPAM, the leases of the Allocator don't record the VMs.
+func (a *Allocator) Assign(context.Context, string, int) error {
+	return nil
+}
+
+// Release removes all leases of the machine.
+func (a *Allocator) Release(ctx context.Context, owner string) error {
+	leases, err := a.store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the leases: %w", err)
+	}
+
+	for _, lease := range leases {
+		if lease.Owner != owner {
+			continue
+		}
+
+		if err = a.store.Delete(ctx, lease.Address.Addr()); err != nil {
+			return fmt.Errorf("failed to release %s: %w", lease.Address.Addr(), err)
+		}
+	}
+
+	return nil
+}
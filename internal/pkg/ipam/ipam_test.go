@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipam_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+)
+
+func TestAllocate(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	allocator := ipam.NewAllocator(ipam.NewMemoryStore())
+
+	pool := ipam.Pool{
+		Name:    "lan",
+		CIDR:    "10.5.0.0/24",
+		Gateway: "10.5.0.1",
+		Ranges:  []string{"10.5.0.1-10.5.0.5"},
+		Exclude: []string{"10.5.0.3"},
+	}
+
+	inUse := func(addr netip.Addr) bool { return addr == netip.MustParseAddr("10.5.0.4") }
+
+	// the gateway, the excluded and the used addresses are skipped
+	lease, err := allocator.Allocate(ctx, pool, "machine-1", 0, inUse)
+	require.NoError(t, err)
+	assert.Equal(t, ipam.Lease{Address: netip.MustParsePrefix("10.5.0.2/24"), Pool: "lan", Owner: "machine-1"}, lease)
+
+	// the address leased to the NIC is returned again
+	again, err := allocator.Allocate(ctx, pool, "machine-1", 0, inUse)
+	require.NoError(t, err)
+	assert.Equal(t, lease, again)
+
+	lease, err = allocator.Allocate(ctx, pool, "machine-1", 1, inUse)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.5.0.5/24"), lease.Address)
+
+	_, err = allocator.Allocate(ctx, pool, "machine-2", 0, inUse)
+	require.EqualError(t, err, "pool lan: no free addresses left")
+
+	require.NoError(t, allocator.Release(ctx, "machine-1"))
+
+	lease, err = allocator.Allocate(ctx, pool, "machine-2", 0, inUse)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.5.0.2/24"), lease.Address)
+}
+
+func TestReserve(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	store := ipam.NewMemoryStore()
+	allocator := ipam.NewAllocator(store)
+
+	lease := ipam.Lease{Address: netip.MustParsePrefix("10.5.0.10/24"), Pool: "lan", Owner: "machine-1"}
+
+	require.NoError(t, allocator.Reserve(ctx, lease))
+	require.NoError(t, allocator.Reserve(ctx, lease))
+
+	err := allocator.Reserve(ctx, ipam.Lease{Address: netip.MustParsePrefix("10.5.0.10/24"), Pool: "lan", Owner: "machine-2"})
+	require.ErrorIs(t, err, ipam.ErrLeased)
+
+	leases, err := store.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ipam.Lease{lease}, leases)
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipam
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// MemoryStore keeps the leases in memory, they are lost when the provider restarts.
+type MemoryStore struct {
+	leases map[netip.Addr]Lease
+	mu     sync.Mutex
+}
+
+// NewMemoryStore creates a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		leases: map[netip.Addr]Lease{},
+	}
+}
+
+// Create implements Store.
+func (s *MemoryStore) Create(_ context.Context, lease Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.leases[lease.Address.Addr()]; ok {
+		return ErrLeased
+	}
+
+	s.leases[lease.Address.Addr()] = lease
+
+	return nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(_ context.Context, addr netip.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leases, addr)
+
+	return nil
+}
+
+// List implements Store.
+func (s *MemoryStore) List(context.Context) ([]Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.SortedFunc(maps.Values(s.leases), func(a, b Lease) int {
+		return a.Address.Addr().Compare(b.Address.Addr())
+	}), nil
+}
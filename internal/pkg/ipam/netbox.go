@@ -0,0 +1,402 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// NetBoxOptions configures the NetBox backend.
+type NetBoxOptions struct {
+	// HTTPClient is used for the NetBox API requests, defaults to the client with 30s timeout.
+	HTTPClient *http.Client
+	// Tags are set on the allocated addresses, the tags should exist in NetBox.
+	Tags []string
+}
+
+// The custom fields of the NetBox IP addresses which identify the addresses of the machine when they are allocated again or released.
+// The fields should be created in NetBox: the text field with the machine request ID and the integer field with the NIC index.
+const (
+	netboxMachineField = "omni_machine"
+	netboxNICField     = "omni_nic"
+)
+
+// NetBox allocates the addresses from the prefixes in NetBox, or in another IPAM with the NetBox compatible API.
+//
+// The owner of the allocated addresses is recorded in the custom fields, the description "<machine> net<nic>",
+// followed by "vmid <vmid>" once the VM is created, is only informational.
+type NetBox struct {
+	client  *http.Client
+	address *url.URL
+	token   string
+	options NetBoxOptions
+}
+
+// NewNetBox creates a new NetBox backend, the address is the NetBox address, e.g. https://netbox.example.com.
+func NewNetBox(address, token string, options NetBoxOptions) (*NetBox, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NetBox address %q: %w", address, err)
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid NetBox address %q: should be an absolute URL", address)
+	}
+
+	client := options.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &NetBox{
+		client:  client,
+		address: u,
+		token:   token,
+		options: options,
+	}, nil
+}
+
+// netboxIPAddress is the NetBox IP address object.
+type netboxIPAddress struct {
+	CustomFields netboxCustomFields `json:"custom_fields"`
+	Address      string             `json:"address"`
+	Description  string             `json:"description"`
+	ID           int                `json:"id"`
+}
+
+// netboxCustomFields are the custom fields of the NetBox IP address set by the provider, they are empty for the other addresses.
+type netboxCustomFields struct {
+	NIC     *int   `json:"omni_nic"`
+	Machine string `json:"omni_machine"`
+}
+
+// owner returns the machine and the NIC the address is allocated to, ok is false for the addresses not allocated by the provider.
+func (a netboxIPAddress) owner() (owner string, nic int, ok bool) {
+	if a.CustomFields.Machine == "" || a.CustomFields.NIC == nil {
+		return "", 0, false
+	}
+
+	return a.CustomFields.Machine, *a.CustomFields.NIC, true
+}
+
+// netboxTag is the nested tag of the NetBox object.
+type netboxTag struct {
+	Name string `json:"name"`
+}
+
+// netboxError is the response of the failed NetBox API request.
+type netboxError struct {
+	status string
+	detail string
+	code   int
+}
+
+func (e *netboxError) Error() string {
+	if e.detail == "" {
+		return e.status
+	}
+
+	return e.status + ": " + e.detail
+}
+
+// Allocate implements IPAM, the next free address of the NetBox prefix is allocated.
+// The inUse function is ignored, NetBox is the source of truth for the addresses of the prefix.
+func (n *NetBox) Allocate(ctx context.Context, pool Pool, owner string, nic int, _ func(netip.Addr) bool) (Lease, error) {
+	prefix, err := netip.ParsePrefix(pool.CIDR)
+	if err != nil {
+		return Lease{}, fmt.Errorf("pool %s: invalid CIDR %q: %w", pool, pool.CIDR, err)
+	}
+
+	owned, err := n.owned(ctx, owner)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	// the address might be allocated before the machine recorded it
+	for _, address := range owned {
+		if lease, ok := address.lease(pool); ok && lease.NIC == nic && prefix.Contains(lease.Address.Addr()) {
+			return lease, nil
+		}
+	}
+
+	var prefixes struct {
+		Results []struct {
+			ID int `json:"id"`
+		} `json:"results"`
+	}
+
+	query := url.Values{"prefix": {prefix.Masked().String()}}
+
+	if pool.PrefixID != 0 {
+		query.Set("id", strconv.Itoa(pool.PrefixID))
+	}
+
+	if pool.VRFID != 0 {
+		query.Set("vrf_id", strconv.Itoa(pool.VRFID))
+	}
+
+	if err = n.do(ctx, http.MethodGet, n.endpoint("ipam/prefixes", query), nil, &prefixes); err != nil {
+		return Lease{}, fmt.Errorf("pool %s: failed to find the prefix in NetBox: %w", pool, err)
+	}
+
+	switch {
+	case len(prefixes.Results) == 0:
+		return Lease{}, fmt.Errorf("pool %s: prefix %s is not found in NetBox", pool, prefix.Masked())
+	case len(prefixes.Results) > 1:
+		return Lease{}, fmt.Errorf("pool %s: found %d prefixes %s in NetBox, set the VRF or the prefix ID of the pool to pick one of them", pool, len(prefixes.Results), prefix.Masked())
+	}
+
+	var address netboxIPAddress
+
+	err = n.do(ctx, http.MethodPost, n.endpoint(fmt.Sprintf("ipam/prefixes/%d/available-ips", prefixes.Results[0].ID), nil), n.newAddress("", owner, nic), &address)
+
+	var netboxErr *netboxError
+
+	switch {
+	case errors.As(err, &netboxErr) && netboxErr.code == http.StatusConflict:
+		return Lease{}, fmt.Errorf("pool %s: no free addresses left", pool)
+	case err != nil:
+		return Lease{}, fmt.Errorf("pool %s: failed to allocate the address in NetBox: %w", pool, err)
+	}
+
+	lease, ok := address.lease(pool)
+	if !ok {
+		return Lease{}, fmt.Errorf("pool %s: NetBox allocated the unexpected address %q", pool, address.Address)
+	}
+
+	return lease, nil
+}
+
+// Reserve implements IPAM, the address is created in NetBox if it doesn't exist.
+func (n *NetBox) Reserve(ctx context.Context, lease Lease) error {
+	var addresses struct {
+		Results []netboxIPAddress `json:"results"`
+	}
+
+	if err := n.do(ctx, http.MethodGet, n.endpoint("ipam/ip-addresses", url.Values{"address": {lease.Address.Addr().String()}}), nil, &addresses); err != nil {
+		return fmt.Errorf("failed to find %s in NetBox: %w", lease.Address.Addr(), err)
+	}
+
+	for _, address := range addresses.Results {
+		owner, nic, ok := address.owner()
+		if !ok || owner != lease.Owner || nic != lease.NIC {
+			return fmt.Errorf("%s: %w", lease.Address.Addr(), ErrLeased)
+		}
+	}
+
+	if len(addresses.Results) > 0 {
+		return nil
+	}
+
+	if err := n.do(ctx, http.MethodPost, n.endpoint("ipam/ip-addresses", nil), n.newAddress(lease.Address.String(), lease.Owner, lease.NIC), nil); err != nil {
+		return fmt.Errorf("failed to create %s in NetBox: %w", lease.Address, err)
+	}
+
+	return nil
+}
+
+// Assign implements IPAM, the VMID is added to the description of the addresses.
+func (n *NetBox) Assign(ctx context.Context, owner string, vmid int) error {
+	owned, err := n.owned(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range owned {
+		_, nic, _ := address.owner()
+
+		description := formatDescription(owner, nic, vmid)
+		if address.Description == description {
+			continue
+		}
+
+		if err = n.do(ctx, http.MethodPatch, n.endpoint(fmt.Sprintf("ipam/ip-addresses/%d", address.ID), nil), map[string]string{"description": description}, nil); err != nil {
+			return fmt.Errorf("failed to update %s in NetBox: %w", address.Address, err)
+		}
+	}
+
+	return nil
+}
+
+// Release implements IPAM, the addresses of the machine are deleted from NetBox.
+func (n *NetBox) Release(ctx context.Context, owner string) error {
+	owned, err := n.owned(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range owned {
+		err = n.do(ctx, http.MethodDelete, n.endpoint(fmt.Sprintf("ipam/ip-addresses/%d", address.ID), nil), nil, nil)
+
+		var netboxErr *netboxError
+
+		if err != nil && !(errors.As(err, &netboxErr) && netboxErr.code == http.StatusNotFound) {
+			return fmt.Errorf("failed to release %s in NetBox: %w", address.Address, err)
+		}
+	}
+
+	return nil
+}
+
+// owned returns the addresses allocated to the machine, following the pages of the results.
+func (n *NetBox) owned(ctx context.Context, owner string) ([]netboxIPAddress, error) {
+	var owned []netboxIPAddress
+
+	next := n.endpoint("ipam/ip-addresses", url.Values{"cf_" + netboxMachineField: {owner}, "limit": {"100"}})
+
+	for next != "" {
+		var page struct {
+			Next    *string           `json:"next"`
+			Results []netboxIPAddress `json:"results"`
+		}
+
+		if err := n.do(ctx, http.MethodGet, next, nil, &page); err != nil {
+			return nil, fmt.Errorf("failed to list the addresses of %s in NetBox: %w", owner, err)
+		}
+
+		for _, address := range page.Results {
+			// the filter is ignored by the NetBox compatible APIs which don't support the custom fields, so the owner is checked again
+			if addressOwner, _, ok := address.owner(); ok && addressOwner == owner {
+				owned = append(owned, address)
+			}
+		}
+
+		next = ""
+
+		if page.Next != nil {
+			next = *page.Next
+		}
+	}
+
+	return owned, nil
+}
+
+// newAddress returns the body of the request creating the address.
+func (n *NetBox) newAddress(address, owner string, nic int) map[string]any {
+	body := map[string]any{
+		"status":      "active",
+		"description": formatDescription(owner, nic, 0),
+		"custom_fields": map[string]any{
+			netboxMachineField: owner,
+			netboxNICField:     nic,
+		},
+	}
+
+	if address != "" {
+		body["address"] = address
+	}
+
+	if len(n.options.Tags) > 0 {
+		tags := make([]netboxTag, 0, len(n.options.Tags))
+
+		for _, tag := range n.options.Tags {
+			tags = append(tags, netboxTag{Name: tag})
+		}
+
+		body["tags"] = tags
+	}
+
+	return body
+}
+
+func (n *NetBox) endpoint(path string, query url.Values) string {
+	// NetBox redirects the API paths without the trailing slash
+	u := n.address.JoinPath("api", path+"/")
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+func (n *NetBox) do(ctx context.Context, method, endpoint string, in, out any) error {
+	var body io.Reader
+
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Token "+n.token)
+	req.Header.Set("Accept", "application/json")
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var detail struct {
+			Detail string `json:"detail"`
+		}
+
+		json.NewDecoder(resp.Body).Decode(&detail) //nolint:errcheck
+
+		return &netboxError{code: resp.StatusCode, status: resp.Status, detail: detail.Detail}
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode the NetBox response: %w", err)
+	}
+
+	return nil
+}
+
+// lease converts the NetBox address allocated to the machine to the lease.
+func (a netboxIPAddress) lease(pool Pool) (Lease, bool) {
+	owner, nic, ok := a.owner()
+	if !ok {
+		return Lease{}, false
+	}
+
+	address, err := netip.ParsePrefix(a.Address)
+	if err != nil {
+		return Lease{}, false
+	}
+
+	return Lease{
+		Address: address,
+		Pool:    pool.String(),
+		Owner:   owner,
+		NIC:     nic,
+	}, true
+}
+
+func formatDescription(owner string, nic, vmid int) string {
+	description := fmt.Sprintf("%s net%d", owner, nic)
+
+	if vmid != 0 {
+		description += fmt.Sprintf(" vmid %d", vmid)
+	}
+
+	return description
+}
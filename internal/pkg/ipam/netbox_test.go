@@ -0,0 +1,200 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipam_test
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakenetbox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+)
+
+func newNetBox(t *testing.T, token string) (*fakenetbox.Server, *ipam.NetBox) {
+	t.Helper()
+
+	srv := fakenetbox.NewServer()
+	t.Cleanup(srv.Close)
+
+	netbox, err := ipam.NewNetBox(srv.URL(), token, ipam.NetBoxOptions{
+		HTTPClient: srv.HTTPClient(),
+		Tags:       []string{"omni"},
+	})
+	require.NoError(t, err)
+
+	return srv, netbox
+}
+
+func TestNetBoxAllocate(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	srv, netbox := newNetBox(t, fakenetbox.Token)
+
+	srv.AddPrefix("10.5.0.0/29")
+	srv.AddAddress(fakenetbox.Address{Address: "10.5.0.1/29", Description: "gateway"})
+
+	pool := ipam.Pool{Name: "lan", CIDR: "10.5.0.0/29", Backend: ipam.BackendNetBox}
+
+	lease, err := netbox.Allocate(ctx, pool, "machine-1", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ipam.Lease{Address: netip.MustParsePrefix("10.5.0.2/29"), Pool: "lan", Owner: "machine-1"}, lease)
+
+	// the address allocated before is found by the custom fields
+	again, err := netbox.Allocate(ctx, pool, "machine-1", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, lease, again)
+
+	// the machines which names start with the owner are not confused with it
+	lease, err = netbox.Allocate(ctx, pool, "machine-10", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.5.0.3/29"), lease.Address)
+
+	require.NoError(t, netbox.Assign(ctx, "machine-1", 100))
+
+	for i := range 3 {
+		_, err = netbox.Allocate(ctx, pool, fmt.Sprintf("machine-%d", i+2), 0, nil)
+		require.NoError(t, err)
+	}
+
+	_, err = netbox.Allocate(ctx, pool, "machine-5", 0, nil)
+	require.EqualError(t, err, "pool lan: no free addresses left")
+
+	addresses := srv.Addresses()
+	require.Len(t, addresses, 6)
+	assert.Equal(t, fakenetbox.Address{
+		ID:          addresses[1].ID,
+		Address:     "10.5.0.2/29",
+		Description: "machine-1 net0 vmid 100",
+		Status:      "active",
+		Tags:        []string{"omni"},
+		CustomFields: map[string]any{
+			"omni_machine": "machine-1",
+			"omni_nic":     float64(0),
+		},
+	}, addresses[1])
+
+	require.NoError(t, netbox.Release(ctx, "machine-1"))
+
+	addresses = srv.Addresses()
+	require.Len(t, addresses, 5)
+	assert.Equal(t, "10.5.0.3/29", addresses[1].Address)
+
+	lease, err = netbox.Allocate(ctx, pool, "machine-5", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.5.0.2/29"), lease.Address)
+
+	_, err = netbox.Allocate(ctx, ipam.Pool{Name: "wan", CIDR: "10.6.0.0/24"}, "machine-5", 0, nil)
+	require.EqualError(t, err, "pool wan: prefix 10.6.0.0/24 is not found in NetBox")
+}
+
+func TestNetBoxPrefixes(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	srv, netbox := newNetBox(t, fakenetbox.Token)
+
+	srv.AddVRFPrefix("10.5.0.0/24", 1)
+	prefixID := srv.AddVRFPrefix("10.5.0.0/24", 2)
+
+	_, err := netbox.Allocate(ctx, ipam.Pool{Name: "lan", CIDR: "10.5.0.0/24"}, "machine-1", 0, nil)
+	require.EqualError(t, err, "pool lan: found 2 prefixes 10.5.0.0/24 in NetBox, set the VRF or the prefix ID of the pool to pick one of them")
+
+	_, err = netbox.Allocate(ctx, ipam.Pool{Name: "lan", CIDR: "10.5.0.0/24", VRFID: 2}, "machine-1", 0, nil)
+	require.NoError(t, err)
+
+	_, err = netbox.Allocate(ctx, ipam.Pool{Name: "lan", CIDR: "10.5.0.0/24", PrefixID: prefixID}, "machine-2", 0, nil)
+	require.NoError(t, err)
+
+	_, err = netbox.Allocate(ctx, ipam.Pool{Name: "lan", CIDR: "10.5.0.0/24", VRFID: 3}, "machine-3", 0, nil)
+	require.EqualError(t, err, "pool lan: prefix 10.5.0.0/24 is not found in NetBox")
+}
+
+func TestNetBoxOwner(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	srv, netbox := newNetBox(t, fakenetbox.Token)
+
+	srv.AddPrefix("10.5.0.0/24")
+
+	// the description of the address not allocated by the provider doesn't make it owned
+	srv.AddAddress(fakenetbox.Address{Address: "10.5.0.1/24", Description: "machine-1 net0"})
+
+	lease, err := netbox.Allocate(ctx, ipam.Pool{Name: "lan", CIDR: "10.5.0.0/24"}, "machine-1", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParsePrefix("10.5.0.2/24"), lease.Address)
+
+	require.ErrorIs(t, netbox.Reserve(ctx, ipam.Lease{Address: netip.MustParsePrefix("10.5.0.1/24"), Pool: "lan", Owner: "machine-1"}), ipam.ErrLeased)
+
+	// the description can be edited in NetBox
+	addresses := srv.Addresses()
+	require.Len(t, addresses, 2)
+
+	srv.SetDescription(addresses[1].ID, "control plane")
+
+	again, err := netbox.Allocate(ctx, ipam.Pool{Name: "lan", CIDR: "10.5.0.0/24"}, "machine-1", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, lease, again)
+
+	require.NoError(t, netbox.Release(ctx, "machine-1"))
+
+	addresses = srv.Addresses()
+	require.Len(t, addresses, 1)
+	assert.Equal(t, "10.5.0.1/24", addresses[0].Address)
+}
+
+func TestNetBoxReserve(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	srv, netbox := newNetBox(t, fakenetbox.Token)
+
+	srv.AddAddress(fakenetbox.Address{Address: "10.5.0.1/24", Description: "gateway"})
+
+	lease := ipam.Lease{Address: netip.MustParsePrefix("10.5.0.10/24"), Pool: "lan", Owner: "machine-1"}
+
+	// the address recorded in the machine is created again if it was removed from NetBox
+	require.NoError(t, netbox.Reserve(ctx, lease))
+	require.NoError(t, netbox.Reserve(ctx, lease))
+
+	addresses := srv.Addresses()
+	require.Len(t, addresses, 2)
+	assert.Equal(t, "10.5.0.10/24", addresses[1].Address)
+	assert.Equal(t, "machine-1 net0", addresses[1].Description)
+
+	err := netbox.Reserve(ctx, ipam.Lease{Address: netip.MustParsePrefix("10.5.0.1/24"), Pool: "lan", Owner: "machine-1"})
+	require.ErrorIs(t, err, ipam.ErrLeased)
+}
+
+func TestNetBoxPages(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	srv, netbox := newNetBox(t, fakenetbox.Token)
+
+	for i := range 150 {
+		srv.AddAddress(fakenetbox.Address{
+			Address:      fmt.Sprintf("10.5.%d.%d/16", i/100, i%100+1),
+			CustomFields: map[string]any{"omni_machine": "machine-1", "omni_nic": i},
+		})
+	}
+
+	require.NoError(t, netbox.Release(ctx, "machine-1"))
+	assert.Empty(t, srv.Addresses())
+}
+
+func TestNetBoxToken(t *testing.T) {
+	t.Parallel()
+
+	_, netbox := newNetBox(t, "wrong")
+
+	err := netbox.Release(t.Context(), "machine-1")
+	require.ErrorContains(t, err, "failed to list the addresses of machine-1 in NetBox: 403 Forbidden: Invalid token")
+}
@@ -0,0 +1,215 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"net/netip"
+	"strings"
+)
+
+// Pool is the subnet the static addresses of the VM NICs are allocated from.
+type Pool struct {
+	// Name is referred by the machine classes, it's empty for the subnets set in the machine class.
+	Name string `yaml:"name"`
+	// CIDR is the subnet of the pool, e.g. 10.5.0.0/24.
+	CIDR string `yaml:"cidr"`
+	// Gateway is the default gateway of the subnet, it is never allocated.
+	Gateway string `yaml:"gateway,omitempty"`
+	// Backend allocates the addresses of the pool: builtin (default) or netbox.
+	// The NetBox pools refer to the prefix with the same CIDR in NetBox, the ranges and the exclusions are managed in NetBox.
+	Backend string `yaml:"backend,omitempty"`
+	// Ranges limit the allocated addresses to the parts of the subnet, e.g. 10.5.0.100-10.5.0.200, the whole subnet is used if not set.
+	Ranges []string `yaml:"ranges,omitempty"`
+	// Exclude are the addresses and the ranges which are never allocated, e.g. the addresses of the routers.
+	Exclude []string `yaml:"exclude,omitempty"`
+	// VRFID limits the NetBox prefixes of the pool to the VRF with the ID, if the same prefix exists in multiple VRFs.
+	VRFID int `yaml:"vrfID,omitempty"`
+	// PrefixID is the ID of the NetBox prefix of the pool, it picks the prefix if there are multiple prefixes with the same CIDR.
+	PrefixID int `yaml:"prefixID,omitempty"`
+}
+
+// addrRange is the inclusive range of the addresses.
+type addrRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+func (r addrRange) contains(addr netip.Addr) bool {
+	return !addr.Less(r.first) && !r.last.Less(addr)
+}
+
+// String implements fmt.Stringer.
+func (r addrRange) String() string {
+	if r.first == r.last {
+		return r.first.String()
+	}
+
+	return r.first.String() + "-" + r.last.String()
+}
+
+// subnet is the parsed Pool.
+type subnet struct {
+	gateway netip.Addr
+	prefix  netip.Prefix
+	ranges  []addrRange
+	exclude []addrRange
+}
+
+// Validate checks the pool settings.
+func (p Pool) Validate() error {
+	_, err := p.parse()
+
+	switch p.Backend {
+	case "", BackendBuiltin:
+		if p.VRFID != 0 || p.PrefixID != 0 {
+			err = errors.Join(err, errors.New("the VRF and the prefix ID can be set only for the NetBox pools"))
+		}
+	case BackendNetBox:
+		if len(p.Ranges) > 0 || len(p.Exclude) > 0 {
+			err = errors.Join(err, errors.New("the ranges and the exclusions of the NetBox pools are managed in NetBox"))
+		}
+	default:
+		err = errors.Join(err, fmt.Errorf("unknown backend %q: should be %s or %s", p.Backend, BackendBuiltin, BackendNetBox))
+	}
+
+	return err
+}
+
+// String returns the pool name, or the subnet for the pools without the name.
+func (p Pool) String() string {
+	if p.Name != "" {
+		return p.Name
+	}
+
+	return p.CIDR
+}
+
+//nolint:gocognit
+func (p Pool) parse() (subnet, error) {
+	prefix, err := netip.ParsePrefix(p.CIDR)
+	if err != nil {
+		return subnet{}, fmt.Errorf("invalid CIDR %q: %w", p.CIDR, err)
+	}
+
+	result := subnet{prefix: prefix.Masked()}
+
+	whole := addrRange{first: result.prefix.Addr(), last: lastAddr(result.prefix)}
+
+	// the network and the broadcast addresses can't be used by the VMs
+	if prefix.Addr().Is4() && prefix.Bits() < 31 {
+		whole.first = whole.first.Next()
+		whole.last = whole.last.Prev()
+	}
+
+	var errs []error
+
+	for _, r := range p.Ranges {
+		parsed, err := parseRange(r)
+		if err == nil && (!whole.contains(parsed.first) || !whole.contains(parsed.last)) {
+			err = fmt.Errorf("should be in %s", whole)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid range %q: %w", r, err))
+
+			continue
+		}
+
+		result.ranges = append(result.ranges, parsed)
+	}
+
+	if len(p.Ranges) == 0 {
+		result.ranges = []addrRange{whole}
+	}
+
+	for _, r := range p.Exclude {
+		parsed, err := parseRange(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid exclude %q: %w", r, err))
+
+			continue
+		}
+
+		result.exclude = append(result.exclude, parsed)
+	}
+
+	if p.Gateway != "" {
+		if result.gateway, err = netip.ParseAddr(p.Gateway); err != nil {
+			errs = append(errs, fmt.Errorf("invalid gateway %q: %w", p.Gateway, err))
+		} else if !prefix.Contains(result.gateway) {
+			errs = append(errs, fmt.Errorf("gateway %s is not in %s", result.gateway, result.prefix))
+		}
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// parseRange parses the range like 10.5.0.100-10.5.0.200, or the single address.
+func parseRange(r string) (addrRange, error) {
+	from, to, isRange := strings.Cut(r, "-")
+
+	first, err := netip.ParseAddr(strings.TrimSpace(from))
+	if err != nil {
+		return addrRange{}, err
+	}
+
+	if !isRange {
+		return addrRange{first: first, last: first}, nil
+	}
+
+	last, err := netip.ParseAddr(strings.TrimSpace(to))
+	if err != nil {
+		return addrRange{}, err
+	}
+
+	if last.Less(first) || first.Is4() != last.Is4() {
+		return addrRange{}, errors.New("the last address should follow the first one")
+	}
+
+	return addrRange{first: first, last: last}, nil
+}
+
+// lastAddr returns the last address of the prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr().AsSlice()
+
+	for bit := prefix.Bits(); bit < len(addr)*8; bit++ {
+		addr[bit/8] |= 0x80 >> (bit % 8)
+	}
+
+	last, _ := netip.AddrFromSlice(addr)
+
+	return last
+}
+
+// candidates returns the addresses of the pool which can be allocated, in order.
+func (s subnet) candidates() iter.Seq[netip.Addr] {
+	return func(yield func(netip.Addr) bool) {
+		for _, r := range s.ranges {
+			for addr := r.first; addr.IsValid() && r.contains(addr); addr = addr.Next() {
+				if addr == s.gateway || s.excluded(addr) {
+					continue
+				}
+
+				if !yield(addr) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s subnet) excluded(addr netip.Addr) bool {
+	for _, r := range s.exclude {
+		if r.contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipam_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+)
+
+func TestPoolValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name string
+		errs []string
+		pool ipam.Pool
+	}{
+		{
+			name: "subnet",
+			pool: ipam.Pool{CIDR: "10.5.0.0/24"},
+		},
+		{
+			name: "ranges",
+			pool: ipam.Pool{
+				CIDR:    "fd00:5::/64",
+				Gateway: "fd00:5::1",
+				Ranges:  []string{"fd00:5::10-fd00:5::20", "fd00:5::100"},
+				Exclude: []string{"fd00:5::15"},
+			},
+		},
+		{
+			name: "invalid",
+			pool: ipam.Pool{
+				CIDR:    "10.5.0.0/24",
+				Gateway: "10.6.0.1",
+				Ranges:  []string{"10.5.0.20-10.5.0.10", "10.5.0.0-10.5.0.10"},
+				Exclude: []string{"router"},
+			},
+			errs: []string{
+				`invalid range "10.5.0.20-10.5.0.10": the last address should follow the first one`,
+				`invalid range "10.5.0.0-10.5.0.10": should be in 10.5.0.1-10.5.0.254`,
+				`invalid exclude "router"`,
+				"gateway 10.6.0.1 is not in 10.5.0.0/24",
+			},
+		},
+		{
+			name: "invalid CIDR",
+			pool: ipam.Pool{CIDR: "10.5.0.0"},
+			errs: []string{`invalid CIDR "10.5.0.0"`},
+		},
+		{
+			name: "NetBox VRF",
+			pool: ipam.Pool{CIDR: "10.5.0.0/24", Backend: ipam.BackendNetBox, VRFID: 2},
+		},
+		{
+			name: "builtin VRF",
+			pool: ipam.Pool{CIDR: "10.5.0.0/24", PrefixID: 3},
+			errs: []string{"the VRF and the prefix ID can be set only for the NetBox pools"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := test.pool.Validate()
+
+			if test.errs == nil {
+				require.NoError(t, err)
+
+				return
+			}
+
+			for _, expected := range test.errs {
+				assert.ErrorContains(t, err, expected)
+			}
+		})
+	}
+}
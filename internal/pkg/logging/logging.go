@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package logging implements the logger configuration of the provider and the debug logging of the Proxmox API requests.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The log formats.
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Redacted replaces the values of the secrets in the debug logs.
+const Redacted = "<redacted>"
+
+// New creates the logger writing to stderr with the level (debug, info, warn or error) and the format (json or console).
+func New(level, format string) (*zap.Logger, error) {
+	atomicLevel, err := zap.ParseAtomicLevel(level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = atomicLevel
+
+	switch format {
+	case FormatJSON:
+	case FormatConsole:
+		loggerConfig.Encoding = FormatConsole
+		loggerConfig.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected %q or %q", format, FormatJSON, FormatConsole)
+	}
+
+	if atomicLevel.Level() == zapcore.DebugLevel {
+		// the debug logs are not sampled, so that the logs of the API requests are complete
+		loggerConfig.Sampling = nil
+	}
+
+	return loggerConfig.Build(zap.AddStacktrace(zapcore.ErrorLevel))
+}
+
+// IsSecret returns true if the parameter with the name holds a secret, e.g. the password, the API token or the auth ticket.
+func IsSecret(name string) bool {
+	name = strings.ToLower(name)
+
+	for _, secret := range []string{"password", "secret", "token", "ticket"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RedactJSON replaces the values of the secret fields of the JSON document at any depth,
+// the documents which are not valid JSON are replaced as a whole.
+func RedactJSON(data []byte) string {
+	var doc any
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Redacted
+	}
+
+	redacted, err := json.Marshal(redactValue(doc))
+	if err != nil {
+		return Redacted
+	}
+
+	return string(redacted)
+}
+
+func redactValue(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for k, v := range value {
+			if IsSecret(k) {
+				value[k] = Redacted
+
+				continue
+			}
+
+			value[k] = redactValue(v)
+		}
+	case []any:
+		for i, v := range value {
+			value[i] = redactValue(v)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,70 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logging_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/logging"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name   string
+		level  string
+		format string
+		err    string
+	}{
+		{name: "json", level: "info", format: logging.FormatJSON},
+		{name: "console debug", level: "debug", format: logging.FormatConsole},
+		{name: "invalid level", level: "verbose", format: logging.FormatJSON, err: `invalid log level "verbose"`},
+		{name: "invalid format", level: "info", format: "text", err: `invalid log format "text"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger, err := logging.New(test.level, test.format)
+			if test.err != "" {
+				require.ErrorContains(t, err, test.err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, test.level == "debug", logger.Core().Enabled(zap.DebugLevel))
+			assert.True(t, logger.Core().Enabled(zap.InfoLevel))
+		})
+	}
+}
+
+func TestIsSecret(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"password", "cipassword", "ticket", "CSRFPreventionToken", "token_secret"} {
+		assert.True(t, logging.IsSecret(name), name)
+	}
+
+	for _, name := range []string{"cores", "memory", "keyboard", "sshkeys", "username"} {
+		assert.False(t, logging.IsSecret(name), name)
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	t.Parallel()
+
+	assert.JSONEq(t,
+		`{"data":{"ticket":"<redacted>","CSRFPreventionToken":"<redacted>","username":"root@pam","cap":[{"password":"<redacted>"}]}}`,
+		logging.RedactJSON([]byte(`{"data":{"ticket":"PVE:root@pam:1234","CSRFPreventionToken":"1234:abcd","username":"root@pam","cap":[{"password":"hunter2"}]}}`)),
+	)
+
+	assert.Equal(t, logging.Redacted, logging.RedactJSON([]byte(`password=hunter2`)))
+}
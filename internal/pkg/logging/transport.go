@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Transport logs the Proxmox API requests and the responses with the bodies at the debug level, the secrets are redacted.
+// The headers are not logged, as they carry the API token or the auth ticket.
+//
+// If base is nil, http.DefaultTransport is used.
+func Transport(logger *zap.Logger, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &transport{
+		base:   base,
+		logger: logger,
+	}
+}
+
+type transport struct {
+	base   http.RoundTripper
+	logger *zap.Logger
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.logger.Core().Enabled(zap.DebugLevel) {
+		return t.base.RoundTrip(req)
+	}
+
+	fields := []zap.Field{
+		zap.String("method", req.Method),
+		zap.String("url", redactURL(req.URL)),
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close() //nolint:errcheck
+
+		if err != nil {
+			return nil, err
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		fields = append(fields, zap.String("request", redactBody(req.Header.Get("Content-Type"), body)))
+	}
+
+	start := time.Now()
+
+	resp, err := t.base.RoundTrip(req)
+
+	fields = append(fields, zap.Duration("duration", time.Since(start)))
+
+	if err != nil {
+		t.logger.Debug("Proxmox API request failed", append(fields, zap.Error(err))...)
+
+		return nil, err
+	}
+
+	fields = append(fields, zap.Int("status", resp.StatusCode))
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close() //nolint:errcheck
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	t.logger.Debug("Proxmox API request", append(fields, zap.String("response", redactBody(resp.Header.Get("Content-Type"), body)))...)
+
+	return resp, nil
+}
+
+// redactBody returns the body with the secrets redacted, the bodies other than JSON and forms are omitted, e.g. the uploaded images.
+func redactBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType) //nolint:errcheck
+
+	switch mediaType {
+	case "application/json":
+		return RedactJSON(body)
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return Redacted
+		}
+
+		return redactValues(values).Encode()
+	default:
+		return fmt.Sprintf("<%d bytes omitted>", len(body))
+	}
+}
+
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = redactValues(u.Query()).Encode()
+
+	return redacted.String()
+}
+
+func redactValues(values url.Values) url.Values {
+	for name := range values {
+		if IsSecret(name) {
+			values[name] = []string{Redacted}
+		}
+	}
+
+	return values
+}
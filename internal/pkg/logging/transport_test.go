@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package logging_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/logging"
+)
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		// the logged request body is still sent
+		assert.JSONEq(t, `{"username":"root@pam","password":"hunter2"}`, string(body))
+
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.Write([]byte(`{"data":{"ticket":"PVE:root@pam:1234","username":"root@pam"}}`)) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	core, logs := observer.New(zap.DebugLevel)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, srv.URL+"/api2/json/access/ticket?token=abcd", strings.NewReader(`{"username":"root@pam","password":"hunter2"}`))
+	require.NoError(t, err)
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Transport: logging.Transport(zap.New(core), nil)}).Do(req)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	// the logged response body is still returned
+	assert.JSONEq(t, `{"data":{"ticket":"PVE:root@pam:1234","username":"root@pam"}}`, string(body))
+
+	entries := logs.All()
+	require.Len(t, entries, 1)
+
+	fields := entries[0].ContextMap()
+
+	assert.Equal(t, http.MethodPost, fields["method"])
+	assert.Equal(t, srv.URL+"/api2/json/access/ticket?token=%3Credacted%3E", fields["url"])
+	assert.JSONEq(t, `{"username":"root@pam","password":"<redacted>"}`, fields["request"].(string))         //nolint:forcetypeassert
+	assert.JSONEq(t, `{"data":{"ticket":"<redacted>","username":"root@pam"}}`, fields["response"].(string)) //nolint:forcetypeassert
+	assert.EqualValues(t, http.StatusOK, fields["status"])
+}
+
+func TestTransportDisabled(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(`{"data":{}}`)) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	core, logs := observer.New(zap.InfoLevel)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/api2/json/version", nil)
+	require.NoError(t, err)
+
+	resp, err := (&http.Client{Transport: logging.Transport(zap.New(core), nil)}).Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	assert.Empty(t, logs.All())
+}
@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package metrics implements the Prometheus metrics of the provisioning steps and the Proxmox API calls.
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+)
+
+const namespace = "omni_infra_provider_proxmox"
+
+// The results of the provisioning steps.
+const (
+	ResultSuccess = "success"
+	ResultRetry   = "retry"
+	ResultError   = "error"
+)
+
+// The kinds of the images cached on the Proxmox storages.
+const (
+	ImageISO    = "iso"
+	ImageImport = "import"
+)
+
+// Metrics are the provider metrics.
+//
+// All methods can be called on the nil Metrics, they do nothing then.
+type Metrics struct {
+	stepDuration *prometheus.HistogramVec
+	stepRetries  *prometheus.CounterVec
+	apiDuration  *prometheus.HistogramVec
+	apiErrors    *prometheus.CounterVec
+	imageCache   *prometheus.CounterVec
+	managedVMs   *prometheus.GaugeVec
+	// vms are the nodes of the VMs managed by the provider, keyed by the machine request ID.
+	vms map[string]vmLocation
+	mu  sync.Mutex
+}
+
+type vmLocation struct {
+	cluster string
+	node    string
+}
+
+// New creates the metrics and registers them.
+func New(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "step_duration_seconds",
+			Help:      "Duration of the provisioning steps and the deprovisioning, by the step and the result: success, retry or error.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"step", "result"}),
+		stepRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "step_retries_total",
+			Help:      "Number of times the provisioning steps asked to be retried later, e.g. while waiting for the Proxmox tasks.",
+		}, []string{"step"}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "api_request_duration_seconds",
+			Help:      "Latency of the Proxmox API requests, by the cluster, the method and the endpoint.",
+			Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"cluster", "method", "endpoint"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_errors_total",
+			Help:      "Number of the failed Proxmox API requests, by the cluster, the method, the endpoint and the HTTP status code, or error if there was no response.",
+		}, []string{"cluster", "method", "endpoint", "code"}),
+		imageCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "image_cache_requests_total",
+			Help:      "Number of the lookups of the Talos images on the Proxmox storages, by the image kind (iso or import) and the result (hit or miss).",
+		}, []string{"kind", "result"}),
+		managedVMs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "managed_vms",
+			Help:      "Number of the VMs managed by the provider, by the cluster and the node.",
+		}, []string{"cluster", "node"}),
+		vms: map[string]vmLocation{},
+	}
+
+	registerer.MustRegister(m.stepDuration, m.stepRetries, m.apiDuration, m.apiErrors, m.imageCache, m.managedVMs)
+
+	return m
+}
+
+// ObserveStep records the duration and the result of the provisioning step.
+func (m *Metrics) ObserveStep(step string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	result := ResultSuccess
+
+	var retryErr *provision.RetryError
+
+	switch {
+	case errors.As(err, &retryErr):
+		result = ResultRetry
+
+		m.stepRetries.WithLabelValues(step).Inc()
+	case err != nil:
+		result = ResultError
+	}
+
+	m.stepDuration.WithLabelValues(step, result).Observe(duration.Seconds())
+}
+
+// ObserveImageCache records whether the image was already downloaded to the storage.
+func (m *Metrics) ObserveImageCache(kind string, hit bool) {
+	if m == nil {
+		return
+	}
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	m.imageCache.WithLabelValues(kind, result).Inc()
+}
+
+// TrackVM records the node of the VM of the machine request.
+func (m *Metrics) TrackVM(requestID, cluster, node string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	location := vmLocation{cluster: cluster, node: node}
+
+	previous, ok := m.vms[requestID]
+	if ok && previous == location {
+		return
+	}
+
+	if ok {
+		m.managedVMs.WithLabelValues(previous.cluster, previous.node).Dec()
+	}
+
+	m.vms[requestID] = location
+	m.managedVMs.WithLabelValues(cluster, node).Inc()
+}
+
+// ForgetVM removes the VM of the machine request, e.g. when it's deprovisioned.
+func (m *Metrics) ForgetVM(requestID string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	location, ok := m.vms[requestID]
+	if !ok {
+		return
+	}
+
+	delete(m.vms, requestID)
+	m.managedVMs.WithLabelValues(location.cluster, location.node).Dec()
+}
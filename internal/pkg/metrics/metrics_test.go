@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package metrics_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/metrics"
+)
+
+func TestObserveStep(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+
+	m.ObserveStep("uploadISO", time.Second, provision.NewRetryInterval(time.Second))
+	m.ObserveStep("uploadISO", time.Second, provision.NewRetryInterval(time.Second))
+	m.ObserveStep("uploadISO", time.Second, nil)
+	m.ObserveStep("syncVM", time.Second, errors.New("failed"))
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP omni_infra_provider_proxmox_step_retries_total Number of times the provisioning steps asked to be retried later, e.g. while waiting for the Proxmox tasks.
+# TYPE omni_infra_provider_proxmox_step_retries_total counter
+omni_infra_provider_proxmox_step_retries_total{step="uploadISO"} 2
+`), "omni_infra_provider_proxmox_step_retries_total"))
+
+	// uploadISO retry and success, syncVM error
+	count, err := testutil.GatherAndCount(registry, "omni_infra_provider_proxmox_step_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestObserveImageCache(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+
+	m.ObserveImageCache(metrics.ImageISO, false)
+	m.ObserveImageCache(metrics.ImageISO, true)
+	m.ObserveImageCache(metrics.ImageISO, true)
+	m.ObserveImageCache(metrics.ImageImport, false)
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP omni_infra_provider_proxmox_image_cache_requests_total Number of the lookups of the Talos images on the Proxmox storages, by the image kind (iso or import) and the result (hit or miss).
+# TYPE omni_infra_provider_proxmox_image_cache_requests_total counter
+omni_infra_provider_proxmox_image_cache_requests_total{kind="import",result="miss"} 1
+omni_infra_provider_proxmox_image_cache_requests_total{kind="iso",result="hit"} 2
+omni_infra_provider_proxmox_image_cache_requests_total{kind="iso",result="miss"} 1
+`), "omni_infra_provider_proxmox_image_cache_requests_total"))
+}
+
+func TestTrackVM(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+
+	m.TrackVM("machine-1", "default", "pve1")
+	m.TrackVM("machine-1", "default", "pve1")
+	m.TrackVM("machine-2", "default", "pve1")
+	m.TrackVM("machine-3", "lab", "pve1")
+
+	// the VM is moved to the other node
+	m.TrackVM("machine-2", "default", "pve2")
+
+	m.ForgetVM("machine-3")
+	m.ForgetVM("machine-4")
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP omni_infra_provider_proxmox_managed_vms Number of the VMs managed by the provider, by the cluster and the node.
+# TYPE omni_infra_provider_proxmox_managed_vms gauge
+omni_infra_provider_proxmox_managed_vms{cluster="default",node="pve1"} 1
+omni_infra_provider_proxmox_managed_vms{cluster="default",node="pve2"} 1
+omni_infra_provider_proxmox_managed_vms{cluster="lab",node="pve1"} 0
+`), "omni_infra_provider_proxmox_managed_vms"))
+}
+
+func TestNilMetrics(t *testing.T) {
+	t.Parallel()
+
+	var m *metrics.Metrics
+
+	m.ObserveStep("syncVM", time.Second, nil)
+	m.ObserveImageCache(metrics.ImageISO, true)
+	m.TrackVM("machine-1", "default", "pve1")
+	m.ForgetVM("machine-1")
+
+	assert.Nil(t, m.Transport("default", nil))
+}
@@ -0,0 +1,99 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// identifiers are the path segments followed by the name or the ID of the object,
+// they are replaced in the endpoint label to keep its cardinality low.
+var identifiers = map[string]string{
+	"nodes":     "{node}",
+	"qemu":      "{vmid}",
+	"lxc":       "{vmid}",
+	"tasks":     "{upid}",
+	"storage":   "{storage}",
+	"resources": "{sid}",
+	"groups":    "{group}",
+	"pci":       "{mapping}",
+	"zones":     "{zone}",
+	"vnets":     "{vnet}",
+	"subnets":   "{subnet}",
+	"rules":     "{pos}",
+	"ipset":     "{ipset}",
+}
+
+// Endpoint returns the Proxmox API path with the names and the IDs replaced by the placeholders,
+// e.g. /nodes/{node}/qemu/{vmid}/status/current.
+func Endpoint(path string) string {
+	if _, rest, ok := strings.Cut(path, "/api2/json"); ok {
+		path = rest
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for i := 0; i < len(segments); i++ {
+		// the volume ID might contain the slashes
+		if segments[i] == "content" && i+1 < len(segments) {
+			segments = append(segments[:i+1], "{volume}")
+
+			break
+		}
+
+		if placeholder, ok := identifiers[segments[i]]; ok && i+1 < len(segments) {
+			segments[i+1] = placeholder
+			i++
+		}
+	}
+
+	return "/" + strings.Join(segments, "/")
+}
+
+// Transport returns the http.RoundTripper recording the latency and the errors of the Proxmox API requests of the cluster.
+// The base transport is returned as is if the metrics are nil, the default transport is used if the base is nil.
+func (m *Metrics) Transport(cluster string, base http.RoundTripper) http.RoundTripper {
+	if m == nil {
+		return base
+	}
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &transport{
+		base:    base,
+		metrics: m,
+		cluster: cluster,
+	}
+}
+
+type transport struct {
+	base    http.RoundTripper
+	metrics *Metrics
+	cluster string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := Endpoint(req.URL.Path)
+	start := time.Now()
+
+	resp, err := t.base.RoundTrip(req)
+
+	t.metrics.apiDuration.WithLabelValues(t.cluster, req.Method, endpoint).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil:
+		t.metrics.apiErrors.WithLabelValues(t.cluster, req.Method, endpoint, "error").Inc()
+	case resp.StatusCode >= http.StatusBadRequest:
+		t.metrics.apiErrors.WithLabelValues(t.cluster, req.Method, endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	}
+
+	return resp, err
+}
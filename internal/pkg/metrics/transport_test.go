@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/metrics"
+)
+
+func TestEndpoint(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		path     string
+		expected string
+	}{
+		{path: "/api2/json/version", expected: "/version"},
+		{path: "/api2/json/nodes", expected: "/nodes"},
+		{path: "/api2/json/nodes/pve1/qemu/100/status/current", expected: "/nodes/{node}/qemu/{vmid}/status/current"},
+		{path: "/api2/json/nodes/pve1/tasks/UPID:pve1:0000:download:/status", expected: "/nodes/{node}/tasks/{upid}/status"},
+		{path: "/api2/json/nodes/pve1/storage/local/content/local:import/image.qcow2", expected: "/nodes/{node}/storage/{storage}/content/{volume}"},
+		{path: "/api2/json/nodes/pve1/storage/local/download-url", expected: "/nodes/{node}/storage/{storage}/download-url"},
+		{path: "/api2/json/cluster/ha/resources/vm:100", expected: "/cluster/ha/resources/{sid}"},
+		{path: "/api2/json/cluster/nextid", expected: "/cluster/nextid"},
+		{path: "/api2/json/cluster/sdn/vnets/omni1/subnets", expected: "/cluster/sdn/vnets/{vnet}/subnets"},
+		{path: "/api2/json/cluster/sdn/vnets/omni1/subnets/omni-10.8.0.0-24", expected: "/cluster/sdn/vnets/{vnet}/subnets/{subnet}"},
+		{path: "/pve/api2/json/cluster/sdn/zones/omni", expected: "/cluster/sdn/zones/{zone}"},
+	} {
+		assert.Equal(t, test.expected, metrics.Endpoint(test.path), test.path)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/status/current") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	registry := prometheus.NewRegistry()
+	client := &http.Client{Transport: metrics.New(registry).Transport("lab", nil)}
+
+	for _, path := range []string{"/api2/json/nodes/pve1/qemu/100/config", "/api2/json/nodes/pve2/qemu/101/config", "/api2/json/nodes/pve1/qemu/100/status/current"} {
+		resp, err := client.Get(srv.URL + path) //nolint:noctx
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	srv.Close()
+
+	_, err := client.Get(srv.URL + "/api2/json/version") //nolint:noctx,bodyclose
+	require.Error(t, err)
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP omni_infra_provider_proxmox_api_errors_total Number of the failed Proxmox API requests, by the cluster, the method, the endpoint and the HTTP status code, or error if there was no response.
+# TYPE omni_infra_provider_proxmox_api_errors_total counter
+omni_infra_provider_proxmox_api_errors_total{cluster="lab",code="500",endpoint="/nodes/{node}/qemu/{vmid}/status/current",method="GET"} 1
+omni_infra_provider_proxmox_api_errors_total{cluster="lab",code="error",endpoint="/version",method="GET"} 1
+`), "omni_infra_provider_proxmox_api_errors_total"))
+
+	count, err := testutil.GatherAndCount(registry, "omni_infra_provider_proxmox_api_request_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
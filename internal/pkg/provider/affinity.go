@@ -0,0 +1,167 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+)
+
+const (
+	affinityHard = "hard"
+	affinitySoft = "soft"
+
+	// topologyKeyCluster is the topology key making each Proxmox cluster a topology domain.
+	topologyKeyCluster = "cluster"
+
+	// controlPlanesSetSuffix is the suffix of the machine request set ID Omni creates for the cluster control planes.
+	controlPlanesSetSuffix = "-control-planes"
+)
+
+// isControlPlane checks if the machine is requested for the control plane machine set of an Omni cluster.
+func isControlPlane(machineRequest *infra.MachineRequest) bool {
+	if _, ok := machineRequest.Metadata().Labels().Get(omni.LabelControlPlaneRole); ok {
+		return true
+	}
+
+	machineRequestSet, ok := machineRequest.Metadata().Labels().Get(omni.LabelMachineRequestSet)
+
+	return ok && strings.HasSuffix(machineRequestSet, controlPlanesSetSuffix)
+}
+
+// controlPlaneGroup returns the group of the control plane machines spread by the anti-affinity: the Omni cluster, or the machine request set
+// if the cluster is not known. It's empty for the workers.
+func controlPlaneGroup(machineRequest *infra.MachineRequest) string {
+	if !isControlPlane(machineRequest) {
+		return ""
+	}
+
+	machineRequestSet, _ := machineRequest.Metadata().Labels().Get(omni.LabelMachineRequestSet)
+
+	return cmp.Or(omniClusterName(machineRequest), machineRequestSet)
+}
+
+func validateAffinity(affinity Affinity) error {
+	for name, value := range map[string]string{
+		"control_plane_anti_affinity": affinity.ControlPlaneAntiAffinity,
+		"storage_node_affinity":       affinity.StorageNodeAffinity,
+	} {
+		if value != "" && value != affinityHard && value != affinitySoft {
+			return fmt.Errorf("invalid %s %q: should be either %q or %q", name, value, affinityHard, affinitySoft)
+		}
+	}
+
+	return nil
+}
+
+// topologyDomain returns the node tag "<key>=<value>" defining the node topology domain, the "cluster" key makes each Proxmox cluster a domain.
+// The node is its own domain if the key is not set or the node doesn't have the tag.
+func (ns nodeStatus) topologyDomain(key string) string {
+	switch key {
+	case "":
+	case topologyKeyCluster:
+		return topologyKeyCluster + "=" + cmp.Or(ns.Cluster, DefaultCluster)
+	default:
+		for _, tag := range ns.Tags {
+			if strings.HasPrefix(tag, key+"=") {
+				return tag
+			}
+		}
+	}
+
+	return "node=" + ns.qualifiedName()
+}
+
+// applyAffinity drops the candidates violating the hard affinity rules and narrows down the candidates to the preferred ones for the soft rules.
+// All nodes are used to find the topology domains of the existing machines, as they might run on the nodes which are not candidates.
+func applyAffinity(candidates, all []nodeStatus, affinity Affinity, controlPlane bool) ([]nodeStatus, []NodeRejection) {
+	var rejected []NodeRejection
+
+	domains := map[string]int{}
+
+	for _, node := range all {
+		domains[node.topologyDomain(affinity.TopologyKey)] += node.ClusterControlPlaneVMs
+	}
+
+	if controlPlane && affinity.ControlPlaneAntiAffinity != "" {
+		switch affinity.ControlPlaneAntiAffinity {
+		case affinityHard:
+			candidates = slices.DeleteFunc(candidates, func(node nodeStatus) bool {
+				domain := node.topologyDomain(affinity.TopologyKey)
+
+				if domains[domain] > 0 {
+					rejected = append(rejected, NodeRejection{
+						Node:   node.qualifiedName(),
+						Reason: fmt.Sprintf("control plane anti-affinity: %s already runs %d control plane machine(s) of the cluster", domain, domains[domain]),
+					})
+
+					return true
+				}
+
+				return false
+			})
+		case affinitySoft:
+			candidates = preferNodes(candidates, func(node nodeStatus) int {
+				return domains[node.topologyDomain(affinity.TopologyKey)]
+			})
+		}
+	}
+
+	if affinity.StorageNode != "" {
+		storageDomain := "node=" + affinity.StorageNode
+
+		if index := slices.IndexFunc(all, func(node nodeStatus) bool { return node.qualifiedName() == affinity.StorageNode }); index != -1 {
+			storageDomain = all[index].topologyDomain(affinity.TopologyKey)
+		}
+
+		distance := func(node nodeStatus) int {
+			if node.topologyDomain(affinity.TopologyKey) == storageDomain {
+				return 0
+			}
+
+			return 1
+		}
+
+		switch affinity.StorageNodeAffinity {
+		case affinitySoft:
+			candidates = preferNodes(candidates, distance)
+		default:
+			candidates = slices.DeleteFunc(candidates, func(node nodeStatus) bool {
+				if distance(node) != 0 {
+					rejected = append(rejected, NodeRejection{
+						Node:   node.qualifiedName(),
+						Reason: fmt.Sprintf("storage node affinity: not in the same topology domain as %s (%s)", affinity.StorageNode, storageDomain),
+					})
+
+					return true
+				}
+
+				return false
+			})
+		}
+	}
+
+	return candidates, rejected
+}
+
+// preferNodes keeps only the nodes with the lowest penalty.
+func preferNodes(nodes []nodeStatus, penalty func(nodeStatus) int) []nodeStatus {
+	if len(nodes) == 0 {
+		return nodes
+	}
+
+	lowest := penalty(slices.MinFunc(nodes, func(a, b nodeStatus) int {
+		return penalty(a) - penalty(b)
+	}))
+
+	return slices.DeleteFunc(nodes, func(node nodeStatus) bool {
+		return penalty(node) > lowest
+	})
+}
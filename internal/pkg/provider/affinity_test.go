@@ -0,0 +1,218 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+func TestApplyAffinity(t *testing.T) {
+	t.Parallel()
+
+	nodes := []provider.NodeStatus{
+		{Name: "pve1", Tags: []string{"rack=r1"}, ClusterControlPlaneVMs: 1},
+		{Name: "pve2", Tags: []string{"rack=r1"}},
+		{Name: "pve3", Tags: []string{"rack=r2"}},
+		{Name: "pve4"},
+	}
+
+	names := func(nodes []provider.NodeStatus) []string {
+		result := make([]string, 0, len(nodes))
+
+		for _, node := range nodes {
+			result = append(result, node.Name)
+		}
+
+		return result
+	}
+
+	for _, test := range []struct {
+		affinity     provider.Affinity
+		name         string
+		expected     []string
+		rejected     []provider.NodeRejection
+		controlPlane bool
+	}{
+		{
+			name:         "no rules",
+			controlPlane: true,
+			expected:     []string{"pve1", "pve2", "pve3", "pve4"},
+		},
+		{
+			name:         "hard anti-affinity per node",
+			affinity:     provider.Affinity{ControlPlaneAntiAffinity: "hard"},
+			controlPlane: true,
+			expected:     []string{"pve2", "pve3", "pve4"},
+			rejected: []provider.NodeRejection{
+				{Node: "pve1", Reason: "control plane anti-affinity: node=pve1 already runs 1 control plane machine(s) of the cluster"},
+			},
+		},
+		{
+			name:         "hard anti-affinity per rack",
+			affinity:     provider.Affinity{ControlPlaneAntiAffinity: "hard", TopologyKey: "rack"},
+			controlPlane: true,
+			expected:     []string{"pve3", "pve4"},
+			rejected: []provider.NodeRejection{
+				{Node: "pve1", Reason: "control plane anti-affinity: rack=r1 already runs 1 control plane machine(s) of the cluster"},
+				{Node: "pve2", Reason: "control plane anti-affinity: rack=r1 already runs 1 control plane machine(s) of the cluster"},
+			},
+		},
+		{
+			name:         "soft anti-affinity per rack",
+			affinity:     provider.Affinity{ControlPlaneAntiAffinity: "soft", TopologyKey: "rack"},
+			controlPlane: true,
+			expected:     []string{"pve3", "pve4"},
+		},
+		{
+			name:     "anti-affinity ignored for workers",
+			affinity: provider.Affinity{ControlPlaneAntiAffinity: "hard"},
+			expected: []string{"pve1", "pve2", "pve3", "pve4"},
+		},
+		{
+			name:     "hard storage node affinity",
+			affinity: provider.Affinity{StorageNode: "pve2", TopologyKey: "rack"},
+			expected: []string{"pve1", "pve2"},
+			rejected: []provider.NodeRejection{
+				{Node: "pve3", Reason: "storage node affinity: not in the same topology domain as pve2 (rack=r1)"},
+				{Node: "pve4", Reason: "storage node affinity: not in the same topology domain as pve2 (rack=r1)"},
+			},
+		},
+		{
+			name:     "soft storage node affinity",
+			affinity: provider.Affinity{StorageNode: "pve3", StorageNodeAffinity: "soft"},
+			expected: []string{"pve3"},
+		},
+		{
+			name:         "combined rules",
+			affinity:     provider.Affinity{ControlPlaneAntiAffinity: "hard", StorageNode: "pve1", StorageNodeAffinity: "soft", TopologyKey: "rack"},
+			controlPlane: true,
+			expected:     []string{"pve3", "pve4"},
+			rejected: []provider.NodeRejection{
+				{Node: "pve1", Reason: "control plane anti-affinity: rack=r1 already runs 1 control plane machine(s) of the cluster"},
+				{Node: "pve2", Reason: "control plane anti-affinity: rack=r1 already runs 1 control plane machine(s) of the cluster"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			candidates, rejected := provider.ApplyAffinity(append([]provider.NodeStatus(nil), nodes...), nodes, test.affinity, test.controlPlane)
+
+			assert.Equal(t, test.expected, names(candidates))
+			assert.Equal(t, test.rejected, rejected)
+		})
+	}
+}
+
+func TestProvisionControlPlaneAntiAffinity(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := fakeproxmox.NewServer()
+
+	t.Cleanup(srv.Close)
+
+	for node, rack := range map[string]string{"pve1": "r1", "pve2": "r1", "pve3": "r2"} {
+		srv.AddNode(fakeproxmox.Node{Name: node, CPUs: 16, MaxMemory: 64 * gib, Memory: 8 * gib, Description: "tags: rack=" + rack})
+		srv.AddStorage(node, fakeproxmox.Storage{Name: "local", Content: []string{"iso"}, Total: 100 * gib})
+		srv.AddStorage(node, fakeproxmox.Storage{Name: "local-lvm", Type: "lvmthin", Content: []string{"images"}, Total: 1024 * gib})
+	}
+
+	p := provider.NewProvisioner(srv.Client())
+
+	const data = baseMachineClass + `affinity:
+  topology_key: rack
+  control_plane_anti_affinity: hard
+`
+
+	labels := map[string]string{
+		omni.LabelMachineRequestSet: "talos-default-control-planes",
+	}
+
+	pickNode := p.ProvisionSteps()[0]
+	require.Equal(t, "pickNode", pickNode.Name())
+
+	// the node picked for the first machine is taken into account before its VM is created
+	first := newProvisionContext("cp-1", data, labels)
+	require.NoError(t, pickNode.Run(ctx, zaptest.NewLogger(t), first))
+
+	second := newProvisionContext("cp-2", data, labels)
+	require.NoError(t, runSteps(ctx, t, p, second))
+
+	racks := map[string]string{"pve1": "r1", "pve2": "r1", "pve3": "r2"}
+
+	assert.NotEqual(t, racks[first.State.TypedSpec().Value.Node], racks[second.State.TypedSpec().Value.Node])
+
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	// both racks run a control plane machine already
+	third := newProvisionContext("cp-3", data, labels)
+	require.ErrorContains(t, runSteps(ctx, t, p, third), "control plane anti-affinity: rack=r1 already runs 1 control plane machine(s) of the cluster")
+
+	// the workers are not affected
+	worker := newProvisionContext("worker-1", data, map[string]string{
+		omni.LabelMachineRequestSet: "talos-default-workers",
+	})
+	require.NoError(t, runSteps(ctx, t, p, worker))
+
+	// the machine slot is freed once the machine is deprovisioned
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), first.State, first.MachineRequest))
+
+	require.NoError(t, runSteps(ctx, t, p, third))
+	assert.Equal(t, racks[first.State.TypedSpec().Value.Node], racks[third.State.TypedSpec().Value.Node])
+}
+
+func TestProvisionControlPlaneAntiAffinityCluster(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+	p := provider.NewProvisioner(srv.Client())
+
+	const data = baseMachineClass + `affinity:
+  control_plane_anti_affinity: hard
+`
+
+	controlPlane := func(id, cluster, machineRequestSet string) provision.Context[*resources.Machine] {
+		return newProvisionContext(id, data, map[string]string{
+			omni.LabelCluster:           cluster,
+			omni.LabelControlPlaneRole:  "",
+			omni.LabelMachineRequestSet: machineRequestSet,
+		})
+	}
+
+	// the control planes of a cluster are spread even if they are requested by different machine request sets
+	first := controlPlane("cp-1", "talos-a", "pool-a")
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	second := controlPlane("cp-2", "talos-a", "pool-b")
+	require.NoError(t, runSteps(ctx, t, p, second))
+
+	assert.NotEqual(t, first.State.TypedSpec().Value.Node, second.State.TypedSpec().Value.Node)
+	vm, ok := srv.VM(first.State.TypedSpec().Value.Node, int(first.State.TypedSpec().Value.Vmid))
+	require.True(t, ok)
+	assert.Contains(t, vm.Tags(), "omni-control-plane.talos-a")
+
+	require.ErrorContains(t, runSteps(ctx, t, p, controlPlane("cp-3", "talos-a", "pool-a")), "already runs 1 control plane machine(s) of the cluster")
+
+	// the control planes of the other clusters are not counted
+	require.NoError(t, runSteps(ctx, t, p, controlPlane("cp-4", "talos-b", "pool-a")))
+}
@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/luthermonson/go-proxmox"
+)
+
+const (
+	mib = 1024 * 1024
+	gib = 1024 * mib
+)
+
+// overcommit limits the resources allocated to the VMs on a node relative to the node capacity, zero ratio disables the limit.
+type overcommit struct {
+	cpu    float64
+	memory float64
+}
+
+// resourceDemand is the amount of the node resources required by the machine.
+type resourceDemand struct {
+	// Memory is the VM memory in bytes.
+	Memory uint64
+	// Disk is the total size of all VM disks in bytes.
+	Disk uint64
+	CPUs int
+}
+
+func newResourceDemand(data Data) resourceDemand {
+	demand := resourceDemand{
+		Memory: data.Memory * mib,
+		Disk:   uint64(max(data.DiskSize, 0)) * gib,
+		CPUs:   data.Cores * max(data.Sockets, 1),
+	}
+
+	for _, disk := range data.AdditionalDisks {
+		demand.Disk += uint64(max(disk.DiskSize, 0)) * gib
+	}
+
+	return demand
+}
+
+func (d resourceDemand) String() string {
+	return fmt.Sprintf("%d CPUs, %d MiB of memory and %d GiB of disk", d.CPUs, d.Memory/mib, d.Disk/gib)
+}
+
+// NodeRejection is the reason why the node can't run the machine.
+type NodeRejection struct {
+	Node   string
+	Reason string
+}
+
+// CapacityError is returned when none of the Proxmox nodes can run the machine.
+type CapacityError struct {
+	Rejected []NodeRejection
+	Demand   resourceDemand
+}
+
+// Error implements error.
+func (e *CapacityError) Error() string {
+	reasons := make([]string, 0, len(e.Rejected))
+
+	for _, rejection := range e.Rejected {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", rejection.Node, rejection.Reason))
+	}
+
+	return fmt.Sprintf("no nodes match the placement requirements for %s: %s", e.Demand, strings.Join(reasons, "; "))
+}
+
+// checkCapacity returns the reason why the machine doesn't fit into the node, empty if it fits.
+func checkCapacity(node nodeStatus, demand resourceDemand, overcommit overcommit) string {
+	switch {
+	case node.FreeMemory < demand.Memory:
+		return fmt.Sprintf("not enough free memory: %d MiB required, %d MiB available", demand.Memory/mib, node.FreeMemory/mib)
+	case node.CPUs < demand.CPUs:
+		return fmt.Sprintf("not enough CPUs: %d required, %d available", demand.CPUs, node.CPUs)
+	case overcommit.memory > 0 && float64(node.AllocatedMemory+demand.Memory) > float64(node.MaxMemory)*overcommit.memory:
+		return fmt.Sprintf("memory overcommit limit reached: %d MiB allocated, %d MiB required, %.0f MiB allowed",
+			node.AllocatedMemory/mib, demand.Memory/mib, float64(node.MaxMemory)*overcommit.memory/mib)
+	case overcommit.cpu > 0 && float64(node.AllocatedCPUs+demand.CPUs) > float64(node.CPUs)*overcommit.cpu:
+		return fmt.Sprintf("CPU overcommit limit reached: %d CPUs allocated, %d required, %.0f allowed",
+			node.AllocatedCPUs, demand.CPUs, float64(node.CPUs)*overcommit.cpu)
+	case node.StorageShortage != "":
+		return node.StorageShortage
+	}
+
+	return ""
+}
+
+// diskPlan is the storages picked for the machine disks.
+type diskPlan struct {
+	Primary    string
+	Additional []string
+}
+
+// planDisks picks the storages for the primary and the additional disks making sure that all disks fit into the available space.
+// Each disk goes to the first storage matching its selector which still has enough space after placing the previous disks.
+func (p *Provisioner) planDisks(ctx context.Context, node *proxmox.Node, data Data) (diskPlan, error) {
+	storages, err := node.Storages(ctx)
+	if err != nil {
+		return diskPlan{}, err
+	}
+
+	available := map[string]uint64{}
+
+	for _, storage := range storages {
+		available[storage.Name] = storage.Avail
+	}
+
+	pick := func(selector string, sizeGiB int) (string, error) {
+		matches, err := diskStorages(node, storages, selector)
+		if err != nil {
+			return "", err
+		}
+
+		if len(matches) == 0 {
+			if selector == "" {
+				return "", errors.New("failed to pick the disk: no storages accept the images content")
+			}
+
+			return "", fmt.Errorf("failed to pick the disk: no matches for the condition %q", selector)
+		}
+
+		size := uint64(max(sizeGiB, 0)) * gib
+
+		index := slices.IndexFunc(matches, func(storage *proxmox.Storage) bool {
+			return available[storage.Name] >= size
+		})
+
+		if index == -1 {
+			if selector == "" {
+				return "", fmt.Errorf("not enough storage space: %d GiB required, no storage accepting the images content has enough space", sizeGiB)
+			}
+
+			return "", fmt.Errorf("not enough storage space: %d GiB required, no storage matching %q has enough space", sizeGiB, selector)
+		}
+
+		available[matches[index].Name] -= size
+
+		return matches[index].Name, nil
+	}
+
+	var plan diskPlan
+
+	if plan.Primary, err = pick(data.StorageSelector, data.DiskSize); err != nil {
+		return diskPlan{}, err
+	}
+
+	for i, disk := range data.AdditionalDisks {
+		storage, err := pick(disk.StorageSelector, disk.DiskSize)
+		if err != nil {
+			return diskPlan{}, fmt.Errorf("failed to pick storage for additional disk %d: %w", i+1, err)
+		}
+
+		plan.Additional = append(plan.Additional, storage)
+	}
+
+	return plan, nil
+}
+
+// diskStorages returns the storages matching the disk storage selector, the storages accepting the images content if the selector is not set.
+func diskStorages(node *proxmox.Node, storages proxmox.Storages, selector string) ([]*proxmox.Storage, error) {
+	if selector != "" {
+		return matchStorages(node, storages, selector)
+	}
+
+	var matches []*proxmox.Storage
+
+	for _, storage := range storages {
+		if slices.Contains(strings.Split(storage.Content, ","), "images") {
+			matches = append(matches, storage)
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,123 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/google/cel-go/cel"
+	"github.com/luthermonson/go-proxmox"
+	siderocel "github.com/siderolabs/talos/pkg/machinery/cel"
+)
+
+// DefaultCluster is the name of the Proxmox cluster of the client passed to NewProvisioner.
+// The machines created before the clusters were introduced are in the default cluster.
+const DefaultCluster = "default"
+
+// proxmoxCluster is one of the Proxmox clusters managed by the provisioner.
+type proxmoxCluster struct {
+	client *proxmox.Client
+	labels map[string]string
+}
+
+// WithCluster adds the Proxmox cluster managed by the provisioner.
+// The labels are matched by the cluster_selector of the machine class.
+func WithCluster(name string, client *proxmox.Client, labels map[string]string) Option {
+	return func(p *Provisioner) {
+		p.clusters[name] = proxmoxCluster{
+			client: client,
+			labels: labels,
+		}
+	}
+}
+
+// client returns the client of the Proxmox cluster by its name.
+func (p *Provisioner) client(cluster string) (*proxmox.Client, error) {
+	clusters, _ := p.snapshot()
+
+	c, ok := clusters[cmp.Or(cluster, DefaultCluster)]
+	if !ok {
+		return nil, fmt.Errorf("unknown Proxmox cluster %q", cluster)
+	}
+
+	return c.client, nil
+}
+
+// selectClusters returns the names of the clusters the machine can be placed in, all clusters are used if neither cluster nor cluster_selector is set.
+func (p *Provisioner) selectClusters(data Data) ([]string, error) {
+	clusters, _ := p.snapshot()
+	names := slices.Sorted(maps.Keys(clusters))
+
+	switch {
+	case data.Cluster != "" && data.ClusterSelector != "":
+		return nil, errors.New("cluster and cluster_selector can't be set at the same time")
+	case data.Cluster != "":
+		if _, ok := clusters[data.Cluster]; !ok {
+			return nil, fmt.Errorf("unknown Proxmox cluster %q, should be one of %v", data.Cluster, names)
+		}
+
+		return []string{data.Cluster}, nil
+	case data.ClusterSelector != "":
+		env, err := clusterCELEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		expr, err := siderocel.ParseBooleanExpression(data.ClusterSelector, env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster selector: %w", err)
+		}
+
+		var selected []string
+
+		for _, name := range names {
+			labels := clusters[name].labels
+			if labels == nil {
+				labels = map[string]string{}
+			}
+
+			matched, err := expr.EvalBool(env, map[string]any{
+				"name":   name,
+				"labels": labels,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate the cluster selector for cluster %q: %w", name, err)
+			}
+
+			if matched {
+				selected = append(selected, name)
+			}
+		}
+
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("no Proxmox clusters match the cluster selector, available clusters: %v", names)
+		}
+
+		return selected, nil
+	}
+
+	return names, nil
+}
+
+// clusterCELEnv creates the CEL environment for the cluster selector.
+func clusterCELEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("name", cel.StringType),
+		cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+	)
+}
+
+// qualifiedName is the node name prefixed with the cluster name, the nodes of the default cluster are referred by their names.
+func (ns nodeStatus) qualifiedName() string {
+	if ns.Cluster == "" || ns.Cluster == DefaultCluster {
+		return ns.Name
+	}
+
+	return ns.Cluster + "/" + ns.Name
+}
@@ -0,0 +1,164 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestProvisionMultipleClusters(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	siteA := newFakeProxmox(t, "pve1")
+	siteB := newFakeProxmox(t, "pve1", "pve2")
+
+	// the cluster which is down
+	lab := newFakeProxmox(t, "pve1")
+	lab.Close()
+
+	p := provider.NewProvisioner(nil,
+		provider.WithCluster("site-a", siteA.Client(), map[string]string{"site": "a"}),
+		provider.WithCluster("site-b", siteB.Client(), map[string]string{"site": "b"}),
+		provider.WithCluster("lab", lab.Client(), nil),
+	)
+
+	first := newProvisionContext("machine-1", baseMachineClass+"cluster: site-b\nnode: pve2\n", nil)
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	spec := first.State.TypedSpec().Value
+
+	assert.Equal(t, "site-b", spec.Cluster)
+	assert.Equal(t, "pve2", spec.Node)
+	assert.Len(t, siteB.VMs("pve2"), 1)
+
+	pctx := newProvisionContext("machine-2", baseMachineClass+`cluster_selector: has(labels.site) && labels.site == "a"`+"\n", nil)
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Equal(t, "site-a", pctx.State.TypedSpec().Value.Cluster)
+	assert.Len(t, siteA.VMs("pve1"), 1)
+
+	// the VMIDs are allocated by each cluster on its own
+	assert.Equal(t, spec.Vmid, pctx.State.TypedSpec().Value.Vmid)
+
+	// the node outside of the default cluster is referred with the cluster name if the node name is not unique
+	pctx = newProvisionContext("machine-3", baseMachineClass+"node: pve1\n", nil)
+	require.ErrorContains(t, runSteps(ctx, t, p, pctx), `specified node "pve1" is found in multiple clusters`)
+
+	pctx = newProvisionContext("machine-3", baseMachineClass+"node: site-b/pve1\n", nil)
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Equal(t, "site-b", pctx.State.TypedSpec().Value.Cluster)
+	assert.Equal(t, "pve1", pctx.State.TypedSpec().Value.Node)
+
+	// the nodes of the available clusters are scored together, the cluster which is down is skipped
+	pctx = newProvisionContext("machine-4", baseMachineClass+`node_selector: cluster == "site-b" && name == "pve2"`+"\n", nil)
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Equal(t, "site-b", pctx.State.TypedSpec().Value.Cluster)
+	assert.Equal(t, "pve2", pctx.State.TypedSpec().Value.Node)
+
+	pctx = newProvisionContext("machine-5", baseMachineClass+"cluster: lab\n", nil)
+	require.ErrorContains(t, runSteps(ctx, t, p, pctx), "connection refused")
+
+	pctx = newProvisionContext("machine-5", baseMachineClass+"cluster: dc\n", nil)
+	require.ErrorContains(t, runSteps(ctx, t, p, pctx), `unknown Proxmox cluster "dc", should be one of [lab site-a site-b]`)
+
+	pctx = newProvisionContext("machine-5", baseMachineClass+`cluster_selector: name.startsWith("dc-")`+"\n", nil)
+	require.ErrorContains(t, runSteps(ctx, t, p, pctx), "no Proxmox clusters match the cluster selector")
+
+	// the machine is deprovisioned in its cluster
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), first.State, first.MachineRequest))
+
+	assert.Len(t, siteA.VMs("pve1"), 1)
+	assert.Len(t, siteB.VMs("pve1"), 1)
+	require.Len(t, siteB.VMs("pve2"), 1)
+	assert.Equal(t, "machine-4", siteB.VMs("pve2")[0].Name())
+}
+
+func TestProvisionClusterAntiAffinity(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	siteA := newFakeProxmox(t, "pve1", "pve2")
+	siteB := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(nil,
+		provider.WithCluster("site-a", siteA.Client(), nil),
+		provider.WithCluster("site-b", siteB.Client(), nil),
+	)
+
+	const data = baseMachineClass + `affinity:
+  topology_key: cluster
+  control_plane_anti_affinity: hard
+`
+
+	labels := map[string]string{
+		omni.LabelMachineRequestSet: "talos-default-control-planes",
+	}
+
+	first := newProvisionContext("cp-1", data, labels)
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	second := newProvisionContext("cp-2", data, labels)
+	require.NoError(t, runSteps(ctx, t, p, second))
+
+	assert.ElementsMatch(t, []string{"site-a", "site-b"}, []string{first.State.TypedSpec().Value.Cluster, second.State.TypedSpec().Value.Cluster})
+
+	third := newProvisionContext("cp-3", data, labels)
+
+	err := runSteps(ctx, t, p, third)
+	require.ErrorContains(t, err, "site-a/pve1: control plane anti-affinity: cluster=site-a already runs 1 control plane machine(s) of the cluster")
+	assert.ErrorContains(t, err, "site-b/pve1: control plane anti-affinity: cluster=site-b already runs 1 control plane machine(s) of the cluster")
+}
+
+func TestReconfigureClusters(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	siteA := newFakeProxmox(t, "pve1")
+	siteB := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(nil, provider.WithCluster("site-a", siteA.Client(), nil))
+
+	const data = baseMachineClass
+
+	first := newProvisionContext("machine-1", data, nil)
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	// the client of the cluster is replaced, e.g. after the API token rotation
+	p.Reconfigure(nil,
+		provider.WithCluster("site-a", siteA.Client(), nil),
+		provider.WithCluster("site-b", siteB.Client(), nil),
+	)
+
+	pctx := newProvisionContext("machine-2", data+"cluster: site-b\n", nil)
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Len(t, siteB.VMs("pve1"), 1)
+
+	p.Reconfigure(nil, provider.WithCluster("site-b", siteB.Client(), nil))
+
+	require.ErrorContains(t, p.Deprovision(ctx, zaptest.NewLogger(t), first.State, first.MachineRequest), `unknown Proxmox cluster "site-a"`)
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, pctx.MachineRequest))
+
+	assert.Empty(t, siteB.VMs("pve1"))
+	assert.Len(t, siteA.VMs("pve1"), 1)
+}
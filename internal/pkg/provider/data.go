@@ -6,27 +6,102 @@ package provider
 
 // Data is the provider custom machine config.
 type Data struct {
-	Balloon         *bool            `yaml:"balloon,omitempty"`
-	Node            string           `yaml:"node,omitempty"`
-	StorageSelector string           `yaml:"storage_selector,omitempty"`
-	NetworkBridge   string           `yaml:"network_bridge"`
-	Hugepages       string           `yaml:"hugepages,omitempty"`
-	MachineType     string           `yaml:"machine_type,omitempty"`
-	CPUType         string           `yaml:"cpu_type,omitempty"`
-	DiskAIO         string           `yaml:"disk_aio,omitempty"`
-	DiskCache       string           `yaml:"disk_cache,omitempty"`
-	AdditionalDisks []AdditionalDisk `yaml:"additional_disks,omitempty"`
-	AdditionalNICs  []AdditionalNIC  `yaml:"additional_nics,omitempty"`
-	PCIDevices      []PCIDevice      `yaml:"pci_devices,omitempty"`
-	Vlan            uint64           `yaml:"vlan"`
-	Memory          uint64           `yaml:"memory"`
-	Sockets         int              `yaml:"sockets"`
-	DiskSize        int              `yaml:"disk_size"`
-	Cores           int              `yaml:"cores"`
-	DiskIOThread    bool             `yaml:"disk_iothread,omitempty"`
-	NUMA            bool             `yaml:"numa,omitempty"`
-	DiskDiscard     bool             `yaml:"disk_discard,omitempty"`
-	DiskSSD         bool             `yaml:"disk_ssd,omitempty"`
+	Balloon              *bool            `yaml:"balloon,omitempty"`
+	HA                   *HA              `yaml:"ha,omitempty"`
+	Firewall             *Firewall        `yaml:"firewall,omitempty"`
+	IP                   *IPConfig        `yaml:"ip,omitempty"`
+	NetworkClusterVNet   *ClusterVNet     `yaml:"network_cluster_vnet,omitempty"`
+	Cluster              string           `yaml:"cluster,omitempty"`
+	ClusterSelector      string           `yaml:"cluster_selector,omitempty"`
+	Node                 string           `yaml:"node,omitempty"`
+	StorageSelector      string           `yaml:"storage_selector,omitempty"`
+	NodeSelector         string           `yaml:"node_selector,omitempty"`
+	NetworkBridge        string           `yaml:"network_bridge"`
+	NetworkVNet          string           `yaml:"network_vnet,omitempty"`
+	NetworkSubnet        string           `yaml:"network_subnet,omitempty"`
+	Hugepages            string           `yaml:"hugepages,omitempty"`
+	ProvisionMode        string           `yaml:"provision_mode,omitempty"`
+	PlacementStrategy    string           `yaml:"placement_strategy,omitempty"`
+	PlacementScore       string           `yaml:"placement_score,omitempty"`
+	MachineType          string           `yaml:"machine_type,omitempty"`
+	CPUType              string           `yaml:"cpu_type,omitempty"`
+	DiskAIO              string           `yaml:"disk_aio,omitempty"`
+	DiskCache            string           `yaml:"disk_cache,omitempty"`
+	Affinity             Affinity         `yaml:"affinity,omitempty"`
+	AdditionalDisks      []AdditionalDisk `yaml:"additional_disks,omitempty"`
+	AdditionalNICs       []AdditionalNIC  `yaml:"additional_nics,omitempty"`
+	PCIDevices           []PCIDevice      `yaml:"pci_devices,omitempty"`
+	NodeTags             []string         `yaml:"node_tags,omitempty"`
+	DNSServers           []string         `yaml:"dns_servers,omitempty"`
+	SearchDomains        []string         `yaml:"search_domains,omitempty"`
+	Vlan                 uint64           `yaml:"vlan"`
+	Memory               uint64           `yaml:"memory"`
+	Sockets              int              `yaml:"sockets"`
+	DiskSize             int              `yaml:"disk_size"`
+	Cores                int              `yaml:"cores"`
+	MTU                  int              `yaml:"mtu,omitempty"`
+	NetworkConfigVersion int              `yaml:"network_config_version,omitempty"`
+	DiskIOThread         bool             `yaml:"disk_iothread,omitempty"`
+	NUMA                 bool             `yaml:"numa,omitempty"`
+	DiskDiscard          bool             `yaml:"disk_discard,omitempty"`
+	DiskSSD              bool             `yaml:"disk_ssd,omitempty"`
+	FullClone            bool             `yaml:"full_clone,omitempty"`
+}
+
+// Affinity describes the VM placement rules relative to the other VMs and the Proxmox nodes.
+type Affinity struct {
+	// TopologyKey is the node tag key defining the topology domains, e.g. "rack" for the "rack=r1" node tags.
+	// Each node is its own domain if not set.
+	TopologyKey string `yaml:"topology_key,omitempty"`
+	// ControlPlaneAntiAffinity spreads the control plane machines of the same cluster across the topology domains: hard or soft.
+	ControlPlaneAntiAffinity string `yaml:"control_plane_anti_affinity,omitempty"`
+	// StorageNode is the node the VM should be co-located with, in the same topology domain.
+	StorageNode string `yaml:"storage_node,omitempty"`
+	// StorageNodeAffinity is either hard (default) or soft.
+	StorageNodeAffinity string `yaml:"storage_node_affinity,omitempty"`
+}
+
+// HA describes the Proxmox HA resource the VM is registered as.
+type HA struct {
+	// MaxRestart is the maximal number of tries to restart the VM on the same node, Proxmox default is used if not set.
+	MaxRestart *int `yaml:"max_restart,omitempty"`
+	// MaxRelocate is the maximal number of tries to relocate the VM to another node, Proxmox default is used if not set.
+	MaxRelocate *int `yaml:"max_relocate,omitempty"`
+	// Group is the HA group restricting the nodes the VM can be moved to.
+	Group string `yaml:"group,omitempty"`
+	// State is the requested HA resource state, started by default.
+	State string `yaml:"state,omitempty"`
+}
+
+// Firewall describes the Proxmox firewall of the VM.
+// The security groups and the rules are added above the VM rules created in Proxmox, they are removed with the VM.
+type Firewall struct {
+	// Enable enables the VM firewall, true by default. The rules take effect only if the datacenter firewall is enabled as well.
+	Enable *bool `yaml:"enable,omitempty"`
+	// PolicyIn is the policy of the incoming traffic: ACCEPT, DROP or REJECT, Proxmox default (DROP) is used if not set.
+	PolicyIn string `yaml:"policy_in,omitempty"`
+	// PolicyOut is the policy of the outgoing traffic: ACCEPT, DROP or REJECT, Proxmox default (ACCEPT) is used if not set.
+	PolicyOut string `yaml:"policy_out,omitempty"`
+	// SecurityGroups are the names of the datacenter security groups attached to the VM.
+	SecurityGroups []string `yaml:"security_groups,omitempty"`
+	// ControlPlaneSecurityGroups are the security groups attached only to the control plane machines.
+	ControlPlaneSecurityGroups []string `yaml:"control_plane_security_groups,omitempty"`
+	// Rules are the inline rules, applied after the security groups.
+	Rules []FirewallRule `yaml:"rules,omitempty"`
+}
+
+// FirewallRule represents a VM firewall rule.
+type FirewallRule struct {
+	Type         string `yaml:"type,omitempty"`          // in (default) or out
+	Action       string `yaml:"action"`                  // ACCEPT, DROP or REJECT
+	Proto        string `yaml:"proto,omitempty"`         // Protocol, e.g. tcp or udp, required with the ports
+	DPort        string `yaml:"dport,omitempty"`         // Destination ports, e.g. 50000 or 2379:2380
+	SPort        string `yaml:"sport,omitempty"`         // Source ports
+	Source       string `yaml:"source,omitempty"`        // Source address, CIDR, IP set or alias
+	Dest         string `yaml:"dest,omitempty"`          // Destination address, CIDR, IP set or alias
+	Iface        string `yaml:"iface,omitempty"`         // NIC the rule applies to, e.g. net0
+	Comment      string `yaml:"comment,omitempty"`       // Rule comment
+	ControlPlane bool   `yaml:"control_plane,omitempty"` // Add the rule only to the control plane machines
 }
 
 // AdditionalDisk represents an additional disk configuration.
@@ -50,7 +125,34 @@ type PCIDevice struct {
 
 // AdditionalNIC represents an additional network interface configuration.
 type AdditionalNIC struct {
-	Bridge   string `yaml:"bridge"`             // Network bridge (e.g., vmbr1)
-	Vlan     uint64 `yaml:"vlan,omitempty"`     // Optional VLAN tag
-	Firewall bool   `yaml:"firewall,omitempty"` // Enable firewall (default: false for storage networks)
+	IP          *IPConfig    `yaml:"ip,omitempty"`           // Optional static IP, DHCP is used if not set
+	ClusterVNet *ClusterVNet `yaml:"cluster_vnet,omitempty"` // SDN VNet created for the Omni cluster, instead of the bridge
+	Bridge      string       `yaml:"bridge"`                 // Network bridge (e.g., vmbr1)
+	VNet        string       `yaml:"vnet,omitempty"`         // SDN VNet, instead of the bridge
+	Subnet      string       `yaml:"subnet,omitempty"`       // Optional SDN subnet of the VNet, the static IP is allocated from it
+	Vlan        uint64       `yaml:"vlan,omitempty"`         // Optional VLAN tag
+	MTU         int          `yaml:"mtu,omitempty"`          // Optional MTU of the guest interface
+	Firewall    bool         `yaml:"firewall,omitempty"`     // Enable firewall (default: false for storage networks)
+}
+
+// ClusterVNet is the SDN VNet created for each Omni cluster, so that the clusters are isolated from each other.
+// The VNet is removed once the last VM of the cluster attached to it is removed.
+type ClusterVNet struct {
+	// Zone is the SDN zone the VNet is created in.
+	Zone string `yaml:"zone"`
+	// Tags is the range of the VLAN or VXLAN tags, e.g. 100-199, the first tag not used in the zone is picked.
+	// The tag is not needed in the simple zones.
+	Tags string `yaml:"tags,omitempty"`
+}
+
+// IPConfig is the static IP addressing of the NIC, the address is allocated from the pool or from the subnet.
+type IPConfig struct {
+	// Pool is the name of the address pool from the provider config, the cidr, the range and the gateway are taken from the pool.
+	Pool string `yaml:"pool,omitempty"`
+	// CIDR is the subnet the address is allocated from, e.g. 10.5.0.0/24.
+	CIDR string `yaml:"cidr,omitempty"`
+	// Range limits the allocated addresses to the part of the subnet, e.g. 10.5.0.100-10.5.0.200.
+	Range string `yaml:"range,omitempty"`
+	// Gateway is the default gateway, it is never allocated to the VMs.
+	Gateway string `yaml:"gateway,omitempty"`
 }
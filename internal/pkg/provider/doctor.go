@@ -0,0 +1,416 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/luthermonson/go-proxmox"
+)
+
+// NodeReport is the result of the checks of the Proxmox node prerequisites for provisioning the VMs.
+type NodeReport struct {
+	Cluster string
+	Node    string
+	// Permissions are the privileges needed by the provision steps, and whether the API user has them.
+	Permissions []PermissionCheck
+	// ISOStorages are the storages with the iso content type, the ISO is downloaded to the first one.
+	ISOStorages []string
+	// ImportStorages are the storages with the import content type, the disk image of the template is downloaded to the first one.
+	ImportStorages []string
+	// SelectedStorages are the storages matching the storage_selector of the machine class.
+	SelectedStorages []string
+	Bridges          []string
+	VLANAwareBridges []string
+	// VNets are the SDN VNets applied on the node.
+	VNets []string
+	// PCIMappings are the PCI resource mappings referenced by the machine class, which have the device on the node.
+	PCIMappings []string
+	// Problems are the issues which make the provisioning on the node fail.
+	Problems []string
+}
+
+// PermissionCheck is the privilege on the ACL path needed by the provision steps.
+type PermissionCheck struct {
+	Path      string
+	Privilege string
+	Steps     []string
+	Granted   bool
+}
+
+// requirement is the set of privileges on the ACL path needed by the step.
+type requirement struct {
+	path       string
+	step       string
+	privileges []string
+}
+
+var vmConfigPrivileges = []string{
+	"VM.Allocate", "VM.Config.CDROM", "VM.Config.CPU", "VM.Config.Cloudinit", "VM.Config.Disk",
+	"VM.Config.HWType", "VM.Config.Memory", "VM.Config.Network", "VM.Config.Options",
+}
+
+// Doctor checks the permissions of the API user and the prerequisites of the machine class on each node of every cluster.
+// The data is the machine class provider data, only the generic checks are done if it's nil.
+func (p *Provisioner) Doctor(ctx context.Context, data *Data) ([]NodeReport, error) {
+	clusters, _ := p.snapshot()
+
+	var reports []NodeReport
+
+	for _, cluster := range slices.Sorted(maps.Keys(clusters)) {
+		client := clusters[cluster].client
+
+		nodes, err := client.Nodes(ctx)
+		if err != nil {
+			return reports, fmt.Errorf("cluster %q: %w", cluster, err)
+		}
+
+		var pciMappings map[string][]string
+
+		if data != nil && len(data.PCIDevices) > 0 {
+			if pciMappings, err = listPCIMappings(ctx, client); err != nil {
+				return reports, fmt.Errorf("cluster %q: %w", cluster, err)
+			}
+		}
+
+		slices.SortFunc(nodes, func(a, b *proxmox.NodeStatus) int { return cmp.Compare(a.Node, b.Node) })
+
+		for _, nodeStatus := range nodes {
+			report := NodeReport{
+				Cluster: cluster,
+				Node:    nodeStatus.Node,
+			}
+
+			if nodeStatus.Status != "online" {
+				report.Problems = append(report.Problems, fmt.Sprintf("node is %s", nodeStatus.Status))
+				reports = append(reports, report)
+
+				continue
+			}
+
+			if err = p.checkNode(ctx, client, &report, data, pciMappings); err != nil {
+				report.Problems = append(report.Problems, err.Error())
+			}
+
+			reports = append(reports, report)
+		}
+	}
+
+	return reports, nil
+}
+
+//nolint:gocognit,gocyclo,cyclop
+func (p *Provisioner) checkNode(ctx context.Context, client *proxmox.Client, report *NodeReport, data *Data, pciMappings map[string][]string) error {
+	node, err := client.Node(ctx, report.Node)
+	if err != nil {
+		return err
+	}
+
+	storages, err := node.Storages(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, storage := range storages {
+		if storage.Enabled == 0 {
+			continue
+		}
+
+		content := strings.Split(storage.Content, ",")
+
+		if slices.Contains(content, "iso") {
+			report.ISOStorages = append(report.ISOStorages, storage.Name)
+		}
+
+		if slices.Contains(content, "import") {
+			report.ImportStorages = append(report.ImportStorages, storage.Name)
+		}
+	}
+
+	templateMode := data != nil && data.ProvisionMode == provisionModeTemplate
+
+	if len(report.ISOStorages) == 0 && !templateMode {
+		report.Problems = append(report.Problems, "no storage accepts the iso content")
+	}
+
+	if len(report.ImportStorages) == 0 && templateMode {
+		report.Problems = append(report.Problems, "no storage accepts the import content, it's needed for the template provision mode")
+	}
+
+	if data != nil && data.StorageSelector != "" {
+		matches, err := matchStorages(node, storages, data.StorageSelector)
+		if err != nil {
+			return fmt.Errorf("invalid storage selector: %w", err)
+		}
+
+		for _, storage := range matches {
+			report.SelectedStorages = append(report.SelectedStorages, storage.Name)
+		}
+
+		if len(report.SelectedStorages) == 0 {
+			report.Problems = append(report.Problems, "no storages match the storage_selector")
+		}
+	}
+
+	var bridges []struct {
+		Iface     string `json:"iface"`
+		VLANAware int    `json:"bridge_vlan_aware"`
+	}
+
+	if err = client.Get(ctx, fmt.Sprintf("/nodes/%s/network?type=any_bridge", report.Node), &bridges); err != nil {
+		return fmt.Errorf("failed to list the network bridges: %w", err)
+	}
+
+	for _, bridge := range bridges {
+		report.Bridges = append(report.Bridges, bridge.Iface)
+
+		if bridge.VLANAware == 1 {
+			report.VLANAwareBridges = append(report.VLANAwareBridges, bridge.Iface)
+		}
+	}
+
+	vnets, err := appliedVNets(ctx, client, report.Node)
+	if err != nil {
+		return err
+	}
+
+	report.VNets = slices.Sorted(maps.Keys(vnets))
+
+	// networks are the ACL paths of the bridges and the VNets the NICs are attached to
+	var networks []string
+
+	if data != nil {
+		var zones []sdnZone
+
+		for _, nic := range data.nicConfigs() {
+			switch {
+			case nic.clusterVNet != nil:
+				if zones == nil {
+					if err = client.Get(ctx, "/cluster/sdn/zones", &zones); err != nil {
+						return fmt.Errorf("failed to list the SDN zones: %w", err)
+					}
+				}
+
+				if !slices.ContainsFunc(zones, func(zone sdnZone) bool { return zone.Zone == nic.clusterVNet.Zone }) {
+					report.Problems = append(report.Problems, fmt.Sprintf("SDN zone %q does not exist", nic.clusterVNet.Zone))
+				}
+
+				networks = append(networks, "/sdn/zones/"+nic.clusterVNet.Zone)
+			case nic.vnet != "":
+				zone, ok := vnets[nic.vnet]
+				if !ok {
+					report.Problems = append(report.Problems, fmt.Sprintf("SDN VNet %q does not exist or is not applied on the node", nic.vnet))
+
+					continue
+				}
+
+				networks = append(networks, "/sdn/zones/"+zone+"/"+nic.vnet)
+
+				if nic.subnet != "" {
+					if _, err = vnetSubnet(ctx, client, nic.vnet, nic.subnet); err != nil {
+						report.Problems = append(report.Problems, err.Error())
+					}
+				}
+			default:
+				bridge := cmp.Or(nic.bridge, "vmbr0")
+
+				networks = append(networks, "/sdn/zones/localnetwork/"+bridge)
+
+				switch {
+				case !slices.Contains(report.Bridges, bridge):
+					report.Problems = append(report.Problems, fmt.Sprintf("bridge %q does not exist", bridge))
+				case nic.vlan != 0 && !slices.Contains(report.VLANAwareBridges, bridge):
+					report.Problems = append(report.Problems, fmt.Sprintf("bridge %q is not VLAN aware, but the VLAN tag %d is set", bridge, nic.vlan))
+				}
+			}
+		}
+
+		for _, pci := range data.PCIDevices {
+			if slices.Contains(pciMappings[pci.Mapping], report.Node) {
+				report.PCIMappings = append(report.PCIMappings, pci.Mapping)
+
+				continue
+			}
+
+			if _, ok := pciMappings[pci.Mapping]; !ok {
+				report.Problems = append(report.Problems, fmt.Sprintf("PCI resource mapping %q does not exist", pci.Mapping))
+			} else {
+				report.Problems = append(report.Problems, fmt.Sprintf("PCI resource mapping %q has no device on the node", pci.Mapping))
+			}
+		}
+	}
+
+	report.Permissions, err = checkPermissions(ctx, client, provisionRequirements(report, data, slices.Compact(slices.Sorted(slices.Values(networks)))))
+	if err != nil {
+		return err
+	}
+
+	for _, check := range report.Permissions {
+		if !check.Granted {
+			report.Problems = append(report.Problems, fmt.Sprintf("missing %s on %s, needed by %s", check.Privilege, check.Path, strings.Join(check.Steps, ", ")))
+		}
+	}
+
+	return nil
+}
+
+// provisionRequirements lists the privileges needed by the provision steps and the deprovision on the node.
+// The networks are the ACL paths of the bridges and the VNets the NICs are attached to.
+func provisionRequirements(report *NodeReport, data *Data, networks []string) []requirement {
+	nodePath := "/nodes/" + report.Node
+
+	requirements := []requirement{
+		{step: "pickNode", path: nodePath, privileges: []string{"Sys.Audit"}},
+		{step: "pickNode", path: "/vms", privileges: []string{"VM.Audit"}},
+		{step: "syncVM", path: "/vms", privileges: vmConfigPrivileges},
+		{step: "startVM", path: "/vms", privileges: []string{"VM.PowerMgmt"}},
+		{step: "deprovision", path: "/vms", privileges: []string{"VM.Allocate", "VM.PowerMgmt"}},
+	}
+
+	if data != nil && data.ProvisionMode == provisionModeTemplate {
+		requirements = append(requirements,
+			requirement{step: "syncTemplate", path: "/vms", privileges: append([]string{"VM.Clone"}, vmConfigPrivileges...)},
+			requirement{step: "syncTemplate", path: nodePath, privileges: []string{"Sys.Audit", "Sys.Modify"}},
+		)
+
+		if len(report.ImportStorages) > 0 {
+			requirements = append(requirements, requirement{step: "syncTemplate", path: "/storage/" + report.ImportStorages[0], privileges: []string{"Datastore.AllocateTemplate"}})
+		}
+	} else {
+		requirements = append(requirements, requirement{step: "uploadISO", path: nodePath, privileges: []string{"Sys.Audit", "Sys.Modify"}})
+
+		if len(report.ISOStorages) > 0 {
+			requirements = append(requirements,
+				requirement{step: "uploadISO", path: "/storage/" + report.ISOStorages[0], privileges: []string{"Datastore.AllocateTemplate"}},
+				requirement{step: "syncVM", path: "/storage/" + report.ISOStorages[0], privileges: []string{"Datastore.Audit"}},
+			)
+		}
+	}
+
+	for _, storage := range report.SelectedStorages {
+		requirements = append(requirements,
+			requirement{step: "pickNode", path: "/storage/" + storage, privileges: []string{"Datastore.Audit"}},
+			requirement{step: "syncVM", path: "/storage/" + storage, privileges: []string{"Datastore.AllocateSpace"}},
+		)
+	}
+
+	for _, network := range networks {
+		requirements = append(requirements, requirement{step: "syncVM", path: network, privileges: []string{"SDN.Use"}})
+	}
+
+	if data != nil {
+		for _, nic := range data.nicConfigs() {
+			if nic.clusterVNet == nil {
+				continue
+			}
+
+			// the VNets are created in the zone, and the SDN config is applied in the whole cluster
+			requirements = append(requirements,
+				requirement{step: "syncNetwork", path: "/sdn/zones/" + nic.clusterVNet.Zone, privileges: []string{"SDN.Allocate"}},
+				requirement{step: "syncNetwork", path: "/sdn", privileges: []string{"SDN.Allocate"}},
+				requirement{step: "deprovision", path: "/sdn/zones/" + nic.clusterVNet.Zone, privileges: []string{"SDN.Allocate"}},
+			)
+		}
+
+		for _, pci := range data.PCIDevices {
+			requirements = append(requirements, requirement{step: "syncVM", path: "/mapping/pci/" + pci.Mapping, privileges: []string{"Mapping.Use"}})
+		}
+
+		if data.Firewall != nil {
+			requirements = append(requirements, requirement{step: "syncFirewall", path: "/vms", privileges: []string{"VM.Audit", "VM.Config.Network"}})
+		}
+
+		if data.HA != nil {
+			requirements = append(requirements,
+				requirement{step: "registerHA", path: "/", privileges: []string{"Sys.Console"}},
+				requirement{step: "deprovision", path: "/", privileges: []string{"Sys.Console"}},
+			)
+		}
+	}
+
+	return requirements
+}
+
+// checkPermissions queries the effective privileges of the API user on each path of the requirements.
+func checkPermissions(ctx context.Context, client *proxmox.Client, requirements []requirement) ([]PermissionCheck, error) {
+	var checks []PermissionCheck
+
+	granted := map[string]map[string]int{}
+
+	for _, req := range requirements {
+		privileges, ok := granted[req.path]
+		if !ok {
+			var permissions map[string]map[string]int
+
+			if err := client.Get(ctx, "/access/permissions?path="+url.QueryEscape(req.path), &permissions); err != nil {
+				return nil, fmt.Errorf("failed to get the permissions on %s: %w", req.path, err)
+			}
+
+			privileges = permissions[req.path]
+			granted[req.path] = privileges
+		}
+
+		for _, privilege := range req.privileges {
+			index := slices.IndexFunc(checks, func(check PermissionCheck) bool {
+				return check.Path == req.path && check.Privilege == privilege
+			})
+
+			if index == -1 {
+				checks = append(checks, PermissionCheck{
+					Path:      req.path,
+					Privilege: privilege,
+					Granted:   privileges[privilege] == 1,
+				})
+
+				index = len(checks) - 1
+			}
+
+			if !slices.Contains(checks[index].Steps, req.step) {
+				checks[index].Steps = append(checks[index].Steps, req.step)
+			}
+		}
+	}
+
+	slices.SortStableFunc(checks, func(a, b PermissionCheck) int {
+		return cmp.Or(cmp.Compare(a.Path, b.Path), cmp.Compare(a.Privilege, b.Privilege))
+	})
+
+	return checks, nil
+}
+
+// listPCIMappings returns the nodes having the device of each PCI resource mapping.
+func listPCIMappings(ctx context.Context, client *proxmox.Client) (map[string][]string, error) {
+	var mappings []struct {
+		ID  string   `json:"id"`
+		Map []string `json:"map"`
+	}
+
+	if err := client.Get(ctx, "/cluster/mapping/pci", &mappings); err != nil {
+		return nil, fmt.Errorf("failed to list the PCI resource mappings: %w", err)
+	}
+
+	result := make(map[string][]string, len(mappings))
+
+	for _, mapping := range mappings {
+		result[mapping.ID] = []string{}
+
+		// each entry is like "node=pve1,path=0000:01:00.0,id=10de:2204"
+		for _, entry := range mapping.Map {
+			for property := range strings.SplitSeq(entry, ",") {
+				if node, ok := strings.CutPrefix(property, "node="); ok {
+					result[mapping.ID] = append(result[mapping.ID], node)
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,135 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func missingPermissions(report provider.NodeReport) []string {
+	var missing []string
+
+	for _, check := range report.Permissions {
+		if !check.Granted {
+			missing = append(missing, check.Privilege+" on "+check.Path)
+		}
+	}
+
+	return missing
+}
+
+func TestDoctor(t *testing.T) {
+	t.Parallel()
+
+	srv := fakeproxmox.NewServer()
+	t.Cleanup(srv.Close)
+
+	srv.AddNode(fakeproxmox.Node{
+		Name:      "pve1",
+		CPUs:      16,
+		MaxMemory: 64 * gib,
+		Bridges:   []fakeproxmox.Bridge{{Name: "vmbr0"}, {Name: "vmbr1", VLANAware: true}},
+	})
+	srv.AddStorage("pve1", fakeproxmox.Storage{Name: "local", Content: []string{"iso", "import"}, Total: 100 * gib})
+	srv.AddStorage("pve1", fakeproxmox.Storage{Name: "local-lvm", Type: "lvmthin", Content: []string{"images"}, Total: 1024 * gib})
+
+	srv.AddNode(fakeproxmox.Node{
+		Name:      "pve2",
+		CPUs:      16,
+		MaxMemory: 64 * gib,
+		Bridges:   []fakeproxmox.Bridge{{Name: "vmbr0"}},
+	})
+	srv.AddStorage("pve2", fakeproxmox.Storage{Name: "ceph", Type: "rbd", Content: []string{"images"}, Total: 1024 * gib})
+
+	srv.AddNode(fakeproxmox.Node{Name: "pve3", Status: "offline"})
+
+	srv.AddPCIMapping("gpu", map[string]string{"pve1": "0000:01:00.0"})
+
+	p := provider.NewProvisioner(srv.Client())
+
+	reports, err := p.Doctor(t.Context(), nil)
+	require.NoError(t, err)
+	require.Len(t, reports, 3)
+
+	assert.Equal(t, "pve1", reports[0].Node)
+	assert.Equal(t, []string{"local"}, reports[0].ISOStorages)
+	assert.Equal(t, []string{"local"}, reports[0].ImportStorages)
+	assert.Equal(t, []string{"vmbr0", "vmbr1"}, reports[0].Bridges)
+	assert.Equal(t, []string{"vmbr1"}, reports[0].VLANAwareBridges)
+	assert.NotEmpty(t, reports[0].Permissions)
+	assert.Empty(t, missingPermissions(reports[0]))
+	assert.Empty(t, reports[0].Problems)
+
+	assert.Equal(t, []string{"no storage accepts the iso content"}, reports[1].Problems)
+	assert.Equal(t, []string{"node is offline"}, reports[2].Problems)
+
+	data := &provider.Data{
+		StorageSelector: `name == "local-lvm"`,
+		Vlan:            10,
+		AdditionalNICs:  []provider.AdditionalNIC{{Bridge: "vmbr1", Vlan: 20}, {Bridge: "vmbr2"}},
+		PCIDevices:      []provider.PCIDevice{{Mapping: "gpu"}, {Mapping: "nic"}},
+	}
+
+	srv.SetPermissions("/", "Sys.Audit", "Sys.Modify")
+	srv.SetPermissions("/vms", "VM.Allocate", "VM.Audit", "VM.Config.CDROM", "VM.Config.CPU", "VM.Config.Cloudinit", "VM.Config.Disk",
+		"VM.Config.HWType", "VM.Config.Memory", "VM.Config.Network", "VM.Config.Options", "VM.PowerMgmt")
+	srv.SetPermissions("/storage", "Datastore.Audit", "Datastore.AllocateSpace")
+	srv.SetPermissions("/storage/local", "Datastore.Audit", "Datastore.AllocateTemplate")
+	srv.SetPermissions("/sdn", "SDN.Use")
+	srv.SetPermissions("/mapping/pci/gpu", "Mapping.Use")
+
+	reports, err = p.Doctor(t.Context(), data)
+	require.NoError(t, err)
+	require.Len(t, reports, 3)
+
+	assert.Equal(t, []string{"local-lvm"}, reports[0].SelectedStorages)
+	assert.Equal(t, []string{"gpu"}, reports[0].PCIMappings)
+	assert.Equal(t, []string{"Mapping.Use on /mapping/pci/nic"}, missingPermissions(reports[0]))
+	assert.Equal(t, []string{
+		`bridge "vmbr0" is not VLAN aware, but the VLAN tag 10 is set`,
+		`bridge "vmbr2" does not exist`,
+		`PCI resource mapping "nic" does not exist`,
+		"missing Mapping.Use on /mapping/pci/nic, needed by syncVM",
+	}, reports[0].Problems)
+
+	assert.Equal(t, []string{
+		"no storage accepts the iso content",
+		"no storages match the storage_selector",
+		`bridge "vmbr0" is not VLAN aware, but the VLAN tag 10 is set`,
+		`bridge "vmbr1" does not exist`,
+		`bridge "vmbr2" does not exist`,
+		`PCI resource mapping "gpu" has no device on the node`,
+		`PCI resource mapping "nic" does not exist`,
+		"missing Mapping.Use on /mapping/pci/nic, needed by syncVM",
+	}, reports[1].Problems)
+
+	// the template mode needs the import storage and the privilege to clone the VMs
+	reports, err = p.Doctor(t.Context(), &provider.Data{ProvisionMode: "template"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"VM.Clone on /vms"}, missingPermissions(reports[0]))
+	assert.Equal(t, []string{"missing VM.Clone on /vms, needed by syncTemplate"}, reports[0].Problems)
+
+	// the SDN VNets are checked instead of the bridges
+	srv.AddZone(fakeproxmox.Zone{Name: "zone1", Nodes: []string{"pve1"}})
+	srv.AddVNet(fakeproxmox.VNet{Name: "lan", Zone: "zone1", Applied: true})
+
+	reports, err = p.Doctor(t.Context(), &provider.Data{
+		NetworkVNet:    "lan",
+		AdditionalNICs: []provider.AdditionalNIC{{ClusterVNet: &provider.ClusterVNet{Zone: "zone2"}}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"lan"}, reports[0].VNets)
+	assert.Equal(t, []string{"SDN.Allocate on /sdn", "SDN.Allocate on /sdn/zones/zone2"}, missingPermissions(reports[0]))
+	assert.Contains(t, reports[0].Problems, `SDN zone "zone2" does not exist`)
+	assert.Contains(t, reports[1].Problems, `SDN VNet "lan" does not exist or is not applied on the node`)
+}
@@ -0,0 +1,320 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/safe"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"go.uber.org/zap"
+	"go.yaml.in/yaml/v4"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+// driftOptions are the VM config options checked for the drift, besides the network interfaces and the PCI devices.
+var driftOptions = []string{"cpu", "cores", "sockets", "memory", "machine", "numa", "hugepages", "balloon", "onboot", "tags", "description"}
+
+// nonDisruptiveOptions can be changed without restarting the VM.
+var nonDisruptiveOptions = []string{"tags", "description", "onboot", "balloon"}
+
+var deviceOptionRe = regexp.MustCompile(`^(net|hostpci)\d+$`)
+
+// DriftOptions configures the VM config drift detection.
+type DriftOptions struct {
+	// Interval is the period of the VM config checks.
+	Interval time.Duration
+	// Fix applies the non-disruptive changes: tags, description, onboot and balloon.
+	Fix bool
+	// FixDisruptive applies the rest of the changes, most of them take effect after the VM restart.
+	FixDisruptive bool
+}
+
+// detectDrift compares the VM config with the config generated from the machine request provider data.
+// The drift is fixed according to the options, the drift which is left is returned.
+//
+//nolint:gocognit,gocyclo,cyclop
+func (p *Provisioner) detectDrift(ctx context.Context, logger *zap.Logger, machine *resources.Machine, machineRequest *infra.MachineRequest, opts DriftOptions) ([]*specs.ConfigDrift, error) {
+	spec := machine.TypedSpec().Value
+
+	var data Data
+
+	if err := yaml.Unmarshal([]byte(machineRequest.TypedSpec().Value.ProviderData), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse the provider data: %w", err)
+	}
+
+	machineRequestSet, _ := machineRequest.Metadata().Labels().Get(omni.LabelMachineRequestSet)
+	machineClass, _ := machineRequest.Metadata().Labels().Get(omni.LabelMachineClassName)
+
+	identity := vmIdentity{
+		requestID:         machine.Metadata().ID(),
+		uuid:              spec.Uuid,
+		machineRequestSet: machineRequestSet,
+		machineClass:      machineClass,
+		talosVersion:      machineRequest.TypedSpec().Value.TalosVersion,
+		schematic:         spec.Schematic,
+		omniCluster:       omniClusterName(machineRequest),
+		controlPlaneGroup: controlPlaneGroup(machineRequest),
+	}
+
+	expected := map[string]string{}
+
+	// the disks are not checked, so the storages don't matter
+	for _, option := range p.vmOptions(identity, data, diskPlan{Additional: make([]string, len(data.AdditionalDisks))}) {
+		expected[option.Name] = fmt.Sprint(option.Value)
+	}
+
+	client, err := p.client(spec.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := p.vmNode(ctx, client, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	configPath := fmt.Sprintf("/nodes/%s/qemu/%d/config", node, spec.Vmid)
+
+	actual, err := p.vmConfig(ctx, client, node, int(spec.Vmid))
+	if err != nil {
+		return nil, err
+	}
+
+	options := slices.Clone(driftOptions)
+
+	for option := range maps.Keys(expected) {
+		if deviceOptionRe.MatchString(option) {
+			options = append(options, option)
+		}
+	}
+
+	for option := range maps.Keys(actual) {
+		if deviceOptionRe.MatchString(option) && !slices.Contains(options, option) {
+			options = append(options, option)
+		}
+	}
+
+	slices.Sort(options)
+
+	var (
+		drift  []*specs.ConfigDrift
+		params = map[string]any{}
+		remove []string
+	)
+
+	for _, option := range options {
+		if !optionDrifted(option, expected[option], actual[option]) {
+			continue
+		}
+
+		disruptive := !slices.Contains(nonDisruptiveOptions, option)
+
+		if (disruptive && !opts.FixDisruptive) || (!disruptive && !opts.Fix) {
+			drift = append(drift, &specs.ConfigDrift{
+				Option:     option,
+				Expected:   expected[option],
+				Actual:     actual[option],
+				Disruptive: disruptive,
+			})
+
+			continue
+		}
+
+		switch {
+		case expected[option] == "":
+			remove = append(remove, option)
+		case option == "tags":
+			// the tags added manually are kept
+			params[option] = strings.Join(mergeTags(splitTags(actual[option]), splitTags(expected[option])), ";")
+		default:
+			params[option] = expected[option]
+		}
+	}
+
+	if len(params) == 0 && len(remove) == 0 {
+		return drift, nil
+	}
+
+	if len(remove) > 0 {
+		params["delete"] = strings.Join(remove, ",")
+	}
+
+	if err = client.Put(ctx, configPath, params, nil); err != nil {
+		return nil, fmt.Errorf("failed to fix the VM config drift: %w", err)
+	}
+
+	logger.Info("fixed the VM config drift", zap.Strings("options", slices.Sorted(maps.Keys(params))), zap.Strings("removed", remove))
+
+	return drift, nil
+}
+
+// optionDrifted compares the VM config option values ignoring the values Proxmox fills in on its own.
+func optionDrifted(option, expected, actual string) bool {
+	switch {
+	case option == "tags":
+		return slices.ContainsFunc(splitTags(expected), func(tag string) bool {
+			return !slices.Contains(splitTags(actual), tag)
+		})
+	case option == "description":
+		// Proxmox might drop the trailing newline
+		return strings.TrimSpace(expected) != strings.TrimSpace(actual)
+	case option == "balloon":
+		// any value except 0 enables the ballooning, which is the default
+		return (expected == "0") != (actual == "0")
+	case option == "numa" && expected == "":
+		return actual != "" && actual != "0"
+	case deviceOptionRe.MatchString(option):
+		return !maps.Equal(deviceProperties(expected), deviceProperties(actual))
+	}
+
+	return expected != actual
+}
+
+// deviceProperties parses the device config like "virtio=BC:24:11:00:00:01,bridge=vmbr0,firewall=1", the MAC address is dropped.
+func deviceProperties(value string) map[string]string {
+	if value == "" {
+		return nil
+	}
+
+	properties := map[string]string{}
+
+	for i, property := range strings.Split(value, ",") {
+		key, val, _ := strings.Cut(property, "=")
+
+		if i == 0 && strings.Count(val, ":") == 5 {
+			val = ""
+		}
+
+		properties[key] = val
+	}
+
+	return properties
+}
+
+func splitTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
+}
+
+func mergeTags(tags ...[]string) []string {
+	var merged []string
+
+	for _, list := range tags {
+		for _, tag := range list {
+			if !slices.Contains(merged, tag) {
+				merged = append(merged, tag)
+			}
+		}
+	}
+
+	return merged
+}
+
+// DriftReconciler periodically checks the provisioned VMs for the config drift and records it in the Machine resources.
+type DriftReconciler struct {
+	state       state.State
+	provisioner *Provisioner
+	options     DriftOptions
+}
+
+// NewDriftReconciler creates a new DriftReconciler, the state is the Omni state which has the Machine and the MachineRequest resources.
+func NewDriftReconciler(provisioner *Provisioner, st state.State, options DriftOptions) *DriftReconciler {
+	return &DriftReconciler{
+		state:       st,
+		provisioner: provisioner,
+		options:     options,
+	}
+}
+
+// Run checks the VMs every interval until the context is canceled.
+func (r *DriftReconciler) Run(ctx context.Context, logger *zap.Logger) {
+	ticker := time.NewTicker(r.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.reconcile(ctx, logger); err != nil {
+			logger.Error("failed to check the VMs for the config drift", zap.Error(err))
+		}
+	}
+}
+
+func (r *DriftReconciler) reconcile(ctx context.Context, logger *zap.Logger) error {
+	machines, err := safe.StateListAll[*resources.Machine](ctx, r.state)
+	if err != nil {
+		return err
+	}
+
+	for machine := range machines.All() {
+		spec := machine.TypedSpec().Value
+
+		// only the VMs which are fully provisioned are checked
+		if machine.Metadata().Phase() != resource.PhaseRunning || spec.VmStartTask == "" {
+			continue
+		}
+
+		machineRequest, err := safe.StateGetByID[*infra.MachineRequest](ctx, r.state, machine.Metadata().ID())
+		if err != nil {
+			if state.IsNotFoundError(err) {
+				continue
+			}
+
+			return err
+		}
+
+		machineRequestSet, _ := machineRequest.Metadata().Labels().Get(omni.LabelMachineRequestSet)
+
+		machineLogger := logger.With(machineFields(machine.Metadata().ID(), machineRequestSet, spec)...)
+
+		drift, err := r.provisioner.detectDrift(ctx, machineLogger, machine, machineRequest, r.options)
+		if err != nil {
+			machineLogger.Warn("failed to check the VM config drift", zap.Error(err))
+
+			continue
+		}
+
+		if slices.EqualFunc(spec.ConfigDrift, drift, (*specs.ConfigDrift).EqualVT) {
+			continue
+		}
+
+		for _, d := range drift {
+			machineLogger.Warn("VM config drift detected",
+				zap.String("option", d.Option),
+				zap.String("expected", d.Expected),
+				zap.String("actual", d.Actual),
+				zap.Bool("disruptive", d.Disruptive),
+			)
+		}
+
+		// the Machine resource is owned by the provision controller
+		if _, err = safe.StateUpdateWithConflicts(ctx, r.state, machine.Metadata(), func(res *resources.Machine) error {
+			res.TypedSpec().Value.ConfigDrift = drift
+
+			return nil
+		}, state.WithUpdateOwner(machine.Metadata().Owner())); err != nil {
+			machineLogger.Warn("failed to record the VM config drift", zap.Error(err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestDetectDrift(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`node: pve1
+`, map[string]string{
+		omni.LabelMachineRequestSet: "workers",
+	})
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	spec := pctx.State.TypedSpec().Value
+
+	drift, err := provider.DetectDrift(ctx, p, pctx.State, pctx.MachineRequest, false, false)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+
+	vm, ok := srv.VM("pve1", int(spec.Vmid))
+	require.True(t, ok)
+
+	configPath := fmt.Sprintf("/nodes/pve1/qemu/%d/config", spec.Vmid)
+
+	tags := "omni-provider.proxmox;omni-request.machine-1;machine-request.workers;talos-version.v1.11.0;talos-schematic." + spec.Schematic
+
+	// the VM is changed manually
+	require.NoError(t, srv.Client().Put(ctx, configPath, map[string]any{
+		"tags":        "custom",
+		"description": "my notes",
+		"onboot":      0,
+		"balloon":     0,
+		"cores":       4,
+		"numa":        0,
+		"net0":        "virtio,bridge=vmbr1,firewall=1",
+	}, nil))
+
+	drift, err = provider.DetectDrift(ctx, p, pctx.State, pctx.MachineRequest, false, false)
+	require.NoError(t, err)
+
+	net0, _ := srv.VM("pve1", int(spec.Vmid))
+
+	assert.Equal(t, []*specs.ConfigDrift{
+		{Option: "balloon", Actual: "0"},
+		{Option: "cores", Expected: "2", Actual: "4", Disruptive: true},
+		{Option: "description", Expected: vm.Config["description"], Actual: "my notes"},
+		{Option: "net0", Expected: "virtio,bridge=vmbr0,firewall=1", Actual: net0.Config["net0"], Disruptive: true},
+		{Option: "onboot", Expected: "1", Actual: "0"},
+		{Option: "tags", Expected: tags, Actual: "custom"},
+	}, drift)
+
+	// the non-disruptive changes are fixed
+	drift, err = provider.DetectDrift(ctx, p, pctx.State, pctx.MachineRequest, true, false)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"cores", "net0"}, driftOptions(drift))
+
+	fixed, _ := srv.VM("pve1", int(spec.Vmid))
+
+	assert.Equal(t, "custom;"+tags, fixed.Config["tags"])
+	assert.Equal(t, vm.Config["description"], fixed.Config["description"])
+	assert.Equal(t, "1", fixed.Config["onboot"])
+	assert.NotContains(t, fixed.Config, "balloon")
+	assert.Equal(t, "4", fixed.Config["cores"])
+
+	// the disruptive changes are fixed only with the opt-in
+	drift, err = provider.DetectDrift(ctx, p, pctx.State, pctx.MachineRequest, false, true)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+
+	fixed, _ = srv.VM("pve1", int(spec.Vmid))
+
+	assert.Equal(t, "2", fixed.Config["cores"])
+	assert.Equal(t, vm.Config["net0"], fixed.Config["net0"])
+
+	drift, err = provider.DetectDrift(ctx, p, pctx.State, pctx.MachineRequest, false, false)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+
+	// the VM is checked on the node it was moved to
+	srv.MoveVM("pve1", int(spec.Vmid), "pve2")
+
+	drift, err = provider.DetectDrift(ctx, p, pctx.State, pctx.MachineRequest, false, false)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+}
+
+func driftOptions(drift []*specs.ConfigDrift) []string {
+	options := make([]string, 0, len(drift))
+
+	for _, d := range drift {
+		options = append(options, d.Option)
+	}
+
+	return options
+}
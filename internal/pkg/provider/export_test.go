@@ -4,8 +4,70 @@
 
 package provider
 
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
 type NodeStatus = nodeStatus
 
 func PickNode(nodes []NodeStatus) NodeStatus {
 	return pickNode(nodes)
 }
+
+func SetTaskPollInterval(interval time.Duration) {
+	taskPollInterval = interval
+}
+
+func PickNodeWithStrategy(data Data, nodes []NodeStatus) (NodeStatus, error) {
+	strategy, err := newPlacementStrategy(data)
+	if err != nil {
+		return NodeStatus{}, err
+	}
+
+	return strategy.pick(nodes)
+}
+
+func FilterNodes(nodes []NodeStatus, data Data, cpuOvercommit, memoryOvercommit float64) ([]NodeStatus, []NodeRejection, error) {
+	return filterNodes(nodes, data, overcommit{
+		cpu:    cpuOvercommit,
+		memory: memoryOvercommit,
+	})
+}
+
+func ParseNodeTags(description string) []string {
+	return parseNodeTags(description)
+}
+
+func ApplyAffinity(candidates, all []NodeStatus, affinity Affinity, controlPlane bool) ([]NodeStatus, []NodeRejection) {
+	return applyAffinity(candidates, all, affinity, controlPlane)
+}
+
+func DetectDrift(ctx context.Context, p *Provisioner, machine *resources.Machine, machineRequest *infra.MachineRequest, fix, fixDisruptive bool) ([]*specs.ConfigDrift, error) {
+	return p.detectDrift(ctx, zap.NewNop(), machine, machineRequest, DriftOptions{
+		Fix:           fix,
+		FixDisruptive: fixDisruptive,
+	})
+}
+
+func CollectGarbage(ctx context.Context, p *Provisioner, machines []*specs.MachineSpec, gracePeriod time.Duration, dryRun bool) ([]Orphan, error) {
+	return p.collectGarbage(ctx, zap.NewNop(), machines, GCOptions{
+		GracePeriod: gracePeriod,
+		DryRun:      dryRun,
+	})
+}
+
+func RenderNetworkConfig(data Data, addresses []*specs.NICAddress, macs []string) (string, error) {
+	return renderNetworkConfig(data, addresses, macs)
+}
+
+func ConfigValue(value json.RawMessage) string {
+	return configValue(value)
+}
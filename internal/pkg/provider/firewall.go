@@ -0,0 +1,296 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/luthermonson/go-proxmox"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+// firewallComment marks the VM firewall rules managed by the provider, the rule comment is appended to it.
+const firewallComment = "omni"
+
+var (
+	firewallActions = []string{"ACCEPT", "DROP", "REJECT"}
+
+	// securityGroupRe is the Proxmox security group name format.
+	securityGroupRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]+$`)
+)
+
+type securityGroup struct {
+	Group string `json:"group"`
+}
+
+type firewallOptions struct {
+	PolicyIn  string `json:"policy_in"`
+	PolicyOut string `json:"policy_out"`
+	Enable    int    `json:"enable"`
+}
+
+type firewallRule struct {
+	Type    string `json:"type"`
+	Action  string `json:"action"`
+	Proto   string `json:"proto,omitempty"`
+	DPort   string `json:"dport,omitempty"`
+	SPort   string `json:"sport,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Dest    string `json:"dest,omitempty"`
+	Iface   string `json:"iface,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	Pos     int    `json:"pos"`
+	Enable  int    `json:"enable"`
+}
+
+func (rule firewallRule) managed() bool {
+	return rule.Comment == firewallComment || strings.HasPrefix(rule.Comment, firewallComment+": ")
+}
+
+func (rule firewallRule) params() map[string]any {
+	params := map[string]any{
+		"type":   rule.Type,
+		"action": rule.Action,
+		"enable": rule.Enable,
+	}
+
+	for key, value := range map[string]string{
+		"proto":   rule.Proto,
+		"dport":   rule.DPort,
+		"sport":   rule.SPort,
+		"source":  rule.Source,
+		"dest":    rule.Dest,
+		"iface":   rule.Iface,
+		"comment": rule.Comment,
+	} {
+		if value != "" {
+			params[key] = value
+		}
+	}
+
+	return params
+}
+
+// firewallRules builds the managed rules of the VM in the order they should be applied: the security groups first, then the inline rules.
+func firewallRules(firewall Firewall, controlPlane bool) []firewallRule {
+	var rules []firewallRule
+
+	groups := firewall.SecurityGroups
+	if controlPlane {
+		groups = append(slices.Clone(groups), firewall.ControlPlaneSecurityGroups...)
+	}
+
+	for _, group := range groups {
+		rules = append(rules, firewallRule{Type: "group", Action: group, Comment: firewallComment, Enable: 1})
+	}
+
+	for _, rule := range firewall.Rules {
+		if rule.ControlPlane && !controlPlane {
+			continue
+		}
+
+		comment := firewallComment
+		if rule.Comment != "" {
+			comment += ": " + rule.Comment
+		}
+
+		rules = append(rules, firewallRule{
+			Type:    cmp.Or(rule.Type, "in"),
+			Action:  rule.Action,
+			Proto:   rule.Proto,
+			DPort:   rule.DPort,
+			SPort:   rule.SPort,
+			Source:  rule.Source,
+			Dest:    rule.Dest,
+			Iface:   rule.Iface,
+			Comment: comment,
+			Enable:  1,
+		})
+	}
+
+	return rules
+}
+
+// syncFirewall applies the firewall options, the security groups and the rules to the VM.
+// The managed rules are removed if the firewall is not set, e.g. once it's dropped from the machine class, the options are kept as is.
+// The managed rules are replaced as a whole if they don't match the machine config, the other rules of the VM are kept.
+//
+//nolint:gocognit,gocyclo,cyclop
+func (p *Provisioner) syncFirewall(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+	var data Data
+
+	if err := pctx.UnmarshalProviderData(&data); err != nil {
+		return err
+	}
+
+	if data.Firewall != nil {
+		if err := validateFirewall(*data.Firewall); err != nil {
+			return err
+		}
+	}
+
+	client, err := p.client(pctx.State.TypedSpec().Value.Cluster)
+	if err != nil {
+		return err
+	}
+
+	node, err := p.vmNode(ctx, client, pctx.State.TypedSpec().Value)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("/nodes/%s/qemu/%d/firewall", node, pctx.State.TypedSpec().Value.Vmid)
+
+	if data.Firewall == nil {
+		return syncFirewallRules(ctx, logger, client, path, nil)
+	}
+
+	rules := firewallRules(*data.Firewall, isControlPlane(pctx.MachineRequest))
+
+	if slices.ContainsFunc(rules, func(rule firewallRule) bool { return rule.Type == "group" }) {
+		var groups []securityGroup
+
+		if err = client.Get(ctx, "/cluster/firewall/groups", &groups); err != nil {
+			return fmt.Errorf("failed to list firewall security groups: %w", err)
+		}
+
+		for _, rule := range rules {
+			if rule.Type == "group" && !slices.ContainsFunc(groups, func(g securityGroup) bool { return g.Group == rule.Action }) {
+				return fmt.Errorf("firewall security group %q does not exist", rule.Action)
+			}
+		}
+	}
+
+	desired := firewallOptions{
+		Enable:    1,
+		PolicyIn:  data.Firewall.PolicyIn,
+		PolicyOut: data.Firewall.PolicyOut,
+	}
+
+	if data.Firewall.Enable != nil && !*data.Firewall.Enable {
+		desired.Enable = 0
+	}
+
+	var options firewallOptions
+
+	if err = client.Get(ctx, path+"/options", &options); err != nil {
+		return fmt.Errorf("failed to get the VM firewall options: %w", err)
+	}
+
+	if options.Enable != desired.Enable ||
+		(desired.PolicyIn != "" && options.PolicyIn != desired.PolicyIn) ||
+		(desired.PolicyOut != "" && options.PolicyOut != desired.PolicyOut) {
+		params := map[string]any{"enable": desired.Enable}
+
+		if desired.PolicyIn != "" {
+			params["policy_in"] = desired.PolicyIn
+		}
+
+		if desired.PolicyOut != "" {
+			params["policy_out"] = desired.PolicyOut
+		}
+
+		if err = client.Put(ctx, path+"/options", params, nil); err != nil {
+			return fmt.Errorf("failed to set the VM firewall options: %w", err)
+		}
+	}
+
+	return syncFirewallRules(ctx, logger, client, path, rules)
+}
+
+// syncFirewallRules replaces the managed rules of the VM firewall at the path with the rules, the other rules are kept.
+func syncFirewallRules(ctx context.Context, logger *zap.Logger, client *proxmox.Client, path string, rules []firewallRule) error {
+	var existing []firewallRule
+
+	if err := client.Get(ctx, path+"/rules", &existing); err != nil {
+		return fmt.Errorf("failed to list the VM firewall rules: %w", err)
+	}
+
+	existing = slices.DeleteFunc(existing, func(rule firewallRule) bool { return !rule.managed() })
+
+	if slices.EqualFunc(existing, rules, func(a, b firewallRule) bool {
+		a.Pos, b.Pos = 0, 0
+
+		return a == b
+	}) {
+		return nil
+	}
+
+	// the positions shift once a rule is removed, so the rules are removed from the bottom
+	slices.Reverse(existing)
+
+	for _, rule := range existing {
+		if err := client.Delete(ctx, fmt.Sprintf("%s/rules/%d", path, rule.Pos), nil); err != nil {
+			return fmt.Errorf("failed to remove the VM firewall rule %d: %w", rule.Pos, err)
+		}
+	}
+
+	// the new rules are inserted at the top, so they are created in the reverse order
+	for i := len(rules) - 1; i >= 0; i-- {
+		if err := client.Post(ctx, path+"/rules", rules[i].params(), nil); err != nil {
+			return fmt.Errorf("failed to add the VM firewall rule %s %s: %w", rules[i].Type, rules[i].Action, err)
+		}
+	}
+
+	logger.Info("applied the VM firewall rules", zap.Int("rules", len(rules)))
+
+	return nil
+}
+
+func validateFirewall(firewall Firewall) error {
+	var errs []error
+
+	for _, policy := range []struct {
+		field, value string
+	}{
+		{field: "firewall.policy_in", value: firewall.PolicyIn},
+		{field: "firewall.policy_out", value: firewall.PolicyOut},
+	} {
+		if policy.value != "" && !slices.Contains(firewallActions, policy.value) {
+			errs = append(errs, fmt.Errorf("%s: invalid policy %q: should be one of %s", policy.field, policy.value, strings.Join(firewallActions, ", ")))
+		}
+	}
+
+	for _, groups := range []struct {
+		field  string
+		groups []string
+	}{
+		{field: "firewall.security_groups", groups: firewall.SecurityGroups},
+		{field: "firewall.control_plane_security_groups", groups: firewall.ControlPlaneSecurityGroups},
+	} {
+		for i, group := range groups.groups {
+			if !securityGroupRe.MatchString(group) {
+				errs = append(errs, fmt.Errorf("%s[%d]: invalid security group name %q", groups.field, i, group))
+			}
+		}
+	}
+
+	for i, rule := range firewall.Rules {
+		field := fmt.Sprintf("firewall.rules[%d]", i)
+
+		if rule.Type != "" && rule.Type != "in" && rule.Type != "out" {
+			errs = append(errs, fmt.Errorf("%s.type: invalid type %q: should be either \"in\" or \"out\"", field, rule.Type))
+		}
+
+		if !slices.Contains(firewallActions, rule.Action) {
+			errs = append(errs, fmt.Errorf("%s.action: invalid action %q: should be one of %s", field, rule.Action, strings.Join(firewallActions, ", ")))
+		}
+
+		if (rule.DPort != "" || rule.SPort != "") && rule.Proto == "" {
+			errs = append(errs, fmt.Errorf("%s.proto: the proto should be set with the ports", field))
+		}
+	}
+
+	return errors.Join(errs...)
+}
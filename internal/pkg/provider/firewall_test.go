@@ -0,0 +1,152 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestProvisionFirewall(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	srv.AddSecurityGroup("talos")
+	srv.AddSecurityGroup("talos-cp")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	const base = baseMachineClass + `node: pve1
+firewall:
+  policy_in: DROP
+  security_groups:
+    - talos
+  control_plane_security_groups:
+    - talos-cp
+  rules:
+    - action: ACCEPT
+      proto: tcp
+      dport: "50000"
+      comment: apid
+    - action: ACCEPT
+      proto: tcp
+      dport: "6443"
+      comment: kube-apiserver
+      control_plane: true
+`
+
+	const siderolink = `    - type: out
+      action: ACCEPT
+      proto: udp
+      dport: "51820"
+      comment: siderolink
+`
+
+	data := base + siderolink
+
+	controlPlane := newProvisionContext("machine-1", data, map[string]string{omni.LabelControlPlaneRole: ""})
+	require.NoError(t, runSteps(ctx, t, p, controlPlane))
+
+	worker := newProvisionContext("machine-2", data, map[string]string{omni.LabelMachineRequestSet: "talos-1-workers"})
+	require.NoError(t, runSteps(ctx, t, p, worker))
+
+	vm, ok := srv.VM("pve1", int(controlPlane.State.TypedSpec().Value.Vmid))
+	require.True(t, ok)
+
+	assert.Equal(t, map[string]string{"enable": "1", "policy_in": "DROP"}, vm.FirewallOptions)
+	assert.Equal(t, []fakeproxmox.FirewallRule{
+		{Type: "group", Action: "talos", Comment: "omni", Enable: true},
+		{Type: "group", Action: "talos-cp", Comment: "omni", Enable: true},
+		{Type: "in", Action: "ACCEPT", Proto: "tcp", DPort: "50000", Comment: "omni: apid", Enable: true},
+		{Type: "in", Action: "ACCEPT", Proto: "tcp", DPort: "6443", Comment: "omni: kube-apiserver", Enable: true},
+		{Type: "out", Action: "ACCEPT", Proto: "udp", DPort: "51820", Comment: "omni: siderolink", Enable: true},
+	}, vm.FirewallRules)
+
+	// the control plane rules are not added to the workers
+	vm, ok = srv.VM("pve1", int(worker.State.TypedSpec().Value.Vmid))
+	require.True(t, ok)
+
+	assert.Equal(t, []string{"talos", "50000", "51820"}, ruleTargets(vm.FirewallRules))
+
+	// the rules created in Proxmox are kept, the managed rules are not created again if they match
+	vm.FirewallRules = append(vm.FirewallRules, fakeproxmox.FirewallRule{Type: "in", Action: "ACCEPT", Proto: "icmp", Enable: true})
+	srv.AddVM(vm)
+
+	rulesPath := fmt.Sprintf("/nodes/pve1/qemu/%d/firewall/rules", vm.ID)
+	created := srv.Requests(http.MethodPost, rulesPath)
+
+	require.NoError(t, runSteps(ctx, t, p, worker))
+	assert.Equal(t, created, srv.Requests(http.MethodPost, rulesPath))
+
+	// the managed rules are replaced once the machine config changes, on the node the VM was moved to
+	srv.MoveVM("pve1", vm.ID, "pve2")
+
+	updated := newProvisionContext("machine-2", base, nil)
+	updated.State.TypedSpec().Value = worker.State.TypedSpec().Value
+
+	require.NoError(t, runSteps(ctx, t, p, updated))
+
+	vm, ok = srv.VM("pve2", vm.ID)
+	require.True(t, ok)
+
+	assert.Equal(t, []string{"talos", "50000", ""}, ruleTargets(vm.FirewallRules))
+	assert.Equal(t, "icmp", vm.FirewallRules[2].Proto)
+
+	// the managed rules are removed once the firewall is dropped from the machine class
+	updated = newProvisionContext("machine-2", baseMachineClass, nil)
+	updated.State.TypedSpec().Value = worker.State.TypedSpec().Value
+
+	require.NoError(t, runSteps(ctx, t, p, updated))
+
+	vm, ok = srv.VM("pve2", vm.ID)
+	require.True(t, ok)
+
+	assert.Equal(t, []string{""}, ruleTargets(vm.FirewallRules))
+	assert.Equal(t, "icmp", vm.FirewallRules[0].Proto)
+
+	err := runSteps(ctx, t, p, newProvisionContext("machine-3", baseMachineClass+`firewall:
+  security_groups:
+    - k8s
+`, nil))
+	require.ErrorContains(t, err, `step syncFirewall failed: firewall security group "k8s" does not exist`)
+
+	// the firewall config is removed with the VM
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), controlPlane.State, controlPlane.MachineRequest))
+
+	_, ok = srv.VM("pve1", int(controlPlane.State.TypedSpec().Value.Vmid))
+	assert.False(t, ok)
+}
+
+// ruleTargets returns the security groups and the destination ports of the firewall rules.
+func ruleTargets(rules []fakeproxmox.FirewallRule) []string {
+	targets := make([]string, 0, len(rules))
+
+	for _, rule := range rules {
+		if rule.Type == "group" {
+			targets = append(targets, rule.Action)
+
+			continue
+		}
+
+		targets = append(targets, rule.DPort)
+	}
+
+	return targets
+}
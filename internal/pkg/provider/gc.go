@@ -0,0 +1,491 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/safe"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/luthermonson/go-proxmox"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+const (
+	orphanKindVM    = "vm"
+	orphanKindISO   = "iso"
+	orphanKindImage = "image"
+)
+
+var (
+	// isoNameRe matches the ISO names generated by the uploadISO step: the hash of the image URL.
+	isoNameRe = regexp.MustCompile(`^[0-9a-f]{64}\.iso$`)
+
+	// imageNameRe matches the disk image names the templates are imported from: the hash of the image URL.
+	imageNameRe = regexp.MustCompile(`^[0-9a-f]{64}\.qcow2$`)
+)
+
+// GCOptions configures the garbage collection of the VMs, the ISOs and the disk images which don't belong to any machine.
+type GCOptions struct {
+	// Interval is the period of the garbage collection.
+	Interval time.Duration
+	// GracePeriod is the minimal age of the orphaned VM, ISO or disk image to be removed.
+	GracePeriod time.Duration
+	// DryRun only reports the orphans.
+	DryRun bool
+}
+
+// Orphan is the VM, the ISO or the disk image left on Proxmox without a machine.
+type Orphan struct {
+	Created time.Time
+	// Kind is either vm, iso or image.
+	Kind    string
+	Cluster string
+	Node    string
+	// ID is the VMID or the volume ID of the ISO or the disk image.
+	ID string
+	// Name is the VM name.
+	Name string
+}
+
+type clusterVM struct {
+	Node   string `json:"node"`
+	Name   string `json:"name"`
+	Tags   string `json:"tags"`
+	Status string `json:"status"`
+	// Type is either qemu or lxc.
+	Type     string `json:"type"`
+	VMID     int    `json:"vmid"`
+	Template int    `json:"template"`
+}
+
+// clusterVMConfig is the QEMU VM of the cluster with its config.
+type clusterVMConfig struct {
+	config map[string]string
+	clusterVM
+}
+
+// qemuVMs returns the QEMU VMs on the online nodes of the cluster with their configs, the containers are skipped.
+// The VMs which config can't be read are skipped as well, so that a single VM doesn't stop the walk over the cluster,
+// complete reports whether the configs of all the VMs are read.
+func (p *Provisioner) qemuVMs(ctx context.Context, logger *zap.Logger, client *proxmox.Client) (vms []clusterVMConfig, complete bool, err error) {
+	nodes, err := client.Nodes(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	onlineNodes := map[string]struct{}{}
+
+	for _, node := range nodes {
+		if node.Status == "online" {
+			onlineNodes[node.Node] = struct{}{}
+		}
+	}
+
+	var list []clusterVM
+
+	if err = client.Get(ctx, "/cluster/resources?type=vm", &list); err != nil {
+		return nil, false, fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	complete = true
+
+	for _, vm := range list {
+		if vm.Type != "qemu" {
+			continue
+		}
+
+		if _, online := onlineNodes[vm.Node]; !online {
+			complete = false
+
+			continue
+		}
+
+		config, err := p.vmConfig(ctx, client, vm.Node, vm.VMID)
+		if err != nil {
+			// the VM might be removed in the meantime
+			if strings.Contains(err.Error(), "does not exist") {
+				continue
+			}
+
+			logger.Warn("skipping the VM with the config which can't be read", zap.String("node", vm.Node), zap.Int("vmid", vm.VMID), zap.Error(err))
+
+			complete = false
+
+			continue
+		}
+
+		vms = append(vms, clusterVMConfig{clusterVM: vm, config: config})
+	}
+
+	return vms, complete, nil
+}
+
+// collectGarbage removes the VMs tagged by the provider, the ISOs and the disk images downloaded by the provider which are not used by any of the machines.
+// The VMs, the ISOs and the disk images younger than the grace period are kept, as the machines might have not recorded them yet.
+// The clusters are collected independently, the failure to reach one of them doesn't stop the collection in the others.
+func (p *Provisioner) collectGarbage(ctx context.Context, logger *zap.Logger, machines []*specs.MachineSpec, opts GCOptions) ([]Orphan, error) {
+	ownedVMs := map[string]struct{}{}
+	ownedVolumes := map[string]struct{}{}
+
+	for _, machine := range machines {
+		if machine.Vmid != 0 {
+			// the VMIDs are unique in the cluster, the node is not part of the key as the VM can be moved to another node
+			ownedVMs[fmt.Sprintf("%s/%d", cmp.Or(machine.Cluster, DefaultCluster), machine.Vmid)] = struct{}{}
+		}
+
+		// the ISO is recorded by the name, the disk image the template is imported from by the volume ID
+		if machine.VolumeId != "" {
+			ownedVolumes[machine.VolumeId] = struct{}{}
+		}
+	}
+
+	var (
+		orphans []Orphan
+		errs    []error
+	)
+
+	clusters, _ := p.snapshot()
+
+	for _, cluster := range slices.Sorted(maps.Keys(clusters)) {
+		clusterOrphans, err := p.collectClusterGarbage(ctx, logger, cluster, clusters[cluster].client, ownedVMs, maps.Clone(ownedVolumes), opts)
+
+		orphans = append(orphans, clusterOrphans...)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %q: %w", cluster, err))
+		}
+	}
+
+	return orphans, errors.Join(errs...)
+}
+
+//nolint:gocognit,gocyclo,cyclop
+func (p *Provisioner) collectClusterGarbage(
+	ctx context.Context, logger *zap.Logger, cluster string, client *proxmox.Client, ownedVMs, ownedVolumes map[string]struct{}, opts GCOptions,
+) ([]Orphan, error) {
+	vms, complete, err := p.qemuVMs(ctx, logger, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+
+	now := time.Now()
+
+	for _, vm := range vms {
+		if vm.Template == 1 {
+			continue
+		}
+
+		// the ISOs attached to any VM are kept, even if the VM is created by another provider instance
+		for _, value := range vm.config {
+			if volID, _, _ := strings.Cut(value, ","); strings.Contains(value, "media=cdrom") {
+				if _, name, ok := strings.Cut(volID, "iso/"); ok {
+					ownedVolumes[name] = struct{}{}
+				}
+			}
+		}
+
+		if !slices.Contains(splitTags(vm.Tags), providerTag()) {
+			continue
+		}
+
+		if _, ok := ownedVMs[fmt.Sprintf("%s/%d", cluster, vm.VMID)]; ok {
+			continue
+		}
+
+		created, ok := vmCreated(vm.config["meta"])
+		if !ok {
+			logger.Warn("skipping the orphaned VM with unknown creation time", zap.String("cluster", cluster), zap.String("node", vm.Node), zap.Int("vmid", vm.VMID))
+
+			continue
+		}
+
+		if now.Sub(created) < opts.GracePeriod {
+			continue
+		}
+
+		orphans = append(orphans, Orphan{
+			Kind:    orphanKindVM,
+			Cluster: cluster,
+			Node:    vm.Node,
+			ID:      strconv.Itoa(vm.VMID),
+			Name:    vm.Name,
+			Created: created,
+		})
+
+		if opts.DryRun {
+			continue
+		}
+
+		if err = p.removeVM(ctx, client, vm.clusterVM); err != nil {
+			return orphans, fmt.Errorf("failed to remove the orphaned VM %d: %w", vm.VMID, err)
+		}
+	}
+
+	// the ISOs attached to the VMs which configs are not read might be still in use
+	if !complete {
+		logger.Info("skipping the ISOs and the disk images, as not all VMs are read", zap.String("cluster", cluster))
+
+		return orphans, nil
+	}
+
+	nodes, err := client.Nodes(ctx)
+	if err != nil {
+		return orphans, err
+	}
+
+	seen := map[string]struct{}{}
+
+	for _, nodeStatus := range nodes {
+		if nodeStatus.Status != "online" {
+			continue
+		}
+
+		node, err := client.Node(ctx, nodeStatus.Node)
+		if err != nil {
+			return orphans, err
+		}
+
+		storages, err := node.Storages(ctx)
+		if err != nil {
+			return orphans, err
+		}
+
+		for _, storage := range storages {
+			if storage.Enabled == 0 {
+				continue
+			}
+
+			for _, volumes := range []struct {
+				nameRe  *regexp.Regexp
+				content string
+				kind    string
+			}{
+				{content: "iso", kind: orphanKindISO, nameRe: isoNameRe},
+				{content: "import", kind: orphanKindImage, nameRe: imageNameRe},
+			} {
+				if !slices.Contains(strings.Split(storage.Content, ","), volumes.content) {
+					continue
+				}
+
+				var content []struct {
+					VolID string `json:"volid"`
+					CTime int64  `json:"ctime"`
+				}
+
+				if err = client.Get(ctx, fmt.Sprintf("/nodes/%s/storage/%s/content?content=%s", node.Name, storage.Name, volumes.content), &content); err != nil {
+					return orphans, fmt.Errorf("failed to list the %s content on storage %q: %w", volumes.content, storage.Name, err)
+				}
+
+				for _, volume := range content {
+					// shared storages are listed on every node
+					if _, ok := seen[volume.VolID]; ok {
+						continue
+					}
+
+					seen[volume.VolID] = struct{}{}
+
+					_, name, _ := strings.Cut(volume.VolID, volumes.content+"/")
+
+					if !volumes.nameRe.MatchString(name) {
+						continue
+					}
+
+					// the machines record the ISO by the name and the disk image by the volume ID
+					_, ownedName := ownedVolumes[name]
+					_, ownedID := ownedVolumes[volume.VolID]
+
+					if ownedName || ownedID {
+						continue
+					}
+
+					created := time.Unix(volume.CTime, 0)
+
+					if now.Sub(created) < opts.GracePeriod {
+						continue
+					}
+
+					orphans = append(orphans, Orphan{
+						Kind:    volumes.kind,
+						Cluster: cluster,
+						Node:    node.Name,
+						ID:      volume.VolID,
+						Created: created,
+					})
+
+					if opts.DryRun {
+						continue
+					}
+
+					var upid proxmox.UPID
+
+					if err = client.Delete(ctx, fmt.Sprintf("/nodes/%s/storage/%s/content/%s", node.Name, storage.Name, url.PathEscape(volume.VolID)), &upid); err != nil {
+						return orphans, fmt.Errorf("failed to remove the orphaned %s %q: %w", volumes.kind, volume.VolID, err)
+					}
+
+					// older Proxmox versions remove the volume synchronously
+					if upid != "" {
+						if err = p.waitForTaskToFinish(ctx, proxmox.NewTask(upid, client)); err != nil {
+							return orphans, err
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+func (p *Provisioner) vmConfig(ctx context.Context, client *proxmox.Client, node string, vmid int) (map[string]string, error) {
+	var config map[string]json.RawMessage
+
+	if err := client.Get(ctx, fmt.Sprintf("/nodes/%s/qemu/%d/config", node, vmid), &config); err != nil {
+		return nil, fmt.Errorf("failed to get the VM %d config: %w", vmid, err)
+	}
+
+	result := make(map[string]string, len(config))
+
+	for key, value := range config {
+		result[key] = configValue(value)
+	}
+
+	return result, nil
+}
+
+// configValue returns the VM config value as a string, the numbers are kept as Proxmox sends them, e.g. 1048576 rather than 1.048576e+06.
+func configValue(value json.RawMessage) string {
+	var s string
+
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+
+	return string(value)
+}
+
+// removeVM stops and destroys the VM, removing it from the HA resources and the backup jobs as well.
+func (p *Provisioner) removeVM(ctx context.Context, client *proxmox.Client, vm clusterVM) error {
+	path := fmt.Sprintf("/nodes/%s/qemu/%d", vm.Node, vm.VMID)
+
+	if vm.Status == "running" {
+		var upid proxmox.UPID
+
+		if err := client.Post(ctx, path+"/status/stop", nil, &upid); err != nil {
+			return err
+		}
+
+		if err := p.waitForTaskToFinish(ctx, proxmox.NewTask(upid, client)); err != nil {
+			return err
+		}
+	}
+
+	var upid proxmox.UPID
+
+	if err := client.Delete(ctx, path+"?purge=1", &upid); err != nil {
+		return err
+	}
+
+	return p.waitForTaskToFinish(ctx, proxmox.NewTask(upid, client))
+}
+
+// vmCreated reads the VM creation time from the meta config option, e.g. "creation-qemu=9.2.0,ctime=1700000000".
+func vmCreated(meta string) (time.Time, bool) {
+	for property := range strings.SplitSeq(meta, ",") {
+		if value, ok := strings.CutPrefix(property, "ctime="); ok {
+			ctime, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+
+			return time.Unix(ctime, 0), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// GarbageCollector periodically removes the VMs, the ISOs and the disk images which don't belong to any of the provider Machine resources.
+type GarbageCollector struct {
+	state       state.State
+	provisioner *Provisioner
+	options     GCOptions
+}
+
+// NewGarbageCollector creates a new GarbageCollector, the state is the Omni state which has the Machine resources.
+func NewGarbageCollector(provisioner *Provisioner, st state.State, options GCOptions) *GarbageCollector {
+	return &GarbageCollector{
+		state:       st,
+		provisioner: provisioner,
+		options:     options,
+	}
+}
+
+// Run collects the garbage every interval until the context is canceled.
+func (gc *GarbageCollector) Run(ctx context.Context, logger *zap.Logger) {
+	ticker := time.NewTicker(gc.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := gc.collect(ctx, logger); err != nil {
+			logger.Error("failed to collect the orphaned VMs, ISOs and disk images", zap.Error(err))
+		}
+	}
+}
+
+func (gc *GarbageCollector) collect(ctx context.Context, logger *zap.Logger) error {
+	// the garbage is never collected without the full list of the machines
+	machines, err := safe.StateListAll[*resources.Machine](ctx, gc.state)
+	if err != nil {
+		return err
+	}
+
+	machineSpecs := make([]*specs.MachineSpec, 0, machines.Len())
+
+	for machine := range machines.All() {
+		machineSpecs = append(machineSpecs, machine.TypedSpec().Value)
+	}
+
+	orphans, err := gc.provisioner.collectGarbage(ctx, logger, machineSpecs, gc.options)
+
+	for _, orphan := range orphans {
+		message := "removed the orphaned " + orphan.Kind
+		if gc.options.DryRun {
+			message = "found the orphaned " + orphan.Kind
+		}
+
+		logger.Info(message,
+			zap.String("cluster", orphan.Cluster),
+			zap.String("node", orphan.Node),
+			zap.String("id", orphan.ID),
+			zap.String("name", orphan.Name),
+			zap.Time("created", orphan.Created),
+		)
+	}
+
+	return err
+}
@@ -0,0 +1,200 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	machines := []*specs.MachineSpec{pctx.State.TypedSpec().Value}
+
+	created := fmt.Sprintf("creation-qemu=9.2.0,ctime=%d", time.Now().Add(-2*time.Hour).Unix())
+	orphanISO := "local:iso/" + strings.Repeat("a", 64) + ".iso"
+	otherISO := "local:iso/" + strings.Repeat("b", 64) + ".iso"
+	orphanImage := "local:import/" + strings.Repeat("c", 64) + ".qcow2"
+
+	// the VM left after the provider crash
+	srv.AddVM(fakeproxmox.VM{ID: 200, Node: "pve1", Status: "running", Config: map[string]string{
+		"name": "machine-2",
+		"tags": "omni-provider.proxmox",
+		"meta": created,
+	}})
+
+	// the VM created by another provider instance using the ISO which is not known to this instance
+	srv.AddVM(fakeproxmox.VM{ID: 201, Node: "pve1", Status: "running", Config: map[string]string{
+		"name": "machine-3",
+		"tags": "omni-provider.other",
+		"meta": created,
+		"ide2": otherISO + ",media=cdrom",
+	}})
+
+	// the VM which is not managed by any provider
+	srv.AddVM(fakeproxmox.VM{ID: 202, Node: "pve1", Config: map[string]string{
+		"name": "router",
+		"meta": created,
+	}})
+
+	// the container doesn't have the QEMU config
+	srv.AddContainer("pve1", 300)
+
+	srv.AddVolume("pve1", orphanISO, 100*1024*1024)
+	srv.AddVolume("pve1", otherISO, 100*1024*1024)
+	srv.AddVolume("pve1", "local:iso/debian.iso", 100*1024*1024)
+	srv.AddVolume("pve1", orphanImage, 100*1024*1024)
+	srv.AddVolume("pve1", "local:import/debian.qcow2", 100*1024*1024)
+
+	orphans, err := provider.CollectGarbage(ctx, p, machines, 0, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"vm 200", "iso " + orphanISO, "image " + orphanImage}, orphanIDs(orphans))
+	assert.Len(t, srv.VMs("pve1"), 4)
+	assert.True(t, srv.HasVolume("pve1", orphanISO))
+
+	// the ISO is younger than the grace period
+	orphans, err = provider.CollectGarbage(ctx, p, machines, time.Hour, false)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"vm 200"}, orphanIDs(orphans))
+	assert.Equal(t, "machine-2", orphans[0].Name)
+
+	_, ok := srv.VM("pve1", 200)
+	assert.False(t, ok)
+	assert.True(t, srv.HasVolume("pve1", orphanISO))
+
+	orphans, err = provider.CollectGarbage(ctx, p, machines, 0, false)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"iso " + orphanISO, "image " + orphanImage}, orphanIDs(orphans))
+	assert.False(t, srv.HasVolume("pve1", orphanISO))
+	assert.False(t, srv.HasVolume("pve1", orphanImage))
+	assert.True(t, srv.HasVolume("pve1", "local:import/debian.qcow2"))
+	assert.True(t, srv.HasVolume("pve1", otherISO))
+	assert.True(t, srv.HasVolume("pve1", "local:iso/debian.iso"))
+	assert.True(t, srv.HasVolume("pve1", "local:iso/"+pctx.State.TypedSpec().Value.VolumeId))
+	assert.Len(t, srv.VMs("pve1"), 3)
+
+	// the VM of the machine which is not recorded yet is kept during the grace period
+	orphans, err = provider.CollectGarbage(ctx, p, nil, time.Hour, false)
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+}
+
+func TestCollectGarbageMovedVM(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`node: pve1
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	// the VM is moved by the HA manager, the machine still records the node it was created on
+	vmid := int(pctx.State.TypedSpec().Value.Vmid)
+	srv.MoveVM("pve1", vmid, "pve2")
+
+	orphans, err := provider.CollectGarbage(ctx, p, []*specs.MachineSpec{pctx.State.TypedSpec().Value}, 0, false)
+	require.NoError(t, err)
+
+	assert.Empty(t, orphans)
+
+	_, ok := srv.VM("pve2", vmid)
+	assert.True(t, ok)
+}
+
+func TestCollectGarbageTemplateImage(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`provision_mode: template
+node: pve1
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	spec := pctx.State.TypedSpec().Value
+	require.True(t, srv.HasVolume("pve1", spec.VolumeId))
+
+	// the VM on the offline node might use the ISOs, the volumes are kept then
+	srv.AddVM(fakeproxmox.VM{ID: 300, Node: "pve2"})
+	srv.SetNodeStatus("pve2", "offline")
+
+	orphans, err := provider.CollectGarbage(ctx, p, nil, 0, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vm " + strconv.Itoa(int(spec.Vmid))}, orphanIDs(orphans))
+
+	srv.SetNodeStatus("pve2", "online")
+
+	// the disk image the template is imported from is kept while the machine references it
+	orphans, err = provider.CollectGarbage(ctx, p, []*specs.MachineSpec{spec}, 0, false)
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	orphans, err = provider.CollectGarbage(ctx, p, []*specs.MachineSpec{{Cluster: spec.Cluster, Vmid: spec.Vmid}}, 0, true)
+	require.NoError(t, err)
+	assert.Contains(t, orphanIDs(orphans), "image "+spec.VolumeId)
+}
+
+func orphanIDs(orphans []provider.Orphan) []string {
+	ids := make([]string, 0, len(orphans))
+
+	for _, orphan := range orphans {
+		ids = append(ids, orphan.Kind+" "+orphan.ID)
+	}
+
+	return ids
+}
+
+func TestConfigValue(t *testing.T) {
+	t.Parallel()
+
+	for raw, expected := range map[string]string{
+		`"virtio,bridge=vmbr0"`: "virtio,bridge=vmbr0",
+		`"4096"`:                "4096",
+		`2`:                     "2",
+		`1048576`:               "1048576",
+		`0.5`:                   "0.5",
+	} {
+		assert.Equal(t, expected, provider.ConfigValue(json.RawMessage(raw)), raw)
+	}
+}
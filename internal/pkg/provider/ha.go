@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/luthermonson/go-proxmox"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+const haStateStarted = "started"
+
+var haStates = []string{haStateStarted, "stopped", "enabled", "disabled", "ignored"}
+
+type haResource struct {
+	SID string `json:"sid"`
+}
+
+func haResourceID(vmid int32) string {
+	return fmt.Sprintf("vm:%d", vmid)
+}
+
+// validateHA checks the HA settings before the VM is created, so the invalid settings don't leave the started VM behind.
+func validateHA(ha *HA) error {
+	if ha != nil && ha.State != "" && !slices.Contains(haStates, ha.State) {
+		return fmt.Errorf("invalid HA state %q: should be one of %s", ha.State, strings.Join(haStates, ", "))
+	}
+
+	return nil
+}
+
+// registerHA registers the VM as the Proxmox HA resource, the existing resource is updated to match the machine config.
+func (p *Provisioner) registerHA(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+	var data Data
+
+	if err := pctx.UnmarshalProviderData(&data); err != nil {
+		return err
+	}
+
+	if data.HA == nil {
+		return nil
+	}
+
+	state := data.HA.State
+	if state == "" {
+		state = haStateStarted
+	}
+
+	params := map[string]any{
+		"state":   state,
+		"comment": fmt.Sprintf("Omni machine %s", pctx.GetRequestID()),
+	}
+
+	if data.HA.Group != "" {
+		params["group"] = data.HA.Group
+	}
+
+	if data.HA.MaxRestart != nil {
+		params["max_restart"] = *data.HA.MaxRestart
+	}
+
+	if data.HA.MaxRelocate != nil {
+		params["max_relocate"] = *data.HA.MaxRelocate
+	}
+
+	client, err := p.client(pctx.State.TypedSpec().Value.Cluster)
+	if err != nil {
+		return err
+	}
+
+	sid := haResourceID(pctx.State.TypedSpec().Value.Vmid)
+
+	var haResources []haResource
+
+	if err = client.Get(ctx, "/cluster/ha/resources", &haResources); err != nil {
+		return fmt.Errorf("failed to list HA resources: %w", err)
+	}
+
+	if slices.ContainsFunc(haResources, func(r haResource) bool { return r.SID == sid }) {
+		if err = client.Put(ctx, "/cluster/ha/resources/"+sid, params, nil); err != nil {
+			return fmt.Errorf("failed to update HA resource %s: %w", sid, err)
+		}
+	} else {
+		params["sid"] = sid
+
+		if err = client.Post(ctx, "/cluster/ha/resources", params, nil); err != nil {
+			return fmt.Errorf("failed to register HA resource %s: %w", sid, err)
+		}
+
+		logger.Info("registered the VM as the HA resource", zap.String("sid", sid), zap.String("group", data.HA.Group))
+	}
+
+	pctx.State.TypedSpec().Value.HaResource = sid
+
+	return nil
+}
+
+// unregisterHA removes the HA resource of the VM, so the HA manager doesn't start the VM again while it's being removed.
+// The resource is removed even if it's not recorded in the machine, as the step might have failed to save the state after the resource was registered.
+func (p *Provisioner) unregisterHA(ctx context.Context, logger *zap.Logger, client *proxmox.Client, machine *resources.Machine) error {
+	recorded := machine.TypedSpec().Value.HaResource != ""
+	sid := haResourceID(machine.TypedSpec().Value.Vmid)
+
+	if err := client.Delete(ctx, "/cluster/ha/resources/"+sid, nil); err != nil {
+		if strings.Contains(err.Error(), "no such resource") {
+			return nil
+		}
+
+		// the API token without the privilege to manage the HA resources couldn't have registered the VM
+		if !recorded && proxmox.IsNotAuthorized(err) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to remove HA resource %s: %w", sid, err)
+	}
+
+	logger.Info("removed the HA resource", zap.String("sid", sid))
+
+	return nil
+}
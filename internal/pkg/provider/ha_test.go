@@ -0,0 +1,159 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestProvisionHA(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+	srv.AddHAGroup("control-planes")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	const data = baseMachineClass + `ha:
+  group: control-planes
+  max_restart: 2
+  max_relocate: 0
+`
+
+	pctx := newProvisionContext("machine-1", data, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	spec := pctx.State.TypedSpec().Value
+
+	assert.Equal(t, "vm:100", spec.HaResource)
+
+	resource, ok := srv.HAResource(spec.HaResource)
+	require.True(t, ok)
+
+	assert.Equal(t, map[string]string{
+		"state":        "started",
+		"group":        "control-planes",
+		"max_restart":  "2",
+		"max_relocate": "0",
+		"comment":      "Omni machine machine-1",
+	}, resource)
+
+	// the step is idempotent, the existing resource is updated
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+	assert.Equal(t, 1, srv.Requests(http.MethodPost, "/cluster/ha/resources"))
+	assert.Equal(t, 1, srv.Requests(http.MethodPut, "/cluster/ha/resources/vm:100"))
+
+	// the HA resource is removed before the VM is stopped, otherwise the VM can't be destroyed
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, pctx.MachineRequest))
+
+	_, ok = srv.HAResource(spec.HaResource)
+	assert.False(t, ok)
+	assert.Empty(t, srv.VMs("pve1"))
+
+	pctx = newProvisionContext("machine-2", baseMachineClass+`ha:
+  group: workers
+`, nil)
+
+	err := runSteps(ctx, t, p, pctx)
+	require.ErrorContains(t, err, "failed to register HA resource vm:100")
+	assert.ErrorContains(t, err, "group 'workers' does not exist")
+
+	pctx = newProvisionContext("machine-3", baseMachineClass+`ha:
+  state: running
+`, nil)
+
+	// the invalid state is reported before the VM is created
+	require.ErrorContains(t, runSteps(ctx, t, p, pctx), `step pickNode failed: invalid HA state "running": should be one of started, stopped, enabled, disabled, ignored`)
+	assert.Len(t, srv.VMs("pve1"), 1)
+}
+
+func TestDeprovisionUnrecordedHAResource(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`ha: {}
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	// the resource was registered, but the state wasn't saved
+	sid := pctx.State.TypedSpec().Value.HaResource
+	pctx.State.TypedSpec().Value.HaResource = ""
+
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, pctx.MachineRequest))
+	assert.Empty(t, srv.VMs("pve1"))
+
+	_, ok := srv.HAResource(sid)
+	assert.False(t, ok)
+}
+
+func TestDeprovisionRemovedHAResource(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`ha: {}
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	// the HA resource was removed manually
+	require.NoError(t, srv.Client().Delete(ctx, "/cluster/ha/resources/"+pctx.State.TypedSpec().Value.HaResource, nil))
+
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, pctx.MachineRequest))
+	assert.Empty(t, srv.VMs("pve1"))
+}
+
+func TestDeprovisionMovedVM(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`node: pve1
+ha: {}
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	spec := pctx.State.TypedSpec().Value
+
+	// the HA manager relocated the VM after the node failure
+	srv.MoveVM("pve1", int(spec.Vmid), "pve2")
+
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, pctx.MachineRequest))
+	assert.Empty(t, srv.VMs("pve2"))
+
+	_, ok := srv.HAResource(spec.HaResource)
+	assert.False(t, ok)
+}
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/luthermonson/go-proxmox"
+	"github.com/siderolabs/omni/client/pkg/infra"
+
+	providermeta "github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/meta"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+// CheckProxmox checks that the API of every Proxmox cluster is reachable and accepts the credentials,
+// and that each cluster has an online node with the storage accepting the ISO images.
+func (p *Provisioner) CheckProxmox(ctx context.Context) error {
+	clusters, _ := p.snapshot()
+
+	if len(clusters) == 0 {
+		return errors.New("no Proxmox clusters are configured")
+	}
+
+	var errs []error
+
+	for _, cluster := range slices.Sorted(maps.Keys(clusters)) {
+		if err := checkCluster(ctx, clusters[cluster].client); err != nil {
+			errs = append(errs, fmt.Errorf("cluster %q: %w", cluster, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkCluster(ctx context.Context, client *proxmox.Client) error {
+	// the version endpoint fails if the credentials are not accepted
+	if _, err := client.Version(ctx); err != nil {
+		return fmt.Errorf("failed to reach the Proxmox API: %w", err)
+	}
+
+	nodes, err := client.Nodes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the nodes: %w", err)
+	}
+
+	online := false
+
+	for _, nodeStatus := range nodes {
+		if nodeStatus.Status != "online" {
+			continue
+		}
+
+		online = true
+
+		node, err := client.Node(ctx, nodeStatus.Node)
+		if err != nil {
+			continue
+		}
+
+		if _, err = node.StorageISO(ctx); err == nil {
+			return nil
+		}
+	}
+
+	if !online {
+		return errors.New("no nodes are online")
+	}
+
+	return errors.New("no online nodes have the storage accepting the ISO images")
+}
+
+// CheckOmni checks that the Omni API is reachable and accepts the service account, by reading the provider state.
+func CheckOmni(ctx context.Context, st state.State) error {
+	_, err := st.Get(ctx, resources.NewMachine(infra.ResourceNamespace(providermeta.ProviderID), "healthz").Metadata())
+	if err != nil && !state.IsNotFoundError(err) {
+		return fmt.Errorf("failed to reach Omni: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/luthermonson/go-proxmox"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestCheckProxmox(t *testing.T) {
+	t.Parallel()
+
+	siteA := newFakeProxmox(t, "pve1")
+
+	require.NoError(t, provider.NewProvisioner(siteA.Client()).CheckProxmox(t.Context()))
+
+	require.ErrorContains(t, provider.NewProvisioner(nil).CheckProxmox(t.Context()), "no Proxmox clusters are configured")
+
+	// the API token is not accepted
+	unauthorized := proxmox.NewClient(siteA.URL(), proxmox.WithAPIToken(fakeproxmox.TokenID, "wrong"))
+
+	require.ErrorContains(t, provider.NewProvisioner(unauthorized).CheckProxmox(t.Context()), `cluster "default": failed to reach the Proxmox API`)
+
+	// no nodes are online
+	siteB := fakeproxmox.NewServer()
+	t.Cleanup(siteB.Close)
+
+	siteB.AddNode(fakeproxmox.Node{Name: "pve1", Status: "offline"})
+
+	p := provider.NewProvisioner(siteA.Client(), provider.WithCluster("site-b", siteB.Client(), nil))
+
+	require.EqualError(t, p.CheckProxmox(t.Context()), `cluster "site-b": no nodes are online`)
+
+	// the online node doesn't have the ISO storage
+	siteB.AddNode(fakeproxmox.Node{Name: "pve2"})
+	siteB.AddStorage("pve2", fakeproxmox.Storage{Name: "local-lvm", Type: "lvmthin", Content: []string{"images"}, Total: 1024 * gib})
+
+	require.EqualError(t, p.CheckProxmox(t.Context()), `cluster "site-b": no online nodes have the storage accepting the ISO images`)
+
+	siteB.AddStorage("pve2", fakeproxmox.Storage{Name: "local", Content: []string{"iso"}, Total: 100 * gib})
+
+	require.NoError(t, p.CheckProxmox(t.Context()))
+}
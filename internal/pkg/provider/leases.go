@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/cosi-project/runtime/pkg/safe"
+	"github.com/cosi-project/runtime/pkg/state"
+	"github.com/siderolabs/omni/client/pkg/infra"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+	providermeta "github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/meta"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+// LeaseStore keeps the leases of the static addresses as the IPLease resources in the provider state in Omni,
+// next to the Machine resources, so that the leases survive the provider restarts.
+type LeaseStore struct {
+	state state.State
+}
+
+// NewLeaseStore creates a new LeaseStore, resources.RegisterIPLease should be called before.
+func NewLeaseStore(st state.State) *LeaseStore {
+	return &LeaseStore{state: st}
+}
+
+// Create implements ipam.Store.
+func (s *LeaseStore) Create(ctx context.Context, lease ipam.Lease) error {
+	res := resources.NewIPLease(infra.ResourceNamespace(providermeta.ProviderID), lease.Address.Addr().String())
+	res.TypedSpec().Value.Address = lease.Address.String()
+	res.TypedSpec().Value.Pool = lease.Pool
+	res.TypedSpec().Value.Machine = lease.Owner
+	res.TypedSpec().Value.Nic = int32(lease.NIC)
+
+	err := s.state.Create(ctx, res)
+	if state.IsConflictError(err) {
+		return ipam.ErrLeased
+	}
+
+	return err
+}
+
+// Delete implements ipam.Store.
+func (s *LeaseStore) Delete(ctx context.Context, addr netip.Addr) error {
+	err := s.state.Destroy(ctx, resources.NewIPLease(infra.ResourceNamespace(providermeta.ProviderID), addr.String()).Metadata())
+	if err != nil && !state.IsNotFoundError(err) {
+		return err
+	}
+
+	return nil
+}
+
+// List implements ipam.Store.
+func (s *LeaseStore) List(ctx context.Context) ([]ipam.Lease, error) {
+	list, err := safe.StateListAll[*resources.IPLease](ctx, s.state)
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make([]ipam.Lease, 0, list.Len())
+
+	for res := range list.All() {
+		spec := res.TypedSpec().Value
+
+		address, err := netip.ParsePrefix(spec.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q of the lease %s: %w", spec.Address, res.Metadata().ID(), err)
+		}
+
+		leases = append(leases, ipam.Lease{
+			Address: address,
+			Pool:    spec.Pool,
+			Owner:   spec.Machine,
+			NIC:     int(spec.Nic),
+		})
+	}
+
+	return leases, nil
+}
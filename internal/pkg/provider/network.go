@@ -0,0 +1,601 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/luthermonson/go-proxmox"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+	"go.yaml.in/yaml/v4"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+// dhcpNetworkConfig is the network-config of the VMs which NICs use DHCP.
+const dhcpNetworkConfig = "version: 1"
+
+// nicConfig is the network the VM NIC is attached to and its guest network settings.
+type nicConfig struct {
+	ip          *IPConfig
+	clusterVNet *ClusterVNet
+	bridge      string
+	vnet        string
+	subnet      string
+	vlan        uint64
+	mtu         int
+}
+
+// nicConfigs returns the network settings of the VM NICs, the primary NIC is the first one.
+func (data Data) nicConfigs() []nicConfig {
+	nics := []nicConfig{{
+		ip:          data.IP,
+		clusterVNet: data.NetworkClusterVNet,
+		bridge:      data.NetworkBridge,
+		vnet:        data.NetworkVNet,
+		subnet:      data.NetworkSubnet,
+		vlan:        data.Vlan,
+		mtu:         data.MTU,
+	}}
+
+	for _, nic := range data.AdditionalNICs {
+		nics = append(nics, nicConfig{
+			ip:          nic.IP,
+			clusterVNet: nic.ClusterVNet,
+			bridge:      nic.Bridge,
+			vnet:        nic.VNet,
+			subnet:      nic.Subnet,
+			vlan:        nic.Vlan,
+			mtu:         nic.MTU,
+		})
+	}
+
+	return nics
+}
+
+// bridgeName returns the name of the bridge the NIC is attached to: the VNet of the Omni cluster, the SDN VNet or the Linux bridge.
+func (nic nicConfig) bridgeName(omniCluster string) string {
+	switch {
+	case nic.clusterVNet != nil:
+		return clusterVNetName(omniCluster)
+	case nic.vnet != "":
+		return nic.vnet
+	default:
+		return nic.bridge
+	}
+}
+
+// pool returns the address pool of the NIC: the pool from the provider config referred by the name, or the subnet set in the machine class.
+func (p *Provisioner) pool(ip *IPConfig) (ipam.Pool, error) {
+	if ip.Pool == "" {
+		return inlinePool(ip), nil
+	}
+
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+
+	pool, ok := p.pools[ip.Pool]
+	if !ok {
+		return ipam.Pool{}, fmt.Errorf("unknown address pool %q", ip.Pool)
+	}
+
+	return pool, nil
+}
+
+// inlinePool converts the subnet set in the machine class to the pool without the name.
+func inlinePool(ip *IPConfig) ipam.Pool {
+	pool := ipam.Pool{
+		CIDR:    ip.CIDR,
+		Gateway: ip.Gateway,
+	}
+
+	if ip.Range != "" {
+		pool.Ranges = []string{ip.Range}
+	}
+
+	return pool
+}
+
+// allocateAddresses leases the static addresses of the VM NICs from their pools and records them in the machine spec,
+// the addresses are allocated once, before the VM is created.
+//
+//nolint:gocognit
+func (p *Provisioner) allocateAddresses(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+	var data Data
+
+	if err := pctx.UnmarshalProviderData(&data); err != nil {
+		return err
+	}
+
+	if err := validateNetwork(data); err != nil {
+		return err
+	}
+
+	spec := pctx.State.TypedSpec().Value
+
+	var inUse func(netip.Addr) bool
+
+	for i, nic := range data.nicConfigs() {
+		if nic.ip == nil {
+			continue
+		}
+
+		pool, err := p.pool(nic.ip)
+		if err == nil && pool.CIDR == "" && nic.subnet != "" {
+			pool, err = p.subnetPool(ctx, spec.Cluster, nic)
+		}
+
+		if err != nil {
+			return fmt.Errorf("net%d: %w", i, err)
+		}
+
+		backend, err := p.ipamBackend(pool)
+		if err != nil {
+			return fmt.Errorf("net%d: %w", i, err)
+		}
+
+		// the address recorded in the machine is leased again, e.g. if the lease was lost
+		if index := slices.IndexFunc(spec.Addresses, func(address *specs.NICAddress) bool { return int(address.Nic) == i }); index != -1 {
+			address, err := netip.ParsePrefix(spec.Addresses[index].Address)
+			if err != nil {
+				return fmt.Errorf("invalid address %q allocated to net%d: %w", spec.Addresses[index].Address, i, err)
+			}
+
+			if err = backend.Reserve(ctx, ipam.Lease{Address: address, Pool: pool.String(), Owner: pctx.GetRequestID(), NIC: i}); err != nil {
+				return fmt.Errorf("net%d: %w", i, err)
+			}
+
+			continue
+		}
+
+		// the external IPAMs know the addresses in use better than the VM configs
+		if inUse == nil && backend == p.ipam {
+			used, err := p.usedAddresses(ctx, logger, spec.Cluster)
+			if err != nil {
+				return err
+			}
+
+			inUse = func(addr netip.Addr) bool {
+				_, ok := used[addr]
+
+				return ok
+			}
+		}
+
+		lease, err := backend.Allocate(ctx, pool, pctx.GetRequestID(), i, inUse)
+		if err != nil {
+			return fmt.Errorf("net%d: %w", i, err)
+		}
+
+		spec.Addresses = append(spec.Addresses, &specs.NICAddress{
+			Nic:     int32(i),
+			Address: lease.Address.String(),
+			Gateway: pool.Gateway,
+		})
+
+		logger.Info("allocated the static address", zap.String("nic", fmt.Sprintf("net%d", i)), zap.String("address", lease.Address.String()),
+			zap.String("pool", pool.String()))
+	}
+
+	return nil
+}
+
+// vmAddressesTTL is how long the addresses of the VMs are reused by the next allocations, e.g. when the machines of a machine set are created together.
+// The addresses allocated by the provider in the meantime are leased in the IPAM, so they are never reused.
+const vmAddressesTTL = 10 * time.Second
+
+type vmAddresses struct {
+	read      time.Time
+	addresses map[netip.Addr]struct{}
+}
+
+// usedAddresses returns the addresses of the existing VMs in the cluster, so that they are not allocated to the new VMs:
+// the static addresses set in the cloud-init options of the VMs, and the addresses the guest agent reports for the running VMs.
+// The containers, the VMs on the offline nodes and the VMs which config can't be read are skipped.
+//
+//nolint:gocognit
+func (p *Provisioner) usedAddresses(ctx context.Context, logger *zap.Logger, cluster string) (map[netip.Addr]struct{}, error) {
+	p.addressMu.Lock()
+	defer p.addressMu.Unlock()
+
+	if cached, ok := p.vmAddresses[cluster]; ok && time.Since(cached.read) < vmAddressesTTL {
+		return cached.addresses, nil
+	}
+
+	client, err := p.client(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	vms, _, err := p.qemuVMs(ctx, logger, client)
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[netip.Addr]struct{}{}
+
+	for _, vm := range vms {
+		if vm.Template == 1 {
+			continue
+		}
+
+		for key, value := range vm.config {
+			if !strings.HasPrefix(key, "ipconfig") {
+				continue
+			}
+
+			for option := range strings.SplitSeq(value, ",") {
+				name, address, _ := strings.Cut(option, "=")
+				if name != "ip" && name != "ip6" {
+					continue
+				}
+
+				if prefix, err := netip.ParsePrefix(address); err == nil {
+					used[prefix.Addr()] = struct{}{}
+				}
+			}
+		}
+
+		if vm.Status != "running" {
+			continue
+		}
+
+		// the guest agent might be not installed or not running, the VM is skipped then
+		var agent struct {
+			Result []struct {
+				IPAddresses []struct {
+					IPAddress string `json:"ip-address"`
+				} `json:"ip-addresses"`
+			} `json:"result"`
+		}
+
+		if err = client.Get(ctx, fmt.Sprintf("/nodes/%s/qemu/%d/agent/network-get-interfaces", vm.Node, vm.VMID), &agent); err != nil {
+			continue
+		}
+
+		for _, iface := range agent.Result {
+			for _, address := range iface.IPAddresses {
+				if addr, err := netip.ParseAddr(address.IPAddress); err == nil && addr.IsGlobalUnicast() {
+					used[addr] = struct{}{}
+				}
+			}
+		}
+	}
+
+	if p.vmAddresses == nil {
+		p.vmAddresses = map[string]vmAddresses{}
+	}
+
+	p.vmAddresses[cluster] = vmAddresses{read: time.Now(), addresses: used}
+
+	return used, nil
+}
+
+// ipamBackend returns the IPAM the addresses of the pool are allocated by.
+func (p *Provisioner) ipamBackend(pool ipam.Pool) (ipam.IPAM, error) {
+	if pool.Backend == "" || pool.Backend == ipam.BackendBuiltin {
+		return p.ipam, nil
+	}
+
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+
+	backend, ok := p.externalIPAM[pool.Backend]
+	if !ok {
+		return nil, fmt.Errorf("pool %s: the %s IPAM is not configured", pool, pool.Backend)
+	}
+
+	return backend, nil
+}
+
+// ipamBackends returns the built-in IPAM and the configured external IPAMs.
+func (p *Provisioner) ipamBackends() []ipam.IPAM {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+
+	backends := []ipam.IPAM{p.ipam}
+
+	for _, name := range slices.Sorted(maps.Keys(p.externalIPAM)) {
+		backends = append(backends, p.externalIPAM[name])
+	}
+
+	return backends
+}
+
+// assignAddresses records the VMID in the leases of the static addresses allocated to the machine.
+func (p *Provisioner) assignAddresses(ctx context.Context, requestID string, vmid int) error {
+	for _, backend := range p.ipamBackends() {
+		if err := backend.Assign(ctx, requestID, vmid); err != nil {
+			return fmt.Errorf("failed to record the VM of the static addresses: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// releaseAddresses removes the leases of the static addresses allocated to the machine.
+func (p *Provisioner) releaseAddresses(ctx context.Context, requestID string) error {
+	for _, backend := range p.ipamBackends() {
+		if err := backend.Release(ctx, requestID); err != nil {
+			return fmt.Errorf("failed to release the static addresses: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// networkConfig renders the nocloud network-config of the VM, the NICs are matched by the MAC addresses Proxmox generated.
+func (p *Provisioner) networkConfig(ctx context.Context, client *proxmox.Client, data Data, spec *specs.MachineSpec) (string, error) {
+	nics := data.nicConfigs()
+
+	if len(data.DNSServers) == 0 && len(data.SearchDomains) == 0 && !slices.ContainsFunc(nics, func(nic nicConfig) bool {
+		return nic.ip != nil || nic.mtu != 0
+	}) {
+		return dhcpNetworkConfig, nil
+	}
+
+	config, err := p.vmConfig(ctx, client, spec.Node, int(spec.Vmid))
+	if err != nil {
+		return "", err
+	}
+
+	macs := make([]string, len(nics))
+
+	for i := range nics {
+		model, _, _ := strings.Cut(config[fmt.Sprintf("net%d", i)], ",")
+
+		if _, macs[i], _ = strings.Cut(model, "="); macs[i] == "" {
+			return "", fmt.Errorf("failed to find the MAC address of net%d", i)
+		}
+	}
+
+	return renderNetworkConfig(data, spec.Addresses, macs)
+}
+
+// networkConfigV1 is the nocloud network-config version 1.
+type networkConfigV1 struct {
+	Config  []networkConfigV1Entry `yaml:"config"`
+	Version int                    `yaml:"version"`
+}
+
+type networkConfigV1Entry struct {
+	Type       string                  `yaml:"type"`
+	Name       string                  `yaml:"name,omitempty"`
+	MACAddress string                  `yaml:"mac_address,omitempty"`
+	Subnets    []networkConfigV1Subnet `yaml:"subnets,omitempty"`
+	Address    []string                `yaml:"address,omitempty"`
+	Search     []string                `yaml:"search,omitempty"`
+	MTU        int                     `yaml:"mtu,omitempty"`
+}
+
+type networkConfigV1Subnet struct {
+	Type    string `yaml:"type"`
+	Address string `yaml:"address,omitempty"`
+	Gateway string `yaml:"gateway,omitempty"`
+}
+
+// networkConfigV2 is the nocloud network-config version 2.
+type networkConfigV2 struct {
+	Ethernets map[string]networkConfigV2Ethernet `yaml:"ethernets"`
+	Version   int                                `yaml:"version"`
+}
+
+type networkConfigV2Ethernet struct {
+	Nameservers *networkConfigV2Nameservers `yaml:"nameservers,omitempty"`
+	Match       networkConfigV2Match        `yaml:"match"`
+	Gateway4    string                      `yaml:"gateway4,omitempty"`
+	Gateway6    string                      `yaml:"gateway6,omitempty"`
+	Addresses   []string                    `yaml:"addresses,omitempty"`
+	MTU         int                         `yaml:"mtu,omitempty"`
+	DHCP4       bool                        `yaml:"dhcp4,omitempty"`
+}
+
+type networkConfigV2Match struct {
+	MACAddress string `yaml:"macaddress"`
+}
+
+type networkConfigV2Nameservers struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
+}
+
+// renderNetworkConfig renders the network-config of the NICs with the MAC addresses, the primary NIC is the first one.
+// The NICs without the static addresses use DHCP, the additional NICs without any settings are omitted.
+func renderNetworkConfig(data Data, addresses []*specs.NICAddress, macs []string) (string, error) {
+	nics := data.nicConfigs()
+
+	addressOf := func(i int) (netip.Prefix, *specs.NICAddress, error) {
+		index := slices.IndexFunc(addresses, func(address *specs.NICAddress) bool { return int(address.Nic) == i })
+		if nics[i].ip == nil || index == -1 {
+			return netip.Prefix{}, nil, nil
+		}
+
+		prefix, err := netip.ParsePrefix(addresses[index].Address)
+
+		return prefix, addresses[index], err
+	}
+
+	var config any
+
+	switch data.NetworkConfigVersion {
+	case 0, 1:
+		v1 := networkConfigV1{Version: 1}
+
+		for i, nic := range nics {
+			if i > 0 && nic.ip == nil && nic.mtu == 0 {
+				continue
+			}
+
+			prefix, address, err := addressOf(i)
+			if err != nil {
+				return "", err
+			}
+
+			entry := networkConfigV1Entry{
+				Type:       "physical",
+				Name:       fmt.Sprintf("eth%d", i),
+				MACAddress: macs[i],
+				MTU:        nic.mtu,
+				Subnets:    []networkConfigV1Subnet{{Type: "dhcp"}},
+			}
+
+			if address != nil {
+				entry.Subnets = []networkConfigV1Subnet{{Type: "static", Address: prefix.String(), Gateway: address.Gateway}}
+			}
+
+			v1.Config = append(v1.Config, entry)
+		}
+
+		if len(data.DNSServers) > 0 || len(data.SearchDomains) > 0 {
+			v1.Config = append(v1.Config, networkConfigV1Entry{
+				Type:    "nameserver",
+				Address: data.DNSServers,
+				Search:  data.SearchDomains,
+			})
+		}
+
+		config = v1
+	case 2:
+		v2 := networkConfigV2{Version: 2, Ethernets: map[string]networkConfigV2Ethernet{}}
+
+		for i, nic := range nics {
+			if i > 0 && nic.ip == nil && nic.mtu == 0 {
+				continue
+			}
+
+			prefix, address, err := addressOf(i)
+			if err != nil {
+				return "", err
+			}
+
+			ethernet := networkConfigV2Ethernet{
+				Match: networkConfigV2Match{MACAddress: macs[i]},
+				MTU:   nic.mtu,
+				DHCP4: address == nil,
+			}
+
+			if address != nil {
+				ethernet.Addresses = []string{prefix.String()}
+
+				if prefix.Addr().Is4() {
+					ethernet.Gateway4 = address.Gateway
+				} else {
+					ethernet.Gateway6 = address.Gateway
+				}
+			}
+
+			// the DNS settings are global, they are set on the primary NIC
+			if i == 0 && (len(data.DNSServers) > 0 || len(data.SearchDomains) > 0) {
+				ethernet.Nameservers = &networkConfigV2Nameservers{
+					Addresses: data.DNSServers,
+					Search:    data.SearchDomains,
+				}
+			}
+
+			v2.Ethernets[fmt.Sprintf("net%d", i)] = ethernet
+		}
+
+		config = v2
+	default:
+		return "", fmt.Errorf("unsupported network config version %d: should be 1 or 2", data.NetworkConfigVersion)
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// validateNetwork checks the networks the NICs are attached to and the static addressing settings of the NICs.
+//
+//nolint:gocognit,gocyclo,cyclop
+func validateNetwork(data Data) error {
+	var errs []error
+
+	for i, nic := range data.nicConfigs() {
+		var field string
+
+		// the primary NIC network fields are prefixed with network_, except for the vlan
+		network, vlan := "network_", "vlan"
+
+		if i > 0 {
+			field = fmt.Sprintf("additional_nics[%d].", i-1)
+			network, vlan = field, field+"vlan"
+		}
+
+		attachments := 0
+
+		for _, set := range []bool{nic.bridge != "", nic.vnet != "", nic.clusterVNet != nil} {
+			if set {
+				attachments++
+			}
+		}
+
+		switch {
+		case attachments > 1:
+			errs = append(errs, fmt.Errorf("%sbridge: only one of the bridge, the vnet and the cluster_vnet should be set", network))
+		case attachments == 0 && i > 0:
+			errs = append(errs, fmt.Errorf("%sbridge: either the bridge, the vnet or the cluster_vnet should be set", network))
+		case nic.vlan != 0 && (nic.vnet != "" || nic.clusterVNet != nil):
+			errs = append(errs, fmt.Errorf("%s: the VLAN tag is set by the SDN zone, it can't be set for the VNet", vlan))
+		}
+
+		if nic.subnet != "" && nic.vnet == "" {
+			errs = append(errs, fmt.Errorf("%ssubnet: the subnet should be set with the vnet", network))
+		}
+
+		if nic.clusterVNet != nil {
+			if nic.clusterVNet.Zone == "" {
+				errs = append(errs, fmt.Errorf("%scluster_vnet.zone: should be set", network))
+			}
+
+			if nic.clusterVNet.Tags != "" {
+				if _, _, err := parseTagRange(nic.clusterVNet.Tags); err != nil {
+					errs = append(errs, fmt.Errorf("%scluster_vnet.tags: %w", network, err))
+				}
+			}
+		}
+
+		switch {
+		case nic.ip == nil:
+		case nic.ip.Pool != "" && (nic.ip.CIDR != "" || nic.ip.Range != "" || nic.ip.Gateway != ""):
+			errs = append(errs, fmt.Errorf("%sip: either the pool or the cidr should be set, not both", field))
+		case nic.ip.Pool == "" && nic.ip.CIDR == "" && nic.subnet == "":
+			errs = append(errs, fmt.Errorf("%sip: either the pool or the cidr should be set", field))
+		case nic.ip.Pool == "" && nic.ip.CIDR != "":
+			if err := inlinePool(nic.ip).Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%sip: %w", field, err))
+			}
+		}
+
+		if nic.mtu < 0 {
+			errs = append(errs, fmt.Errorf("%smtu: should be positive", field))
+		}
+	}
+
+	for _, server := range data.DNSServers {
+		if _, err := netip.ParseAddr(server); err != nil {
+			errs = append(errs, fmt.Errorf("dns_servers: invalid address %q", server))
+		}
+	}
+
+	if data.NetworkConfigVersion < 0 || data.NetworkConfigVersion > 2 {
+		errs = append(errs, errors.New("network_config_version: should be 1 or 2"))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,286 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakenetbox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestRenderNetworkConfig(t *testing.T) {
+	t.Parallel()
+
+	data := provider.Data{
+		IP: &provider.IPConfig{
+			CIDR:    "10.5.0.0/24",
+			Gateway: "10.5.0.1",
+		},
+		MTU:           1450,
+		DNSServers:    []string{"10.5.0.2"},
+		SearchDomains: []string{"lab.example.com"},
+		AdditionalNICs: []provider.AdditionalNIC{
+			{Bridge: "vmbr1", MTU: 9000, IP: &provider.IPConfig{CIDR: "fd00:5::/64"}},
+			{Bridge: "vmbr2"},
+			{Bridge: "vmbr3", MTU: 9000},
+		},
+	}
+
+	addresses := []*specs.NICAddress{
+		{Nic: 0, Address: "10.5.0.10/24", Gateway: "10.5.0.1"},
+		{Nic: 1, Address: "fd00:5::1/64"},
+	}
+
+	macs := []string{"BC:24:11:00:00:01", "BC:24:11:00:00:02", "BC:24:11:00:00:03", "BC:24:11:00:00:04"}
+
+	config, err := provider.RenderNetworkConfig(data, addresses, macs)
+	require.NoError(t, err)
+
+	assert.Equal(t, `config:
+    - type: physical
+      name: eth0
+      mac_address: BC:24:11:00:00:01
+      subnets:
+        - type: static
+          address: 10.5.0.10/24
+          gateway: 10.5.0.1
+      mtu: 1450
+    - type: physical
+      name: eth1
+      mac_address: BC:24:11:00:00:02
+      subnets:
+        - type: static
+          address: fd00:5::1/64
+      mtu: 9000
+    - type: physical
+      name: eth3
+      mac_address: BC:24:11:00:00:04
+      subnets:
+        - type: dhcp
+      mtu: 9000
+    - type: nameserver
+      address:
+        - 10.5.0.2
+      search:
+        - lab.example.com
+version: 1
+`, config)
+
+	data.NetworkConfigVersion = 2
+
+	config, err = provider.RenderNetworkConfig(data, addresses, macs)
+	require.NoError(t, err)
+
+	assert.Equal(t, `ethernets:
+    net0:
+        nameservers:
+            addresses:
+                - 10.5.0.2
+            search:
+                - lab.example.com
+        match:
+            macaddress: BC:24:11:00:00:01
+        gateway4: 10.5.0.1
+        addresses:
+            - 10.5.0.10/24
+        mtu: 1450
+    net1:
+        match:
+            macaddress: BC:24:11:00:00:02
+        addresses:
+            - fd00:5::1/64
+        mtu: 9000
+    net3:
+        match:
+            macaddress: BC:24:11:00:00:04
+        mtu: 9000
+        dhcp4: true
+version: 2
+`, config)
+
+	data.NetworkConfigVersion = 3
+
+	_, err = provider.RenderNetworkConfig(data, addresses, macs)
+	require.ErrorContains(t, err, "unsupported network config version 3")
+}
+
+func TestProvisionStaticAddresses(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	const data = baseMachineClass + `ip:
+  cidr: 10.5.0.0/24
+  range: 10.5.0.1-10.5.0.3
+  gateway: 10.5.0.1
+dns_servers:
+  - 10.5.0.1
+additional_nics:
+  - bridge: vmbr1
+    mtu: 9000
+`
+
+	first := newProvisionContext("machine-1", data, nil)
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	second := newProvisionContext("machine-2", data, nil)
+	require.NoError(t, runSteps(ctx, t, p, second))
+
+	// the gateway is not allocated
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.2/24", Gateway: "10.5.0.1"}}, first.State.TypedSpec().Value.Addresses)
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.3/24", Gateway: "10.5.0.1"}}, second.State.TypedSpec().Value.Addresses)
+
+	// the allocation is kept when the steps are run again
+	require.NoError(t, runSteps(ctx, t, p, first))
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.2/24", Gateway: "10.5.0.1"}}, first.State.TypedSpec().Value.Addresses)
+
+	third := newProvisionContext("machine-3", data, nil)
+	require.ErrorContains(t, runSteps(ctx, t, p, third), "net0: pool 10.5.0.0/24: no free addresses left")
+
+	// the address is released with the VM
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), first.State, first.MachineRequest))
+	require.NoError(t, runSteps(ctx, t, p, third))
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.2/24", Gateway: "10.5.0.1"}}, third.State.TypedSpec().Value.Addresses)
+}
+
+func TestProvisionIPPools(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	// the containers and the VMs on the offline nodes are skipped
+	srv.AddContainer("pve1", 300)
+	srv.AddVM(fakeproxmox.VM{ID: 301, Node: "pve2"})
+	srv.SetNodeStatus("pve2", "offline")
+
+	// the addresses of the VMs not managed by the provider are not allocated
+	srv.AddVM(fakeproxmox.VM{
+		ID:     200,
+		Node:   "pve1",
+		Config: map[string]string{"name": "router", "ipconfig0": "ip=10.5.0.10/24,gw=10.5.0.1"},
+	})
+
+	srv.AddVM(fakeproxmox.VM{
+		ID:             201,
+		Node:           "pve1",
+		Status:         "running",
+		Config:         map[string]string{"name": "dns"},
+		GuestAddresses: []string{"127.0.0.1", "10.5.0.12", "fe80::1"},
+	})
+
+	store := ipam.NewMemoryStore()
+	pools := provider.WithIPPools(ipam.Pool{
+		Name:    "lan",
+		CIDR:    "10.5.0.0/24",
+		Gateway: "10.5.0.1",
+		Ranges:  []string{"10.5.0.10-10.5.0.20"},
+		Exclude: []string{"10.5.0.11"},
+	})
+
+	p := provider.NewProvisioner(srv.Client(), pools, provider.WithLeaseStore(store))
+
+	const data = baseMachineClass + `ip:
+  pool: lan
+`
+
+	first := newProvisionContext("machine-1", data, nil)
+	require.NoError(t, runSteps(ctx, t, p, first))
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.13/24", Gateway: "10.5.0.1"}}, first.State.TypedSpec().Value.Addresses)
+
+	leases, err := store.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ipam.Lease{{Address: netip.MustParsePrefix("10.5.0.13/24"), Pool: "lan", Owner: "machine-1"}}, leases)
+
+	// the leases survive the provider restart
+	restarted := provider.NewProvisioner(srv.Client(), pools, provider.WithLeaseStore(store))
+
+	second := newProvisionContext("machine-2", data, nil)
+	require.NoError(t, runSteps(ctx, t, restarted, second))
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.14/24", Gateway: "10.5.0.1"}}, second.State.TypedSpec().Value.Addresses)
+
+	require.NoError(t, runSteps(ctx, t, restarted, first))
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.13/24", Gateway: "10.5.0.1"}}, first.State.TypedSpec().Value.Addresses)
+
+	require.NoError(t, restarted.Deprovision(ctx, zaptest.NewLogger(t), first.State, first.MachineRequest))
+
+	leases, err = store.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ipam.Lease{{Address: netip.MustParsePrefix("10.5.0.14/24"), Pool: "lan", Owner: "machine-2"}}, leases)
+
+	unknown := newProvisionContext("machine-3", "cores: 2\nsockets: 1\nmemory: 4096\ndisk_size: 20\nip:\n  pool: wan\n", nil)
+	require.ErrorContains(t, runSteps(ctx, t, restarted, unknown), `net0: unknown address pool "wan"`)
+
+	// the addresses of the VMs are read once for the machines allocated together
+	fourth := newProvisionContext("machine-4", data, nil)
+	require.NoError(t, runSteps(ctx, t, restarted, fourth))
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.13/24", Gateway: "10.5.0.1"}}, fourth.State.TypedSpec().Value.Addresses)
+	assert.Equal(t, 2, srv.Requests(http.MethodGet, "/nodes/pve1/qemu/201/agent/network-get-interfaces"))
+}
+
+func TestProvisionNetBox(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	netboxSrv := fakenetbox.NewServer()
+	t.Cleanup(netboxSrv.Close)
+
+	netboxSrv.AddPrefix("10.5.0.0/24")
+	netboxSrv.AddAddress(fakenetbox.Address{Address: "10.5.0.1/24", Description: "gateway"})
+
+	netbox, err := ipam.NewNetBox(netboxSrv.URL(), fakenetbox.Token, ipam.NetBoxOptions{HTTPClient: netboxSrv.HTTPClient()})
+	require.NoError(t, err)
+
+	p := provider.NewProvisioner(srv.Client(),
+		provider.WithIPPools(ipam.Pool{Name: "lan", CIDR: "10.5.0.0/24", Gateway: "10.5.0.1", Backend: ipam.BackendNetBox}),
+		provider.WithExternalIPAM(ipam.BackendNetBox, netbox),
+	)
+
+	const data = baseMachineClass + `ip:
+  pool: lan
+`
+
+	pctx := newProvisionContext("machine-1", data, nil)
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.2/24", Gateway: "10.5.0.1"}}, pctx.State.TypedSpec().Value.Addresses)
+
+	// the retries don't allocate the address again
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	addresses := netboxSrv.Addresses()
+	require.Len(t, addresses, 2)
+	assert.Equal(t, "10.5.0.2/24", addresses[1].Address)
+	assert.Equal(t, fmt.Sprintf("machine-1 net0 vmid %d", pctx.State.TypedSpec().Value.Vmid), addresses[1].Description)
+
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, pctx.MachineRequest))
+	assert.Len(t, netboxSrv.Addresses(), 1)
+
+	unconfigured := provider.NewProvisioner(srv.Client(), provider.WithIPPools(ipam.Pool{Name: "lan", CIDR: "10.5.0.0/24", Backend: ipam.BackendNetBox}))
+	require.ErrorContains(t, runSteps(ctx, t, unconfigured, newProvisionContext("machine-2", data, nil)), "net0: pool lan: the netbox IPAM is not configured")
+}
@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"regexp"
+
+	"go.yaml.in/yaml/v4"
+
+	providermeta "github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/meta"
+)
+
+// The VM tags written by the provider, each tag is the prefix followed by the value.
+const (
+	machineRequestTagPrefix = "machine-request."
+	// providerTagPrefix marks the VMs created by the provider with the provider ID.
+	providerTagPrefix     = "omni-provider."
+	requestTagPrefix      = "omni-request."
+	machineClassTagPrefix = "omni-machine-class."
+	talosVersionTagPrefix = "talos-version."
+	schematicTagPrefix    = "talos-schematic."
+	// controlPlaneTagPrefix marks the control plane VMs with the group spread by the anti-affinity.
+	controlPlaneTagPrefix = "omni-control-plane."
+)
+
+// invalidTagCharsRe matches the characters Proxmox doesn't allow in the tags.
+var invalidTagCharsRe = regexp.MustCompile(`[^a-zA-Z0-9_\-+.]`)
+
+func providerTag() string {
+	return providerTagPrefix + providermeta.ProviderID
+}
+
+// tags returns the VM tags marking the VM as owned by the provider and the machine request.
+func (identity vmIdentity) tags() []string {
+	tags := []string{providerTag()}
+
+	for _, tag := range []struct {
+		prefix string
+		value  string
+	}{
+		{requestTagPrefix, identity.requestID},
+		{machineRequestTagPrefix, identity.machineRequestSet},
+		{machineClassTagPrefix, identity.machineClass},
+		{talosVersionTagPrefix, identity.talosVersion},
+		{schematicTagPrefix, identity.schematic},
+		{controlPlaneTagPrefix, identity.controlPlaneGroup},
+	} {
+		if tag.value != "" {
+			tags = append(tags, tagValue(tag.prefix, tag.value))
+		}
+	}
+
+	return tags
+}
+
+// tagValue builds the VM tag replacing the characters Proxmox doesn't allow.
+func tagValue(prefix, value string) string {
+	return prefix + invalidTagCharsRe.ReplaceAllString(value, "_")
+}
+
+// vmDescription is written as YAML to the VM description, so that the inventory tools can read the same data as in the tags.
+type vmDescription struct {
+	Provider          string `yaml:"provider"`
+	MachineRequest    string `yaml:"machineRequest"`
+	MachineRequestSet string `yaml:"machineRequestSet,omitempty"`
+	MachineClass      string `yaml:"machineClass,omitempty"`
+	TalosVersion      string `yaml:"talosVersion,omitempty"`
+	Schematic         string `yaml:"schematic,omitempty"`
+	ControlPlaneOf    string `yaml:"controlPlaneOf,omitempty"`
+}
+
+// description returns the VM description with the unescaped tag values.
+func (identity vmIdentity) description() string {
+	// the struct of strings is always marshaled
+	out, _ := yaml.Marshal(struct {
+		Omni vmDescription `yaml:"omni"`
+	}{
+		Omni: vmDescription{
+			Provider:          providermeta.ProviderID,
+			MachineRequest:    identity.requestID,
+			MachineRequestSet: identity.machineRequestSet,
+			MachineClass:      identity.machineClass,
+			TalosVersion:      identity.talosVersion,
+			Schematic:         identity.schematic,
+			ControlPlaneOf:    identity.controlPlaneGroup,
+		},
+	})
+
+	return string(out)
+}
@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.yaml.in/yaml/v4"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestProvisionOwnership(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass, map[string]string{
+		omni.LabelMachineRequestSet: "workers",
+		omni.LabelMachineClassName:  "Large Workers",
+	})
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	vm, ok := srv.VM("pve1", int(pctx.State.TypedSpec().Value.Vmid))
+	require.True(t, ok)
+
+	// go-proxmox adds the tag of its own to the VMs with the cloud-init drive
+	assert.Subset(t, vm.Tags(), []string{
+		"omni-provider.proxmox",
+		"omni-request.machine-1",
+		"machine-request.workers",
+		"omni-machine-class.Large_Workers",
+		"talos-version.v1.11.0",
+		"talos-schematic." + pctx.State.TypedSpec().Value.Schematic,
+	})
+
+	var description map[string]map[string]string
+
+	require.NoError(t, yaml.Unmarshal([]byte(vm.Config["description"]), &description))
+
+	assert.Equal(t, map[string]string{
+		"provider":          "proxmox",
+		"machineRequest":    "machine-1",
+		"machineRequestSet": "workers",
+		"machineClass":      "Large Workers",
+		"talosVersion":      "v1.11.0",
+		"schematic":         pctx.State.TypedSpec().Value.Schematic,
+	}, description["omni"])
+
+	// the machine request set and the machine class tags are skipped when not set
+	pctx = newProvisionContext("machine-2", baseMachineClass, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	vm, ok = srv.VM("pve1", int(pctx.State.TypedSpec().Value.Vmid))
+	require.True(t, ok)
+
+	assert.NotContains(t, vm.Config["tags"], "machine-request.")
+	assert.Subset(t, vm.Tags(), []string{
+		"omni-provider.proxmox",
+		"omni-request.machine-2",
+		"talos-version.v1.11.0",
+		"talos-schematic." + pctx.State.TypedSpec().Value.Schematic,
+	})
+}
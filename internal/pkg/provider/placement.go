@@ -0,0 +1,377 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+	siderocel "github.com/siderolabs/talos/pkg/machinery/cel"
+)
+
+const (
+	placementStrategyDefault  = "default"
+	placementStrategySpread   = "spread"
+	placementStrategyBinpack  = "binpack"
+	placementStrategyLeastCPU = "least_cpu"
+	placementStrategyRandom   = "random"
+	placementStrategyCEL      = "cel"
+)
+
+// nodeStatus is the state of the Proxmox node used to pick the node for the new VM.
+type nodeStatus struct {
+	// vmNames are the names of the VMs on the node, the pending placements are not counted for the created VMs.
+	vmNames map[string]struct{}
+	// Cluster is the name of the Proxmox cluster the node belongs to.
+	Cluster string
+	Name    string
+	Status  string
+	// StorageShortage is the reason why the machine disks don't fit into the node storages, empty if they fit.
+	StorageShortage string
+	Tags            []string
+	// Pools are the resource pools which have the VMs or the storages on the node.
+	Pools []string
+	// MemoryFree is the ratio of the free memory to the total memory.
+	MemoryFree float64
+	CPUUsage   float64
+	// LoadAverage is the 1 minute load average.
+	LoadAverage float64
+	MaxMemory   uint64
+	FreeMemory  uint64
+	// AllocatedMemory is the total memory of all VMs on the node.
+	AllocatedMemory uint64
+	Uptime          uint64
+	// StorageAvailable is the largest amount of space available on the storages matching the storage selector.
+	StorageAvailable uint64
+	CPUs             int
+	// AllocatedCPUs is the total number of vCPUs of all VMs on the node.
+	AllocatedCPUs            int
+	VMs                      int
+	SameMachineRequestSetVMs int
+	// ClusterControlPlaneVMs is the number of the control plane VMs of the same Omni cluster, they are spread by the anti-affinity.
+	ClusterControlPlaneVMs int
+}
+
+// placementStrategy picks the node for the new VM out of the nodes which passed the filters.
+type placementStrategy interface {
+	pick(nodes []nodeStatus) (nodeStatus, error)
+}
+
+func newPlacementStrategy(data Data) (placementStrategy, error) {
+	switch data.PlacementStrategy {
+	case "", placementStrategyDefault:
+		return defaultPlacement{}, nil
+	case placementStrategySpread:
+		return spreadPlacement{}, nil
+	case placementStrategyBinpack:
+		return binpackPlacement{}, nil
+	case placementStrategyLeastCPU:
+		return leastCPUPlacement{}, nil
+	case placementStrategyRandom:
+		return randomPlacement{}, nil
+	case placementStrategyCEL:
+		return newCELPlacement(data.PlacementScore)
+	}
+
+	return nil, fmt.Errorf("unknown placement strategy %q", data.PlacementStrategy)
+}
+
+// defaultPlacement prefers the nodes with the least number of machines from the same machine request set, then the most free memory.
+type defaultPlacement struct{}
+
+func (defaultPlacement) pick(nodes []nodeStatus) (nodeStatus, error) {
+	return pickNode(nodes), nil
+}
+
+func pickNode(nodeInfoList []nodeStatus) nodeStatus {
+	// Auto-pick node with most free memory and with the least number of machines from the same machine request set
+	slices.SortFunc(nodeInfoList, func(a, b nodeStatus) int {
+		if c := cmp.Compare(a.SameMachineRequestSetVMs, b.SameMachineRequestSetVMs); c != 0 {
+			return c
+		}
+
+		return -cmp.Compare(a.MemoryFree, b.MemoryFree)
+	})
+
+	return nodeInfoList[0]
+}
+
+// spreadPlacement distributes the VMs evenly across the nodes.
+type spreadPlacement struct{}
+
+func (spreadPlacement) pick(nodes []nodeStatus) (nodeStatus, error) {
+	return slices.MinFunc(nodes, func(a, b nodeStatus) int {
+		return cmp.Or(
+			cmp.Compare(a.SameMachineRequestSetVMs, b.SameMachineRequestSetVMs),
+			cmp.Compare(a.VMs, b.VMs),
+			-cmp.Compare(a.MemoryFree, b.MemoryFree),
+			cmp.Compare(a.Name, b.Name),
+		)
+	}), nil
+}
+
+// binpackPlacement fills up the busiest nodes first, keeping the other nodes free for the large VMs.
+type binpackPlacement struct{}
+
+func (binpackPlacement) pick(nodes []nodeStatus) (nodeStatus, error) {
+	return slices.MinFunc(nodes, func(a, b nodeStatus) int {
+		return cmp.Or(
+			cmp.Compare(a.FreeMemory, b.FreeMemory),
+			-cmp.Compare(a.VMs, b.VMs),
+			cmp.Compare(a.Name, b.Name),
+		)
+	}), nil
+}
+
+// leastCPUPlacement picks the node with the lowest CPU usage.
+type leastCPUPlacement struct{}
+
+func (leastCPUPlacement) pick(nodes []nodeStatus) (nodeStatus, error) {
+	return slices.MinFunc(nodes, func(a, b nodeStatus) int {
+		return cmp.Or(
+			cmp.Compare(a.CPUUsage, b.CPUUsage),
+			cmp.Compare(a.LoadAverage, b.LoadAverage),
+			-cmp.Compare(a.MemoryFree, b.MemoryFree),
+			cmp.Compare(a.Name, b.Name),
+		)
+	}), nil
+}
+
+// randomPlacement picks a random node, the probability is proportional to the amount of the free memory on the node.
+type randomPlacement struct{}
+
+func (randomPlacement) pick(nodes []nodeStatus) (nodeStatus, error) {
+	var total float64
+
+	for _, node := range nodes {
+		total += float64(node.FreeMemory)
+	}
+
+	if total == 0 {
+		return nodes[rand.IntN(len(nodes))], nil //nolint:gosec
+	}
+
+	target := rand.Float64() * total //nolint:gosec
+
+	for _, node := range nodes {
+		target -= float64(node.FreeMemory)
+
+		if target < 0 {
+			return node, nil
+		}
+	}
+
+	return nodes[len(nodes)-1], nil
+}
+
+// celPlacement picks the node with the highest score calculated by the CEL expression.
+type celPlacement struct {
+	program cel.Program
+	expr    string
+}
+
+func newCELPlacement(expr string) (*celPlacement, error) {
+	if expr == "" {
+		return nil, fmt.Errorf("placement_score is required for the %q placement strategy", placementStrategyCEL)
+	}
+
+	env, err := nodeCELEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("failed to compile the placement score expression: %w", issues.Err())
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	return &celPlacement{
+		program: program,
+		expr:    expr,
+	}, nil
+}
+
+func (p *celPlacement) pick(nodes []nodeStatus) (nodeStatus, error) {
+	var (
+		best      nodeStatus
+		bestScore float64
+	)
+
+	for i, node := range nodes {
+		out, _, err := p.program.Eval(node.celVariables())
+		if err != nil {
+			return nodeStatus{}, fmt.Errorf("failed to calculate the placement score for node %q: %w", node.Name, err)
+		}
+
+		score, err := celNumber(out)
+		if err != nil {
+			return nodeStatus{}, fmt.Errorf("placement score expression %q: %w", p.expr, err)
+		}
+
+		if i == 0 || score > bestScore || (score == bestScore && node.Name < best.Name) {
+			best = node
+			bestScore = score
+		}
+	}
+
+	return best, nil
+}
+
+func celNumber(val ref.Val) (float64, error) {
+	switch v := val.Value().(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	}
+
+	return 0, fmt.Errorf("expected a number, got %s", val.Type().TypeName())
+}
+
+// nodeCELEnv creates the CEL environment for the expressions evaluated against the Proxmox nodes.
+func nodeCELEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("name", cel.StringType),
+		cel.Variable("cluster", cel.StringType),
+		cel.Variable("status", cel.StringType),
+		cel.Variable("tags", cel.ListType(cel.StringType)),
+		cel.Variable("pools", cel.ListType(cel.StringType)),
+		cel.Variable("cpus", cel.IntType),
+		cel.Variable("cpuUsage", cel.DoubleType),
+		cel.Variable("loadAverage", cel.DoubleType),
+		cel.Variable("maxMemory", cel.UintType),
+		cel.Variable("freeMemory", cel.UintType),
+		cel.Variable("allocatedMemory", cel.UintType),
+		cel.Variable("allocatedCpus", cel.IntType),
+		cel.Variable("uptime", cel.UintType),
+		cel.Variable("vms", cel.IntType),
+		cel.Variable("sameMachineRequestSetVMs", cel.IntType),
+		cel.Variable("storageAvailable", cel.UintType),
+	)
+}
+
+func (ns nodeStatus) celVariables() map[string]any {
+	return map[string]any{
+		"name":                     ns.Name,
+		"cluster":                  cmp.Or(ns.Cluster, DefaultCluster),
+		"status":                   ns.Status,
+		"tags":                     ns.Tags,
+		"pools":                    ns.Pools,
+		"cpus":                     ns.CPUs,
+		"cpuUsage":                 ns.CPUUsage,
+		"loadAverage":              ns.LoadAverage,
+		"maxMemory":                ns.MaxMemory,
+		"freeMemory":               ns.FreeMemory,
+		"allocatedMemory":          ns.AllocatedMemory,
+		"allocatedCpus":            ns.AllocatedCPUs,
+		"uptime":                   ns.Uptime,
+		"vms":                      ns.VMs,
+		"sameMachineRequestSetVMs": ns.SameMachineRequestSetVMs,
+		"storageAvailable":         ns.StorageAvailable,
+	}
+}
+
+// filterNodes drops the nodes which can't run the machine, the reasons are returned for each dropped node.
+func filterNodes(nodes []nodeStatus, data Data, overcommit overcommit) ([]nodeStatus, []NodeRejection, error) {
+	var (
+		candidates []nodeStatus
+		rejected   []NodeRejection
+		selector   *siderocel.Expression
+	)
+
+	env, err := nodeCELEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if data.NodeSelector != "" {
+		expr, err := siderocel.ParseBooleanExpression(data.NodeSelector, env)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid node selector: %w", err)
+		}
+
+		selector = &expr
+	}
+
+	demand := newResourceDemand(data)
+
+	for _, node := range nodes {
+		var reason string
+
+		missingTags := slices.DeleteFunc(slices.Clone(data.NodeTags), func(tag string) bool {
+			return slices.Contains(node.Tags, tag)
+		})
+
+		switch {
+		case node.Status != "online":
+			reason = fmt.Sprintf("node is %s", node.Status)
+		case len(missingTags) > 0:
+			reason = fmt.Sprintf("missing node tags %s", strings.Join(missingTags, ", "))
+		default:
+			reason = checkCapacity(node, demand, overcommit)
+		}
+
+		if reason == "" && selector != nil {
+			matched, err := selector.EvalBool(env, node.celVariables())
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to evaluate the node selector for node %q: %w", node.qualifiedName(), err)
+			}
+
+			if !matched {
+				reason = "doesn't match the node selector"
+			}
+		}
+
+		if reason != "" {
+			rejected = append(rejected, NodeRejection{
+				Node:   node.qualifiedName(),
+				Reason: reason,
+			})
+
+			continue
+		}
+
+		candidates = append(candidates, node)
+	}
+
+	return candidates, rejected, nil
+}
+
+// usesNodeTags checks if the node tags are needed to place the VM: by the required tags, the expressions or the topology key.
+func (data Data) usesNodeTags() bool {
+	return len(data.NodeTags) > 0 || data.NodeSelector != "" || data.PlacementScore != "" ||
+		(data.Affinity.TopologyKey != "" && data.Affinity.TopologyKey != topologyKeyCluster)
+}
+
+// parseNodeTags reads the node tags from the node notes.
+// The tags are defined on a line starting with "tags:", separated by semicolons, commas or spaces, e.g. "tags: gpu;rack=r1".
+func parseNodeTags(description string) []string {
+	var tags []string
+
+	for line := range strings.Lines(description) {
+		value, ok := strings.CutPrefix(strings.TrimSpace(line), "tags:")
+		if !ok {
+			continue
+		}
+
+		tags = append(tags, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ';' || r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+
+	return tags
+}
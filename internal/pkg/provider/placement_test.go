@@ -0,0 +1,416 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestPlacementStrategies(t *testing.T) {
+	t.Parallel()
+
+	nodes := []provider.NodeStatus{
+		{Name: "pve1", MemoryFree: 0.5, FreeMemory: 32 * gib, CPUUsage: 0.1, LoadAverage: 2, VMs: 10, SameMachineRequestSetVMs: 1, CPUs: 32},
+		{Name: "pve2", MemoryFree: 0.9, FreeMemory: 8 * gib, CPUUsage: 0.6, LoadAverage: 6, VMs: 1, SameMachineRequestSetVMs: 1, CPUs: 8},
+		{Name: "pve3", MemoryFree: 0.2, FreeMemory: 4 * gib, CPUUsage: 0.1, LoadAverage: 1, VMs: 4, SameMachineRequestSetVMs: 2, CPUs: 16},
+	}
+
+	for _, tt := range []struct {
+		name          string
+		expected      string
+		expectedError string
+		data          provider.Data
+	}{
+		{
+			name:     "default",
+			expected: "pve2",
+		},
+		{
+			name:     "spread",
+			data:     provider.Data{PlacementStrategy: "spread"},
+			expected: "pve2",
+		},
+		{
+			name:     "binpack",
+			data:     provider.Data{PlacementStrategy: "binpack"},
+			expected: "pve3",
+		},
+		{
+			name:     "least CPU",
+			data:     provider.Data{PlacementStrategy: "least_cpu"},
+			expected: "pve3",
+		},
+		{
+			name:     "CEL score",
+			data:     provider.Data{PlacementStrategy: "cel", PlacementScore: "double(cpus) * (1.0 - cpuUsage)"},
+			expected: "pve1",
+		},
+		{
+			name:     "CEL integer score",
+			data:     provider.Data{PlacementStrategy: "cel", PlacementScore: "-vms"},
+			expected: "pve2",
+		},
+		{
+			name:          "CEL score is not a number",
+			data:          provider.Data{PlacementStrategy: "cel", PlacementScore: "name"},
+			expectedError: "expected a number, got string",
+		},
+		{
+			name:          "CEL score is missing",
+			data:          provider.Data{PlacementStrategy: "cel"},
+			expectedError: `placement_score is required for the "cel" placement strategy`,
+		},
+		{
+			name:          "unknown strategy",
+			data:          provider.Data{PlacementStrategy: "roundrobin"},
+			expectedError: `unknown placement strategy "roundrobin"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			picked, err := provider.PickNodeWithStrategy(tt.data, append([]provider.NodeStatus(nil), nodes...))
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, picked.Name)
+		})
+	}
+}
+
+func TestRandomPlacement(t *testing.T) {
+	t.Parallel()
+
+	nodes := []provider.NodeStatus{
+		{Name: "pve1", FreeMemory: 0},
+		{Name: "pve2", FreeMemory: 8 * gib},
+		{Name: "pve3", FreeMemory: 24 * gib},
+	}
+
+	picked := map[string]int{}
+
+	for range 1000 {
+		node, err := provider.PickNodeWithStrategy(provider.Data{PlacementStrategy: "random"}, nodes)
+		require.NoError(t, err)
+
+		picked[node.Name]++
+	}
+
+	assert.Zero(t, picked["pve1"])
+	assert.Greater(t, picked["pve3"], picked["pve2"])
+}
+
+func TestFilterNodes(t *testing.T) {
+	t.Parallel()
+
+	nodes := []provider.NodeStatus{
+		{Name: "pve1", Status: "online", FreeMemory: 32 * gib, MaxMemory: 64 * gib, CPUs: 32, Tags: []string{"gpu", "rack=r1"}},
+		{Name: "pve2", Status: "online", FreeMemory: 2 * gib, MaxMemory: 64 * gib, CPUs: 32, Tags: []string{"gpu"}},
+		{Name: "pve3", Status: "online", FreeMemory: 32 * gib, MaxMemory: 64 * gib, CPUs: 4, Tags: []string{"gpu"}},
+		{Name: "pve4", Status: "online", FreeMemory: 32 * gib, MaxMemory: 64 * gib, CPUs: 32},
+		{Name: "pve5", Status: "offline"},
+		{Name: "pve6", Status: "online", FreeMemory: 32 * gib, MaxMemory: 64 * gib, CPUs: 32, AllocatedMemory: 94 * gib, Tags: []string{"gpu"}},
+		{Name: "pve7", Status: "online", FreeMemory: 32 * gib, MaxMemory: 64 * gib, CPUs: 32, AllocatedCPUs: 60, Tags: []string{"gpu"}},
+		{Name: "pve8", Status: "online", FreeMemory: 32 * gib, MaxMemory: 64 * gib, CPUs: 32, StorageShortage: "not enough storage space", Tags: []string{"gpu"}},
+	}
+
+	candidates, rejected, err := provider.FilterNodes(nodes, provider.Data{
+		Memory:   4096,
+		Cores:    4,
+		Sockets:  2,
+		NodeTags: []string{"gpu"},
+	}, 2, 1.5)
+	require.NoError(t, err)
+
+	require.Len(t, candidates, 1)
+	assert.Equal(t, "pve1", candidates[0].Name)
+	assert.Equal(t, []provider.NodeRejection{
+		{Node: "pve2", Reason: "not enough free memory: 4096 MiB required, 2048 MiB available"},
+		{Node: "pve3", Reason: "not enough CPUs: 8 required, 4 available"},
+		{Node: "pve4", Reason: "missing node tags gpu"},
+		{Node: "pve5", Reason: "node is offline"},
+		{Node: "pve6", Reason: "memory overcommit limit reached: 96256 MiB allocated, 4096 MiB required, 98304 MiB allowed"},
+		{Node: "pve7", Reason: "CPU overcommit limit reached: 60 CPUs allocated, 8 required, 64 allowed"},
+		{Node: "pve8", Reason: "not enough storage space"},
+	}, rejected)
+
+	// overcommit limits are disabled by default
+	candidates, _, err = provider.FilterNodes(nodes, provider.Data{
+		Memory:   4096,
+		Cores:    4,
+		Sockets:  2,
+		NodeTags: []string{"gpu"},
+	}, 0, 0)
+	require.NoError(t, err)
+
+	require.Len(t, candidates, 3)
+}
+
+func TestNodeSelector(t *testing.T) {
+	t.Parallel()
+
+	nodes := []provider.NodeStatus{
+		{Name: "pve1", Status: "online", FreeMemory: 32 * gib, MaxMemory: 64 * gib, CPUs: 32, CPUUsage: 0.2, Uptime: 86400, Tags: []string{"gpu"}, Pools: []string{"k8s"}},
+		{Name: "pve2", Status: "online", FreeMemory: 48 * gib, MaxMemory: 64 * gib, CPUs: 16, CPUUsage: 0.1, Uptime: 86400, Pools: []string{"k8s", "backup"}},
+		{Name: "pve3", Status: "online", FreeMemory: 8 * gib, MaxMemory: 16 * gib, CPUs: 8, CPUUsage: 0.9, Uptime: 60},
+	}
+
+	for _, tt := range []struct {
+		name          string
+		selector      string
+		expectedError string
+		expected      []string
+	}{
+		{
+			name:     "name",
+			selector: `name.startsWith("pve") && name != "pve2"`,
+			expected: []string{"pve1", "pve3"},
+		},
+		{
+			name:     "tags",
+			selector: `"gpu" in tags`,
+			expected: []string{"pve1"},
+		},
+		{
+			name:     "pools",
+			selector: `"k8s" in pools`,
+			expected: []string{"pve1", "pve2"},
+		},
+		{
+			name:     "resources",
+			selector: `cpus >= 16 && cpuUsage < 0.5 && freeMemory > 40u * 1024u * 1024u * 1024u && maxMemory == 64u * 1024u * 1024u * 1024u`,
+			expected: []string{"pve2"},
+		},
+		{
+			name:     "uptime",
+			selector: `uptime < 3600u`,
+			expected: []string{"pve3"},
+		},
+		{
+			name:          "invalid expression",
+			selector:      `cpus > "a"`,
+			expectedError: "invalid node selector",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			candidates, _, err := provider.FilterNodes(nodes, provider.Data{NodeSelector: tt.selector}, 0, 0)
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			names := make([]string, 0, len(candidates))
+
+			for _, node := range candidates {
+				names = append(names, node.Name)
+			}
+
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestParseNodeTags(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"gpu", "nvme", "rack=r1", "room=a"}, provider.ParseNodeTags("GPU host\n\ntags: gpu;nvme, rack=r1\n  tags: room=a\n"))
+	assert.Empty(t, provider.ParseNodeTags("no tags here"))
+}
+
+func TestProvisionPlacement(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2", "pve3")
+
+	// pve3 has the most free memory, but it's not a GPU node
+	srv.AddNode(fakeproxmox.Node{Name: "pve1", CPUs: 16, MaxMemory: 64 * gib, Memory: 32 * gib, Description: "tags: gpu"})
+	srv.AddNode(fakeproxmox.Node{Name: "pve2", CPUs: 16, MaxMemory: 64 * gib, Memory: 16 * gib, Description: "tags: gpu"})
+	srv.AddStorage("pve1", fakeproxmox.Storage{Name: "local-lvm", Type: "lvmthin", Content: []string{"images"}, Total: 1024 * gib})
+	srv.AddStorage("pve2", fakeproxmox.Storage{Name: "local-lvm", Type: "lvmthin", Content: []string{"images"}, Total: 1024 * gib})
+	srv.AddStorage("pve1", fakeproxmox.Storage{Name: "local", Content: []string{"iso"}, Total: 100 * gib})
+	srv.AddStorage("pve2", fakeproxmox.Storage{Name: "local", Content: []string{"iso"}, Total: 100 * gib})
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`placement_strategy: binpack
+node_tags:
+  - gpu
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Equal(t, "pve1", pctx.State.TypedSpec().Value.Node)
+	assert.Equal(t, 1, srv.Requests(http.MethodGet, "/nodes/pve3/config"))
+
+	// the node notes are not read if the tags are not used
+	pctx = newProvisionContext("machine-0", baseMachineClass, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+	assert.Equal(t, 1, srv.Requests(http.MethodGet, "/nodes/pve3/config"))
+
+	pctx = newProvisionContext("machine-2", baseMachineClass+`node_tags:
+  - nvme
+`, nil)
+
+	require.ErrorContains(t, runSteps(ctx, t, p, pctx), "no nodes match the placement requirements for 2 CPUs, 4096 MiB of memory and 20 GiB of disk: pve1: missing node tags nvme; pve2: missing node tags nvme; pve3: missing node tags nvme")
+
+	srv.AddStorage("pve2", fakeproxmox.Storage{Name: "ceph", Type: "rbd", Content: []string{"images"}, Total: 1024 * gib, Pool: "k8s"})
+
+	pctx = newProvisionContext("machine-3", baseMachineClass+`node_selector: '"k8s" in pools && "gpu" in tags'
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Equal(t, "pve2", pctx.State.TypedSpec().Value.Node)
+
+	pctx = newProvisionContext("machine-4", baseMachineClass+`node_selector: 'name == "pve4"'
+`, nil)
+
+	require.ErrorContains(t, runSteps(ctx, t, p, pctx), "pve1: doesn't match the node selector; pve2: doesn't match the node selector; pve3: doesn't match the node selector")
+}
+
+func TestProvisionCapacity(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	srv.AddStorage("pve2", fakeproxmox.Storage{Name: "local-lvm", Type: "lvmthin", Content: []string{"images"}, Total: 50 * gib})
+	srv.AddVM(fakeproxmox.VM{ID: 100, Node: "pve1", Status: "running", Config: map[string]string{"cores": "8", "memory": "65536"}})
+
+	p := provider.NewProvisioner(srv.Client(), provider.WithOvercommit(4, 1))
+
+	const data = `cores: 2
+sockets: 2
+memory: 4096
+disk_size: 40
+storage_selector: name == "local-lvm"
+additional_disks:
+  - storage_selector: name == "local-lvm"
+    disk_size: 20
+`
+
+	pctx := newProvisionContext("machine-1", data, nil)
+
+	err := runSteps(ctx, t, p, pctx)
+
+	var capacityErr *provider.CapacityError
+
+	require.ErrorAs(t, err, &capacityErr)
+	assert.Equal(t, []provider.NodeRejection{
+		{Node: "pve1", Reason: "memory overcommit limit reached: 65536 MiB allocated, 4096 MiB required, 65536 MiB allowed"},
+		{Node: "pve2", Reason: `failed to pick storage for additional disk 1: not enough storage space: 20 GiB required, no storage matching "name == \"local-lvm\"" has enough space`},
+	}, capacityErr.Rejected)
+	assert.EqualError(t, err, "step pickNode failed: "+capacityErr.Error())
+	assert.Contains(t, err.Error(), "no nodes match the placement requirements for 4 CPUs, 4096 MiB of memory and 60 GiB of disk")
+
+	// the configured node is checked as well
+	pctx = newProvisionContext("machine-2", data+"node: pve1\n", nil)
+
+	require.ErrorAs(t, runSteps(ctx, t, p, pctx), &capacityErr)
+	assert.Equal(t, "pve1", capacityErr.Rejected[0].Node)
+
+	// the VM fits once the disks are placed on the different storages
+	srv.AddStorage("pve2", fakeproxmox.Storage{Name: "local-zfs", Type: "zfspool", Content: []string{"images"}, Total: 50 * gib})
+
+	pctx = newProvisionContext("machine-3", strings.ReplaceAll(data, `name == "local-lvm"`, `name.startsWith("local-")`), nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	vm, ok := srv.VM("pve2", int(pctx.State.TypedSpec().Value.Vmid))
+	require.True(t, ok)
+
+	assert.True(t, strings.HasPrefix(vm.Config["scsi0"], "local-lvm:"), vm.Config["scsi0"])
+	assert.True(t, strings.HasPrefix(vm.Config["scsi1"], "local-zfs:"), vm.Config["scsi1"])
+}
+
+func TestProvisionSpreadMachineRequestSet(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	srv.AddVM(fakeproxmox.VM{ID: 100, Node: "pve1", Status: "running"})
+	srv.AddVM(fakeproxmox.VM{ID: 101, Node: "pve1", Status: "running"})
+
+	const data = baseMachineClass + "placement_strategy: spread\n"
+
+	// the machine request set ID has the characters which are not allowed in the tags
+	labels := map[string]string{omni.LabelMachineRequestSet: "talos@eu:workers"}
+
+	first := newProvisionContext("machine-1", data, labels)
+	require.NoError(t, runSteps(ctx, t, provider.NewProvisioner(srv.Client()), first))
+	assert.Equal(t, "pve2", first.State.TypedSpec().Value.Node)
+
+	// the new provisioner counts the VMs of the machine request set by their tags only
+	second := newProvisionContext("machine-2", data, labels)
+	require.NoError(t, runSteps(ctx, t, provider.NewProvisioner(srv.Client()), second))
+	assert.Equal(t, "pve1", second.State.TypedSpec().Value.Node)
+}
+
+func TestProvisionCapacityPendingPlacements(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+	p := provider.NewProvisioner(srv.Client())
+
+	// the storage selector is not set, so the disks go to the storages accepting the images content
+	const data = `cores: 2
+sockets: 1
+memory: 32768
+disk_size: 20
+`
+
+	pickNode := p.ProvisionSteps()[0]
+	require.Equal(t, "pickNode", pickNode.Name())
+
+	// the memory of the machine placed on the node is taken into account before its VM is created
+	first := newProvisionContext("machine-1", data, nil)
+	require.NoError(t, pickNode.Run(ctx, zaptest.NewLogger(t), first))
+
+	require.ErrorContains(t, runSteps(ctx, t, p, newProvisionContext("machine-2", data, nil)),
+		"pve1: not enough free memory: 32768 MiB required, 24576 MiB available")
+
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	vm, ok := srv.VM("pve1", int(first.State.TypedSpec().Value.Vmid))
+	require.True(t, ok)
+
+	assert.True(t, strings.HasPrefix(vm.Config["scsi0"], "local-lvm:"), vm.Config["scsi0"])
+
+	require.ErrorContains(t, runSteps(ctx, t, p, newProvisionContext("machine-3", strings.ReplaceAll(data, "disk_size: 20", "disk_size: 2048"), nil)),
+		"pve1: not enough storage space: 2048 GiB required, no storage accepting the images content has enough space")
+}
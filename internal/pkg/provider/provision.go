@@ -14,40 +14,193 @@ import (
 	"fmt"
 	"net/url"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/cosi-project/runtime/pkg/state"
 	"github.com/google/cel-go/cel"
 	"github.com/google/uuid"
 	"github.com/luthermonson/go-proxmox"
 	"github.com/siderolabs/omni/client/pkg/constants"
 	"github.com/siderolabs/omni/client/pkg/infra/provision"
 	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
 	siderocel "github.com/siderolabs/talos/pkg/machinery/cel"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/logging"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/metrics"
 	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/tracing"
 )
 
-const machineRequestTagPrefix = "machine-request."
+// taskPollInterval is the interval between the Proxmox task status checks while waiting for the task to finish.
+var taskPollInterval = time.Second * 5
 
 // Provisioner implements Talos emulator infra provider.
 type Provisioner struct {
-	proxmoxClient *proxmox.Client
+	// clusters are the Proxmox clusters managed by the provisioner, keyed by the cluster name.
+	clusters map[string]proxmoxCluster
+	// placements are the nodes picked for the machines which VMs are not created yet, keyed by the machine request ID.
+	placements map[string]placement
+	// pools are the address pools from the provider config, keyed by the pool name.
+	pools map[string]ipam.Pool
+	// externalIPAM are the IPAMs the pools with the external backends use, keyed by the backend name.
+	externalIPAM map[string]ipam.IPAM
+	// vnetClaims are the machines which use the VNets of the Omni clusters, keyed by the VNet name.
+	// They cover the machines which resources are not updated yet, the claims are read from the Machine resources in the state otherwise.
+	vnetClaims map[string]map[string]struct{}
+	// state is the Omni state with the provider Machine resources, nil if not set.
+	state state.State
+	// templateLocks serialize the builds of each template, keyed by the cluster and the template name.
+	templateLocks map[string]*sync.Mutex
+	// vmAddresses are the addresses of the VMs read by the last address allocation, keyed by the cluster name.
+	vmAddresses map[string]vmAddresses
+	ipam        ipam.IPAM
+	// metrics are nil if the metrics are disabled.
+	metrics    *metrics.Metrics
+	tracer     trace.Tracer
+	overcommit overcommit
+	// placementGeneration changes once a placement is dropped, the node statuses read before that might miss the VM of the machine.
+	placementGeneration uint64
+	// templateMu guards the template locks.
+	templateMu sync.Mutex
+	// addressMu guards the VM addresses.
+	addressMu sync.Mutex
+	// placementMu guards the placements and the placement generation.
+	placementMu sync.Mutex
+	// sdnMu serializes the changes of the SDN config and guards the VNet claims.
+	sdnMu sync.Mutex
+	// configMu guards the clusters, the overcommit, the pools and the external IPAMs, which are replaced by Reconfigure.
+	configMu sync.RWMutex
+}
+
+type placement struct {
+	cluster           string
+	node              string
+	machineRequestSet string
+	controlPlaneGroup string
+	demand            resourceDemand
+}
+
+// Option configures the provisioner.
+type Option func(*Provisioner)
+
+// WithOvercommit limits the vCPUs and the memory allocated to the VMs on a node to the node capacity multiplied by the ratios.
+// Zero ratio disables the limit.
+func WithOvercommit(cpuRatio, memoryRatio float64) Option {
+	return func(p *Provisioner) {
+		p.overcommit = overcommit{
+			cpu:    cpuRatio,
+			memory: memoryRatio,
+		}
+	}
+}
+
+// WithMetrics records the durations of the provisioning steps, the image cache lookups and the VMs managed on each node.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(p *Provisioner) {
+		p.metrics = m
+	}
+}
+
+// WithTracerProvider sets the tracer provider of the machine request spans, the global one is used by default.
+func WithTracerProvider(tracerProvider trace.TracerProvider) Option {
+	return func(p *Provisioner) {
+		p.tracer = tracerProvider.Tracer(tracing.TracerName)
+	}
+}
+
+// WithIPPools sets the address pools the static addresses of the NICs are allocated from, the machine classes refer to the pools by the name.
+func WithIPPools(pools ...ipam.Pool) Option {
+	return func(p *Provisioner) {
+		for _, pool := range pools {
+			p.pools[pool.Name] = pool
+		}
+	}
+}
+
+// WithLeaseStore keeps the leases of the static addresses in the store, they are kept in memory by default.
+func WithLeaseStore(store ipam.Store) Option {
+	return func(p *Provisioner) {
+		p.ipam = ipam.NewAllocator(store)
+	}
+}
+
+// WithState reads the provider Machine resources from the Omni state, so the cluster VNets used by the machines are known after the restarts.
+func WithState(st state.State) Option {
+	return func(p *Provisioner) {
+		p.state = st
+	}
+}
+
+// WithExternalIPAM allocates the addresses of the pools with the backend by the external IPAM, e.g. NetBox.
+func WithExternalIPAM(backend string, external ipam.IPAM) Option {
+	return func(p *Provisioner) {
+		p.externalIPAM[backend] = external
+	}
 }
 
 // NewProvisioner creates a new provisioner.
-func NewProvisioner(proxmoxClient *proxmox.Client) *Provisioner {
-	return &Provisioner{
-		proxmoxClient: proxmoxClient,
+// The client is used for the default cluster, it can be nil if all clusters are added with WithCluster.
+func NewProvisioner(proxmoxClient *proxmox.Client, opts ...Option) *Provisioner {
+	p := &Provisioner{
+		clusters:     map[string]proxmoxCluster{},
+		placements:   map[string]placement{},
+		pools:        map[string]ipam.Pool{},
+		externalIPAM: map[string]ipam.IPAM{},
+		vnetClaims:   map[string]map[string]struct{}{},
+		ipam:         ipam.NewAllocator(ipam.NewMemoryStore()),
+		tracer:       otel.Tracer(tracing.TracerName),
+	}
+
+	if proxmoxClient != nil {
+		p.clusters[DefaultCluster] = proxmoxCluster{
+			client: proxmoxClient,
+		}
+	}
+
+	for _, opt := range opts {
+		opt(p)
 	}
+
+	return p
+}
+
+// Reconfigure replaces the Proxmox clusters and the options of the provisioner, e.g. when the config file is reloaded.
+// The steps which already got the Proxmox client finish with it, the next steps use the new clients.
+func (p *Provisioner) Reconfigure(proxmoxClient *proxmox.Client, opts ...Option) {
+	next := NewProvisioner(proxmoxClient, opts...)
+
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	p.clusters = next.clusters
+	p.overcommit = next.overcommit
+	p.pools = next.pools
+	p.externalIPAM = next.externalIPAM
+}
+
+// snapshot returns the current clusters and overcommit limits.
+func (p *Provisioner) snapshot() (map[string]proxmoxCluster, overcommit) {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+
+	return p.clusters, p.overcommit
 }
 
 // ProvisionSteps implements infra.Provisioner.
 //
 //nolint:gocognit,gocyclo,cyclop,maintidx
 func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
-	return []provision.Step[*resources.Machine]{
+	return p.instrument([]provision.Step[*resources.Machine]{
 		provision.NewStep("pickNode", func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
 			var data Data
 
@@ -55,71 +208,197 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 				return err
 			}
 
-			nodes, err := p.proxmoxClient.Nodes(ctx)
-			if err != nil {
+			if err := validateAffinity(data.Affinity); err != nil {
 				return err
 			}
 
-			if len(nodes) == 0 {
-				return fmt.Errorf("no nodes available")
+			if err := validateHA(data.HA); err != nil {
+				return err
+			}
+
+			clusters, err := p.selectClusters(data)
+			if err != nil {
+				return err
 			}
 
+			_, limits := p.snapshot()
+
 			// If user specified a node, validate and use it
 			if data.Node != "" {
-				for _, node := range nodes {
-					if node.Node == data.Node {
-						if node.Status != "online" {
-							return fmt.Errorf("specified node %q is not online (status: %s)", data.Node, node.Status)
+				var errs []error
+
+				readNode := func() ([]nodeStatus, error) {
+					var matches []nodeStatus
+
+					errs = nil
+
+					for _, cluster := range clusters {
+						client, err := p.client(cluster)
+						if err != nil {
+							return nil, err
+						}
+
+						nodes, err := client.Nodes(ctx)
+						if err != nil {
+							// the node might be found in the other clusters
+							errs = append(errs, fmt.Errorf("cluster %q: %w", cluster, err))
+
+							continue
 						}
 
-						pctx.State.TypedSpec().Value.Node = data.Node
+						// the nodes outside of the default cluster can be referred as "<cluster>/<node>"
+						index := slices.IndexFunc(nodes, func(node *proxmox.NodeStatus) bool {
+							return node.Node == data.Node || cluster+"/"+node.Node == data.Node
+						})
 
-						logger.Info("using configured node for the Proxmox VM", zap.String("node", data.Node))
+						if index == -1 {
+							continue
+						}
+
+						if nodes[index].Status != "online" {
+							return nil, fmt.Errorf("specified node %q is not online (status: %s)", data.Node, nodes[index].Status)
+						}
 
-						return nil
+						nodeInfoList, err := p.nodeStatuses(ctx, pctx, cluster, client, nodes[index:index+1], data)
+						if err != nil {
+							return nil, err
+						}
+
+						matches = append(matches, nodeInfoList[0])
 					}
+
+					return matches, nil
 				}
 
-				return fmt.Errorf("specified node %q not found in cluster", data.Node)
+				return p.placeMachine(pctx, readNode, func(matches []nodeStatus) error {
+					switch {
+					case len(matches) == 0 && len(errs) > 0:
+						return fmt.Errorf("specified node %q not found in cluster: %w", data.Node, errors.Join(errs...))
+					case len(matches) == 0:
+						return fmt.Errorf("specified node %q not found in cluster", data.Node)
+					case len(matches) == 1:
+					default:
+						return fmt.Errorf("specified node %q is found in multiple clusters, set the cluster to pick one of them", data.Node)
+					}
+
+					demand := newResourceDemand(data)
+
+					if reason := checkCapacity(matches[0], demand, limits); reason != "" {
+						return &CapacityError{
+							Demand: demand,
+							Rejected: []NodeRejection{
+								{
+									Node:   data.Node,
+									Reason: reason,
+								},
+							},
+						}
+					}
+
+					pctx.State.TypedSpec().Value.Cluster = matches[0].Cluster
+					pctx.State.TypedSpec().Value.Node = matches[0].Name
+
+					logger.Info("using configured node for the Proxmox VM", zap.String("node", matches[0].Name), zap.String("cluster", matches[0].Cluster))
+
+					return nil
+				})
+			}
+
+			strategy, err := newPlacementStrategy(data)
+			if err != nil {
+				return err
 			}
 
-			nodeInfoList := make([]nodeStatus, 0, len(nodes))
+			var listRejected []NodeRejection
 
-			for _, node := range nodes {
-				var ns nodeStatus
+			// the nodes of all selected clusters are scored together
+			readNodes := func() ([]nodeStatus, error) {
+				var nodeInfoList []nodeStatus
 
-				ns.Name = node.Node
-				ns.MemoryFree = float64(node.MaxMem-node.Mem) / float64(node.MaxMem)
+				listRejected = nil
 
-				if machineRequestSet, ok := pctx.GetMachineRequestSetID(); ok {
-					n, err := p.proxmoxClient.Node(ctx, node.Node)
+				for _, cluster := range clusters {
+					client, err := p.client(cluster)
 					if err != nil {
-						return fmt.Errorf("failed to get node %q, %w", node.Node, err)
+						return nil, err
 					}
 
-					vms, err := n.VirtualMachines(ctx)
+					nodes, err := client.Nodes(ctx)
 					if err != nil {
-						return fmt.Errorf("failed to get vms for now %q, %w", node.Node, err)
+						if len(clusters) == 1 {
+							return nil, err
+						}
+
+						// the machine can still be placed in the other clusters
+						listRejected = append(listRejected, NodeRejection{
+							Node:   cluster + "/*",
+							Reason: fmt.Sprintf("failed to list the cluster nodes: %v", err),
+						})
+
+						continue
 					}
 
-					for _, vm := range vms {
-						if vm.HasTag(machineRequestTagPrefix + machineRequestSet) {
-							ns.SameMachineRequestSetVMs += 1
-						}
+					clusterNodes, err := p.nodeStatuses(ctx, pctx, cluster, client, nodes, data)
+					if err != nil {
+						return nil, err
 					}
+
+					nodeInfoList = append(nodeInfoList, clusterNodes...)
 				}
 
-				nodeInfoList = append(nodeInfoList, ns)
+				return nodeInfoList, nil
 			}
 
-			pickedNode := pickNode(nodeInfoList)
+			return p.placeMachine(pctx, readNodes, func(nodeInfoList []nodeStatus) error {
+				if len(nodeInfoList) == 0 && len(listRejected) == 0 {
+					return fmt.Errorf("no nodes available")
+				}
+
+				candidates, filterRejected, err := filterNodes(nodeInfoList, data, limits)
+				if err != nil {
+					return err
+				}
 
-			pctx.State.TypedSpec().Value.Node = pickedNode.Name
+				candidates, affinityRejected := applyAffinity(candidates, nodeInfoList, data.Affinity, isControlPlane(pctx.MachineRequest))
 
-			logger.Info("auto-selected node for the Proxmox VM", zap.String("node", pickedNode.Name))
+				rejected := slices.Concat(listRejected, filterRejected, affinityRejected)
 
-			return nil
+				if len(candidates) == 0 {
+					return &CapacityError{
+						Demand:   newResourceDemand(data),
+						Rejected: rejected,
+					}
+				}
+
+				pickedNode, err := strategy.pick(candidates)
+				if err != nil {
+					return err
+				}
+
+				pctx.State.TypedSpec().Value.Cluster = pickedNode.Cluster
+				pctx.State.TypedSpec().Value.Node = pickedNode.Name
+
+				machineRequestSet, _ := pctx.GetMachineRequestSetID()
+
+				p.placements[pctx.GetRequestID()] = placement{
+					cluster:           pickedNode.Cluster,
+					node:              pickedNode.Name,
+					machineRequestSet: machineRequestSet,
+					controlPlaneGroup: controlPlaneGroup(pctx.MachineRequest),
+					demand:            newResourceDemand(data),
+				}
+
+				logger.Info("auto-selected node for the Proxmox VM",
+					zap.String("node", pickedNode.Name),
+					zap.String("cluster", pickedNode.Cluster),
+					zap.String("strategy", cmp.Or(data.PlacementStrategy, placementStrategyDefault)),
+				)
+
+				return nil
+			})
 		}),
+		provision.NewStep("syncNetwork", p.syncNetwork),
+		provision.NewStep("allocateAddresses", p.allocateAddresses),
 		provision.NewStep("createSchematic", func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
 			// generating schematic with join configs as it's going to be used in the ISO image which doesn't support partial configs
 			schematic, err := pctx.GenerateSchematicID(ctx, logger,
@@ -135,9 +414,27 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 			return nil
 		}),
 		provision.NewStep("uploadISO", func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+			var data Data
+
+			if err := pctx.UnmarshalProviderData(&data); err != nil {
+				return err
+			}
+
+			// the image is downloaded as a part of the template build
+			if data.ProvisionMode == provisionModeTemplate {
+				return nil
+			}
+
+			client, err := p.client(pctx.State.TypedSpec().Value.Cluster)
+			if err != nil {
+				return err
+			}
+
 			if pctx.State.TypedSpec().Value.VolumeUploadTask != "" {
-				err := p.checkTaskStatus(ctx, pctx.State.TypedSpec().Value.VolumeUploadTask)
-				if err != nil && err.Error() != "stopped" {
+				var taskErr *taskError
+
+				err := p.checkTaskStatus(ctx, client, pctx.State.TypedSpec().Value.VolumeUploadTask)
+				if err != nil && !errors.As(err, &taskErr) {
 					return err
 				}
 
@@ -145,7 +442,7 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 					return nil
 				}
 
-				logger.Info("retrying download")
+				logger.Info("retrying download", zap.Error(err))
 			}
 
 			pctx.State.TypedSpec().Value.TalosVersion = pctx.GetTalosVersion()
@@ -155,13 +452,6 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 				return err
 			}
 
-			var data Data
-
-			err = pctx.UnmarshalProviderData(&data)
-			if err != nil {
-				return err
-			}
-
 			url = url.JoinPath("image",
 				pctx.State.TypedSpec().Value.Schematic,
 				pctx.GetTalosVersion(),
@@ -178,7 +468,7 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 
 			pctx.State.TypedSpec().Value.VolumeId = isoName
 
-			node, err := p.proxmoxClient.Node(ctx, pctx.State.TypedSpec().Value.Node)
+			node, err := client.Node(ctx, pctx.State.TypedSpec().Value.Node)
 			if err != nil {
 				return err
 			}
@@ -193,6 +483,8 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 			_, err = storage.ISO(ctx, isoName)
 			// Already downloaded
 			// TODO: figure out a better way to check the errors
+			p.metrics.ObserveImageCache(metrics.ImageISO, err == nil)
+
 			if err == nil {
 				return nil
 			}
@@ -208,13 +500,34 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 
 			return provision.NewRetryInterval(time.Second)
 		}),
+		provision.NewStep("syncTemplate", func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+			var data Data
+
+			if err := pctx.UnmarshalProviderData(&data); err != nil {
+				return err
+			}
+
+			if data.ProvisionMode != provisionModeTemplate {
+				return nil
+			}
+
+			return p.syncTemplate(ctx, logger, pctx, data)
+		}),
 		provision.NewStep("syncVM", func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+			client, err := p.client(pctx.State.TypedSpec().Value.Cluster)
+			if err != nil {
+				return err
+			}
+
 			if pctx.State.TypedSpec().Value.VmCreateTask != "" {
-				err := p.checkTaskStatus(ctx, pctx.State.TypedSpec().Value.VmCreateTask)
+				err := p.checkTaskStatus(ctx, client, pctx.State.TypedSpec().Value.VmCreateTask)
 				if err != nil {
 					return err
 				}
 
+				// the VM is visible for the placement of the other machines from now on
+				p.forgetPlacement(pctx.GetRequestID())
+
 				return nil
 			}
 
@@ -225,17 +538,20 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 
 			var data Data
 
-			err := pctx.UnmarshalProviderData(&data)
-			if err != nil {
+			if err = pctx.UnmarshalProviderData(&data); err != nil {
 				return err
 			}
 
-			node, err := p.proxmoxClient.Node(ctx, pctx.State.TypedSpec().Value.Node)
+			node, err := client.Node(ctx, pctx.State.TypedSpec().Value.Node)
 			if err != nil {
 				return err
 			}
 
-			cluster, err := p.proxmoxClient.Cluster(ctx)
+			if data.ProvisionMode == provisionModeTemplate {
+				return p.cloneVM(ctx, logger, pctx, client, node, data)
+			}
+
+			cluster, err := client.Cluster(ctx)
 			if err != nil {
 				return err
 			}
@@ -255,239 +571,30 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 				return err
 			}
 
-			if data.NetworkBridge == "" {
-				data.NetworkBridge = "vmbr0"
-			}
-
-			// Parse out the network config
-			var networkString string
-			if data.Vlan == 0 {
-				networkString = fmt.Sprintf("virtio,bridge=%s,firewall=1", data.NetworkBridge)
-			} else {
-				networkString = fmt.Sprintf("virtio,bridge=%s,firewall=1,tag=%d", data.NetworkBridge, data.Vlan)
-			}
-
-			// Build primary disk options
-			selectedStorage, err := p.pickStorage(ctx, node, data.StorageSelector)
+			disks, err := p.planDisks(ctx, node, data)
 			if err != nil {
 				return err
 			}
 
-			diskOptions := []string{fmt.Sprintf("%s:%d", selectedStorage, data.DiskSize)}
-			if data.DiskSSD {
-				diskOptions = append(diskOptions, "ssd=1")
-			}
-
-			if data.DiskDiscard {
-				diskOptions = append(diskOptions, "discard=on")
-			}
-
-			if data.DiskIOThread {
-				diskOptions = append(diskOptions, "iothread=1")
-			}
-
-			if data.DiskCache != "" {
-				diskOptions = append(diskOptions, fmt.Sprintf("cache=%s", data.DiskCache))
-			}
-
-			if data.DiskAIO != "" {
-				diskOptions = append(diskOptions, fmt.Sprintf("aio=%s", data.DiskAIO))
-			}
+			// Build primary disk options
+			diskOptions := append([]string{fmt.Sprintf("%s:%d", disks.Primary, data.DiskSize)}, primaryDiskOptions(data)...)
 
 			diskString := strings.Join(diskOptions, ",")
 
-			// Determine CPU type (default to x86-64-v2-AES for compatibility)
-			cpuType := "x86-64-v2-AES"
-			if data.CPUType != "" {
-				cpuType = data.CPUType
-			}
+			vmOptions := p.vmOptions(newVMIdentity(pctx), data, disks)
 
-			// Build VM options
-			vmOptions := []proxmox.VirtualMachineOption{
-				{
-					Name:  "smbios1",
-					Value: "uuid=" + pctx.State.TypedSpec().Value.Uuid,
-				},
-				{
-					Name:  "name",
-					Value: pctx.GetRequestID(),
-				},
-				{
+			vmOptions = append(vmOptions,
+				proxmox.VirtualMachineOption{
 					Name:  "cdrom",
 					Value: iso.VolID,
 				},
-				{
-					Name:  "cpu",
-					Value: cpuType,
-				},
-				{
-					Name:  "cores",
-					Value: data.Cores,
-				},
-				{
-					Name:  "sockets",
-					Value: data.Sockets,
-				},
-				{
-					Name:  "memory",
-					Value: data.Memory,
-				},
-				{
+				proxmox.VirtualMachineOption{
 					Name:  "scsi0",
 					Value: diskString,
 				},
-				{
-					Name:  "scsihw",
-					Value: "virtio-scsi-single",
-				},
-				{
-					Name:  "onboot",
-					Value: 1,
-				},
-				{
-					Name:  "net0",
-					Value: networkString,
-				},
-				{
-					Name:  "agent",
-					Value: "enabled=true",
-				},
-			}
-
-			if machineRequestSet, ok := pctx.GetMachineRequestSetID(); ok {
-				vmOptions = append(vmOptions,
-					proxmox.VirtualMachineOption{
-						Name:  "tags",
-						Value: machineRequestTagPrefix + machineRequestSet,
-					},
-				)
-			}
-
-			// Primary disk is always scsi0. Additional disks start from scsi1.
-			for i, disk := range data.AdditionalDisks {
-				var storage string
-
-				storage, err = p.pickStorage(ctx, node, disk.StorageSelector)
-				if err != nil {
-					return fmt.Errorf("failed to pick storage for additional disk %d: %w", i+1, err)
-				}
-
-				opts := []string{fmt.Sprintf("%s:%d", storage, disk.DiskSize)}
-				if disk.DiskSSD {
-					opts = append(opts, "ssd=1")
-				}
-
-				if disk.DiskDiscard {
-					opts = append(opts, "discard=on")
-				}
-
-				if disk.DiskIOThread {
-					opts = append(opts, "iothread=1")
-				}
-
-				if disk.DiskCache != "" {
-					opts = append(opts, fmt.Sprintf("cache=%s", disk.DiskCache))
-				}
-
-				if disk.DiskAIO != "" {
-					opts = append(opts, fmt.Sprintf("aio=%s", disk.DiskAIO))
-				}
-
-				vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
-					Name:  fmt.Sprintf("scsi%d", i+1),
-					Value: strings.Join(opts, ","),
-				})
-			}
-
-			// Add machine type if specified (q35 for GPU passthrough)
-			if data.MachineType != "" {
-				vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
-					Name:  "machine",
-					Value: data.MachineType,
-				})
-			}
-
-			// Add NUMA if enabled
-			if data.NUMA {
-				vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
-					Name:  "numa",
-					Value: 1,
-				})
-			}
-
-			// Add hugepages if specified (Proxmox expects: "any", "2" for 2MB, "1024" for 1GB)
-			if data.Hugepages != "" {
-				var hugepagesStr string
-
-				switch data.Hugepages {
-				case "2MB", "2":
-					hugepagesStr = "2"
-				case "1GB", "1024":
-					hugepagesStr = "1024"
-				case "any":
-					hugepagesStr = "any"
-				default:
-					hugepagesStr = data.Hugepages
-				}
-
-				vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
-					Name:  "hugepages",
-					Value: hugepagesStr,
-				})
-			}
-
-			// Disable balloon if explicitly set to false (for GPU/hugepages)
-			if data.Balloon != nil && !*data.Balloon {
-				vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
-					Name:  "balloon",
-					Value: 0,
-				})
-			}
-
-			// Add additional NICs for storage/backup networks
-			for i, nic := range data.AdditionalNICs {
-				var nicString string
-
-				firewallVal := 0
-				if nic.Firewall {
-					firewallVal = 1
-				}
-
-				if nic.Vlan == 0 {
-					nicString = fmt.Sprintf("virtio,bridge=%s,firewall=%d", nic.Bridge, firewallVal)
-				} else {
-					nicString = fmt.Sprintf("virtio,bridge=%s,firewall=%d,tag=%d", nic.Bridge, firewallVal, nic.Vlan)
-				}
-
-				vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
-					Name:  fmt.Sprintf("net%d", i+1), // net1, net2, etc.
-					Value: nicString,
-				})
-			}
-
-			// Add PCI device passthrough using Resource Mappings
-			for i, pci := range data.PCIDevices {
-				var pciParts []string
-
-				pciParts = append(pciParts, fmt.Sprintf("mapping=%s", pci.Mapping))
-				if pci.PCIExpress {
-					pciParts = append(pciParts, "pcie=1")
-				}
-
-				if pci.PrimaryGPU {
-					pciParts = append(pciParts, "x-vga=1")
-				}
-
-				if pci.ROMBar {
-					pciParts = append(pciParts, "rombar=1")
-				}
+			)
 
-				pciString := strings.Join(pciParts, ",")
-				vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
-					Name:  fmt.Sprintf("hostpci%d", i), // hostpci0, hostpci1, etc.
-					Value: pciString,
-				})
-			}
+			logger.Debug("creating the VM", zap.Int("vmid", vmid), vmOptionsField(vmOptions))
 
 			task, err := node.NewVirtualMachine(ctx, vmid, vmOptions...)
 			if err != nil {
@@ -499,13 +606,36 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 
 			return provision.NewRetryInterval(time.Second * 10)
 		}),
+		provision.NewStep("syncFirewall", p.syncFirewall),
 		provision.NewStep("startVM", func(ctx context.Context, _ *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+			var data Data
+
+			if err := pctx.UnmarshalProviderData(&data); err != nil {
+				return err
+			}
+
+			client, err := p.client(pctx.State.TypedSpec().Value.Cluster)
+			if err != nil {
+				return err
+			}
+
 			if pctx.State.TypedSpec().Value.VmStartTask != "" {
-				if err := p.checkTaskStatus(ctx, pctx.State.TypedSpec().Value.VmStartTask); err != nil {
+				if err = p.checkTaskStatus(ctx, client, pctx.State.TypedSpec().Value.VmStartTask); err != nil {
 					return err
 				}
 			} else {
-				vm, err := p.getVM(ctx, pctx.State.TypedSpec().Value.Node, pctx.State.TypedSpec().Value.Vmid)
+				vm, err := p.getVM(ctx, client, pctx.State.TypedSpec().Value.Node, pctx.State.TypedSpec().Value.Vmid)
+				if err != nil {
+					return err
+				}
+
+				if len(pctx.State.TypedSpec().Value.Addresses) > 0 {
+					if err = p.assignAddresses(ctx, pctx.GetRequestID(), int(pctx.State.TypedSpec().Value.Vmid)); err != nil {
+						return err
+					}
+				}
+
+				networkConfig, err := p.networkConfig(ctx, client, data, pctx.State.TypedSpec().Value)
 				if err != nil {
 					return err
 				}
@@ -521,7 +651,7 @@ hostname: %s`,
 						pctx.GetRequestID(),
 					),
 					"",
-					"version: 1",
+					networkConfig,
 				)
 				if err != nil {
 					return fmt.Errorf("failed to inject nocloud config: %w", err)
@@ -539,11 +669,148 @@ hostname: %s`,
 
 			return nil
 		}),
+		provision.NewStep("registerHA", p.registerHA),
+	})
+}
+
+// instrument wraps the steps to record their durations and results, and the nodes of the created VMs.
+// Each step attempt is traced in the trace of the machine request.
+func (p *Provisioner) instrument(steps []provision.Step[*resources.Machine]) []provision.Step[*resources.Machine] {
+	for i, step := range steps {
+		steps[i] = provision.NewStep(step.Name(), func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+			ctx, span := tracing.StartRequestSpan(ctx, p.tracer, pctx.GetRequestID(), step.Name(), tracing.AttributeStep.String(step.Name()))
+
+			machineRequestSet, _ := pctx.GetMachineRequestSetID()
+
+			logger = logger.With(machineFields(pctx.GetRequestID(), machineRequestSet, pctx.State.TypedSpec().Value)...)
+
+			start := time.Now()
+
+			err := step.Run(ctx, logger, pctx)
+
+			p.metrics.ObserveStep(step.Name(), time.Since(start), err)
+
+			spec := pctx.State.TypedSpec().Value
+
+			if spec.Vmid != 0 {
+				p.metrics.TrackVM(pctx.GetRequestID(), cmp.Or(spec.Cluster, DefaultCluster), spec.Node)
+			}
+
+			span.SetAttributes(machineAttributes(spec)...)
+			tracing.End(span, err)
+
+			return err
+		})
 	}
+
+	return steps
+}
+
+// machineFields returns the log fields identifying the machine and its Proxmox VM,
+// the cluster, the node and the VMID are added once they are picked.
+func machineFields(requestID, machineRequestSet string, spec *specs.MachineSpec) []zap.Field {
+	fields := []zap.Field{zap.String("machine", requestID)}
+
+	if machineRequestSet != "" {
+		fields = append(fields, zap.String("machineRequestSet", machineRequestSet))
+	}
+
+	if spec.Node != "" {
+		fields = append(fields,
+			zap.String("cluster", cmp.Or(spec.Cluster, DefaultCluster)),
+			zap.String("node", spec.Node),
+		)
+	}
+
+	if spec.Vmid != 0 {
+		fields = append(fields, zap.Int32("vmid", spec.Vmid))
+	}
+
+	return fields
+}
+
+// vmOptionsField returns the log field listing the VM options, the values of the secrets are redacted.
+func vmOptionsField(options []proxmox.VirtualMachineOption) zap.Field {
+	values := make([]string, 0, len(options))
+
+	for _, option := range options {
+		if logging.IsSecret(option.Name) {
+			values = append(values, option.Name+"="+logging.Redacted)
+
+			continue
+		}
+
+		values = append(values, fmt.Sprintf("%s=%v", option.Name, option.Value))
+	}
+
+	return zap.Strings("vmOptions", values)
+}
+
+// machineAttributes returns the span attributes of the Proxmox objects of the machine.
+func machineAttributes(spec *specs.MachineSpec) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{tracing.AttributeCluster.String(cmp.Or(spec.Cluster, DefaultCluster))}
+
+	if spec.Node != "" {
+		attrs = append(attrs, tracing.AttributeNode.String(spec.Node))
+	}
+
+	if spec.Vmid != 0 {
+		attrs = append(attrs, tracing.AttributeVMID.Int(int(spec.Vmid)))
+	}
+
+	var tasks []string
+
+	for _, task := range []string{spec.VolumeUploadTask, spec.TemplateTask, spec.VmCreateTask, spec.VmStartTask} {
+		if task != "" {
+			tasks = append(tasks, task)
+		}
+	}
+
+	if len(tasks) > 0 {
+		attrs = append(attrs, tracing.AttributeTaskUPID.StringSlice(tasks))
+	}
+
+	return attrs
 }
 
 // Deprovision implements infra.Provisioner.
 func (p *Provisioner) Deprovision(ctx context.Context, logger *zap.Logger, machine *resources.Machine, machineRequest *infra.MachineRequest) error {
+	ctx, span := tracing.StartRequestSpan(ctx, p.tracer, machine.Metadata().ID(), "deprovision", machineAttributes(machine.TypedSpec().Value)...)
+
+	var machineRequestSet string
+
+	if machineRequest != nil {
+		machineRequestSet, _ = machineRequest.Metadata().Labels().Get(omni.LabelMachineRequestSet)
+	}
+
+	logger = logger.With(machineFields(machine.Metadata().ID(), machineRequestSet, machine.TypedSpec().Value)...)
+
+	start := time.Now()
+
+	err := p.deprovision(ctx, logger, machine)
+	if err == nil {
+		// the addresses are released once the VM is removed, so that they are not reused while the VM is still running
+		err = p.releaseAddresses(ctx, machine.Metadata().ID())
+	}
+
+	if err == nil {
+		err = p.releaseClusterVNets(ctx, logger, machine)
+	}
+
+	p.metrics.ObserveStep("deprovision", time.Since(start), err)
+
+	if err == nil {
+		p.metrics.ForgetVM(machine.Metadata().ID())
+	}
+
+	tracing.End(span, err)
+
+	return err
+}
+
+func (p *Provisioner) deprovision(ctx context.Context, logger *zap.Logger, machine *resources.Machine) error {
+	p.forgetPlacement(machine.Metadata().ID())
+
 	if machine.TypedSpec().Value.Vmid == 0 {
 		return nil
 	}
@@ -552,7 +819,21 @@ func (p *Provisioner) Deprovision(ctx context.Context, logger *zap.Logger, machi
 		return errors.New("VM is missing the node information")
 	}
 
-	vm, err := p.getVM(ctx, machine.TypedSpec().Value.Node, machine.TypedSpec().Value.Vmid)
+	client, err := p.client(machine.TypedSpec().Value.Cluster)
+	if err != nil {
+		return err
+	}
+
+	if err = p.unregisterHA(ctx, logger, client, machine); err != nil {
+		return err
+	}
+
+	node, err := p.vmNode(ctx, client, machine.TypedSpec().Value)
+	if err != nil {
+		return err
+	}
+
+	vm, err := p.getVM(ctx, client, node, machine.TypedSpec().Value.Vmid)
 	if err != nil {
 		if strings.Contains(err.Error(), "does not exist") {
 			return nil
@@ -582,28 +863,342 @@ func (p *Provisioner) Deprovision(ctx context.Context, logger *zap.Logger, machi
 	return nil
 }
 
-func (p *Provisioner) pickStorage(ctx context.Context, node *proxmox.Node, selector string) (string, error) {
-	storages, err := node.Storages(ctx)
-	if err != nil {
-		return "", err
+func (p *Provisioner) forgetPlacement(requestID string) {
+	p.placementMu.Lock()
+	defer p.placementMu.Unlock()
+
+	if _, ok := p.placements[requestID]; ok {
+		delete(p.placements, requestID)
+
+		p.placementGeneration++
 	}
+}
 
-	for _, storage := range storages {
-		env, err := cel.NewEnv(
-			cel.Variable("name", cel.StringType),
-			cel.Variable("node", cel.StringType),
-			cel.Variable("storageType", cel.StringType),
-			cel.Variable("availableSpace", cel.UintType),
-		)
+// placeMachine reads the node statuses without holding the placement lock, then runs place under the lock with the pending placements accounted for,
+// so the machines picked at the same time are placed consistently.
+// The statuses are read again if a placement was dropped in the meantime, as they might miss the VM of that machine.
+func (p *Provisioner) placeMachine(pctx provision.Context[*resources.Machine], read func() ([]nodeStatus, error), place func([]nodeStatus) error) error {
+	for {
+		p.placementMu.Lock()
+		generation := p.placementGeneration
+		p.placementMu.Unlock()
+
+		nodes, err := read()
 		if err != nil {
-			return "", err
+			return err
 		}
 
-		expr, err := siderocel.ParseBooleanExpression(selector, env)
-		if err != nil {
-			return "", err
+		if placed, err := p.tryPlace(pctx, generation, nodes, place); placed {
+			return err
+		}
+	}
+}
+
+func (p *Provisioner) tryPlace(pctx provision.Context[*resources.Machine], generation uint64, nodes []nodeStatus, place func([]nodeStatus) error) (bool, error) {
+	p.placementMu.Lock()
+	defer p.placementMu.Unlock()
+
+	if p.placementGeneration != generation {
+		return false, nil
+	}
+
+	p.applyPlacements(pctx, nodes)
+
+	return true, place(nodes)
+}
+
+// applyPlacements accounts for the machines placed on the nodes which VMs are not created yet, the placement lock should be held.
+func (p *Provisioner) applyPlacements(pctx provision.Context[*resources.Machine], nodes []nodeStatus) {
+	machineRequestSet, inMachineRequestSet := pctx.GetMachineRequestSetID()
+	group := controlPlaneGroup(pctx.MachineRequest)
+
+	for i := range nodes {
+		ns := &nodes[i]
+
+		for requestID, placement := range p.placements {
+			if _, created := ns.vmNames[requestID]; created || placement.cluster != ns.Cluster || placement.node != ns.Name || requestID == pctx.GetRequestID() {
+				continue
+			}
+
+			ns.VMs++
+			ns.AllocatedCPUs += placement.demand.CPUs
+			ns.AllocatedMemory += placement.demand.Memory
+			ns.FreeMemory -= min(placement.demand.Memory, ns.FreeMemory)
+
+			if inMachineRequestSet && placement.machineRequestSet == machineRequestSet {
+				ns.SameMachineRequestSetVMs++
+			}
+
+			if group != "" && placement.controlPlaneGroup == group {
+				ns.ClusterControlPlaneVMs++
+			}
 		}
 
+		if ns.MaxMemory > 0 {
+			ns.MemoryFree = float64(ns.FreeMemory) / float64(ns.MaxMemory)
+		}
+	}
+}
+
+// vmIdentity is the machine the VM is created for.
+type vmIdentity struct {
+	requestID         string
+	uuid              string
+	machineRequestSet string
+	machineClass      string
+	talosVersion      string
+	schematic         string
+	// omniCluster is the Omni cluster the machine is requested for, it names the VNets of the cluster.
+	omniCluster string
+	// controlPlaneGroup is the group of the control plane machines spread by the anti-affinity, empty for the workers.
+	controlPlaneGroup string
+}
+
+func newVMIdentity(pctx provision.Context[*resources.Machine]) vmIdentity {
+	machineRequestSet, _ := pctx.GetMachineRequestSetID()
+	machineClass, _ := pctx.MachineRequest.Metadata().Labels().Get(omni.LabelMachineClassName)
+
+	return vmIdentity{
+		requestID:         pctx.GetRequestID(),
+		uuid:              pctx.State.TypedSpec().Value.Uuid,
+		machineRequestSet: machineRequestSet,
+		machineClass:      machineClass,
+		talosVersion:      pctx.GetTalosVersion(),
+		schematic:         pctx.State.TypedSpec().Value.Schematic,
+		omniCluster:       omniClusterName(pctx.MachineRequest),
+		controlPlaneGroup: controlPlaneGroup(pctx.MachineRequest),
+	}
+}
+
+// vmOptions builds the VM options shared by all provision modes.
+// The boot media and the primary disk are not included.
+//
+//nolint:gocognit,gocyclo,cyclop
+func (p *Provisioner) vmOptions(identity vmIdentity, data Data, disks diskPlan) []proxmox.VirtualMachineOption {
+	if data.NetworkBridge == "" && data.NetworkVNet == "" && data.NetworkClusterVNet == nil {
+		data.NetworkBridge = "vmbr0"
+	}
+
+	nics := data.nicConfigs()
+
+	// Parse out the network config
+	var networkString string
+	if data.Vlan == 0 {
+		networkString = fmt.Sprintf("virtio,bridge=%s,firewall=1", nics[0].bridgeName(identity.omniCluster))
+	} else {
+		networkString = fmt.Sprintf("virtio,bridge=%s,firewall=1,tag=%d", nics[0].bridgeName(identity.omniCluster), data.Vlan)
+	}
+
+	// Determine CPU type (default to x86-64-v2-AES for compatibility)
+	cpuType := "x86-64-v2-AES"
+	if data.CPUType != "" {
+		cpuType = data.CPUType
+	}
+
+	// Build VM options
+	vmOptions := []proxmox.VirtualMachineOption{
+		{
+			Name:  "smbios1",
+			Value: "uuid=" + identity.uuid,
+		},
+		{
+			Name:  "name",
+			Value: identity.requestID,
+		},
+		{
+			Name:  "cpu",
+			Value: cpuType,
+		},
+		{
+			Name:  "cores",
+			Value: data.Cores,
+		},
+		{
+			Name:  "sockets",
+			Value: data.Sockets,
+		},
+		{
+			Name:  "memory",
+			Value: data.Memory,
+		},
+		{
+			Name:  "scsihw",
+			Value: "virtio-scsi-single",
+		},
+		{
+			Name:  "onboot",
+			Value: 1,
+		},
+		{
+			Name:  "net0",
+			Value: networkString,
+		},
+		{
+			Name:  "agent",
+			Value: "enabled=true",
+		},
+	}
+
+	vmOptions = append(vmOptions,
+		proxmox.VirtualMachineOption{
+			Name:  "tags",
+			Value: strings.Join(identity.tags(), ";"),
+		},
+		proxmox.VirtualMachineOption{
+			Name:  "description",
+			Value: identity.description(),
+		},
+	)
+
+	// Primary disk is always scsi0. Additional disks start from scsi1.
+	for i, disk := range data.AdditionalDisks {
+		opts := []string{fmt.Sprintf("%s:%d", disks.Additional[i], disk.DiskSize)}
+		if disk.DiskSSD {
+			opts = append(opts, "ssd=1")
+		}
+
+		if disk.DiskDiscard {
+			opts = append(opts, "discard=on")
+		}
+
+		if disk.DiskIOThread {
+			opts = append(opts, "iothread=1")
+		}
+
+		if disk.DiskCache != "" {
+			opts = append(opts, fmt.Sprintf("cache=%s", disk.DiskCache))
+		}
+
+		if disk.DiskAIO != "" {
+			opts = append(opts, fmt.Sprintf("aio=%s", disk.DiskAIO))
+		}
+
+		vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
+			Name:  fmt.Sprintf("scsi%d", i+1),
+			Value: strings.Join(opts, ","),
+		})
+	}
+
+	// Add machine type if specified (q35 for GPU passthrough)
+	if data.MachineType != "" {
+		vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
+			Name:  "machine",
+			Value: data.MachineType,
+		})
+	}
+
+	// Add NUMA if enabled
+	if data.NUMA {
+		vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
+			Name:  "numa",
+			Value: 1,
+		})
+	}
+
+	// Add hugepages if specified (Proxmox expects: "any", "2" for 2MB, "1024" for 1GB)
+	if data.Hugepages != "" {
+		var hugepagesStr string
+
+		switch data.Hugepages {
+		case "2MB", "2":
+			hugepagesStr = "2"
+		case "1GB", "1024":
+			hugepagesStr = "1024"
+		case "any":
+			hugepagesStr = "any"
+		default:
+			hugepagesStr = data.Hugepages
+		}
+
+		vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
+			Name:  "hugepages",
+			Value: hugepagesStr,
+		})
+	}
+
+	// Disable balloon if explicitly set to false (for GPU/hugepages)
+	if data.Balloon != nil && !*data.Balloon {
+		vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
+			Name:  "balloon",
+			Value: 0,
+		})
+	}
+
+	// Add additional NICs for storage/backup networks
+	for i, nic := range data.AdditionalNICs {
+		var nicString string
+
+		firewallVal := 0
+		if nic.Firewall {
+			firewallVal = 1
+		}
+
+		bridge := nics[i+1].bridgeName(identity.omniCluster)
+
+		if nic.Vlan == 0 {
+			nicString = fmt.Sprintf("virtio,bridge=%s,firewall=%d", bridge, firewallVal)
+		} else {
+			nicString = fmt.Sprintf("virtio,bridge=%s,firewall=%d,tag=%d", bridge, firewallVal, nic.Vlan)
+		}
+
+		vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
+			Name:  fmt.Sprintf("net%d", i+1), // net1, net2, etc.
+			Value: nicString,
+		})
+	}
+
+	// Add PCI device passthrough using Resource Mappings
+	for i, pci := range data.PCIDevices {
+		var pciParts []string
+
+		pciParts = append(pciParts, fmt.Sprintf("mapping=%s", pci.Mapping))
+		if pci.PCIExpress {
+			pciParts = append(pciParts, "pcie=1")
+		}
+
+		if pci.PrimaryGPU {
+			pciParts = append(pciParts, "x-vga=1")
+		}
+
+		if pci.ROMBar {
+			pciParts = append(pciParts, "rombar=1")
+		}
+
+		pciString := strings.Join(pciParts, ",")
+		vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
+			Name:  fmt.Sprintf("hostpci%d", i), // hostpci0, hostpci1, etc.
+			Value: pciString,
+		})
+	}
+
+	return vmOptions
+}
+
+// storageCELEnv creates the CEL environment for the storage selector.
+func storageCELEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("name", cel.StringType),
+		cel.Variable("node", cel.StringType),
+		cel.Variable("storageType", cel.StringType),
+		cel.Variable("availableSpace", cel.UintType),
+	)
+}
+
+// matchStorages returns the node storages matching the CEL selector.
+func matchStorages(node *proxmox.Node, storages proxmox.Storages, selector string) ([]*proxmox.Storage, error) {
+	env, err := storageCELEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	expr, err := siderocel.ParseBooleanExpression(selector, env)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*proxmox.Storage
+
+	for _, storage := range storages {
 		matched, err := expr.EvalBool(env, map[string]any{
 			"name":           storage.Name,
 			"node":           node.Name,
@@ -611,19 +1206,142 @@ func (p *Provisioner) pickStorage(ctx context.Context, node *proxmox.Node, selec
 			"availableSpace": storage.Avail,
 		})
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		if matched {
-			return storage.Name, nil
+			matches = append(matches, storage)
 		}
 	}
 
-	return "", fmt.Errorf("failed to pick the disk: no matches for the condition %q", selector)
+	return matches, nil
 }
 
-func (p *Provisioner) getVM(ctx context.Context, nodeName string, vmid int32) (*proxmox.VirtualMachine, error) {
-	node, err := p.proxmoxClient.Node(ctx, nodeName)
+// nodeStatuses collects the state of the Proxmox nodes used by the placement strategies.
+func (p *Provisioner) nodeStatuses(ctx context.Context, pctx provision.Context[*resources.Machine], cluster string, client *proxmox.Client, nodes proxmox.NodeStatuses, data Data) ([]nodeStatus, error) {
+	machineRequestSet, inMachineRequestSet := pctx.GetMachineRequestSetID()
+	group := controlPlaneGroup(pctx.MachineRequest)
+
+	var clusterResources []struct {
+		Node string `json:"node"`
+		Pool string `json:"pool"`
+	}
+
+	if err := client.Get(ctx, "/cluster/resources", &clusterResources); err != nil {
+		return nil, fmt.Errorf("failed to get cluster resources: %w", err)
+	}
+
+	nodePools := map[string][]string{}
+
+	for _, resource := range clusterResources {
+		if resource.Pool != "" && resource.Node != "" && !slices.Contains(nodePools[resource.Node], resource.Pool) {
+			nodePools[resource.Node] = append(nodePools[resource.Node], resource.Pool)
+		}
+	}
+
+	nodeInfoList := make([]nodeStatus, 0, len(nodes))
+
+	for _, node := range nodes {
+		ns := nodeStatus{
+			Cluster:    cluster,
+			Name:       node.Node,
+			Status:     node.Status,
+			CPUs:       node.MaxCPU,
+			CPUUsage:   node.CPU,
+			MaxMemory:  node.MaxMem,
+			FreeMemory: node.MaxMem - min(node.Mem, node.MaxMem),
+			Uptime:     node.Uptime,
+			Pools:      nodePools[node.Node],
+		}
+
+		if node.MaxMem > 0 {
+			ns.MemoryFree = float64(ns.FreeMemory) / float64(node.MaxMem)
+		}
+
+		// the details can't be read from the nodes which are down
+		if node.Status != "online" {
+			nodeInfoList = append(nodeInfoList, ns)
+
+			continue
+		}
+
+		n, err := client.Node(ctx, node.Node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get node %q, %w", node.Node, err)
+		}
+
+		if len(n.LoadAvg) > 0 {
+			ns.LoadAverage, _ = strconv.ParseFloat(n.LoadAvg[0], 64) //nolint:errcheck
+		}
+
+		vms, err := n.VirtualMachines(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get vms for now %q, %w", node.Node, err)
+		}
+
+		ns.vmNames = map[string]struct{}{}
+
+		for _, vm := range vms {
+			if vm.Template {
+				continue
+			}
+
+			ns.vmNames[vm.Name] = struct{}{}
+
+			ns.VMs++
+			ns.AllocatedCPUs += vm.CPUs
+			ns.AllocatedMemory += vm.MaxMem
+
+			sameMachineRequestSet := inMachineRequestSet && vm.HasTag(tagValue(machineRequestTagPrefix, machineRequestSet))
+			if sameMachineRequestSet {
+				ns.SameMachineRequestSetVMs++
+			}
+
+			// the control plane VMs created before the group tag was written are matched by the machine request set
+			if group != "" && (vm.HasTag(tagValue(controlPlaneTagPrefix, group)) || sameMachineRequestSet) {
+				ns.ClusterControlPlaneVMs++
+			}
+		}
+
+		// reading the node notes needs the Sys.Audit privilege on the node, so they are read only if the tags are used
+		if data.usesNodeTags() {
+			var nodeConfig struct {
+				Description string `json:"description"`
+			}
+
+			if err = client.Get(ctx, fmt.Sprintf("/nodes/%s/config", node.Node), &nodeConfig); err != nil {
+				return nil, fmt.Errorf("failed to get config for node %q, %w", node.Node, err)
+			}
+
+			ns.Tags = parseNodeTags(nodeConfig.Description)
+		}
+
+		storages, err := n.Storages(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		matches, err := diskStorages(n, storages, data.StorageSelector)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, storage := range matches {
+			ns.StorageAvailable = max(ns.StorageAvailable, storage.Avail)
+		}
+
+		if _, err = p.planDisks(ctx, n, data); err != nil {
+			ns.StorageShortage = err.Error()
+		}
+
+		nodeInfoList = append(nodeInfoList, ns)
+	}
+
+	return nodeInfoList, nil
+}
+
+func (p *Provisioner) getVM(ctx context.Context, client *proxmox.Client, nodeName string, vmid int32) (*proxmox.VirtualMachine, error) {
+	node, err := client.Node(ctx, nodeName)
 	if err != nil {
 		return nil, err
 	}
@@ -631,13 +1349,63 @@ func (p *Provisioner) getVM(ctx context.Context, nodeName string, vmid int32) (*
 	return node.VirtualMachine(ctx, int(vmid))
 }
 
-func (p *Provisioner) checkTaskStatus(ctx context.Context, id string) error {
-	t := proxmox.NewTask(proxmox.UPID(id), p.proxmoxClient)
+// primaryDiskOptions returns the machine class options of the primary disk, besides the storage and the size.
+func primaryDiskOptions(data Data) []string {
+	var options []string
+
+	if data.DiskSSD {
+		options = append(options, "ssd=1")
+	}
+
+	if data.DiskDiscard {
+		options = append(options, "discard=on")
+	}
+
+	if data.DiskIOThread {
+		options = append(options, "iothread=1")
+	}
+
+	if data.DiskCache != "" {
+		options = append(options, fmt.Sprintf("cache=%s", data.DiskCache))
+	}
+
+	if data.DiskAIO != "" {
+		options = append(options, fmt.Sprintf("aio=%s", data.DiskAIO))
+	}
+
+	return options
+}
+
+// vmNode returns the node the VM is on now, as the HA manager or the migration might have moved the VM after it was created.
+// The node recorded in the machine is returned if the VM is not found in the cluster.
+func (p *Provisioner) vmNode(ctx context.Context, client *proxmox.Client, spec *specs.MachineSpec) (string, error) {
+	var vms []clusterVM
+
+	if err := client.Get(ctx, "/cluster/resources?type=vm", &vms); err != nil {
+		return "", fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	for _, vm := range vms {
+		if vm.VMID == int(spec.Vmid) {
+			return vm.Node, nil
+		}
+	}
+
+	return spec.Node, nil
+}
+
+func (p *Provisioner) checkTaskStatus(ctx context.Context, client *proxmox.Client, id string) error {
+	t := proxmox.NewTask(proxmox.UPID(id), client)
 
 	if err := t.Ping(ctx); err != nil {
 		return err
 	}
 
+	trace.SpanFromContext(ctx).AddEvent("proxmox task status", trace.WithAttributes(
+		tracing.AttributeTaskUPID.String(id),
+		attribute.String("proxmox.task.status", t.Status),
+	))
+
 	switch {
 	case t.IsRunning:
 		return provision.NewRetryInterval(time.Second * 10)
@@ -645,11 +1413,24 @@ func (p *Provisioner) checkTaskStatus(ctx context.Context, id string) error {
 		return nil
 	}
 
-	return errors.New(t.Status)
+	return &taskError{taskType: t.Type, exitStatus: t.ExitStatus}
+}
+
+// taskError is returned for the Proxmox task which has finished unsuccessfully.
+type taskError struct {
+	taskType   string
+	exitStatus string
 }
 
-func (p *Provisioner) waitForTaskToFinish(ctx context.Context, t *proxmox.Task) error {
-	ticker := time.NewTicker(time.Second * 5)
+func (e *taskError) Error() string {
+	return fmt.Sprintf("%s task failed: %s", e.taskType, e.exitStatus)
+}
+
+func (p *Provisioner) waitForTaskToFinish(ctx context.Context, t *proxmox.Task) (err error) {
+	ctx, span := p.tracer.Start(ctx, "wait for proxmox task", trace.WithAttributes(tracing.AttributeTaskUPID.String(string(t.UPID))))
+	defer func() { tracing.End(span, err) }()
+
+	ticker := time.NewTicker(taskPollInterval)
 
 	defer ticker.Stop()
 
@@ -664,29 +1445,10 @@ func (p *Provisioner) waitForTaskToFinish(ctx context.Context, t *proxmox.Task)
 
 			switch {
 			case t.IsFailed:
-				return errors.New(t.Status)
+				return &taskError{taskType: t.Type, exitStatus: t.ExitStatus}
 			case t.IsSuccessful:
 				return nil
 			}
 		}
 	}
 }
-
-type nodeStatus struct {
-	Name                     string
-	MemoryFree               float64
-	SameMachineRequestSetVMs int
-}
-
-func pickNode(nodeInfoList []nodeStatus) nodeStatus {
-	// Auto-pick node with most free memory and with the least number of machines from the same machine request set
-	slices.SortFunc(nodeInfoList, func(a, b nodeStatus) int {
-		if c := cmp.Compare(a.SameMachineRequestSetVMs, b.SameMachineRequestSetVMs); c != 0 {
-			return c
-		}
-
-		return -cmp.Compare(a.MemoryFree, b.MemoryFree)
-	})
-
-	return nodeInfoList[0]
-}
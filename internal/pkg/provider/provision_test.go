@@ -5,11 +5,43 @@
 package provider_test
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	omniinfra "github.com/siderolabs/omni/client/pkg/infra"
+	"github.com/siderolabs/omni/client/pkg/infra/imagefactory"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/metrics"
 	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+	providermeta "github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/meta"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/tracing"
 )
 
 func TestPickNode(t *testing.T) {
@@ -73,3 +105,644 @@ func TestPickNode(t *testing.T) {
 		})
 	}
 }
+
+const gib = 1 << 30
+
+var (
+	testImageFactory = &fakeImageFactory{schematics: map[string]struct{}{}}
+
+	testImageFactoryClient *imagefactory.Client
+)
+
+func init() {
+	provider.SetTaskPollInterval(time.Millisecond * 10)
+
+	var err error
+
+	testImageFactoryClient, err = imagefactory.NewClient(imagefactory.ClientOptions{
+		FactoryEndpoint: httptest.NewServer(testImageFactory).URL,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// fakeImageFactory accepts any schematic and records the IDs it has created.
+type fakeImageFactory struct {
+	schematics map[string]struct{}
+	mu         sync.Mutex
+}
+
+func (f *fakeImageFactory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/schematics" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	id := sha256.Sum256(data)
+
+	f.mu.Lock()
+	f.schematics[hex.EncodeToString(id[:])] = struct{}{}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(map[string]string{"id": hex.EncodeToString(id[:])}) //nolint:errcheck
+}
+
+func (f *fakeImageFactory) created(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.schematics[id]
+
+	return ok
+}
+
+func newFakeProxmox(t *testing.T, nodes ...string) *fakeproxmox.Server {
+	t.Helper()
+
+	srv := fakeproxmox.NewServer()
+
+	t.Cleanup(srv.Close)
+
+	for _, node := range nodes {
+		srv.AddNode(fakeproxmox.Node{
+			Name:      node,
+			CPUs:      16,
+			MaxMemory: 64 * gib,
+			Memory:    8 * gib,
+			Uptime:    3600,
+		})
+
+		srv.AddStorage(node, fakeproxmox.Storage{
+			Name:    "local",
+			Content: []string{"iso", "import", "vztmpl"},
+			Total:   100 * gib,
+		})
+
+		srv.AddStorage(node, fakeproxmox.Storage{
+			Name:    "local-lvm",
+			Type:    "lvmthin",
+			Content: []string{"images", "rootdir"},
+			Total:   1024 * gib,
+		})
+	}
+
+	return srv
+}
+
+// baseMachineClass is the machine class the tests extend with the fields they exercise.
+const baseMachineClass = `cores: 2
+sockets: 1
+memory: 4096
+disk_size: 20
+storage_selector: name == "local-lvm"
+`
+
+func newProvisionContext(id, providerData string, labels map[string]string) provision.Context[*resources.Machine] {
+	machineRequest := infra.NewMachineRequest(id)
+	machineRequest.TypedSpec().Value.TalosVersion = "v1.11.0"
+	machineRequest.TypedSpec().Value.ProviderData = providerData
+
+	for k, v := range labels {
+		machineRequest.Metadata().Labels().Set(k, v)
+	}
+
+	return provision.NewContext(
+		machineRequest,
+		infra.NewMachineRequestStatus(id),
+		resources.NewMachine(omniinfra.ResourceNamespace(providermeta.ProviderID), id),
+		provision.ConnectionParams{
+			JoinConfig: "apiVersion: v1alpha1\nkind: SideroLinkConfig",
+		},
+		testImageFactoryClient,
+		nil,
+	)
+}
+
+// runSteps runs the provision steps in order, retrying each step while it asks to be retried.
+func runSteps(ctx context.Context, t *testing.T, p *provider.Provisioner, pctx provision.Context[*resources.Machine]) error {
+	t.Helper()
+
+	return runStepsWithLogger(ctx, p, pctx, zaptest.NewLogger(t))
+}
+
+func runStepsWithLogger(ctx context.Context, p *provider.Provisioner, pctx provision.Context[*resources.Machine], logger *zap.Logger) error {
+	for _, step := range p.ProvisionSteps() {
+		for attempt := 0; ; attempt++ {
+			err := step.Run(ctx, logger.With(zap.String("step", step.Name())), pctx)
+			if err == nil {
+				break
+			}
+
+			var retryErr *provision.RetryError
+
+			if !errors.As(err, &retryErr) {
+				return fmt.Errorf("step %s failed: %w", step.Name(), err)
+			}
+
+			if attempt == 20 {
+				return fmt.Errorf("step %s didn't finish: %w", step.Name(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestProvisionISO(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	srv.SetTaskBehavior("download", fakeproxmox.TaskBehavior{Polls: 2})
+	srv.SetTaskBehavior("qmcreate", fakeproxmox.TaskBehavior{Polls: 1})
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`disk_ssd: true
+`, map[string]string{
+		omni.LabelMachineRequestSet: "workers",
+	})
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	spec := pctx.State.TypedSpec().Value
+
+	assert.Equal(t, "pve1", spec.Node)
+	assert.True(t, testImageFactory.created(spec.Schematic), "the schematic %q is not created in the image factory", spec.Schematic)
+	assert.Equal(t, "v1.11.0", spec.TalosVersion)
+	assert.NotEmpty(t, spec.Uuid)
+	assert.NotEmpty(t, spec.VmStartTask)
+	assert.Equal(t, int32(100), spec.Vmid)
+
+	assert.True(t, srv.HasVolume("pve1", "local:iso/"+spec.VolumeId))
+
+	vm, ok := srv.VM("pve1", 100)
+	require.True(t, ok)
+
+	assert.Equal(t, "running", vm.Status)
+	assert.Equal(t, "machine-1", vm.Name())
+	assert.Contains(t, vm.Tags(), "machine-request.workers")
+	assert.Equal(t, "2", vm.Config["cores"])
+	assert.Equal(t, "4096", vm.Config["memory"])
+	assert.Equal(t, "uuid="+spec.Uuid, vm.Config["smbios1"])
+	assert.Equal(t, "local-lvm:vm-100-disk-0,ssd=1,size=20G", vm.Config["scsi0"])
+	assert.Equal(t, "local:iso/"+spec.VolumeId+",media=cdrom", vm.Config["ide2"])
+	assert.Contains(t, vm.Config["ide0"], "media=cdrom")
+
+	// the ISO is reused by the next machine
+	pctx = newProvisionContext("machine-2", baseMachineClass, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Equal(t, 1, srv.Requests(http.MethodPost, "/nodes/pve1/storage/local/download-url"))
+	assert.Empty(t, pctx.State.TypedSpec().Value.VolumeUploadTask)
+	assert.Len(t, srv.VMs("pve1"), 2)
+
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, nil))
+
+	_, ok = srv.VM("pve1", int(pctx.State.TypedSpec().Value.Vmid))
+	assert.False(t, ok)
+	assert.False(t, srv.HasVolume("pve1", fmt.Sprintf("local-lvm:vm-%d-disk-0", pctx.State.TypedSpec().Value.Vmid)))
+
+	// deprovisioning the VM which is already removed is a no-op
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, nil))
+}
+
+func TestProvisionTemplate(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	srv.SetTaskBehavior("qmclone", fakeproxmox.TaskBehavior{Polls: 1})
+
+	p := provider.NewProvisioner(srv.Client())
+
+	data := `provision_mode: template
+cores: 4
+sockets: 1
+memory: 8192
+disk_size: 40
+storage_selector: name == "local-lvm"
+`
+
+	pctx1 := newProvisionContext("machine-1", data, nil)
+	pctx2 := newProvisionContext("machine-2", data+"full_clone: true\ndisk_ssd: true\ndisk_discard: true\n", nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx1))
+	require.NoError(t, runSteps(ctx, t, p, pctx2))
+
+	spec1 := pctx1.State.TypedSpec().Value
+	spec2 := pctx2.State.TypedSpec().Value
+
+	assert.NotZero(t, spec1.TemplateVmid)
+	assert.Equal(t, spec1.TemplateVmid, spec2.TemplateVmid)
+	assert.Equal(t, 1, srv.Requests(http.MethodPost, "/nodes/pve1/storage/local/download-url"))
+	assert.True(t, srv.HasVolume("pve1", spec1.VolumeId))
+	assert.True(t, strings.HasPrefix(spec1.VolumeId, "local:import/"))
+
+	template, ok := srv.VM("pve1", int(spec1.TemplateVmid))
+	require.True(t, ok)
+
+	assert.True(t, template.Template)
+	assert.Contains(t, template.Tags(), "omni-talos-template")
+
+	for _, spec := range []*struct {
+		disk string
+		vmid int32
+	}{
+		{vmid: spec1.Vmid, disk: fmt.Sprintf("local-lvm:vm-%d-disk-0/vm-%d-disk-0", spec1.TemplateVmid, spec1.Vmid)},
+		{vmid: spec2.Vmid, disk: fmt.Sprintf("local-lvm:vm-%d-disk-0", spec2.Vmid)},
+	} {
+		vm, ok := srv.VM("pve1", int(spec.vmid))
+		require.True(t, ok)
+
+		assert.Equal(t, "running", vm.Status)
+		assert.Equal(t, "4", vm.Config["cores"])
+		assert.Equal(t, "8192", vm.Config["memory"])
+		assert.True(t, strings.HasPrefix(vm.Config["scsi0"], spec.disk+","), vm.Config["scsi0"])
+		assert.Contains(t, vm.Config["scsi0"], "size=40G")
+		assert.NotContains(t, vm.Config, "ide2")
+	}
+
+	// the disk options of the machine class are applied to the cloned disk
+	vm, ok := srv.VM("pve1", int(spec2.Vmid))
+	require.True(t, ok)
+
+	assert.Equal(t, fmt.Sprintf("local-lvm:vm-%d-disk-0,ssd=1,discard=on,size=40G", spec2.Vmid), vm.Config["scsi0"])
+}
+
+func TestProvisionTemplateFailedTasks(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	srv.SetTaskBehavior("qmcreate", fakeproxmox.TaskBehavior{ExitStatus: "unable to import the disk", Count: 1})
+	srv.SetTaskBehavior("qmclone", fakeproxmox.TaskBehavior{ExitStatus: "unable to clone the disk", Count: 1})
+
+	p := provider.NewProvisioner(srv.Client())
+
+	// the disk size is not set, so the size of the template disk is kept
+	pctx := newProvisionContext("machine-1", `provision_mode: template
+cores: 2
+sockets: 1
+memory: 4096
+storage_selector: name == "local-lvm"
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	spec := pctx.State.TypedSpec().Value
+
+	assert.Len(t, srv.VMs("pve1"), 2)
+	assert.Zero(t, srv.Requests(http.MethodPut, fmt.Sprintf("/nodes/pve1/qemu/%d/resize", spec.Vmid)))
+
+	vm, ok := srv.VM("pve1", int(spec.Vmid))
+	require.True(t, ok)
+
+	assert.Contains(t, vm.Config["scsi0"], "size=1G")
+}
+
+func TestProvisionAbandonedTemplate(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	const data = baseMachineClass + `provision_mode: template
+`
+
+	// the machine starts building the template and is removed before the template is converted
+	abandoned := newProvisionContext("machine-1", data, nil)
+
+	for _, step := range p.ProvisionSteps() {
+		for abandoned.State.TypedSpec().Value.TemplateVmid == 0 {
+			err := step.Run(ctx, zaptest.NewLogger(t), abandoned)
+			if err == nil {
+				break
+			}
+
+			var retryErr *provision.RetryError
+
+			require.ErrorAs(t, err, &retryErr)
+		}
+	}
+
+	templateVMID := int(abandoned.State.TypedSpec().Value.TemplateVmid)
+
+	vm, ok := srv.VM("pve1", templateVMID)
+	require.True(t, ok)
+	require.False(t, vm.Template)
+
+	pctx := newProvisionContext("machine-2", data, nil)
+
+	// the other machine waits for the build which is still in progress
+	for _, step := range p.ProvisionSteps() {
+		if step.Name() == "syncTemplate" {
+			require.ErrorAs(t, step.Run(ctx, zaptest.NewLogger(t), pctx), new(*provision.RetryError))
+
+			break
+		}
+
+		require.NoError(t, step.Run(ctx, zaptest.NewLogger(t), pctx), step.Name())
+	}
+
+	_, ok = srv.VM("pve1", templateVMID)
+	require.True(t, ok)
+
+	// the build is abandoned once it's older than the timeout, it's removed and the template is built again
+	vm.Config["meta"] = fmt.Sprintf("creation-qemu=9.2.0,ctime=%d", time.Now().Add(-time.Hour).Unix())
+	srv.AddVM(vm)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Equal(t, 1, srv.Requests(http.MethodDelete, fmt.Sprintf("/nodes/pve1/qemu/%d", templateVMID)))
+
+	template, ok := srv.VM("pve1", int(pctx.State.TypedSpec().Value.TemplateVmid))
+	require.True(t, ok)
+	assert.True(t, template.Template)
+}
+
+func TestProvisionDownloadRetry(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	srv.SetTaskBehavior("download", fakeproxmox.TaskBehavior{ExitStatus: "download failed: 502 Bad Gateway", Polls: 1, Count: 1})
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", `cores: 1
+sockets: 1
+memory: 2048
+disk_size: 10
+storage_selector: name == "local-lvm"
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	assert.Equal(t, 2, srv.Requests(http.MethodPost, "/nodes/pve1/storage/local/download-url"))
+	assert.True(t, srv.HasVolume("pve1", "local:iso/"+pctx.State.TypedSpec().Value.VolumeId))
+}
+
+func TestProvisionFailures(t *testing.T) {
+	t.Parallel()
+
+	const data = `cores: 1
+sockets: 1
+memory: 2048
+disk_size: 10
+storage_selector: name == "local-lvm"
+`
+
+	for _, tt := range []struct {
+		setup         func(*fakeproxmox.Server)
+		name          string
+		data          string
+		expectedError string
+	}{
+		{
+			name: "VM create task fails",
+			setup: func(srv *fakeproxmox.Server) {
+				srv.SetTaskBehavior("qmcreate", fakeproxmox.TaskBehavior{ExitStatus: "unable to create VM"})
+			},
+			data:          data,
+			expectedError: "step syncVM failed: qmcreate task failed: unable to create VM",
+		},
+		{
+			name: "configured node is offline",
+			setup: func(srv *fakeproxmox.Server) {
+				srv.AddNode(fakeproxmox.Node{Name: "pve2", Status: "offline"})
+			},
+			data:          data + "node: pve2\n",
+			expectedError: `specified node "pve2" is not online (status: offline)`,
+		},
+		{
+			name:          "configured node doesn't exist",
+			data:          data + "node: pve3\n",
+			expectedError: `specified node "pve3" not found in cluster`,
+		},
+		{
+			name:          "no matching storage",
+			data:          strings.ReplaceAll(data, "local-lvm", "ceph"),
+			expectedError: `no matches for the condition "name == \"ceph\""`,
+		},
+		{
+			name: "transient API errors",
+			setup: func(srv *fakeproxmox.Server) {
+				srv.FailRequests(http.MethodGet, "/cluster/nextid", 1, http.StatusInternalServerError, "cfs-lock 'file-nextid' error: got lock request timeout")
+			},
+			data:          data,
+			expectedError: "step syncVM failed: 500 cfs-lock 'file-nextid' error: got lock request timeout",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+			defer cancel()
+
+			srv := newFakeProxmox(t, "pve1")
+
+			if tt.setup != nil {
+				tt.setup(srv)
+			}
+
+			p := provider.NewProvisioner(srv.Client())
+
+			pctx := newProvisionContext("machine-1", tt.data, nil)
+
+			err := runSteps(ctx, t, p, pctx)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expectedError)
+
+			// the steps succeed once the API recovers
+			if strings.HasPrefix(tt.name, "transient") {
+				require.NoError(t, runSteps(ctx, t, p, pctx))
+			}
+		})
+	}
+}
+
+func TestDeprovisionWithoutVM(t *testing.T) {
+	t.Parallel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	require.NoError(t, p.Deprovision(t.Context(), zaptest.NewLogger(t), resources.NewMachine(omniinfra.ResourceNamespace(providermeta.ProviderID), "machine-1"), nil))
+
+	assert.Zero(t, srv.Requests(http.MethodGet, "/nodes/pve1/qemu/0/status/current"))
+}
+
+func TestProvisionMetrics(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	srv.SetTaskBehavior("download", fakeproxmox.TaskBehavior{Polls: 1})
+
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+
+	p := provider.NewProvisioner(srv.Client(), provider.WithMetrics(m))
+
+	const data = baseMachineClass
+
+	first := newProvisionContext("machine-1", data, nil)
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	second := newProvisionContext("machine-2", data, nil)
+	require.NoError(t, runSteps(ctx, t, p, second))
+
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), first.State, nil))
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP omni_infra_provider_proxmox_image_cache_requests_total Number of the lookups of the Talos images on the Proxmox storages, by the image kind (iso or import) and the result (hit or miss).
+# TYPE omni_infra_provider_proxmox_image_cache_requests_total counter
+omni_infra_provider_proxmox_image_cache_requests_total{kind="iso",result="hit"} 1
+omni_infra_provider_proxmox_image_cache_requests_total{kind="iso",result="miss"} 1
+# HELP omni_infra_provider_proxmox_managed_vms Number of the VMs managed by the provider, by the cluster and the node.
+# TYPE omni_infra_provider_proxmox_managed_vms gauge
+omni_infra_provider_proxmox_managed_vms{cluster="default",node="pve1"} 1
+`), "omni_infra_provider_proxmox_image_cache_requests_total", "omni_infra_provider_proxmox_managed_vms"))
+
+	// each step and the deprovision succeeded, some of the steps also waited for the tasks
+	count, err := testutil.GatherAndCount(registry, "omni_infra_provider_proxmox_step_duration_seconds")
+	require.NoError(t, err)
+	assert.Greater(t, count, len(p.ProvisionSteps())+1)
+
+	count, err = testutil.GatherAndCount(registry, "omni_infra_provider_proxmox_step_retries_total")
+	require.NoError(t, err)
+	assert.Positive(t, count)
+}
+
+func TestProvisionTracing(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	srv.SetTaskBehavior("download", fakeproxmox.TaskBehavior{Polls: 1})
+
+	recorder := tracetest.NewSpanRecorder()
+
+	p := provider.NewProvisioner(srv.Client(), provider.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+
+	pctx := newProvisionContext("machine-1", baseMachineClass, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), pctx.State, nil))
+
+	spans := recorder.Ended()
+	require.NotEmpty(t, spans)
+
+	traceID := oteltrace.SpanContextFromContext(tracing.RequestContext(ctx, "machine-1")).TraceID()
+
+	var names []string
+
+	for _, span := range spans {
+		assert.Equal(t, traceID, span.SpanContext().TraceID(), span.Name())
+
+		names = append(names, span.Name())
+	}
+
+	assert.Contains(t, names, "uploadISO")
+	assert.Contains(t, names, "wait for proxmox task")
+	assert.Equal(t, "deprovision", names[len(names)-1])
+
+	// the retried step attempt has the download task UPID
+	index := slices.IndexFunc(spans, func(span sdktrace.ReadOnlySpan) bool {
+		return span.Name() == "uploadISO" && slices.Contains(span.Attributes(), tracing.AttributeRetry.Bool(true))
+	})
+	require.NotEqual(t, -1, index)
+
+	assert.Contains(t, spans[index].Attributes(), tracing.AttributeNode.String("pve1"))
+	assert.Contains(t, spans[index].Attributes(), tracing.AttributeTaskUPID.StringSlice([]string{pctx.State.TypedSpec().Value.VolumeUploadTask}))
+
+	index = slices.IndexFunc(spans, func(span sdktrace.ReadOnlySpan) bool { return span.Name() == "startVM" })
+	require.NotEqual(t, -1, index)
+
+	assert.Contains(t, spans[index].Attributes(), tracing.AttributeVMID.Int(int(pctx.State.TypedSpec().Value.Vmid)))
+}
+
+func TestProvisionLogging(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+	srv.AddHAGroup("workers")
+
+	p := provider.NewProvisioner(srv.Client())
+
+	pctx := newProvisionContext("machine-1", baseMachineClass+`ha:
+  group: workers
+`, map[string]string{
+		omni.LabelMachineRequestSet: "workers",
+	})
+
+	core, logs := observer.New(zap.DebugLevel)
+
+	require.NoError(t, runStepsWithLogger(ctx, p, pctx, zap.New(core)))
+	require.NoError(t, p.Deprovision(ctx, zap.New(core), pctx.State, pctx.MachineRequest))
+
+	// the VM options are logged at the debug level
+	created := logs.FilterMessage("creating the VM").All()
+	require.Len(t, created, 1)
+
+	fields := created[0].ContextMap()
+
+	assert.Equal(t, "machine-1", fields["machine"])
+	assert.Equal(t, "workers", fields["machineRequestSet"])
+	assert.Equal(t, provider.DefaultCluster, fields["cluster"])
+	assert.Equal(t, "pve1", fields["node"])
+	assert.Contains(t, fields["vmOptions"], "cores=2")
+
+	// the VMID is known after the VM is created
+	for _, message := range []string{"registered the VM as the HA resource", "removed the HA resource"} {
+		entries := logs.FilterMessage(message).All()
+		require.Len(t, entries, 1, message)
+
+		fields = entries[0].ContextMap()
+
+		assert.Equal(t, "machine-1", fields["machine"], message)
+		assert.Equal(t, "workers", fields["machineRequestSet"], message)
+		assert.Equal(t, "pve1", fields["node"], message)
+		assert.EqualValues(t, pctx.State.TypedSpec().Value.Vmid, fields["vmid"], message)
+	}
+}
@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package resources
+
+import (
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/resource/meta"
+	"github.com/cosi-project/runtime/pkg/resource/protobuf"
+	"github.com/cosi-project/runtime/pkg/resource/typed"
+	"github.com/siderolabs/omni/client/pkg/infra"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	providermeta "github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/meta"
+)
+
+// NewIPLease creates new IPLease, the ID is the leased address.
+func NewIPLease(ns, id string) *IPLease {
+	return typed.NewResource[IPLeaseSpec, IPLeaseExtension](
+		resource.NewMetadata(ns, infra.ResourceType("IPLease", providermeta.ProviderID), id, resource.VersionUndefined),
+		protobuf.NewResourceSpec(&specs.IPLeaseSpec{}),
+	)
+}
+
+// IPLease describes the static address leased to the VM NIC.
+type IPLease = typed.Resource[IPLeaseSpec, IPLeaseExtension]
+
+// IPLeaseSpec wraps specs.IPLeaseSpec.
+type IPLeaseSpec = protobuf.ResourceSpec[specs.IPLeaseSpec, *specs.IPLeaseSpec]
+
+// IPLeaseExtension providers auxiliary methods for IPLease resource.
+type IPLeaseExtension struct{}
+
+// ResourceDefinition implements [typed.Extension] interface.
+func (IPLeaseExtension) ResourceDefinition() meta.ResourceDefinitionSpec {
+	return meta.ResourceDefinitionSpec{
+		Type:             infra.ResourceType("IPLease", providermeta.ProviderID),
+		Aliases:          []resource.Type{},
+		DefaultNamespace: infra.ResourceNamespace(providermeta.ProviderID),
+		PrintColumns:     []meta.PrintColumn{},
+	}
+}
+
+// RegisterIPLease registers the IPLease resource to be decoded from the Omni API, it should be called once after the provider ID is set.
+func RegisterIPLease() error {
+	return protobuf.RegisterDynamic[IPLeaseSpec](infra.ResourceType("IPLease", providermeta.ProviderID), &IPLease{})
+}
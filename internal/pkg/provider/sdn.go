@@ -0,0 +1,536 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cosi-project/runtime/pkg/safe"
+	"github.com/luthermonson/go-proxmox"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/ipam"
+	providermeta "github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/meta"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+const (
+	// workersSetSuffix is the suffix of the machine request set ID Omni creates for the cluster workers.
+	workersSetSuffix = "-workers"
+
+	// maxVNetTag is the maximal VXLAN tag, the VLAN zones allow the tags up to 4094.
+	maxVNetTag = 1<<24 - 1
+)
+
+// sdnVNet is the Proxmox SDN VNet.
+type sdnVNet struct {
+	VNet  string `json:"vnet"`
+	Zone  string `json:"zone"`
+	Alias string `json:"alias"`
+	Tag   int    `json:"tag"`
+}
+
+// sdnZone is the Proxmox SDN zone.
+type sdnZone struct {
+	Zone string `json:"zone"`
+	// Type is the zone type, e.g. simple, vlan or vxlan.
+	Type string `json:"type"`
+}
+
+// sdnSubnet is the subnet of the Proxmox SDN VNet.
+type sdnSubnet struct {
+	// Subnet is the subnet ID, e.g. zone1-10.5.0.0-24.
+	Subnet  string `json:"subnet"`
+	CIDR    string `json:"cidr"`
+	Gateway string `json:"gateway"`
+}
+
+// omniClusterName returns the Omni cluster the machine is requested for, it's empty if the machine is not requested for a cluster.
+func omniClusterName(machineRequest *infra.MachineRequest) string {
+	if cluster, ok := machineRequest.Metadata().Labels().Get(omni.LabelCluster); ok {
+		return cluster
+	}
+
+	machineRequestSet, _ := machineRequest.Metadata().Labels().Get(omni.LabelMachineRequestSet)
+
+	for _, suffix := range []string{controlPlanesSetSuffix, workersSetSuffix} {
+		if cluster, ok := strings.CutSuffix(machineRequestSet, suffix); ok && cluster != "" {
+			return cluster
+		}
+	}
+
+	return ""
+}
+
+// clusterVNetName returns the name of the VNet created for the Omni cluster.
+// Proxmox limits the VNet names to 8 alphanumeric characters, so the name is derived from the hash of the cluster name.
+func clusterVNetName(omniCluster string) string {
+	sum := sha256.Sum256([]byte(providermeta.ProviderID + "/" + omniCluster))
+
+	return "o" + hex.EncodeToString(sum[:])[:7]
+}
+
+// clusterVNetAlias returns the alias of the VNet created for the Omni cluster, it marks the VNet as owned by the provider.
+func clusterVNetAlias(omniCluster string) string {
+	return fmt.Sprintf("omni %s %s", providermeta.ProviderID, omniCluster)
+}
+
+// parseTagRange parses the range of the VNet tags, e.g. 100-199 or 100.
+func parseTagRange(tags string) (first, last int, err error) {
+	firstTag, lastTag, found := strings.Cut(tags, "-")
+	if !found {
+		lastTag = firstTag
+	}
+
+	if first, err = strconv.Atoi(strings.TrimSpace(firstTag)); err != nil {
+		return 0, 0, fmt.Errorf("invalid tag %q", firstTag)
+	}
+
+	if last, err = strconv.Atoi(strings.TrimSpace(lastTag)); err != nil {
+		return 0, 0, fmt.Errorf("invalid tag %q", lastTag)
+	}
+
+	if first < 1 || last > maxVNetTag || first > last {
+		return 0, 0, fmt.Errorf("invalid range %q: should be within 1-%d", tags, maxVNetTag)
+	}
+
+	return first, last, nil
+}
+
+// syncNetwork checks that the SDN VNets the NICs are attached to exist and are applied on the picked node.
+// The VNets of the Omni cluster are created if they don't exist.
+func (p *Provisioner) syncNetwork(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+	var data Data
+
+	if err := pctx.UnmarshalProviderData(&data); err != nil {
+		return err
+	}
+
+	if err := validateNetwork(data); err != nil {
+		return err
+	}
+
+	nics := data.nicConfigs()
+
+	if !slices.ContainsFunc(nics, func(nic nicConfig) bool { return nic.vnet != "" || nic.clusterVNet != nil }) {
+		return nil
+	}
+
+	spec := pctx.State.TypedSpec().Value
+
+	client, err := p.client(spec.Cluster)
+	if err != nil {
+		return err
+	}
+
+	omniCluster := omniClusterName(pctx.MachineRequest)
+
+	for i, nic := range nics {
+		name := nic.vnet
+
+		if nic.clusterVNet != nil {
+			if omniCluster == "" {
+				return fmt.Errorf("net%d: the cluster VNet can be used only by the machines requested for an Omni cluster", i)
+			}
+
+			name = clusterVNetName(omniCluster)
+
+			// the VNet is claimed before it's created, so that it's not removed until the VM is created
+			p.claimVNet(name, pctx.GetRequestID())
+
+			if !slices.Contains(spec.ClusterVnets, name) {
+				spec.ClusterVnets = append(spec.ClusterVnets, name)
+			}
+
+			if err = p.ensureClusterVNet(ctx, logger, client, spec.Node, omniCluster, *nic.clusterVNet); err != nil {
+				return fmt.Errorf("net%d: %w", i, err)
+			}
+		}
+
+		if name == "" {
+			continue
+		}
+
+		if err = checkVNet(ctx, client, spec.Node, name); err != nil {
+			return fmt.Errorf("net%d: %w", i, err)
+		}
+
+		if nic.subnet != "" {
+			if _, err = vnetSubnet(ctx, client, name, nic.subnet); err != nil {
+				return fmt.Errorf("net%d: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// appliedVNets returns the zones of the SDN VNets applied on the node, keyed by the VNet name.
+func appliedVNets(ctx context.Context, client *proxmox.Client, node string) (map[string]string, error) {
+	var zones []struct {
+		Zone   string `json:"zone"`
+		Status string `json:"status"`
+	}
+
+	if err := client.Get(ctx, fmt.Sprintf("/nodes/%s/sdn/zones", node), &zones); err != nil {
+		return nil, fmt.Errorf("failed to list the SDN zones of the node %s: %w", node, err)
+	}
+
+	applied := map[string]string{}
+
+	for _, zone := range zones {
+		if zone.Status != "available" {
+			continue
+		}
+
+		var content []struct {
+			VNet   string `json:"vnet"`
+			Status string `json:"status"`
+		}
+
+		if err := client.Get(ctx, fmt.Sprintf("/nodes/%s/sdn/zones/%s/content", node, url.PathEscape(zone.Zone)), &content); err != nil {
+			return nil, fmt.Errorf("failed to list the VNets of the SDN zone %s on the node %s: %w", zone.Zone, node, err)
+		}
+
+		for _, vnet := range content {
+			if vnet.Status == "available" {
+				applied[vnet.VNet] = zone.Zone
+			}
+		}
+	}
+
+	return applied, nil
+}
+
+// checkVNet checks that the SDN VNet exists and is applied on the node.
+func checkVNet(ctx context.Context, client *proxmox.Client, node, name string) error {
+	applied, err := appliedVNets(ctx, client, node)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := applied[name]; ok {
+		return nil
+	}
+
+	var vnet sdnVNet
+
+	if err = client.Get(ctx, "/cluster/sdn/vnets/"+url.PathEscape(name), &vnet); err != nil {
+		return fmt.Errorf("failed to find the SDN VNet %q: %w", name, err)
+	}
+
+	return fmt.Errorf("SDN VNet %q is not applied on the node %s, the SDN config should be applied", name, node)
+}
+
+// vnetSubnet returns the subnet of the SDN VNet, the subnet is referred either by the ID or by the CIDR.
+func vnetSubnet(ctx context.Context, client *proxmox.Client, vnet, name string) (sdnSubnet, error) {
+	var subnets []sdnSubnet
+
+	if err := client.Get(ctx, fmt.Sprintf("/cluster/sdn/vnets/%s/subnets", url.PathEscape(vnet)), &subnets); err != nil {
+		return sdnSubnet{}, fmt.Errorf("failed to list the subnets of the SDN VNet %q: %w", vnet, err)
+	}
+
+	index := slices.IndexFunc(subnets, func(subnet sdnSubnet) bool { return subnet.Subnet == name || subnet.CIDR == name })
+	if index == -1 {
+		return sdnSubnet{}, fmt.Errorf("SDN VNet %q has no subnet %q", vnet, name)
+	}
+
+	return subnets[index], nil
+}
+
+// subnetPool returns the address pool of the NIC static address allocated from the SDN subnet.
+// The gateway and the range set in the machine class take precedence over the subnet gateway and the whole subnet.
+func (p *Provisioner) subnetPool(ctx context.Context, cluster string, nic nicConfig) (ipam.Pool, error) {
+	client, err := p.client(cluster)
+	if err != nil {
+		return ipam.Pool{}, err
+	}
+
+	subnet, err := vnetSubnet(ctx, client, nic.vnet, nic.subnet)
+	if err != nil {
+		return ipam.Pool{}, err
+	}
+
+	pool := inlinePool(nic.ip)
+	pool.CIDR = subnet.CIDR
+	pool.Gateway = cmp.Or(pool.Gateway, subnet.Gateway)
+
+	return pool, pool.Validate()
+}
+
+// ensureClusterVNet creates the VNet of the Omni cluster if it doesn't exist, and applies the SDN config if the VNet is not applied on the node.
+func (p *Provisioner) ensureClusterVNet(ctx context.Context, logger *zap.Logger, client *proxmox.Client, node, omniCluster string, config ClusterVNet) error {
+	p.sdnMu.Lock()
+	defer p.sdnMu.Unlock()
+
+	name := clusterVNetName(omniCluster)
+
+	var vnets []sdnVNet
+
+	if err := client.Get(ctx, "/cluster/sdn/vnets", &vnets); err != nil {
+		return fmt.Errorf("failed to list the SDN VNets: %w", err)
+	}
+
+	if index := slices.IndexFunc(vnets, func(vnet sdnVNet) bool { return vnet.VNet == name }); index != -1 {
+		switch vnet := vnets[index]; {
+		case vnet.Alias != clusterVNetAlias(omniCluster):
+			return fmt.Errorf("SDN VNet %q of the cluster %s exists, but it's not created by the provider", name, omniCluster)
+		case vnet.Zone != config.Zone:
+			return fmt.Errorf("SDN VNet %q of the cluster %s is in the zone %s, not in %s", name, omniCluster, vnet.Zone, config.Zone)
+		}
+
+		applied, err := appliedVNets(ctx, client, node)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := applied[name]; ok {
+			return nil
+		}
+	} else {
+		if err := createClusterVNet(ctx, client, vnets, omniCluster, config); err != nil {
+			return err
+		}
+
+		logger.Info("created the SDN VNet of the cluster", zap.String("vnet", name), zap.String("zone", config.Zone), zap.String("omni_cluster", omniCluster))
+	}
+
+	return p.applySDN(ctx, client)
+}
+
+// createClusterVNet creates the VNet of the Omni cluster, the tag is picked from the range if the zone needs it.
+func createClusterVNet(ctx context.Context, client *proxmox.Client, vnets []sdnVNet, omniCluster string, config ClusterVNet) error {
+	var zones []sdnZone
+
+	if err := client.Get(ctx, "/cluster/sdn/zones", &zones); err != nil {
+		return fmt.Errorf("failed to list the SDN zones: %w", err)
+	}
+
+	index := slices.IndexFunc(zones, func(zone sdnZone) bool { return zone.Zone == config.Zone })
+	if index == -1 {
+		return fmt.Errorf("SDN zone %q does not exist", config.Zone)
+	}
+
+	params := map[string]any{
+		"vnet":  clusterVNetName(omniCluster),
+		"zone":  config.Zone,
+		"alias": clusterVNetAlias(omniCluster),
+	}
+
+	if zones[index].Type != "simple" {
+		if config.Tags == "" {
+			return fmt.Errorf("SDN zone %q of the type %s needs the VNet tag, the cluster_vnet tags should be set", config.Zone, zones[index].Type)
+		}
+
+		first, last, err := parseTagRange(config.Tags)
+		if err != nil {
+			return err
+		}
+
+		used := map[int]struct{}{}
+
+		for _, vnet := range vnets {
+			if vnet.Zone == config.Zone {
+				used[vnet.Tag] = struct{}{}
+			}
+		}
+
+		tag := first
+
+		for ; tag <= last; tag++ {
+			if _, ok := used[tag]; !ok {
+				break
+			}
+		}
+
+		if tag > last {
+			return fmt.Errorf("no free tags left in the range %s of the SDN zone %q", config.Tags, config.Zone)
+		}
+
+		params["tag"] = tag
+	}
+
+	if err := client.Post(ctx, "/cluster/sdn/vnets", params, nil); err != nil {
+		return fmt.Errorf("failed to create the SDN VNet %s: %w", params["vnet"], err)
+	}
+
+	return nil
+}
+
+// applySDN applies the pending SDN config to the nodes and waits for it to finish.
+func (p *Provisioner) applySDN(ctx context.Context, client *proxmox.Client) error {
+	var upid proxmox.UPID
+
+	if err := client.Put(ctx, "/cluster/sdn", nil, &upid); err != nil {
+		return fmt.Errorf("failed to apply the SDN config: %w", err)
+	}
+
+	if err := p.waitForTaskToFinish(ctx, proxmox.NewTask(upid, client)); err != nil {
+		return fmt.Errorf("failed to apply the SDN config: %w", err)
+	}
+
+	return nil
+}
+
+// claimVNet marks the VNet of the Omni cluster as used by the machine.
+func (p *Provisioner) claimVNet(name, requestID string) {
+	p.sdnMu.Lock()
+	defer p.sdnMu.Unlock()
+
+	if p.vnetClaims[name] == nil {
+		p.vnetClaims[name] = map[string]struct{}{}
+	}
+
+	p.vnetClaims[name][requestID] = struct{}{}
+}
+
+// persistedVNetClaims returns the cluster VNets of the Proxmox cluster recorded in the Machine resources of the other machines.
+func (p *Provisioner) persistedVNetClaims(ctx context.Context, machine *resources.Machine) (map[string]struct{}, error) {
+	claimed := map[string]struct{}{}
+
+	if p.state == nil {
+		return claimed, nil
+	}
+
+	machines, err := safe.StateListAll[*resources.Machine](ctx, p.state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the machines: %w", err)
+	}
+
+	cluster := cmp.Or(machine.TypedSpec().Value.Cluster, DefaultCluster)
+
+	for other := range machines.All() {
+		if other.Metadata().ID() == machine.Metadata().ID() || cmp.Or(other.TypedSpec().Value.Cluster, DefaultCluster) != cluster {
+			continue
+		}
+
+		for _, name := range other.TypedSpec().Value.ClusterVnets {
+			claimed[name] = struct{}{}
+		}
+	}
+
+	return claimed, nil
+}
+
+// releaseClusterVNets removes the VNets of the Omni cluster the removed VM was attached to,
+// unless the other VMs are still attached to them, or the other machines are going to use them.
+func (p *Provisioner) releaseClusterVNets(ctx context.Context, logger *zap.Logger, machine *resources.Machine) error {
+	spec := machine.TypedSpec().Value
+
+	p.sdnMu.Lock()
+	defer p.sdnMu.Unlock()
+
+	for _, name := range spec.ClusterVnets {
+		delete(p.vnetClaims[name], machine.Metadata().ID())
+	}
+
+	if len(spec.ClusterVnets) == 0 {
+		return nil
+	}
+
+	client, err := p.client(spec.Cluster)
+	if err != nil {
+		return err
+	}
+
+	attached, complete, err := p.attachedBridges(ctx, logger, client)
+	if err != nil {
+		return err
+	}
+
+	// the VMs on the offline nodes might be attached to the VNets
+	if !complete {
+		logger.Warn("keeping the SDN VNets of the cluster, as not all VMs are read", zap.Strings("vnets", spec.ClusterVnets))
+
+		return nil
+	}
+
+	claimed, err := p.persistedVNetClaims(ctx, machine)
+	if err != nil {
+		return err
+	}
+
+	var removed bool
+
+	for _, name := range spec.ClusterVnets {
+		_, isAttached := attached[name]
+		_, isClaimed := claimed[name]
+
+		if isAttached || isClaimed || len(p.vnetClaims[name]) > 0 {
+			logger.Debug("the SDN VNet of the cluster is still used", zap.String("vnet", name))
+
+			continue
+		}
+
+		delete(p.vnetClaims, name)
+
+		var vnet sdnVNet
+
+		if err = client.Get(ctx, "/cluster/sdn/vnets/"+url.PathEscape(name), &vnet); err != nil {
+			if strings.Contains(err.Error(), "does not exist") {
+				continue
+			}
+
+			return fmt.Errorf("failed to get the SDN VNet %s: %w", name, err)
+		}
+
+		// the VNet might be recreated outside of the provider
+		if !strings.HasPrefix(vnet.Alias, clusterVNetAlias("")) {
+			continue
+		}
+
+		if err = client.Delete(ctx, "/cluster/sdn/vnets/"+url.PathEscape(name), nil); err != nil {
+			return fmt.Errorf("failed to remove the SDN VNet %s: %w", name, err)
+		}
+
+		removed = true
+
+		logger.Info("removed the SDN VNet of the cluster", zap.String("vnet", name))
+	}
+
+	if !removed {
+		return nil
+	}
+
+	return p.applySDN(ctx, client)
+}
+
+// attachedBridges returns the bridges and the VNets the NICs of the VMs in the cluster are attached to,
+// complete reports whether the configs of all the VMs are read.
+func (p *Provisioner) attachedBridges(ctx context.Context, logger *zap.Logger, client *proxmox.Client) (map[string]struct{}, bool, error) {
+	vms, complete, err := p.qemuVMs(ctx, logger, client)
+	if err != nil {
+		return nil, false, err
+	}
+
+	attached := map[string]struct{}{}
+
+	for _, vm := range vms {
+		for key, value := range vm.config {
+			if !strings.HasPrefix(key, "net") {
+				continue
+			}
+
+			for option := range strings.SplitSeq(value, ",") {
+				if bridge, ok := strings.CutPrefix(option, "bridge="); ok {
+					attached[bridge] = struct{}{}
+				}
+			}
+		}
+	}
+
+	return attached, complete, nil
+}
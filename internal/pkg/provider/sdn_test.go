@@ -0,0 +1,173 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/api/specs"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/fakeproxmox"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestProvisionVNet(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1", "pve2")
+
+	srv.AddZone(fakeproxmox.Zone{Name: "zone1", Nodes: []string{"pve1"}})
+	srv.AddVNet(fakeproxmox.VNet{
+		Name:    "lan",
+		Zone:    "zone1",
+		Subnets: []fakeproxmox.Subnet{{CIDR: "10.5.0.0/24", Gateway: "10.5.0.1"}},
+		Applied: true,
+	})
+	srv.AddVNet(fakeproxmox.VNet{Name: "dmz", Zone: "zone1"})
+
+	p := provider.NewProvisioner(srv.Client())
+
+	const data = baseMachineClass
+
+	pctx := newProvisionContext("machine-1", data+`node: pve1
+network_vnet: lan
+network_subnet: zone1-10.5.0.0-24
+ip:
+  range: 10.5.0.10-10.5.0.20
+`, nil)
+
+	require.NoError(t, runSteps(ctx, t, p, pctx))
+
+	// the address is allocated from the SDN subnet
+	assert.Equal(t, []*specs.NICAddress{{Nic: 0, Address: "10.5.0.10/24", Gateway: "10.5.0.1"}}, pctx.State.TypedSpec().Value.Addresses)
+
+	vms := srv.VMs("pve1")
+	require.Len(t, vms, 1)
+	assert.Contains(t, vms[0].Config["net0"], ",bridge=lan,firewall=1")
+
+	for _, test := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "zone not on the node",
+			data: "node: pve2\nnetwork_vnet: lan\n",
+			err:  `net0: SDN VNet "lan" is not applied on the node pve2`,
+		},
+		{
+			name: "not applied",
+			data: "node: pve1\nnetwork_vnet: dmz\n",
+			err:  `net0: SDN VNet "dmz" is not applied on the node pve1`,
+		},
+		{
+			name: "missing",
+			data: "network_bridge: vmbr0\nadditional_nics:\n  - vnet: wan\n",
+			err:  `net1: failed to find the SDN VNet "wan"`,
+		},
+		{
+			name: "missing subnet",
+			data: "node: pve1\nnetwork_vnet: lan\nnetwork_subnet: 10.6.0.0/24\n",
+			err:  `net0: SDN VNet "lan" has no subnet "10.6.0.0/24"`,
+		},
+	} {
+		require.ErrorContains(t, runSteps(ctx, t, p, newProvisionContext("machine-2", data+test.data, nil)), test.err, test.name)
+	}
+}
+
+func TestProvisionClusterVNet(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Minute)
+	defer cancel()
+
+	srv := newFakeProxmox(t, "pve1")
+
+	srv.AddZone(fakeproxmox.Zone{Name: "isolated", Type: "vxlan"})
+	srv.AddVNet(fakeproxmox.VNet{Name: "shared", Zone: "isolated", Tag: 100, Applied: true})
+
+	// the containers don't stop the VNets from being released
+	srv.AddContainer("pve1", 300)
+
+	p := provider.NewProvisioner(srv.Client())
+
+	const data = baseMachineClass + `additional_nics:
+  - cluster_vnet:
+      zone: isolated
+      tags: 100-101
+`
+
+	first := newProvisionContext("machine-1", data, map[string]string{omni.LabelCluster: "talos-1"})
+	require.NoError(t, runSteps(ctx, t, p, first))
+
+	vnets := srv.VNets()
+	require.Len(t, vnets, 2)
+
+	vnet := vnets[0]
+	if vnet.Name == "shared" {
+		vnet = vnets[1]
+	}
+
+	assert.Equal(t, "isolated", vnet.Zone)
+	assert.Equal(t, 101, vnet.Tag)
+	assert.True(t, vnet.Applied)
+	assert.True(t, strings.HasSuffix(vnet.Alias, " talos-1"), vnet.Alias)
+	assert.Equal(t, []string{vnet.Name}, first.State.TypedSpec().Value.ClusterVnets)
+
+	// the VNet is shared by the machines of the cluster
+	second := newProvisionContext("machine-2", data, map[string]string{omni.LabelMachineRequestSet: "talos-1-workers"})
+	require.NoError(t, runSteps(ctx, t, p, second))
+
+	assert.Len(t, srv.VNets(), 2)
+	assert.Equal(t, 1, srv.Requests(http.MethodPut, "/cluster/sdn"))
+
+	for _, vm := range srv.VMs("pve1") {
+		assert.Contains(t, vm.Config["net1"], ",bridge="+vnet.Name+",firewall=0")
+	}
+
+	err := runSteps(ctx, t, p, newProvisionContext("machine-3", data, map[string]string{omni.LabelCluster: "talos-2"}))
+	require.ErrorContains(t, err, `no free tags left in the range 100-101 of the SDN zone "isolated"`)
+
+	err = runSteps(ctx, t, p, newProvisionContext("machine-4", data, nil))
+	require.ErrorContains(t, err, "net1: the cluster VNet can be used only by the machines requested for an Omni cluster")
+
+	// the VNet is removed with the last VM of the cluster
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), first.State, first.MachineRequest))
+	assert.Len(t, srv.VNets(), 2)
+
+	// the VMs on the offline node might be attached to the VNet, it's kept then
+	srv.AddNode(fakeproxmox.Node{Name: "pve2", Status: "offline"})
+	srv.AddVM(fakeproxmox.VM{ID: 301, Node: "pve2"})
+
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), second.State, second.MachineRequest))
+	assert.Len(t, srv.VNets(), 2)
+
+	srv.SetNodeStatus("pve2", "online")
+
+	require.NoError(t, p.Deprovision(ctx, zaptest.NewLogger(t), second.State, second.MachineRequest))
+	assert.Equal(t, []string{"shared"}, vnetNames(srv.VNets()))
+	assert.Equal(t, 2, srv.Requests(http.MethodPut, "/cluster/sdn"))
+}
+
+func vnetNames(vnets []fakeproxmox.VNet) []string {
+	names := make([]string, 0, len(vnets))
+
+	for _, vnet := range vnets {
+		names = append(names, vnet.Name)
+	}
+
+	return names
+}
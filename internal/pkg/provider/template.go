@@ -0,0 +1,458 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luthermonson/go-proxmox"
+	"github.com/siderolabs/omni/client/pkg/constants"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/metrics"
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider/resources"
+)
+
+const (
+	provisionModeTemplate = "template"
+
+	templateTag        = "omni-talos-template"
+	templateNamePrefix = "talos-template-"
+
+	// templateBuildTimeout is the age after which the template VM which is not converted to the template yet is considered abandoned,
+	// e.g. the machine which started the build was removed.
+	templateBuildTimeout = 30 * time.Minute
+)
+
+// templateName generates the deterministic name of the VM template for the schematic, Talos version, node and storage.
+func templateName(schematic, talosVersion, node, storage string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{schematic, talosVersion, node, storage}, "/")))
+
+	return templateNamePrefix + hex.EncodeToString(hash[:])[:16]
+}
+
+// syncTemplate makes sure that the VM template for the machine exists, building it from the Image Factory nocloud disk image if needed.
+//
+//nolint:gocognit,gocyclo,cyclop
+func (p *Provisioner) syncTemplate(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine], data Data) error {
+	spec := pctx.State.TypedSpec().Value
+
+	spec.TalosVersion = pctx.GetTalosVersion()
+
+	client, err := p.client(spec.Cluster)
+	if err != nil {
+		return err
+	}
+
+	node, err := client.Node(ctx, spec.Node)
+	if err != nil {
+		return err
+	}
+
+	disks, err := p.planDisks(ctx, node, data)
+	if err != nil {
+		return err
+	}
+
+	storage := disks.Primary
+
+	name := templateName(spec.Schematic, spec.TalosVersion, spec.Node, storage)
+
+	logger = logger.With(zap.String("template", name))
+
+	// several machines with the same schematic might be provisioned at the same time,
+	// make sure that only one of them builds the template
+	mu := p.templateLock(spec.Cluster + "/" + name)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	vms, err := node.VirtualMachines(ctx)
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(vms, func(vm *proxmox.VirtualMachine) bool {
+		return vm.Name == name && vm.HasTag(templateTag)
+	})
+
+	if index != -1 {
+		template := vms[index]
+
+		switch {
+		case bool(template.Template):
+			spec.TemplateVmid = int32(template.VMID)
+
+			return nil
+		case int32(template.VMID) != spec.TemplateVmid:
+			config, err := p.vmConfig(ctx, client, node.Name, int(template.VMID))
+			if err != nil {
+				return err
+			}
+
+			if created, ok := vmCreated(config["meta"]); !ok || time.Since(created) < templateBuildTimeout {
+				logger.Info("waiting for the template to be built")
+
+				return provision.NewRetryInterval(time.Second * 10)
+			}
+
+			logger.Warn("removing the abandoned template build", zap.Int("vmid", int(template.VMID)))
+
+			if err = p.removeVM(ctx, client, clusterVM{Node: node.Name, VMID: int(template.VMID), Status: template.Status}); err != nil {
+				return fmt.Errorf("failed to remove the abandoned template build %d: %w", template.VMID, err)
+			}
+
+			return provision.NewRetryInterval(time.Second)
+		}
+
+		if err = p.checkTaskStatus(ctx, client, spec.TemplateTask); err != nil {
+			var taskErr *taskError
+
+			if !errors.As(err, &taskErr) {
+				return err
+			}
+
+			logger.Warn("removing the failed template build", zap.Int("vmid", int(template.VMID)), zap.Error(err))
+
+			if err = p.removeVM(ctx, client, clusterVM{Node: node.Name, VMID: int(template.VMID), Status: template.Status}); err != nil {
+				return fmt.Errorf("failed to remove the failed template build %d: %w", template.VMID, err)
+			}
+
+			spec.TemplateVmid = 0
+			spec.TemplateTask = ""
+
+			return provision.NewRetryInterval(time.Second)
+		}
+
+		task, err := template.ConvertToTemplate(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err = p.waitForTaskToFinish(ctx, task); err != nil {
+			return err
+		}
+
+		logger.Info("created VM template", zap.Int32("vmid", spec.TemplateVmid))
+
+		return nil
+	}
+
+	importStorage, err := p.pickImportStorage(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	if spec.VolumeUploadTask != "" {
+		var taskErr *taskError
+
+		err = p.checkTaskStatus(ctx, client, spec.VolumeUploadTask)
+		if err != nil && !errors.As(err, &taskErr) {
+			return err
+		}
+
+		if err != nil {
+			logger.Info("retrying download", zap.Error(err))
+
+			spec.VolumeUploadTask = ""
+		}
+	}
+
+	if spec.VolumeUploadTask == "" {
+		imageURL, err := url.Parse(constants.ImageFactoryBaseURL)
+		if err != nil {
+			return err
+		}
+
+		imageURL = imageURL.JoinPath("image",
+			spec.Schematic,
+			spec.TalosVersion,
+			"nocloud-amd64.qcow2",
+		)
+
+		hash := sha256.Sum256([]byte(imageURL.String()))
+
+		imageName := hex.EncodeToString(hash[:]) + ".qcow2"
+
+		spec.VolumeId = fmt.Sprintf("%s:import/%s", importStorage.Name, imageName)
+
+		var content map[string]any
+
+		err = client.Get(ctx, fmt.Sprintf("/nodes/%s/storage/%s/content/%s", node.Name, importStorage.Name, spec.VolumeId), &content)
+
+		p.metrics.ObserveImageCache(metrics.ImageImport, err == nil)
+
+		// not downloaded yet
+		if err != nil {
+			var task *proxmox.Task
+
+			task, err = importStorage.DownloadURL(ctx, "import", imageName, imageURL.String())
+			if err != nil {
+				return err
+			}
+
+			logger.Info("uploading new disk image", zap.String("volumeID", spec.VolumeId), zap.String("task", string(task.UPID)))
+
+			spec.VolumeUploadTask = string(task.UPID)
+
+			return provision.NewRetryInterval(time.Second)
+		}
+	}
+
+	cluster, err := client.Cluster(ctx)
+	if err != nil {
+		return err
+	}
+
+	vmid, err := cluster.NextID(ctx)
+	if err != nil {
+		return err
+	}
+
+	task, err := node.NewVirtualMachine(ctx, vmid,
+		proxmox.VirtualMachineOption{
+			Name:  "name",
+			Value: name,
+		},
+		proxmox.VirtualMachineOption{
+			Name:  "tags",
+			Value: templateTag,
+		},
+		proxmox.VirtualMachineOption{
+			Name:  "scsihw",
+			Value: "virtio-scsi-single",
+		},
+		proxmox.VirtualMachineOption{
+			Name:  "scsi0",
+			Value: fmt.Sprintf("%s:0,import-from=%s", storage, spec.VolumeId),
+		},
+		proxmox.VirtualMachineOption{
+			Name:  "agent",
+			Value: "enabled=true",
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("creating VM template", zap.Int("vmid", vmid), zap.String("task", string(task.UPID)))
+
+	spec.TemplateVmid = int32(vmid)
+	spec.TemplateTask = string(task.UPID)
+
+	return provision.NewRetryInterval(time.Second * 10)
+}
+
+// cloneVM creates the machine VM by cloning the template and applies the machine config to it.
+func (p *Provisioner) cloneVM(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine], client *proxmox.Client, node *proxmox.Node, data Data) error {
+	spec := pctx.State.TypedSpec().Value
+
+	if spec.CloneTask == "" {
+		template, err := node.VirtualMachine(ctx, int(spec.TemplateVmid))
+		if err != nil {
+			return err
+		}
+
+		cloneOptions := &proxmox.VirtualMachineCloneOptions{
+			Name: pctx.GetRequestID(),
+		}
+
+		if data.FullClone {
+			disks, err := p.planDisks(ctx, node, data)
+			if err != nil {
+				return err
+			}
+
+			cloneOptions.Full = 1
+			cloneOptions.Storage = disks.Primary
+		}
+
+		vmid, task, err := template.Clone(ctx, cloneOptions)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("cloning VM template", zap.Int32("template", spec.TemplateVmid), zap.Int("vmid", vmid), zap.String("task", string(task.UPID)))
+
+		spec.CloneTask = string(task.UPID)
+		spec.Vmid = int32(vmid)
+
+		return provision.NewRetryInterval(time.Second * 5)
+	}
+
+	if err := p.checkTaskStatus(ctx, client, spec.CloneTask); err != nil {
+		var taskErr *taskError
+
+		if !errors.As(err, &taskErr) {
+			return err
+		}
+
+		logger.Warn("removing the failed clone", zap.Int32("vmid", spec.Vmid), zap.Error(err))
+
+		// Proxmox usually removes the VM itself
+		if err = p.removeVM(ctx, client, clusterVM{Node: node.Name, VMID: int(spec.Vmid)}); err != nil && !strings.Contains(err.Error(), "does not exist") {
+			return fmt.Errorf("failed to remove the failed clone %d: %w", spec.Vmid, err)
+		}
+
+		spec.CloneTask = ""
+		spec.Vmid = 0
+
+		return provision.NewRetryInterval(time.Second)
+	}
+
+	config, err := p.vmConfig(ctx, client, node.Name, int(spec.Vmid))
+	if err != nil {
+		return err
+	}
+
+	_, diskOptions, _ := strings.Cut(config["scsi0"], ",")
+
+	// the disk can't be shrunk, the size of the template disk is kept if it's larger
+	if data.DiskSize > 0 && uint64(data.DiskSize)<<30 > diskOptionSize(diskOptions) {
+		var resizeTask proxmox.UPID
+
+		if err = client.Put(ctx, fmt.Sprintf("/nodes/%s/qemu/%d/resize", node.Name, spec.Vmid), map[string]string{
+			"disk": "scsi0",
+			"size": fmt.Sprintf("%dG", data.DiskSize),
+		}, &resizeTask); err != nil {
+			return fmt.Errorf("failed to resize the primary disk: %w", err)
+		}
+
+		// older Proxmox versions resize the disk synchronously
+		if resizeTask != "" {
+			if err = p.waitForTaskToFinish(ctx, proxmox.NewTask(resizeTask, client)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the primary disk is already allocated by the clone
+	additionalDisks := data
+	additionalDisks.DiskSize = 0
+
+	disks, err := p.planDisks(ctx, node, additionalDisks)
+	if err != nil {
+		return err
+	}
+
+	vmOptions := p.vmOptions(newVMIdentity(pctx), data, disks)
+
+	// the template disk is shared by the machine classes, so the disk options of the machine class are applied to the cloned disk
+	if diskOptions := primaryDiskOptions(data); len(diskOptions) > 0 {
+		config, err := p.vmConfig(ctx, client, node.Name, int(spec.Vmid))
+		if err != nil {
+			return err
+		}
+
+		volID, options, _ := strings.Cut(config["scsi0"], ",")
+
+		for option := range strings.SplitSeq(options, ",") {
+			if strings.HasPrefix(option, "size=") {
+				diskOptions = append(diskOptions, option)
+			}
+		}
+
+		vmOptions = append(vmOptions, proxmox.VirtualMachineOption{
+			Name:  "scsi0",
+			Value: strings.Join(append([]string{volID}, diskOptions...), ","),
+		})
+	}
+
+	vm, err := node.VirtualMachine(ctx, int(spec.Vmid))
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("configuring the cloned VM", vmOptionsField(vmOptions))
+
+	task, err := vm.Config(ctx, vmOptions...)
+	if err != nil {
+		return err
+	}
+
+	spec.VmCreateTask = string(task.UPID)
+
+	return provision.NewRetryInterval(time.Second * 10)
+}
+
+// diskOptionSize returns the disk size in bytes set in the disk options, e.g. "size=32G", zero if it's not set.
+func diskOptionSize(options string) uint64 {
+	for option := range strings.SplitSeq(options, ",") {
+		value, ok := strings.CutPrefix(option, "size=")
+		if !ok || value == "" {
+			continue
+		}
+
+		shift := 0
+
+		switch value[len(value)-1] {
+		case 'T':
+			shift = 40
+		case 'G':
+			shift = 30
+		case 'M':
+			shift = 20
+		case 'K':
+			shift = 10
+		}
+
+		size, err := strconv.ParseFloat(strings.TrimRight(value, "TGMK"), 64)
+		if err != nil {
+			return 0
+		}
+
+		return uint64(size * float64(uint64(1)<<shift))
+	}
+
+	return 0
+}
+
+// templateLock returns the mutex serializing the builds of the template.
+func (p *Provisioner) templateLock(key string) *sync.Mutex {
+	p.templateMu.Lock()
+	defer p.templateMu.Unlock()
+
+	if p.templateLocks == nil {
+		p.templateLocks = map[string]*sync.Mutex{}
+	}
+
+	mu, ok := p.templateLocks[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		p.templateLocks[key] = mu
+	}
+
+	return mu
+}
+
+func (p *Provisioner) pickImportStorage(ctx context.Context, node *proxmox.Node) (*proxmox.Storage, error) {
+	storages, err := node.Storages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, storage := range storages {
+		if storage.Enabled == 0 {
+			continue
+		}
+
+		if slices.Contains(strings.Split(storage.Content, ","), "import") {
+			return storage, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no storage with the import content type enabled on node %q", node.Name)
+}
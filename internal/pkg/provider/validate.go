@@ -0,0 +1,90 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	siderocel "github.com/siderolabs/talos/pkg/machinery/cel"
+	"go.yaml.in/yaml/v4"
+)
+
+// ValidateData checks the machine class provider data without connecting to Proxmox.
+// The data is decoded rejecting the unknown fields, then the expressions and the values are checked the same way the provision steps do.
+// All errors are returned, each prefixed with the name of the field.
+func ValidateData(providerData string) error {
+	var data Data
+
+	decoder := yaml.NewDecoder(strings.NewReader(providerData))
+	decoder.KnownFields(true)
+
+	var (
+		errs     []error
+		loadErrs *yaml.LoadErrors
+	)
+
+	if err := decoder.Decode(&data); errors.As(err, &loadErrs) {
+		for _, loadErr := range loadErrs.Errors {
+			errs = append(errs, loadErr)
+		}
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+	}
+
+	if data.Cluster != "" && data.ClusterSelector != "" {
+		errs = append(errs, errors.New("cluster_selector: cluster and cluster_selector can't be set at the same time"))
+	}
+
+	for _, selector := range []struct {
+		env   func() (*cel.Env, error)
+		field string
+		expr  string
+	}{
+		{field: "cluster_selector", expr: data.ClusterSelector, env: clusterCELEnv},
+		{field: "node_selector", expr: data.NodeSelector, env: nodeCELEnv},
+		{field: "storage_selector", expr: data.StorageSelector, env: storageCELEnv},
+	} {
+		if selector.expr == "" {
+			continue
+		}
+
+		env, err := selector.env()
+		if err != nil {
+			return err
+		}
+
+		_, err = siderocel.ParseBooleanExpression(selector.expr, env)
+		check(selector.field, err)
+	}
+
+	_, err := newPlacementStrategy(data)
+	check("placement_strategy", err)
+
+	check("affinity", validateAffinity(data.Affinity))
+
+	if err := validateNetwork(data); err != nil {
+		errs = append(errs, err)
+	}
+
+	if data.Firewall != nil {
+		if err := validateFirewall(*data.Firewall); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	check("ha.state", validateHA(data.HA))
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,169 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/provider"
+)
+
+func TestValidateData(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name string
+		data string
+		errs []string
+	}{
+		{
+			name: "valid",
+			data: `cores: 2
+sockets: 1
+memory: 4096
+disk_size: 20
+storage_selector: name == "local-lvm" && availableSpace > 1000u
+node_selector: cluster == "site-a" && "ssd" in tags
+placement_strategy: cel
+placement_score: freeMemory
+affinity:
+  control_plane_anti_affinity: hard
+ha:
+  state: started
+`,
+		},
+		{
+			name: "unknown field",
+			data: "cores: 2\nstorage: local-lvm\n",
+			errs: []string{"field storage not found in type provider.Data"},
+		},
+		{
+			name: "wrong type",
+			data: "cores: two\n",
+			errs: []string{"line 1: cannot construct !!str `two` into int"},
+		},
+		{
+			name: "invalid expressions",
+			data: `storage_selector: name == 1
+node_selector: unknown == "a"
+cluster: site-a
+cluster_selector: labels.site == "a"
+placement_strategy: cel
+affinity:
+  storage_node_affinity: always
+ha:
+  state: running
+`,
+			errs: []string{
+				"storage_selector:",
+				"node_selector:",
+				"cluster_selector: cluster and cluster_selector can't be set at the same time",
+				"placement_strategy: placement_score is required",
+				`affinity: invalid storage_node_affinity "always"`,
+				`ha.state: invalid HA state "running"`,
+			},
+		},
+		{
+			name: "invalid network",
+			data: `ip:
+  cidr: 10.5.0.0/24
+  range: 10.5.1.10-10.5.1.20
+  gateway: 10.5.0.1
+dns_servers:
+  - dns.example.com
+network_config_version: 3
+additional_nics:
+  - bridge: vmbr1
+    mtu: -1
+    ip:
+      cidr: 10.6.0.0
+`,
+			errs: []string{
+				`ip: invalid range "10.5.1.10-10.5.1.20": should be in 10.5.0.1-10.5.0.254`,
+				`additional_nics[0].ip: invalid CIDR "10.6.0.0"`,
+				"additional_nics[0].mtu: should be positive",
+				`dns_servers: invalid address "dns.example.com"`,
+				"network_config_version: should be 1 or 2",
+			},
+		},
+		{
+			name: "pool and cidr",
+			data: `ip:
+  pool: lan
+  cidr: 10.5.0.0/24
+additional_nics:
+  - bridge: vmbr1
+    ip:
+      gateway: 10.6.0.1
+`,
+			errs: []string{
+				"ip: either the pool or the cidr should be set, not both",
+				"additional_nics[0].ip: either the pool or the cidr should be set",
+			},
+		},
+		{
+			name: "invalid vnets",
+			data: `network_bridge: vmbr0
+network_vnet: lan
+vlan: 10
+additional_nics:
+  - vnet: storage
+    vlan: 20
+  - subnet: 10.6.0.0/24
+  - cluster_vnet:
+      tags: 200-100
+`,
+			errs: []string{
+				"network_bridge: only one of the bridge, the vnet and the cluster_vnet should be set",
+				"additional_nics[0].vlan: the VLAN tag is set by the SDN zone, it can't be set for the VNet",
+				"additional_nics[1].bridge: either the bridge, the vnet or the cluster_vnet should be set",
+				"additional_nics[1].subnet: the subnet should be set with the vnet",
+				"additional_nics[2].cluster_vnet.zone: should be set",
+				`additional_nics[2].cluster_vnet.tags: invalid range "200-100"`,
+			},
+		},
+		{
+			name: "invalid firewall",
+			data: `firewall:
+  policy_out: ALLOW
+  security_groups:
+    - omni workers
+  rules:
+    - type: forward
+      action: ACCEPT
+    - action: accept
+      dport: "50000"
+`,
+			errs: []string{
+				`firewall.policy_out: invalid policy "ALLOW": should be one of ACCEPT, DROP, REJECT`,
+				`firewall.security_groups[0]: invalid security group name "omni workers"`,
+				`firewall.rules[0].type: invalid type "forward": should be either "in" or "out"`,
+				`firewall.rules[1].action: invalid action "accept": should be one of ACCEPT, DROP, REJECT`,
+				"firewall.rules[1].proto: the proto should be set with the ports",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := provider.ValidateData(test.data)
+
+			if test.errs == nil {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+
+			for _, expected := range test.errs {
+				assert.ErrorContains(t, err, expected)
+			}
+		})
+	}
+}
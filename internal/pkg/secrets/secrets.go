@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package secrets resolves the secret references in the provider config, e.g. file:/run/secrets/proxmox-token.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// SchemeFile refers to the file with the secret, e.g. a Kubernetes or Docker secret: file:/run/secrets/proxmox-password.
+	SchemeFile = "file"
+	// SchemeEnv refers to the environment variable with the secret: env:PROXMOX_PASSWORD.
+	SchemeEnv = "env"
+	// SchemeVault refers to the key of the secret in the Vault KV secrets engine: vault:secret/proxmox#password.
+	SchemeVault = "vault"
+)
+
+// Provider resolves the secret references of a scheme, the reference is passed without the scheme prefix.
+type Provider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// ProviderFunc is the Provider implemented by a function.
+type ProviderFunc func(ctx context.Context, ref string) (string, error)
+
+// Resolve implements Provider.
+func (f ProviderFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+// Resolver resolves the secret references with the providers registered for their schemes.
+type Resolver struct {
+	providers map[string]Provider
+}
+
+// NewResolver creates a new Resolver with the file and env providers registered.
+func NewResolver() *Resolver {
+	r := &Resolver{
+		providers: map[string]Provider{},
+	}
+
+	r.Register(SchemeFile, ProviderFunc(resolveFile))
+	r.Register(SchemeEnv, ProviderFunc(resolveEnv))
+
+	return r
+}
+
+// Register adds the provider for the scheme, replacing the one registered before.
+func (r *Resolver) Register(scheme string, provider Provider) {
+	r.providers[scheme] = provider
+}
+
+// Resolve returns the secret the value refers to.
+// The value is returned as is if it doesn't start with the scheme of any registered provider followed by a colon.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return value, nil
+	}
+
+	provider, ok := r.providers[scheme]
+	if !ok {
+		return value, nil
+	}
+
+	secret, err := provider.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the %s secret reference: %w", scheme, err)
+	}
+
+	return secret, nil
+}
+
+func resolveFile(_ context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// the secret files usually end with a newline
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func resolveEnv(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", name)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secrets_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/secrets"
+)
+
+//nolint:paralleltest
+func TestResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0o600))
+
+	t.Setenv("TEST_PROXMOX_PASSWORD", "from-env")
+
+	resolver := secrets.NewResolver()
+	resolver.Register("static", secrets.ProviderFunc(func(_ context.Context, ref string) (string, error) {
+		return "static-" + ref, nil
+	}))
+
+	for _, test := range []struct {
+		value    string
+		expected string
+		err      string
+	}{
+		{value: "plain", expected: "plain"},
+		{value: "pass:word", expected: "pass:word"},
+		{value: "file:" + path, expected: "from-file"},
+		{value: "env:TEST_PROXMOX_PASSWORD", expected: "from-env"},
+		{value: "static:secret", expected: "static-secret"},
+		{value: "env:TEST_PROXMOX_MISSING", err: `failed to resolve the env secret reference: environment variable "TEST_PROXMOX_MISSING" is not set`},
+		{value: "file:" + path + ".missing", err: "failed to resolve the file secret reference"},
+	} {
+		secret, err := resolver.Resolve(t.Context(), test.value)
+
+		if test.err != "" {
+			require.ErrorContains(t, err, test.err, test.value)
+
+			continue
+		}
+
+		require.NoError(t, err, test.value)
+		assert.Equal(t, test.expected, secret, test.value)
+	}
+}
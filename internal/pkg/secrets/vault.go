@@ -0,0 +1,145 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// VaultOptions configures the VaultProvider.
+type VaultOptions struct {
+	// HTTPClient is used for the Vault API requests, defaults to the client with 30s timeout.
+	HTTPClient *http.Client
+	// Namespace is the Vault Enterprise namespace.
+	Namespace string
+	// KVVersion is the version of the KV secrets engine, 1 or 2, defaults to 2.
+	KVVersion int
+}
+
+// VaultProvider reads the secrets from the HashiCorp Vault compatible KV secrets engine.
+//
+// The reference is the path of the secret, including the secrets engine mount, and the key: secret/proxmox#password.
+type VaultProvider struct {
+	client  *http.Client
+	address *url.URL
+	token   string
+	options VaultOptions
+}
+
+// NewVaultProvider creates a new VaultProvider, the address is the Vault address, e.g. https://vault.example.com:8200.
+func NewVaultProvider(address, token string, options VaultOptions) (*VaultProvider, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vault address %q: %w", address, err)
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Vault address %q: should be an absolute URL", address)
+	}
+
+	switch options.KVVersion {
+	case 0:
+		options.KVVersion = 2
+	case 1, 2:
+	default:
+		return nil, fmt.Errorf("unsupported Vault KV secrets engine version %d", options.KVVersion)
+	}
+
+	client := options.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &VaultProvider{
+		client:  client,
+		address: u,
+		token:   token,
+		options: options,
+	}, nil
+}
+
+// Resolve implements Provider.
+func (v *VaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || key == "" {
+		return "", fmt.Errorf("the Vault secret reference %q should have the key: <mount>/<path>#<key>", ref)
+	}
+
+	mount, secretPath, ok := strings.Cut(strings.Trim(path, "/"), "/")
+	if !ok || secretPath == "" {
+		return "", fmt.Errorf("the Vault secret reference %q should have the secrets engine mount and the path: <mount>/<path>#<key>", ref)
+	}
+
+	apiPath := []string{"v1", mount, secretPath}
+	if v.options.KVVersion == 2 {
+		apiPath = []string{"v1", mount, "data", secretPath}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.address.JoinPath(apiPath...).String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("X-Vault-Token", v.token)
+
+	if v.options.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.options.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	var body struct {
+		Data   map[string]any `json:"data"`
+		Errors []string       `json:"errors"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("failed to decode the Vault response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if len(body.Errors) > 0 {
+			return "", fmt.Errorf("failed to read the Vault secret %q: %s: %s", path, resp.Status, strings.Join(body.Errors, ", "))
+		}
+
+		return "", fmt.Errorf("failed to read the Vault secret %q: %s", path, resp.Status)
+	}
+
+	data := body.Data
+
+	// KV v2 wraps the secret data along with its metadata
+	if v.options.KVVersion == 2 {
+		nested, ok := data["data"].(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("the Vault secret %q has no data, it might be deleted", path)
+		}
+
+		data = nested
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("the Vault secret %q has no key %q", path, key)
+	}
+
+	secret, ok := value.(string)
+	if !ok {
+		return "", errors.New("the Vault secret value should be a string")
+	}
+
+	return secret, nil
+}
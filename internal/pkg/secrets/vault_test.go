@@ -0,0 +1,136 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secrets_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/secrets"
+)
+
+// newFakeVault starts the Vault stand-in serving the KV v1 engine at kv/ and the KV v2 engine at secret/.
+func newFakeVault(t *testing.T, token, namespace string) *httptest.Server {
+	t.Helper()
+
+	kv := map[string]map[string]any{
+		"kv/proxmox": {
+			"password": "v1-password",
+		},
+		"secret/data/proxmox": {
+			"password":    "v2-password",
+			"tokenSecret": "v2-token-secret",
+			"port":        8006,
+		},
+		"secret/data/deleted": nil,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Header.Get("X-Vault-Token") != token || r.Header.Get("X-Vault-Namespace") != namespace {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`)) //nolint:errcheck
+
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+		data, ok := kv[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`)) //nolint:errcheck
+
+			return
+		}
+
+		var response map[string]any
+
+		if strings.HasPrefix(path, "secret/") {
+			response = map[string]any{
+				"data": map[string]any{
+					"data":     data,
+					"metadata": map[string]any{"version": 1},
+				},
+			}
+		} else {
+			response = map[string]any{
+				"data": data,
+			}
+		}
+
+		json.NewEncoder(w).Encode(response) //nolint:errcheck,errchkjson
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestVaultProvider(t *testing.T) {
+	t.Parallel()
+
+	vault := newFakeVault(t, "root-token", "team")
+
+	v2, err := secrets.NewVaultProvider(vault.URL, "root-token", secrets.VaultOptions{Namespace: "team"})
+	require.NoError(t, err)
+
+	v1, err := secrets.NewVaultProvider(vault.URL, "root-token", secrets.VaultOptions{Namespace: "team", KVVersion: 1})
+	require.NoError(t, err)
+
+	forbidden, err := secrets.NewVaultProvider(vault.URL, "wrong-token", secrets.VaultOptions{Namespace: "team"})
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		provider *secrets.VaultProvider
+		name     string
+		ref      string
+		expected string
+		err      string
+	}{
+		{name: "kv v2", provider: v2, ref: "secret/proxmox#password", expected: "v2-password"},
+		{name: "kv v2 other key", provider: v2, ref: "/secret/proxmox#tokenSecret", expected: "v2-token-secret"},
+		{name: "kv v1", provider: v1, ref: "kv/proxmox#password", expected: "v1-password"},
+		{name: "missing key", provider: v2, ref: "secret/proxmox#username", err: `the Vault secret "secret/proxmox" has no key "username"`},
+		{name: "not string", provider: v2, ref: "secret/proxmox#port", err: "the Vault secret value should be a string"},
+		{name: "missing secret", provider: v2, ref: "secret/other#password", err: "404 Not Found"},
+		{name: "deleted secret", provider: v2, ref: "secret/deleted#password", err: "it might be deleted"},
+		{name: "forbidden", provider: forbidden, ref: "secret/proxmox#password", err: "403 Forbidden: permission denied"},
+		{name: "no key", provider: v2, ref: "secret/proxmox", err: "should have the key"},
+		{name: "no mount", provider: v2, ref: "proxmox#password", err: "should have the secrets engine mount"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			secret, err := test.provider.Resolve(t.Context(), test.ref)
+
+			if test.err != "" {
+				require.ErrorContains(t, err, test.err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, secret)
+		})
+	}
+
+	resolver := secrets.NewResolver()
+	resolver.Register(secrets.SchemeVault, v2)
+
+	secret, err := resolver.Resolve(t.Context(), "vault:secret/proxmox#password")
+	require.NoError(t, err)
+	assert.Equal(t, "v2-password", secret)
+
+	_, err = secrets.NewVaultProvider(vault.URL, "root-token", secrets.VaultOptions{KVVersion: 3})
+	require.ErrorContains(t, err, "unsupported Vault KV secrets engine version 3")
+}
@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package tracing implements the OpenTelemetry tracing of the machine requests and the Proxmox API calls.
+package tracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+)
+
+// TracerName is the name of the tracer of the provider spans.
+const TracerName = "github.com/siderolabs/omni-infra-provider-proxmox"
+
+// The attributes of the provider spans.
+const (
+	AttributeRequestID = attribute.Key("omni.machine_request.id")
+	AttributeStep      = attribute.Key("omni.provision.step")
+	AttributeRetry     = attribute.Key("omni.provision.retry")
+	AttributeCluster   = attribute.Key("proxmox.cluster")
+	AttributeNode      = attribute.Key("proxmox.node")
+	AttributeVMID      = attribute.Key("proxmox.vmid")
+	AttributeTaskUPID  = attribute.Key("proxmox.task.upid")
+	AttributeEndpoint  = attribute.Key("proxmox.api.endpoint")
+)
+
+// Setup installs the global tracer provider exporting the spans to the OTLP gRPC endpoint, e.g. http://localhost:4317.
+// The returned function flushes the spans which are not exported yet and stops the exporter.
+func Setup(ctx context.Context, endpoint, serviceName string) (func(context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the OTLP trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// RequestContext returns the context with the remote parent span derived from the machine request ID,
+// so that the spans of all step attempts of the request, even after the provider restarts, belong to the same trace.
+func RequestContext(ctx context.Context, requestID string) context.Context {
+	hash := sha256.Sum256([]byte(requestID))
+
+	var (
+		traceID trace.TraceID
+		spanID  trace.SpanID
+	)
+
+	copy(traceID[:], hash[:16])
+	copy(spanID[:], hash[16:24])
+
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+}
+
+// StartRequestSpan starts the span in the trace of the machine request.
+func StartRequestSpan(ctx context.Context, tracer trace.Tracer, requestID, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(RequestContext(ctx, requestID), name, trace.WithAttributes(append(attrs, AttributeRequestID.String(requestID))...))
+}
+
+// End records the result of the span and ends it, the retry requested by the step is not an error.
+func End(span trace.Span, err error) {
+	var retryErr *provision.RetryError
+
+	switch {
+	case errors.As(err, &retryErr):
+		span.SetAttributes(AttributeRetry.Bool(true))
+
+		// the step might be retried because of the transient error
+		if retryErr.Unwrap() != nil {
+			span.RecordError(err)
+		}
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,66 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tracing_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/tracing"
+)
+
+func TestRequestContext(t *testing.T) {
+	t.Parallel()
+
+	first := trace.SpanContextFromContext(tracing.RequestContext(t.Context(), "machine-1"))
+	again := trace.SpanContextFromContext(tracing.RequestContext(t.Context(), "machine-1"))
+	other := trace.SpanContextFromContext(tracing.RequestContext(t.Context(), "machine-2"))
+
+	assert.True(t, first.IsValid())
+	assert.True(t, first.IsRemote())
+	assert.True(t, first.IsSampled())
+	assert.Equal(t, first, again)
+	assert.NotEqual(t, first.TraceID(), other.TraceID())
+}
+
+func TestStartRequestSpan(t *testing.T) {
+	t.Parallel()
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracing.TracerName)
+
+	_, span := tracing.StartRequestSpan(t.Context(), tracer, "machine-1", "uploadISO")
+	tracing.End(span, provision.NewRetryInterval(time.Second))
+
+	_, span = tracing.StartRequestSpan(t.Context(), tracer, "machine-1", "uploadISO")
+	tracing.End(span, nil)
+
+	_, span = tracing.StartRequestSpan(t.Context(), tracer, "machine-1", "syncVM")
+	tracing.End(span, errors.New("storage is full"))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+
+	// the attempts of the request steps are in the same trace
+	for _, span := range spans {
+		assert.Equal(t, spans[0].SpanContext().TraceID(), span.SpanContext().TraceID())
+		assert.Contains(t, span.Attributes(), tracing.AttributeRequestID.String("machine-1"))
+	}
+
+	assert.Contains(t, spans[0].Attributes(), tracing.AttributeRetry.Bool(true))
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Unset, spans[1].Status().Code)
+	assert.Equal(t, codes.Error, spans[2].Status().Code)
+	assert.Equal(t, "storage is full", spans[2].Status().Description)
+}
@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tracing
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/metrics"
+)
+
+// Transport returns the http.RoundTripper recording the span of each Proxmox API request of the cluster,
+// the default transport is used if the base is nil.
+func Transport(tracerProvider trace.TracerProvider, cluster string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &transport{
+		base:    base,
+		tracer:  tracerProvider.Tracer(TracerName),
+		cluster: cluster,
+	}
+}
+
+type transport struct {
+	base    http.RoundTripper
+	tracer  trace.Tracer
+	cluster string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := metrics.Endpoint(req.URL.Path)
+
+	ctx, span := t.tracer.Start(req.Context(), "proxmox "+req.Method+" "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLPath(req.URL.Path),
+			semconv.ServerAddress(req.URL.Hostname()),
+			AttributeEndpoint.String(endpoint),
+			AttributeCluster.String(t.cluster),
+		),
+	)
+	defer span.End()
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, nil
+}
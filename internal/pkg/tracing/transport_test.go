@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tracing_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+
+	"github.com/siderolabs/omni-infra-provider-proxmox/internal/pkg/tracing"
+)
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+
+	recorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	ctx, parent := tracing.StartRequestSpan(t.Context(), tracerProvider.Tracer(tracing.TracerName), "machine-1", "startVM")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api2/json/nodes/pve1/qemu/100/status/start", nil)
+	require.NoError(t, err)
+
+	resp, err := (&http.Client{Transport: tracing.Transport(tracerProvider, "lab", nil)}).Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+
+	span := spans[0]
+
+	assert.Equal(t, "proxmox POST /nodes/{node}/qemu/{vmid}/status/start", span.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	assert.Equal(t, parent.SpanContext().TraceID(), span.SpanContext().TraceID())
+	assert.Contains(t, span.Attributes(), tracing.AttributeCluster.String("lab"))
+	assert.Contains(t, span.Attributes(), semconv.HTTPResponseStatusCode(http.StatusForbidden))
+	assert.Equal(t, codes.Error, span.Status().Code)
+}